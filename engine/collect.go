@@ -0,0 +1,330 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// ResFilterSortName sorts the collected resources by name.
+	ResFilterSortName = "name"
+	// ResFilterSortKind sorts the collected resources by kind, then name.
+	ResFilterSortKind = "kind"
+	// ResFilterSortHostname sorts the collected resources by the hostname
+	// which exported them, then by kind and name.
+	ResFilterSortHostname = "hostname"
+)
+
+// resFieldFilterOps are the operators of the field predicates.
+var resFieldFilterOps = []string{"==", "!=", "=~", "!~"}
+
+// ResFilter is a query which selects exported resources for collection. Each
+// of the members which is set must match, and an empty filter matches every
+// exported resource.
+type ResFilter struct {
+	// Kind is the kind of the resources, eg: file.
+	Kind string
+	// Hostnames is the list of hosts which exported the resources.
+	Hostnames []string
+	// Labels is a label selector which the hosts that exported the
+	// resources must match, such as `role=db,rack=3`.
+	Labels string
+	// Name is a glob pattern which the resource names must match, eg:
+	// `/tmp/mgmt/*.conf`.
+	Name string
+	// NameRegexp is a regular expression which the names must match.
+	NameRegexp string
+	// Fields is a list of predicates on the fields of the resources, such
+	// as `owner == "www"`. The field is named by its struct field name, or
+	// by its lang or yaml tag. The operator is one of `==`, `!=`, or `=~`
+	// and `!~` for a regular expression match. The value is compared to the
+	// string representation of the field.
+	Fields []string
+	// Sort is either name, kind or hostname. By default the resources are
+	// sorted by hostname, kind and name.
+	Sort string
+	// Limit is the maximum number of resources to collect. Zero is no limit.
+	Limit int
+
+	labels     *LabelSelector
+	nameRegexp *regexp.Regexp
+	fields     []*resFieldFilter
+}
+
+// resFieldFilter is a parsed field predicate.
+type resFieldFilter struct {
+	field  string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+// ExportedRes is an exported resource, along with the host that exported it
+// and the labels of that host.
+type ExportedRes struct {
+	Hostname string
+	Labels   map[string]string
+	Res      Res
+}
+
+// Validate checks the filter, and compiles its patterns for matching. It must
+// be called before any of the matching methods are used.
+func (obj *ResFilter) Validate() error {
+	labels, err := ParseLabelSelector(obj.Labels)
+	if err != nil {
+		return errwrap.Wrapf(err, "invalid labels")
+	}
+	obj.labels = labels
+	if obj.Name != "" {
+		if _, err := filepath.Match(obj.Name, ""); err != nil {
+			return errwrap.Wrapf(err, "invalid name pattern: %s", obj.Name)
+		}
+	}
+	obj.nameRegexp = nil
+	if obj.NameRegexp != "" {
+		if obj.nameRegexp, err = regexp.Compile(obj.NameRegexp); err != nil {
+			return errwrap.Wrapf(err, "invalid name regexp: %s", obj.NameRegexp)
+		}
+	}
+	obj.fields = []*resFieldFilter{}
+	for _, s := range obj.Fields {
+		f, err := parseResFieldFilter(s)
+		if err != nil {
+			return errwrap.Wrapf(err, "invalid field predicate: %s", s)
+		}
+		obj.fields = append(obj.fields, f)
+	}
+	switch obj.Sort {
+	case "", ResFilterSortName, ResFilterSortKind, ResFilterSortHostname:
+	default:
+		return fmt.Errorf("invalid sort: %s", obj.Sort)
+	}
+	if obj.Limit < 0 {
+		return fmt.Errorf("the limit must not be negative")
+	}
+	return nil
+}
+
+// parseResFieldFilter parses a field predicate such as `owner == "www"`.
+func parseResFieldFilter(s string) (*resFieldFilter, error) {
+	i, op := -1, ""
+	for _, x := range resFieldFilterOps { // the first operator wins
+		if j := strings.Index(s, x); j >= 0 && (i < 0 || j < i) {
+			i, op = j, x
+		}
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("missing operator, expected one of: %s", strings.Join(resFieldFilterOps, ", "))
+	}
+
+	f := &resFieldFilter{
+		field: strings.TrimSpace(s[:i]),
+		op:    op,
+		value: strings.TrimSpace(s[i+len(op):]),
+	}
+	if f.field == "" {
+		return nil, fmt.Errorf("missing field name")
+	}
+	if strings.HasPrefix(f.value, `"`) {
+		value, err := strconv.Unquote(f.value)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid quoted value")
+		}
+		f.value = value
+	}
+	if op == "=~" || op == "!~" {
+		var err error
+		if f.regexp, err = regexp.Compile(f.value); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// MatchKey returns true if the hostname, kind and name of an exported resource
+// match the filter. This lets us skip decoding most of the resources.
+func (obj *ResFilter) MatchKey(hostname, kind, name string) bool {
+	if obj.Kind != "" && obj.Kind != kind {
+		return false
+	}
+	if len(obj.Hostnames) > 0 {
+		found := false
+		for _, x := range obj.Hostnames {
+			if x == hostname {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if obj.Name != "" {
+		if matched, err := filepath.Match(obj.Name, name); err != nil || !matched {
+			return false
+		}
+	}
+	if obj.nameRegexp != nil && !obj.nameRegexp.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// MatchLabels returns true if the labels of the host which exported a resource
+// match the label selector of the filter.
+func (obj *ResFilter) MatchLabels(labels map[string]string) bool {
+	return obj.labels == nil || obj.labels.Matches(labels)
+}
+
+// NeedsLabels returns true if the filter can only be matched with the labels of
+// the hosts.
+func (obj *ResFilter) NeedsLabels() bool {
+	return obj.labels != nil && !obj.labels.Empty()
+}
+
+// Match returns true if the exported resource matches the filter.
+func (obj *ResFilter) Match(hostname string, res Res) (bool, error) {
+	if !obj.MatchKey(hostname, res.Kind(), res.Name()) {
+		return false, nil
+	}
+	for _, f := range obj.fields {
+		value, exists, err := resFieldString(res, f.field)
+		if err != nil {
+			return false, err
+		}
+		if !exists { // other kinds of resources are collected together
+			return false, nil
+		}
+		var matched bool
+		switch f.op {
+		case "==":
+			matched = value == f.value
+		case "!=":
+			matched = value != f.value
+		case "=~":
+			matched = f.regexp.MatchString(value)
+		case "!~":
+			matched = !f.regexp.MatchString(value)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Collect returns the resources which match the filter, in the sort order of
+// the filter, and up to its limit.
+func (obj *ResFilter) Collect(exported []*ExportedRes) ([]Res, error) {
+	matches := []*ExportedRes{}
+	for _, x := range exported {
+		if !obj.MatchLabels(x.Labels) {
+			continue
+		}
+		matched, err := obj.Match(x.Hostname, x.Res)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "could not match %s", x.Res)
+		}
+		if matched {
+			matches = append(matches, x)
+		}
+	}
+
+	less := func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if obj.Sort == ResFilterSortName && a.Res.Name() != b.Res.Name() {
+			return a.Res.Name() < b.Res.Name()
+		}
+		if obj.Sort != ResFilterSortKind && a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		if a.Res.Kind() != b.Res.Kind() {
+			return a.Res.Kind() < b.Res.Kind()
+		}
+		if a.Res.Name() != b.Res.Name() {
+			return a.Res.Name() < b.Res.Name()
+		}
+		return a.Hostname < b.Hostname
+	}
+	sort.SliceStable(matches, less)
+
+	if obj.Limit > 0 && len(matches) > obj.Limit {
+		matches = matches[:obj.Limit]
+	}
+	resources := []Res{}
+	for _, x := range matches {
+		resources = append(resources, x.Res)
+	}
+	return resources, nil
+}
+
+// resFieldString returns the string representation of a field of a resource.
+// The field can be named by its struct field name, by its lang or yaml tag, or
+// by its lower case name. Pointers are followed, and nil is the empty string.
+// If the resource has no such field, then this returns false.
+func resFieldString(res Res, field string) (string, bool, error) {
+	sv := reflect.ValueOf(res)
+	for sv.Kind() == reflect.Ptr || sv.Kind() == reflect.Interface {
+		sv = sv.Elem()
+	}
+	if sv.Kind() != reflect.Struct {
+		return "", false, fmt.Errorf("resource is not a struct")
+	}
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		names := []string{f.Name, strings.ToLower(f.Name)}
+		for _, tag := range []string{"lang", "yaml"} {
+			if alias := strings.Split(f.Tag.Get(tag), ",")[0]; alias != "" {
+				names = append(names, alias)
+			}
+		}
+		found := false
+		for _, name := range names {
+			if name == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		v := sv.Field(i)
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return "", true, nil
+			}
+			v = v.Elem()
+		}
+		return fmt.Sprintf("%v", v.Interface()), true, nil
+	}
+	return "", false, nil
+}
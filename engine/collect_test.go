@@ -0,0 +1,181 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+// collectFakeRes is a fake resource with a few fields to match on. Only the
+// methods that the filters use are implemented.
+type collectFakeRes struct {
+	Res // the rest of the interface is unused
+
+	kind  string
+	name  string
+	Owner string  `lang:"owner" yaml:"owner"`
+	Mode  *string `yaml:"mode"`
+}
+
+func (obj *collectFakeRes) Kind() string   { return obj.kind }
+func (obj *collectFakeRes) Name() string   { return obj.name }
+func (obj *collectFakeRes) String() string { return fmt.Sprintf("%s[%s]", obj.kind, obj.name) }
+
+func TestResFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter *ResFilter
+		ok     bool
+	}{
+		{&ResFilter{}, true},
+		{&ResFilter{Kind: "file", Name: "/tmp/*.conf", NameRegexp: "^/tmp/", Sort: "name", Limit: 2}, true},
+		{&ResFilter{Fields: []string{`owner == "www"`, "mode != 0644", `owner =~ ^w+$`}}, true},
+		{&ResFilter{Name: "[/tmp"}, false},
+		{&ResFilter{NameRegexp: "(/tmp"}, false},
+		{&ResFilter{Fields: []string{"owner"}}, false},
+		{&ResFilter{Fields: []string{`== "www"`}}, false},
+		{&ResFilter{Fields: []string{`owner == "www`}}, false},
+		{&ResFilter{Fields: []string{"owner =~ (w"}}, false},
+		{&ResFilter{Sort: "size"}, false},
+		{&ResFilter{Limit: -1}, false},
+	}
+	for i, x := range tests {
+		err := x.filter.Validate()
+		if x.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		}
+		if !x.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestParseResFieldFilter(t *testing.T) {
+	tests := map[string]string{
+		`owner == "www"`:     "owner|==|www",
+		"owner!=www":         "owner|!=|www",
+		`content == "a!=b"`:  "content|==|a!=b",
+		"mode =~ ^06":        "mode|=~|^06",
+		`path !~ "\\.conf$"`: `path|!~|\.conf$`,
+	}
+	for s, expected := range tests {
+		f, err := parseResFieldFilter(s)
+		if err != nil {
+			t.Errorf("predicate %s failed with: %v", s, err)
+			continue
+		}
+		if out := fmt.Sprintf("%s|%s|%s", f.field, f.op, f.value); out != expected {
+			t.Errorf("predicate %s parsed as %s instead of %s", s, out, expected)
+		}
+	}
+}
+
+func TestResFilterMatch(t *testing.T) {
+	mode := "0644"
+	res := &collectFakeRes{kind: "file", name: "/tmp/mgmt/a.conf", Owner: "www", Mode: &mode}
+
+	tests := []struct {
+		filter   *ResFilter
+		hostname string
+		matched  bool
+	}{
+		{&ResFilter{}, "h1", true},
+		{&ResFilter{Kind: "file", Hostnames: []string{"h1", "h2"}}, "h2", true},
+		{&ResFilter{Kind: "svc"}, "h1", false},
+		{&ResFilter{Hostnames: []string{"h1"}}, "h2", false},
+		{&ResFilter{Name: "/tmp/mgmt/*.conf"}, "h1", true},
+		{&ResFilter{Name: "/tmp/*.conf"}, "h1", false},
+		{&ResFilter{NameRegexp: `a\.conf$`}, "h1", true},
+		{&ResFilter{NameRegexp: `^a`}, "h1", false},
+		{&ResFilter{Fields: []string{`owner == "www"`}}, "h1", true},
+		{&ResFilter{Fields: []string{"Owner == www", "mode == 0644"}}, "h1", true},
+		{&ResFilter{Fields: []string{"owner != www"}}, "h1", false},
+		{&ResFilter{Fields: []string{"owner =~ ^w"}}, "h1", true},
+		{&ResFilter{Fields: []string{"owner !~ ^w"}}, "h1", false},
+		{&ResFilter{Fields: []string{"owner == www", "mode == 0600"}}, "h1", false},
+	}
+	for i, x := range tests {
+		if err := x.filter.Validate(); err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+			continue
+		}
+		matched, err := x.filter.Match(x.hostname, res)
+		if err != nil {
+			t.Errorf("test #%d: match failed with: %v", i, err)
+			continue
+		}
+		if matched != x.matched {
+			t.Errorf("test #%d: match returned: %t", i, matched)
+		}
+	}
+
+	// a missing field never matches, whatever the operator is
+	for _, field := range []string{"group == www", "group != www", "group !~ ^w"} {
+		filter := &ResFilter{Fields: []string{field}}
+		if err := filter.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			continue
+		}
+		matched, err := filter.Match("h1", res)
+		if err != nil {
+			t.Errorf("matching a missing field failed with: %v", err)
+		} else if matched {
+			t.Errorf("the missing field matched: %s", field)
+		}
+	}
+}
+
+func TestResFilterCollect(t *testing.T) {
+	exported := []*ExportedRes{
+		{Hostname: "h2", Res: &collectFakeRes{kind: "file", name: "b", Owner: "www"}},
+		{Hostname: "h1", Labels: map[string]string{"role": "db"}, Res: &collectFakeRes{kind: "svc", name: "a"}},
+		{Hostname: "h1", Labels: map[string]string{"role": "db"}, Res: &collectFakeRes{kind: "file", name: "c", Owner: "www"}},
+		{Hostname: "h3", Res: &collectFakeRes{kind: "file", name: "a", Owner: "root"}},
+	}
+
+	tests := []struct {
+		filter   *ResFilter
+		expected string
+	}{
+		{&ResFilter{}, "[file[c] svc[a] file[b] file[a]]"},
+		{&ResFilter{Sort: "hostname"}, "[file[c] svc[a] file[b] file[a]]"},
+		{&ResFilter{Sort: "name"}, "[svc[a] file[a] file[b] file[c]]"},
+		{&ResFilter{Sort: "kind"}, "[file[a] file[b] file[c] svc[a]]"},
+		{&ResFilter{Kind: "file", Sort: "name", Limit: 2}, "[file[a] file[b]]"},
+		{&ResFilter{Fields: []string{"owner == www"}}, "[file[c] file[b]]"},
+		{&ResFilter{Limit: 10}, "[file[c] svc[a] file[b] file[a]]"},
+		{&ResFilter{Labels: "role=db"}, "[file[c] svc[a]]"},
+		{&ResFilter{Labels: "!role", Kind: "file"}, "[file[b] file[a]]"},
+	}
+	for i, x := range tests {
+		if err := x.filter.Validate(); err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+			continue
+		}
+		resources, err := x.filter.Collect(exported)
+		if err != nil {
+			t.Errorf("test #%d: collect failed with: %v", i, err)
+			continue
+		}
+		if s := fmt.Sprintf("%v", resources); s != x.expected {
+			t.Errorf("test #%d: collected: %s", i, s)
+		}
+	}
+}
@@ -28,6 +28,13 @@ import (
 	errwrap "github.com/pkg/errors"
 )
 
+// groupKinds are the kinds which may be grouped into a resource of a different
+// kind. The key is the kind of the parent, and the value is the list of kinds
+// which can be grouped into it. Every other pair must have the same kind.
+var groupKinds = map[string][]string{
+	"http:server": {"http:file"},
+}
+
 // AutoGroup runs the auto grouping on the loaded graph.
 func (obj *Engine) AutoGroup(ag engine.AutoGrouper) error {
 	if obj.nextGraph == nil {
@@ -75,8 +82,8 @@ func (obj *wrappedGrouper) VertexCmp(v1, v2 pgraph.Vertex) error {
 		return fmt.Errorf("v2 is not a GroupableRes")
 	}
 
-	if r1.Kind() != r2.Kind() { // we must group similar kinds
-		// TODO: maybe future resources won't need this limitation?
+	// we must group similar kinds, unless the pair is explicitly allowed
+	if r1.Kind() != r2.Kind() && !util.StrInList(r2.Kind(), groupKinds[r1.Kind()]) {
 		return fmt.Errorf("the two resources aren't the same kind")
 	}
 	// someone doesn't want to group!
@@ -0,0 +1,222 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+const (
+	// LabelOS is the label with the operating system of each host.
+	LabelOS = "os"
+	// LabelArch is the label with the architecture of each host.
+	LabelArch = "arch"
+	// LabelCPUs is the label with the number of cpus of each host.
+	LabelCPUs = "cpus"
+	// LabelMemory is the label with the total memory of each host in MiB.
+	LabelMemory = "memory"
+)
+
+var (
+	// labelKeyRegexp matches the valid label keys. They can't contain the
+	// slash char, since each one is stored under its own key in etcd.
+	labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	// labelValueRegexp matches the valid label values.
+	labelValueRegexp = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+)
+
+// ValidateLabels checks that the keys and values of the labels are valid.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("invalid label key: `%s`", k)
+		}
+		if !labelValueRegexp.MatchString(v) {
+			return fmt.Errorf("invalid value for label `%s`: `%s`", k, v)
+		}
+	}
+	return nil
+}
+
+// ParseLabels parses a list of labels in the `key=value` format into a map.
+func ParseLabels(labels []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, s := range labels {
+		split := strings.SplitN(s, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("label `%s` is not in the key=value format", s)
+		}
+		result[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
+	}
+	if err := ValidateLabels(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LabelSelector selects hosts by their labels. It is a comma separated list of
+// requirements which must all match. Each one is either `key=value` (or `==`),
+// `key!=value`, `key in (a, b)`, `key notin (a, b)`, `key` which requires the
+// label to exist, or `!key` which requires it to be absent. The empty selector
+// matches every host.
+type LabelSelector struct {
+	requirements []*labelRequirement
+}
+
+// labelRequirement is one of the requirements of a label selector.
+type labelRequirement struct {
+	key    string
+	op     string // one of =, !=, in, notin, exists or !exists
+	values []string
+}
+
+// ParseLabelSelector parses a label selector string, such as `role=db,rack=3`.
+func ParseLabelSelector(s string) (*LabelSelector, error) {
+	selector := &LabelSelector{
+		requirements: []*labelRequirement{},
+	}
+	if strings.TrimSpace(s) == "" {
+		return selector, nil // matches everything
+	}
+
+	chunks := []string{}
+	depth, start := 0, 0
+	for i, c := range s { // split on the commas which aren't in a set
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				chunks = append(chunks, s[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("unbalanced parentheses in selector: `%s`", s)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in selector: `%s`", s)
+	}
+	chunks = append(chunks, s[start:])
+
+	for _, chunk := range chunks {
+		r, err := parseLabelRequirement(strings.TrimSpace(chunk))
+		if err != nil {
+			return nil, fmt.Errorf("invalid requirement `%s` in selector: %v", chunk, err)
+		}
+		selector.requirements = append(selector.requirements, r)
+	}
+	return selector, nil
+}
+
+// parseLabelRequirement parses a single requirement of a label selector.
+func parseLabelRequirement(s string) (*labelRequirement, error) {
+	r := &labelRequirement{}
+	if i := strings.Index(s, "("); i >= 0 { // a set based requirement
+		if !strings.HasSuffix(s, ")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		fields := strings.Fields(s[:i])
+		if len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") {
+			return nil, fmt.Errorf("expected `key in (...)` or `key notin (...)`")
+		}
+		r.key, r.op = fields[0], fields[1]
+		for _, x := range strings.Split(s[i+1:len(s)-1], ",") {
+			r.values = append(r.values, strings.TrimSpace(x))
+		}
+
+	} else if i := strings.Index(s, "!="); i >= 0 {
+		r.key, r.op, r.values = s[:i], "!=", []string{s[i+len("!="):]}
+
+	} else if i := strings.Index(s, "=="); i >= 0 {
+		r.key, r.op, r.values = s[:i], "=", []string{s[i+len("=="):]}
+
+	} else if i := strings.Index(s, "="); i >= 0 {
+		r.key, r.op, r.values = s[:i], "=", []string{s[i+len("="):]}
+
+	} else if strings.HasPrefix(s, "!") {
+		r.key, r.op = s[1:], "!exists"
+
+	} else {
+		r.key, r.op = s, "exists"
+	}
+
+	r.key = strings.TrimSpace(r.key)
+	if !labelKeyRegexp.MatchString(r.key) {
+		return nil, fmt.Errorf("invalid label key: `%s`", r.key)
+	}
+	for i, v := range r.values {
+		r.values[i] = strings.TrimSpace(v)
+		if !labelValueRegexp.MatchString(r.values[i]) {
+			return nil, fmt.Errorf("invalid label value: `%s`", v)
+		}
+	}
+	return r, nil
+}
+
+// Matches returns true if the labels satisfy every requirement of the selector.
+func (obj *LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range obj.requirements {
+		value, exists := labels[r.key]
+		switch r.op {
+		case "exists":
+			if !exists {
+				return false
+			}
+		case "!exists":
+			if exists {
+				return false
+			}
+		case "=", "in":
+			if !exists || !util.StrInList(value, r.values) {
+				return false
+			}
+		case "!=", "notin":
+			if exists && util.StrInList(value, r.values) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Empty returns true if the selector has no requirements and so matches every
+// host.
+func (obj *LabelSelector) Empty() bool {
+	return len(obj.requirements) == 0
+}
+
+// Select returns the sorted list of hostnames whose labels match the selector.
+func (obj *LabelSelector) Select(hostLabels map[string]map[string]string) []string {
+	hostnames := []string{}
+	for hostname, labels := range hostLabels {
+		if obj.Matches(labels) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
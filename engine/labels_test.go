@@ -0,0 +1,101 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"role=db", " rack = 3 ", "empty="})
+	if err != nil {
+		t.Errorf("parse failed with: %v", err)
+		return
+	}
+	if s := fmt.Sprintf("%v", labels); s != "map[empty: rack:3 role:db]" {
+		t.Errorf("got wrong labels: %s", s)
+	}
+
+	for _, s := range []string{"role", "=db", "a/b=c", "role=d b", "role=-db"} {
+		if _, err := ParseLabels([]string{s}); err == nil {
+			t.Errorf("label %s should have failed", s)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{
+		"role": "db",
+		"rack": "3",
+		"os":   "linux",
+	}
+	tests := map[string]bool{
+		"":                         true,
+		"role=db":                  true,
+		"role==db, rack=3":         true,
+		"role=db,rack=4":           false,
+		"role!=web":                true,
+		"role!=db":                 false,
+		"zone!=east":               true, // missing labels never equal
+		"rack in (2, 3)":           true,
+		"rack in (1,2),role=db":    false,
+		"rack notin (1, 2)":        true,
+		"os notin (linux,darwin)":  false,
+		"role":                     true,
+		"zone":                     false,
+		"!zone":                    true,
+		"!role":                    false,
+		"role=db,rack in (3),!gpu": true,
+	}
+	for s, expected := range tests {
+		selector, err := ParseLabelSelector(s)
+		if err != nil {
+			t.Errorf("selector `%s` failed with: %v", s, err)
+			continue
+		}
+		if matched := selector.Matches(labels); matched != expected {
+			t.Errorf("selector `%s` returned: %t", s, matched)
+		}
+	}
+
+	for _, s := range []string{"role=db,", "rack in (1,2", "rack in 1,2)", "rack is (1)", "a/b=c", "role=d b", "(role)"} {
+		if _, err := ParseLabelSelector(s); err == nil {
+			t.Errorf("selector `%s` should have failed", s)
+		}
+	}
+}
+
+func TestLabelSelectorSelect(t *testing.T) {
+	hostLabels := map[string]map[string]string{
+		"h3": {"role": "db", "rack": "3"},
+		"h1": {"role": "db", "rack": "3"},
+		"h2": {"role": "web", "rack": "3"},
+		"h4": {},
+	}
+	selector, err := ParseLabelSelector("role=db,rack=3")
+	if err != nil {
+		t.Errorf("selector failed with: %v", err)
+		return
+	}
+	if s := fmt.Sprintf("%v", selector.Select(hostLabels)); s != "[h1 h3]" {
+		t.Errorf("got wrong hosts: %s", s)
+	}
+}
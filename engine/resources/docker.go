@@ -0,0 +1,190 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker
+
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/recwatch"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// DockerExists is the state of a docker image, network or volume which
+	// should be present.
+	DockerExists = "exists"
+	// DockerAbsent is the state of a docker image, network or volume which
+	// should be removed.
+	DockerAbsent = "absent"
+)
+
+// dockerClient returns a new docker api client. The docker host can be changed
+// from the default socket with the usual DOCKER_HOST environment variable.
+func dockerClient(apiVersion string) (*client.Client, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = client.DefaultDockerHost
+	}
+	c, err := client.NewClient(host, apiVersion, nil, nil)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error creating docker client")
+	}
+	return c, nil
+}
+
+// dockerValidateAPIVersion returns an error if the api version override is not
+// of the form v1.37 or similar. The empty string is valid.
+func dockerValidateAPIVersion(apiVersion string) error {
+	if apiVersion == "" {
+		return nil
+	}
+	verOK, err := regexp.MatchString(`^(v)[1-9]\.[0-9]\d*$`, apiVersion)
+	if err != nil {
+		return errwrap.Wrapf(err, "error matching apiversion string")
+	}
+	if !verOK {
+		return fmt.Errorf("invalid apiversion: %s", apiVersion)
+	}
+	return nil
+}
+
+// dockerImageRef returns the normalized form of an image reference, so that
+// alpine and alpine:latest compare equal.
+func dockerImageRef(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "invalid image reference: %s", image)
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named)), nil
+}
+
+// dockerStreamError reads a json message stream from a pull or a build until
+// it is done, and returns the first error that was reported in it, if any.
+func dockerStreamError(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errwrap.Wrapf(err, "error reading docker message stream")
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+	}
+}
+
+// dockerStrMapContains returns true if every key in the wanted map is present
+// in the actual map with the same value. This lets docker add its own defaults.
+func dockerStrMapContains(actual, wanted map[string]string) bool {
+	for k, v := range wanted {
+		if x, exists := actual[k]; !exists || x != v {
+			return false
+		}
+	}
+	return true
+}
+
+// dockerWatch is the Watch loop which is shared by the docker resources. It
+// generates an event every time the docker daemon reports an event that passes
+// through the filters, and if the dir isn't empty, whenever anything in it
+// changes.
+func dockerWatch(init *engine.Init, c *client.Client, args filters.Args, dir string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventChan, errChan := c.Events(ctx, types.EventsOptions{Filters: args})
+
+	var fileChan chan recwatch.Event // nil, and so it blocks, without a dir
+	if dir != "" {
+		recWatcher, err := recwatch.NewRecWatcher(dir, true)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		fileChan = recWatcher.Events()
+	}
+
+	// notify engine that we're running
+	if err := init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-eventChan:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if init.Debug {
+				init.Logf("%+v", event)
+			}
+			send = true
+			init.Dirty() // dirty
+		case err, ok := <-errChan:
+			if !ok {
+				return nil
+			}
+			return err
+		case event, ok := <-fileChan:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown watcher error")
+			}
+			if init.Debug { // don't access event.Body if event.Error isn't nil
+				init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+			init.Dirty() // dirty
+		case event, ok := <-init.Events:
+			if !ok {
+				return nil
+			}
+			if err := init.Read(event); err != nil {
+				return err
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			if err := init.Event(); err != nil {
+				return err // exit if requested
+			}
+		}
+	}
+}
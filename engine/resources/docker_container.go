@@ -22,8 +22,7 @@ package resources
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,6 +33,7 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	errwrap "github.com/pkg/errors"
@@ -47,9 +47,6 @@ const (
 	// ContainerRemoved is the removed container state.
 	ContainerRemoved = "removed"
 
-	// initCtxTimeout is the length of time, in seconds, before requests are
-	// cancelled in Init.
-	initCtxTimeout = 20
 	// checkApplyCtxTimeout is the length of time, in seconds, before requests
 	// are cancelled in CheckApply.
 	checkApplyCtxTimeout = 120
@@ -74,11 +71,29 @@ type DockerContainerRes struct {
 	Env []string `yaml:"env"`
 	// Ports is a map of port bindings. E.g. {"tcp" => {80 => 8080},}.
 	Ports map[string]map[int64]int64 `yaml:"ports"`
+	// Volumes is a list of mounts in the docker format. E.g.
+	// ["data:/var/lib/data", "/srv/www:/usr/share/nginx/html:ro",]. Named
+	// volumes get an automatic edge to the docker:volume which manages them.
+	Volumes []string `yaml:"volumes"`
+	// Networks is a list of networks to attach the container to. The first
+	// one replaces the default bridge network.
+	Networks []string `yaml:"networks"`
+	// RestartPolicy is the docker restart policy, which is one of no,
+	// always, unless-stopped or on-failure. E.g. "on-failure:3".
+	RestartPolicy string `yaml:"restartpolicy"`
+	// Labels are the labels to set on the container.
+	Labels map[string]string `yaml:"labels"`
+	// Memory is the memory limit of the container in bytes. Zero means no
+	// limit.
+	Memory int64 `yaml:"memory"`
+	// CPUs is the number of cpus that the container can use. E.g. 1.5. Zero
+	// means no limit.
+	CPUs float64 `yaml:"cpus"`
 	// APIVersion allows you to override the host's default client API version.
 	APIVersion string `yaml:"apiversion"`
 
-	// Force, if true, will destroy and redeploy the container if the image is
-	// incorrect.
+	// Force, if true, will destroy and redeploy the container if the image or
+	// any of the other settings are incorrect.
 	Force bool `yaml:"force"`
 
 	client *client.Client // docker api client
@@ -117,18 +132,36 @@ func (obj *DockerContainerRes) Validate() error {
 		}
 	}
 
-	// validate APIVersion
-	if obj.APIVersion != "" {
-		verOK, err := regexp.MatchString(`^(v)[1-9]\.[0-9]\d*$`, obj.APIVersion)
-		if err != nil {
-			return errwrap.Wrapf(err, "error matching apiversion string")
+	// validate volumes
+	for _, v := range obj.Volumes {
+		if _, _, err := dockerParseVolume(v); err != nil {
+			return err
 		}
-		if !verOK {
-			return fmt.Errorf("invalid apiversion: %s", obj.APIVersion)
+	}
+
+	// validate networks
+	for i, n := range obj.Networks {
+		if n == "" {
+			return fmt.Errorf("network names must not be empty")
+		}
+		if util.StrInList(n, obj.Networks[i+1:]) {
+			return fmt.Errorf("duplicate network: %s", n)
 		}
 	}
 
-	return nil
+	if _, err := dockerRestartPolicy(obj.RestartPolicy); err != nil {
+		return err
+	}
+
+	if obj.Memory < 0 {
+		return fmt.Errorf("memory must not be negative")
+	}
+	if obj.CPUs < 0 {
+		return fmt.Errorf("cpus must not be negative")
+	}
+
+	// validate APIVersion
+	return dockerValidateAPIVersion(obj.APIVersion)
 }
 
 // Init runs some startup code for this resource.
@@ -136,24 +169,10 @@ func (obj *DockerContainerRes) Init(init *engine.Init) error {
 	var err error
 	obj.init = init // save for later
 
-	ctx, cancel := context.WithTimeout(context.Background(), initCtxTimeout*time.Second)
-	defer cancel()
-
-	// Initialize the docker client.
-	obj.client, err = client.NewClient(client.DefaultDockerHost, obj.APIVersion, nil, nil)
-	if err != nil {
-		return errwrap.Wrapf(err, "error creating docker client")
-	}
-
-	// Validate the image.
-	resp, err := obj.client.ImageSearch(ctx, obj.Image, types.ImageSearchOptions{Limit: 1})
-	if err != nil {
-		return errwrap.Wrapf(err, "error searching for image")
-	}
-	if len(resp) == 0 {
-		return fmt.Errorf("image: %s not found", obj.Image)
-	}
-	return nil
+	// Initialize the docker client. The image isn't validated here, since
+	// it might be built locally by a docker:image resource that hasn't run.
+	obj.client, err = dockerClient(obj.APIVersion)
+	return err
 }
 
 // Close is run by the engine to clean up after the resource is done.
@@ -163,56 +182,13 @@ func (obj *DockerContainerRes) Close() error {
 
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *DockerContainerRes) Watch() error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	eventChan, errChan := obj.client.Events(ctx, types.EventsOptions{})
-
-	// notify engine that we're running
-	if err := obj.init.Running(); err != nil {
-		return err // exit if requested
-	}
-
-	var send = false // send event?
-	for {
-		select {
-		case event, ok := <-eventChan:
-			if !ok { // channel shutdown
-				return nil
-			}
-			if obj.init.Debug {
-				obj.init.Logf("%+v", event)
-			}
-			send = true
-			obj.init.Dirty() // dirty
-		case err, ok := <-errChan:
-			if !ok {
-				return nil
-			}
-			return err
-		case event, ok := <-obj.init.Events:
-			if !ok {
-				return nil
-			}
-			if err := obj.init.Read(event); err != nil {
-				return err
-			}
-		}
-
-		// do all our event sending all together to avoid duplicate msgs
-		if send {
-			send = false
-			if err := obj.init.Event(); err != nil {
-				return err // exit if requested
-			}
-		}
-	}
+	return dockerWatch(obj.init, obj.client, filters.NewArgs(), "")
 }
 
 // CheckApply method for Docker resource.
 func (obj *DockerContainerRes) CheckApply(apply bool) (checkOK bool, err error) {
 	var id string
-	var destroy bool
+	var running, destroy bool
 
 	ctx, cancel := context.WithTimeout(context.Background(), checkApplyCtxTimeout*time.Second)
 	defer cancel()
@@ -222,10 +198,17 @@ func (obj *DockerContainerRes) CheckApply(apply bool) (checkOK bool, err error)
 		All:     true,
 		Filters: filters.NewArgs(filters.KeyValuePair{Key: "name", Value: obj.Name()}),
 	}
-	containerList, err := obj.client.ContainerList(ctx, opts)
+	result, err := obj.client.ContainerList(ctx, opts)
 	if err != nil {
 		return false, errwrap.Wrapf(err, "error listing containers")
 	}
+	// The name filter also matches substrings, so look for the exact name.
+	containerList := []types.Container{}
+	for _, x := range result {
+		if util.StrInList("/"+obj.Name(), x.Names) {
+			containerList = append(containerList, x)
+		}
+	}
 
 	if len(containerList) > 1 {
 		return false, fmt.Errorf("more than one container named %s", obj.Name())
@@ -234,20 +217,21 @@ func (obj *DockerContainerRes) CheckApply(apply bool) (checkOK bool, err error)
 		return true, nil
 	}
 	if len(containerList) == 1 {
-		// If the state and image are correct, we're done.
-		if containerList[0].State == obj.State && containerList[0].Image == obj.Image {
-			return true, nil
-		}
 		id = containerList[0].ID // save the id for later
-		// If the image is wrong, and force is true, mark the container for
-		// destruction.
-		if containerList[0].Image != obj.Image && obj.Force {
+		running = containerList[0].State == ContainerRunning
+	}
+	if id != "" && obj.State != ContainerRemoved {
+		if err := obj.containerCheck(ctx, id, containerList[0].Image); err != nil {
+			// If the container is wrong, and force is true, mark the
+			// container for destruction. Otherwise return an error.
+			if !obj.Force {
+				return false, errwrap.Wrapf(err, "%s exists but is incorrect", obj.Name())
+			}
 			destroy = true
 		}
-		// Otherwise return an error.
-		if containerList[0].Image != obj.Image && !obj.Force {
-			return false, fmt.Errorf("%s exists but has the wrong image: %s", obj.Name(), containerList[0].Image)
-
+		// If the state and the container are correct, we're done.
+		if !destroy && running == (obj.State == ContainerRunning) {
+			return true, nil
 		}
 	}
 
@@ -255,10 +239,6 @@ func (obj *DockerContainerRes) CheckApply(apply bool) (checkOK bool, err error)
 		return false, nil
 	}
 
-	if obj.State == ContainerStopped { // container exists and should be stopped
-		return false, obj.containerStop(ctx, id, nil)
-	}
-
 	if obj.State == ContainerRemoved { // container exists and should be removed
 		if err := obj.containerStop(ctx, id, nil); err != nil {
 			return false, err
@@ -273,52 +253,198 @@ func (obj *DockerContainerRes) CheckApply(apply bool) (checkOK bool, err error)
 		if err := obj.containerRemove(ctx, id, types.ContainerRemoveOptions{}); err != nil {
 			return false, err
 		}
-		containerList = []types.Container{} // zero the list
+		id, running = "", false // it's gone
 	}
 
-	if len(containerList) == 0 { // no container was found
-		// Download the specified image if it doesn't exist locally.
-		p, err := obj.client.ImagePull(ctx, obj.Image, types.ImagePullOptions{})
-		if err != nil {
-			return false, errwrap.Wrapf(err, "error pulling image")
+	if id == "" { // no container was found
+		if id, err = obj.containerCreate(ctx); err != nil {
+			return false, err
 		}
-		// Wait for the image to download, EOF signals that it's done.
-		if _, err := ioutil.ReadAll(p); err != nil {
-			return false, errwrap.Wrapf(err, "error reading image pull result")
+	}
+
+	if obj.State == ContainerStopped {
+		if !running { // it was just created, or it was already stopped
+			return false, nil
 		}
+		return false, obj.containerStop(ctx, id, nil)
+	}
 
-		// set up port bindings
-		containerConfig := &container.Config{
-			Image:        obj.Image,
-			Cmd:          obj.Cmd,
-			Env:          obj.Env,
-			ExposedPorts: make(map[nat.Port]struct{}),
+	return false, obj.containerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+// containerCheck returns an error describing the difference between the
+// existing container and the one we want.
+func (obj *DockerContainerRes) containerCheck(ctx context.Context, id, image string) error {
+	if image != obj.Image {
+		return fmt.Errorf("it has the wrong image: %s", image)
+	}
+	info, err := obj.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return errwrap.Wrapf(err, "error inspecting container")
+	}
+	if info.Config == nil || info.HostConfig == nil {
+		return fmt.Errorf("the container config is missing")
+	}
+	if !dockerStrMapContains(info.Config.Labels, obj.Labels) {
+		return fmt.Errorf("it has the wrong labels")
+	}
+	for _, env := range obj.Env { // docker adds the env of the image too
+		if !util.StrInList(env, info.Config.Env) {
+			return fmt.Errorf("it has the wrong env, missing: %s", env)
 		}
+	}
+	if _, bindings := obj.portBindings(); !dockerPortMapEq(info.HostConfig.PortBindings, bindings) {
+		return fmt.Errorf("it has the wrong ports")
+	}
+	if err := util.SortedStrSliceCompare(info.HostConfig.Binds, obj.Volumes); err != nil {
+		return errwrap.Wrapf(err, "it has the wrong volumes")
+	}
+	policy, err := dockerRestartPolicy(obj.RestartPolicy)
+	if err != nil {
+		return err
+	}
+	actual := info.HostConfig.RestartPolicy
+	if actual.Name == "" {
+		actual.Name = "no" // this is the same as the default
+	}
+	if actual.Name != policy.Name || actual.MaximumRetryCount != policy.MaximumRetryCount {
+		return fmt.Errorf("it has the wrong restart policy: %s", actual.Name)
+	}
+	if info.HostConfig.Memory != obj.Memory {
+		return fmt.Errorf("it has the wrong memory limit: %d", info.HostConfig.Memory)
+	}
+	if info.HostConfig.NanoCPUs != obj.nanoCPUs() {
+		return fmt.Errorf("it has the wrong cpu limit")
+	}
+	for _, n := range obj.Networks {
+		if info.NetworkSettings == nil {
+			return fmt.Errorf("it has no network settings")
+		}
+		if _, exists := info.NetworkSettings.Networks[n]; !exists {
+			return fmt.Errorf("it isn't attached to network: %s", n)
+		}
+	}
+	return nil
+}
 
-		hostConfig := &container.HostConfig{
-			PortBindings: make(map[nat.Port][]nat.PortBinding),
+// portBindings returns the exposed ports and the port bindings of the Ports.
+func (obj *DockerContainerRes) portBindings() (nat.PortSet, nat.PortMap) {
+	exposed := make(nat.PortSet)
+	bindings := make(nat.PortMap)
+	for k, v := range obj.Ports {
+		for p, q := range v {
+			port := nat.Port(fmt.Sprintf("%d/%s", p, k))
+			exposed[port] = struct{}{}
+			bindings[port] = []nat.PortBinding{
+				{
+					HostIP:   "0.0.0.0",
+					HostPort: fmt.Sprintf("%d", q),
+				},
+			}
 		}
+	}
+	return exposed, bindings
+}
 
-		for k, v := range obj.Ports {
-			for p, q := range v {
-				containerConfig.ExposedPorts[nat.Port(k)] = struct{}{}
-				hostConfig.PortBindings[nat.Port(fmt.Sprintf("%d/%s", p, k))] = []nat.PortBinding{
-					{
-						HostIP:   "0.0.0.0",
-						HostPort: fmt.Sprintf("%d", q),
-					},
-				}
+// dockerPortMapEq returns true if both port maps bind the same ports. A port
+// without any bindings is the same as a missing one.
+func dockerPortMapEq(a, b nat.PortMap) bool {
+	count := func(m nat.PortMap) int {
+		n := 0
+		for _, x := range m {
+			if len(x) > 0 {
+				n++
 			}
 		}
+		return n
+	}
+	if count(a) != count(b) {
+		return false
+	}
+	for port, x := range b {
+		y := a[port]
+		if len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i].HostIP != y[i].HostIP || x[i].HostPort != y[i].HostPort {
+				return false
+			}
+		}
+	}
+	return true
+}
 
-		c, err := obj.client.ContainerCreate(ctx, containerConfig, hostConfig, nil, obj.Name())
+// containerCreate creates the container, and pulls the image first if it's not
+// available locally. It returns the id of the new container.
+func (obj *DockerContainerRes) containerCreate(ctx context.Context) (string, error) {
+	// Download the specified image if it doesn't exist locally.
+	if _, _, err := obj.client.ImageInspectWithRaw(ctx, obj.Image); client.IsErrNotFound(err) {
+		p, err := obj.client.ImagePull(ctx, obj.Image, types.ImagePullOptions{})
 		if err != nil {
-			return false, errwrap.Wrapf(err, "error creating container")
+			return "", errwrap.Wrapf(err, "error pulling image")
 		}
-		id = c.ID
+		defer p.Close()
+		// Wait for the image to download, EOF signals that it's done.
+		if err := dockerStreamError(p); err != nil {
+			return "", errwrap.Wrapf(err, "error pulling image")
+		}
+	} else if err != nil {
+		return "", errwrap.Wrapf(err, "error inspecting image")
 	}
 
-	return false, obj.containerStart(ctx, id, types.ContainerStartOptions{})
+	policy, err := dockerRestartPolicy(obj.RestartPolicy)
+	if err != nil {
+		return "", err
+	}
+
+	// set up port bindings
+	exposed, bindings := obj.portBindings()
+	containerConfig := &container.Config{
+		Image:        obj.Image,
+		Cmd:          obj.Cmd,
+		Env:          obj.Env,
+		Labels:       obj.Labels,
+		ExposedPorts: exposed,
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds:         obj.Volumes,
+		PortBindings:  bindings,
+		RestartPolicy: policy,
+		Resources: container.Resources{
+			Memory:   obj.Memory,
+			NanoCPUs: obj.nanoCPUs(),
+		},
+	}
+
+	// Only one network can be given at creation, the rest get connected.
+	var networkingConfig *network.NetworkingConfig
+	if len(obj.Networks) > 0 {
+		hostConfig.NetworkMode = container.NetworkMode(obj.Networks[0])
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				obj.Networks[0]: {},
+			},
+		}
+	}
+
+	c, err := obj.client.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, obj.Name())
+	if err != nil {
+		return "", errwrap.Wrapf(err, "error creating container")
+	}
+
+	for i := 1; i < len(obj.Networks); i++ {
+		if err := obj.client.NetworkConnect(ctx, obj.Networks[i], c.ID, nil); err != nil {
+			return "", errwrap.Wrapf(err, "error connecting container to network: %s", obj.Networks[i])
+		}
+	}
+	return c.ID, nil
+}
+
+// nanoCPUs returns the cpu limit in the units that docker uses.
+func (obj *DockerContainerRes) nanoCPUs() int64 {
+	return int64(obj.CPUs * 1e9)
 }
 
 // containerStart starts the specified container, and waits for it to start.
@@ -395,6 +521,27 @@ func (obj *DockerContainerRes) Cmp(r engine.Res) error {
 			}
 		}
 	}
+	if err := util.SortedStrSliceCompare(obj.Volumes, res.Volumes); err != nil {
+		return errwrap.Wrapf(err, "volumes differ")
+	}
+	if err := util.SortedStrSliceCompare(obj.Networks, res.Networks); err != nil {
+		return errwrap.Wrapf(err, "networks differ")
+	}
+	if len(obj.Networks) > 0 && obj.Networks[0] != res.Networks[0] {
+		return fmt.Errorf("the first network differs")
+	}
+	if obj.RestartPolicy != res.RestartPolicy {
+		return fmt.Errorf("restart policies differ")
+	}
+	if len(obj.Labels) != len(res.Labels) || !dockerStrMapContains(obj.Labels, res.Labels) {
+		return fmt.Errorf("labels differ")
+	}
+	if obj.Memory != res.Memory {
+		return fmt.Errorf("memory limits differ")
+	}
+	if obj.CPUs != res.CPUs {
+		return fmt.Errorf("cpu limits differ")
+	}
 	if obj.APIVersion != res.APIVersion {
 		return fmt.Errorf("apiversions differ")
 	}
@@ -404,6 +551,48 @@ func (obj *DockerContainerRes) Cmp(r engine.Res) error {
 	return nil
 }
 
+// dockerParseVolume splits a volume mount in the docker format into its source
+// and its destination. The source is either a named volume or a host path.
+func dockerParseVolume(volume string) (string, string, error) {
+	split := strings.Split(volume, ":")
+	if len(split) < 2 || len(split) > 3 {
+		return "", "", fmt.Errorf("invalid volume: %s", volume)
+	}
+	source, dest := split[0], split[1]
+	if source == "" || !strings.HasPrefix(dest, "/") {
+		return "", "", fmt.Errorf("invalid volume: %s", volume)
+	}
+	if len(split) == 3 {
+		for _, x := range strings.Split(split[2], ",") {
+			if !util.StrInList(x, []string{"ro", "rw", "z", "Z", "nocopy"}) {
+				return "", "", fmt.Errorf("invalid volume mode: %s", x)
+			}
+		}
+	}
+	return source, dest, nil
+}
+
+// dockerRestartPolicy parses a restart policy string. The empty string is the
+// same as no.
+func dockerRestartPolicy(policy string) (container.RestartPolicy, error) {
+	if policy == "" {
+		return container.RestartPolicy{Name: "no"}, nil
+	}
+	split := strings.SplitN(policy, ":", 2)
+	result := container.RestartPolicy{Name: split[0]}
+	if !util.StrInList(result.Name, []string{"no", "always", "unless-stopped", "on-failure"}) {
+		return result, fmt.Errorf("invalid restart policy: %s", policy)
+	}
+	if len(split) == 2 {
+		count, err := strconv.Atoi(split[1])
+		if err != nil || count < 0 || result.Name != "on-failure" {
+			return result, fmt.Errorf("invalid restart policy: %s", policy)
+		}
+		result.MaximumRetryCount = count
+	}
+	return result, nil
+}
+
 // DockerUID is the UID struct for DockerContainerRes.
 type DockerUID struct {
 	engine.BaseUID
@@ -420,6 +609,56 @@ func (obj *DockerContainerRes) UIDs() []engine.ResUID {
 	return []engine.ResUID{x}
 }
 
+// DockerContainerResAutoEdges holds the state of the auto edge generator.
+type DockerContainerResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *DockerContainerResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *DockerContainerResAutoEdges) Test(input []bool) bool {
+	return false // never keep going
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the image, and the
+// networks and named volumes which the container uses.
+func (obj *DockerContainerRes) AutoEdges() (engine.AutoEdge, error) {
+	var reversed = true // they all have to exist before the container
+	base := engine.BaseUID{
+		Name:     obj.Name(),
+		Kind:     obj.Kind(),
+		Reversed: &reversed,
+	}
+
+	image, err := dockerImageRef(obj.Image)
+	if err != nil {
+		return nil, err
+	}
+	data := []engine.ResUID{
+		&DockerImageUID{BaseUID: base, image: image},
+	}
+	for _, n := range obj.Networks {
+		data = append(data, &DockerNetworkUID{BaseUID: base, name: n})
+	}
+	for _, v := range obj.Volumes {
+		source, _, err := dockerParseVolume(v)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(source, "/") { // a bind mount of a host path
+			continue
+		}
+		data = append(data, &DockerVolumeUID{BaseUID: base, name: source})
+	}
+	return &DockerContainerResAutoEdges{
+		edges: data,
+	}, nil
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct.
 // It is primarily useful for setting the defaults.
 func (obj *DockerContainerRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -28,6 +28,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/util"
+
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
@@ -37,6 +40,14 @@ var res *DockerContainerRes
 
 var id string
 
+// fake is the fake docker daemon which all of the docker tests talk to.
+var fake *dockerFake
+
+// dockerTestDigest returns a fake image digest.
+func dockerTestDigest(n int) string {
+	return fmt.Sprintf("sha256:%064x", n)
+}
+
 func TestMain(m *testing.M) {
 	var setupCode, testCode, cleanupCode int
 
@@ -140,14 +151,167 @@ func Test_containerRemove(t *testing.T) {
 	}
 }
 
+func TestDockerContainerValidate(t *testing.T) {
+	invalid := []*DockerContainerRes{
+		{State: "running", Volumes: []string{"data"}},
+		{State: "running", Volumes: []string{"data:relative"}},
+		{State: "running", Volumes: []string{"data:/data:nope"}},
+		{State: "running", Networks: []string{"front", "front"}},
+		{State: "running", RestartPolicy: "sometimes"},
+		{State: "running", RestartPolicy: "always:3"},
+		{State: "running", Memory: -1},
+	}
+	for i, x := range invalid {
+		x.SetName("mgmt-test-invalid")
+		if err := x.Validate(); err == nil {
+			t.Errorf("invalid res %d passed validate", i)
+		}
+	}
+}
+
+func TestDockerContainerCheckApply(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	r1 := &DockerContainerRes{
+		State:         ContainerRunning,
+		Image:         "nginx:1.15",
+		Volumes:       []string{"mgmt-web:/usr/share/nginx/html:ro", "/srv/www:/srv/www"},
+		Networks:      []string{"mgmt-front", "mgmt-back"},
+		RestartPolicy: "on-failure:3",
+		Labels:        map[string]string{"app": "web"},
+		Env:           []string{"MODE=prod"},
+		Ports:         map[string]map[int64]int64{"tcp": {80: 8080}},
+		Memory:        64 * 1024 * 1024,
+		CPUs:          0.5,
+	}
+	r1.SetName("mgmt-test-web")
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %s", err)
+		return
+	}
+	if err := r1.Init(&engine.Init{Logf: t.Logf}); err != nil {
+		t.Errorf("init failed with: %s", err)
+		return
+	}
+	defer r1.Close()
+
+	for _, n := range r1.Networks {
+		if _, err := res.client.NetworkCreate(ctx, n, types.NetworkCreate{Driver: "bridge"}); err != nil {
+			t.Errorf("error creating network: %s", err)
+			return
+		}
+		defer res.client.NetworkRemove(ctx, n)
+	}
+
+	dockerConverge(t, "running", r1)
+	info, err := res.client.ContainerInspect(ctx, r1.Name())
+	if err != nil {
+		t.Errorf("error inspecting container: %s", err)
+		return
+	}
+	if p := info.HostConfig.RestartPolicy; p.Name != "on-failure" || p.MaximumRetryCount != 3 {
+		t.Errorf("unexpected restart policy: %+v", p)
+	}
+	if info.HostConfig.NanoCPUs != 500000000 {
+		t.Errorf("unexpected cpu limit: %d", info.HostConfig.NanoCPUs)
+	}
+	if n := info.NetworkSettings.Networks; len(n) != 2 || n["mgmt-front"] == nil || n["mgmt-back"] == nil {
+		t.Errorf("unexpected networks: %+v", n)
+	}
+
+	r1.Labels["app"] = "www"
+	if _, err := r1.CheckApply(false); err == nil {
+		t.Errorf("different labels should be an error without force")
+	}
+	r1.Force = true
+	dockerConverge(t, "recreate", r1)
+
+	r1.Env = []string{"MODE=dev"}
+	dockerConverge(t, "env", r1)
+	if info, err := res.client.ContainerInspect(ctx, r1.Name()); err != nil {
+		t.Errorf("error inspecting container: %s", err)
+	} else if !util.StrInList("MODE=dev", info.Config.Env) {
+		t.Errorf("unexpected env: %v", info.Config.Env)
+	}
+
+	r1.Ports = map[string]map[int64]int64{"tcp": {80: 8081}}
+	dockerConverge(t, "ports", r1)
+	if info, err := res.client.ContainerInspect(ctx, r1.Name()); err != nil {
+		t.Errorf("error inspecting container: %s", err)
+	} else if b := info.HostConfig.PortBindings["80/tcp"]; len(b) != 1 || b[0].HostPort != "8081" {
+		t.Errorf("unexpected ports: %+v", info.HostConfig.PortBindings)
+	}
+
+	r1.State = ContainerStopped
+	dockerConverge(t, "stopped", r1)
+
+	r1.State = ContainerRemoved
+	dockerConverge(t, "removed", r1)
+}
+
+func TestDockerContainerAutoEdges(t *testing.T) {
+	r1 := &DockerContainerRes{
+		State:    ContainerRunning,
+		Image:    "alpine",
+		Volumes:  []string{"mgmt-data:/data", "/srv/www:/srv/www:ro"},
+		Networks: []string{"mgmt-net"},
+	}
+	r1.SetName("mgmt-test-edges")
+
+	image := &DockerImageRes{}
+	image.SetName("alpine:latest")
+	network := &DockerNetworkRes{}
+	network.SetName("mgmt-net")
+	volume := &DockerVolumeRes{}
+	volume.SetName("mgmt-data")
+	expected := []engine.ResUID{image.UIDs()[0], network.UIDs()[0], volume.UIDs()[0]}
+
+	ae, err := r1.AutoEdges()
+	if err != nil {
+		t.Errorf("autoedges failed with: %s", err)
+		return
+	}
+	uids := ae.Next()
+	if len(uids) != len(expected) {
+		t.Errorf("expected %d uids, got: %d", len(expected), len(uids))
+		return
+	}
+	for i, uid := range uids {
+		if !uid.IsReversed() {
+			t.Errorf("uid %d should be reversed", i)
+		}
+		if !uid.IFF(expected[i]) {
+			t.Errorf("uid %d does not match: %s", i, expected[i])
+		}
+	}
+}
+
 func setup() error {
 	var err error
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	fake = &dockerFake{
+		Registry: map[string]string{
+			"alpine:latest": dockerTestDigest(1),
+			"alpine:3.8":    dockerTestDigest(1),
+			"alpine:3.7":    dockerTestDigest(2),
+			"busybox:1.29":  dockerTestDigest(3),
+			"busybox:1.28":  dockerTestDigest(4),
+			"nginx:1.15":    dockerTestDigest(5),
+		},
+	}
+	fake.Start()
+	if err := os.Setenv("DOCKER_HOST", fake.Host()); err != nil {
+		return fmt.Errorf("error setting docker host: %s", err)
+	}
+
 	res = &DockerContainerRes{}
-	res.Init(res.init)
+	if err := res.Init(res.init); err != nil {
+		return fmt.Errorf("error initializing: %s", err)
+	}
 
 	p, err := res.client.ImagePull(ctx, "alpine", types.ImagePullOptions{})
 	if err != nil {
@@ -175,6 +339,8 @@ func setup() error {
 }
 
 func cleanup() error {
+	defer fake.Close()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
@@ -0,0 +1,649 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker
+
+package resources
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+)
+
+// dockerFake is a fake docker daemon which implements just enough of the
+// docker api for the tests. Set DOCKER_HOST to the value of Host() to use it.
+type dockerFake struct {
+	// Registry maps the image references which can be pulled to their
+	// digests. E.g. {"alpine:3.8": "sha256:...",}.
+	Registry map[string]string
+
+	mutex      sync.Mutex
+	counter    int
+	images     map[string]*types.ImageInspect // by id
+	containers map[string]*types.ContainerJSON
+	networks   map[string]*types.NetworkResource // by id
+	volumes    map[string]*types.Volume          // by name
+
+	subscribers map[chan events.Message]filters.Args
+
+	server *httptest.Server
+	done   chan struct{}
+}
+
+// dockerFakeCreate is the body of a container create request.
+type dockerFakeCreate struct {
+	*container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
+
+// Start runs the fake docker daemon.
+func (obj *dockerFake) Start() {
+	obj.images = make(map[string]*types.ImageInspect)
+	obj.containers = make(map[string]*types.ContainerJSON)
+	obj.networks = make(map[string]*types.NetworkResource)
+	obj.volumes = make(map[string]*types.Volume)
+	obj.subscribers = make(map[chan events.Message]filters.Args)
+	obj.done = make(chan struct{})
+	for _, name := range []string{"bridge", "host", "none"} {
+		obj.networks[obj.id()] = &types.NetworkResource{Name: name, Driver: name}
+	}
+	obj.server = httptest.NewServer(http.HandlerFunc(obj.handle))
+}
+
+// Close shuts down the fake docker daemon.
+func (obj *dockerFake) Close() {
+	close(obj.done) // end any event streams
+	obj.server.Close()
+}
+
+// Host returns the docker host for connecting to the fake.
+func (obj *dockerFake) Host() string {
+	return strings.Replace(obj.server.URL, "http://", "tcp://", 1)
+}
+
+// id returns a new unique id.
+func (obj *dockerFake) id() string {
+	obj.counter++
+	return fmt.Sprintf("%064x", obj.counter)
+}
+
+// findImage returns the image which matches the reference or id.
+func (obj *dockerFake) findImage(ref string) *types.ImageInspect {
+	if image, exists := obj.images[ref]; exists {
+		return image
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil
+	}
+	for _, image := range obj.images {
+		if _, ok := named.(reference.Digested); ok {
+			for _, x := range image.RepoDigests {
+				if d, err := reference.ParseNormalizedNamed(x); err == nil && d.String() == named.String() {
+					return image
+				}
+			}
+			continue
+		}
+		tagged := reference.FamiliarString(reference.TagNameOnly(named))
+		for _, x := range image.RepoTags {
+			if x == tagged {
+				return image
+			}
+		}
+	}
+	return nil
+}
+
+// tag moves the tag to the image with the id.
+func (obj *dockerFake) tag(id, tag string) {
+	for _, image := range obj.images {
+		tags := []string{}
+		for _, x := range image.RepoTags {
+			if x != tag {
+				tags = append(tags, x)
+			}
+		}
+		image.RepoTags = tags
+	}
+	obj.images[id].RepoTags = append(obj.images[id].RepoTags, tag)
+}
+
+// findNetwork returns the network which matches the name or id.
+func (obj *dockerFake) findNetwork(name string) *types.NetworkResource {
+	for id, n := range obj.networks {
+		if id == name || n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// findContainer returns the container which matches the name or id.
+func (obj *dockerFake) findContainer(name string) *types.ContainerJSON {
+	for id, c := range obj.containers {
+		if id == name || c.Name == "/"+name {
+			return c
+		}
+	}
+	return nil
+}
+
+// event records the event and sends it to the matching subscribers.
+func (obj *dockerFake) event(typ, action, id string) {
+	msg := events.Message{
+		Status: action,
+		ID:     id,
+		Type:   typ,
+		Action: action,
+		Actor:  events.Actor{ID: id},
+	}
+	for ch, args := range obj.subscribers {
+		if dockerFakeMatch(args, msg) {
+			select {
+			case ch <- msg:
+			default: // don't block on slow subscribers
+			}
+		}
+	}
+}
+
+// watched returns true if there is an event stream for the container.
+func (obj *dockerFake) watched(id string) bool {
+	for _, args := range obj.subscribers {
+		if x := args.Get("container"); len(x) > 0 && x[0] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerFakeMatch returns true if the event passes through the filters.
+func dockerFakeMatch(args filters.Args, msg events.Message) bool {
+	if x := args.Get("type"); len(x) > 0 && x[0] != msg.Type {
+		return false
+	}
+	for _, key := range []string{"container", "network", "volume"} {
+		if x := args.Get(key); len(x) > 0 && (key != msg.Type || x[0] != msg.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// reply writes the value as json with the status code.
+func (obj *dockerFake) reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// fail writes a docker api error.
+func (obj *dockerFake) fail(w http.ResponseWriter, code int, format string, v ...interface{}) {
+	obj.reply(w, code, map[string]string{"message": fmt.Sprintf(format, v...)})
+}
+
+// handle routes the docker api requests.
+func (obj *dockerFake) handle(w http.ResponseWriter, r *http.Request) {
+	p := regexp.MustCompile(`^/v[0-9.]+`).ReplaceAllString(r.URL.Path, "")
+	query := r.URL.Query()
+	args, err := filters.FromParam(query.Get("filters"))
+	if err != nil {
+		obj.fail(w, http.StatusBadRequest, "invalid filters: %v", err)
+		return
+	}
+	route := func(method, pattern string) []string {
+		if r.Method != method {
+			return nil
+		}
+		return regexp.MustCompile("^" + pattern + "$").FindStringSubmatch(p)
+	}
+
+	if route("GET", "/events") != nil {
+		obj.events(w, r, args)
+		return
+	}
+
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+
+	if m := route("GET", "/images/(.+)/json"); m != nil {
+		image := obj.findImage(m[1])
+		if image == nil {
+			obj.fail(w, http.StatusNotFound, "No such image: %s", m[1])
+			return
+		}
+		obj.reply(w, http.StatusOK, image)
+
+	} else if route("POST", "/images/create") != nil {
+		repo, tag := query.Get("fromImage"), query.Get("tag")
+		named, err := reference.ParseNormalizedNamed(repo)
+		if err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		repo = reference.FamiliarName(named)
+		digest, pinned := "", strings.HasPrefix(tag, "sha256:")
+		for k, v := range obj.Registry {
+			if (pinned && strings.HasPrefix(k, repo+":") && v == tag) || k == repo+":"+tag {
+				digest = v
+			}
+		}
+		if digest == "" {
+			obj.fail(w, http.StatusNotFound, "manifest for %s:%s not found", repo, tag)
+			return
+		}
+		if _, exists := obj.images[digest]; !exists {
+			obj.images[digest] = &types.ImageInspect{
+				ID:          digest,
+				RepoDigests: []string{repo + "@" + digest},
+				Config:      &container.Config{},
+			}
+		}
+		if !pinned {
+			obj.tag(digest, repo+":"+tag)
+		}
+		obj.event("image", "pull", repo+":"+tag)
+		obj.reply(w, http.StatusOK, map[string]string{"status": "Downloaded newer image"})
+
+	} else if m := route("POST", "/images/(.+)/tag"); m != nil {
+		image := obj.findImage(m[1])
+		if image == nil {
+			obj.fail(w, http.StatusNotFound, "No such image: %s", m[1])
+			return
+		}
+		tag := query.Get("tag")
+		if tag == "" {
+			tag = "latest"
+		}
+		obj.tag(image.ID, query.Get("repo")+":"+tag)
+		obj.event("image", "tag", image.ID)
+		w.WriteHeader(http.StatusCreated)
+
+	} else if m := route("DELETE", "/images/(.+)"); m != nil {
+		image := obj.findImage(m[1])
+		if image == nil {
+			obj.fail(w, http.StatusNotFound, "No such image: %s", m[1])
+			return
+		}
+		for _, c := range obj.containers {
+			if c.Image == image.ID && query.Get("force") != "1" {
+				obj.fail(w, http.StatusConflict, "image is being used by container %s", c.ID)
+				return
+			}
+		}
+		delete(obj.images, image.ID)
+		obj.event("image", "delete", image.ID)
+		obj.reply(w, http.StatusOK, []types.ImageDeleteResponseItem{{Deleted: image.ID}})
+
+	} else if route("POST", "/build") != nil {
+		found := false
+		dockerfile := query.Get("dockerfile")
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				obj.fail(w, http.StatusBadRequest, "invalid build context: %v", err)
+				return
+			}
+			found = found || hdr.Name == dockerfile
+		}
+		if !found {
+			obj.reply(w, http.StatusOK, map[string]string{"error": "Cannot locate specified Dockerfile: " + dockerfile})
+			return
+		}
+		labels := make(map[string]string)
+		if err := json.Unmarshal([]byte(query.Get("labels")), &labels); err != nil {
+			obj.fail(w, http.StatusBadRequest, "invalid labels: %v", err)
+			return
+		}
+		id := "sha256:" + obj.id()
+		obj.images[id] = &types.ImageInspect{ID: id, Config: &container.Config{Labels: labels}}
+		tag, err := dockerImageRef(query.Get("t"))
+		if err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		obj.tag(id, tag)
+		obj.event("image", "tag", id)
+		obj.reply(w, http.StatusOK, map[string]string{"stream": "Successfully built " + id})
+
+	} else if route("GET", "/networks") != nil {
+		result := []types.NetworkResource{}
+		for _, n := range obj.networks {
+			if x := args.Get("name"); len(x) == 0 || strings.Contains(n.Name, x[0]) {
+				result = append(result, *n)
+			}
+		}
+		obj.reply(w, http.StatusOK, result)
+
+	} else if route("POST", "/networks/create") != nil {
+		req := types.NetworkCreateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if obj.findNetwork(req.Name) != nil {
+			obj.fail(w, http.StatusConflict, "network with name %s already exists", req.Name)
+			return
+		}
+		id := obj.id()
+		n := &types.NetworkResource{
+			Name:     req.Name,
+			ID:       id,
+			Driver:   req.Driver,
+			Internal: req.Internal,
+			Labels:   req.Labels,
+			Options:  req.Options,
+		}
+		if req.IPAM != nil {
+			n.IPAM = *req.IPAM
+		}
+		obj.networks[id] = n
+		obj.event("network", "create", req.Name)
+		obj.reply(w, http.StatusCreated, types.NetworkCreateResponse{ID: id})
+
+	} else if m := route("POST", "/networks/([^/]+)/connect"); m != nil {
+		req := types.NetworkConnect{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		n, c := obj.findNetwork(m[1]), obj.findContainer(req.Container)
+		if n == nil || c == nil {
+			obj.fail(w, http.StatusNotFound, "No such network or container")
+			return
+		}
+		c.NetworkSettings.Networks[n.Name] = &network.EndpointSettings{NetworkID: n.ID}
+		obj.event("network", "connect", n.Name)
+		w.WriteHeader(http.StatusOK)
+
+	} else if m := route("DELETE", "/networks/([^/]+)"); m != nil {
+		n := obj.findNetwork(m[1])
+		if n == nil {
+			obj.fail(w, http.StatusNotFound, "network %s not found", m[1])
+			return
+		}
+		for _, c := range obj.containers {
+			if _, exists := c.NetworkSettings.Networks[n.Name]; exists {
+				obj.fail(w, http.StatusForbidden, "network %s has active endpoints", n.Name)
+				return
+			}
+		}
+		delete(obj.networks, n.ID)
+		obj.event("network", "destroy", n.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	} else if m := route("GET", "/volumes/([^/]+)"); m != nil {
+		v, exists := obj.volumes[m[1]]
+		if !exists {
+			obj.fail(w, http.StatusNotFound, "get %s: no such volume", m[1])
+			return
+		}
+		obj.reply(w, http.StatusOK, v)
+
+	} else if route("POST", "/volumes/create") != nil {
+		req := volumetypes.VolumeCreateBody{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if _, exists := obj.volumes[req.Name]; !exists {
+			obj.volumes[req.Name] = &types.Volume{
+				Name:       req.Name,
+				Driver:     req.Driver,
+				Options:    req.DriverOpts,
+				Labels:     req.Labels,
+				Mountpoint: "/var/lib/docker/volumes/" + req.Name + "/_data",
+				Scope:      "local",
+			}
+			obj.event("volume", "create", req.Name)
+		}
+		obj.reply(w, http.StatusCreated, obj.volumes[req.Name])
+
+	} else if m := route("DELETE", "/volumes/([^/]+)"); m != nil {
+		if _, exists := obj.volumes[m[1]]; !exists {
+			obj.fail(w, http.StatusNotFound, "get %s: no such volume", m[1])
+			return
+		}
+		for _, c := range obj.containers {
+			for _, x := range c.HostConfig.Binds {
+				if strings.HasPrefix(x, m[1]+":") && query.Get("force") != "1" {
+					obj.fail(w, http.StatusConflict, "volume is in use")
+					return
+				}
+			}
+		}
+		delete(obj.volumes, m[1])
+		obj.event("volume", "destroy", m[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	} else if route("GET", "/containers/json") != nil {
+		result := []types.Container{}
+		for id, c := range obj.containers {
+			if x := args.Get("name"); len(x) > 0 && !strings.Contains(c.Name, x[0]) {
+				continue
+			}
+			if x := args.Get("id"); len(x) > 0 && !strings.HasPrefix(id, x[0]) {
+				continue
+			}
+			if x := args.Get("status"); len(x) > 0 && c.State.Status != x[0] {
+				continue
+			}
+			if query.Get("all") == "" && !c.State.Running {
+				continue
+			}
+			result = append(result, types.Container{
+				ID:    id,
+				Names: []string{c.Name},
+				Image: c.Config.Image,
+				State: c.State.Status,
+			})
+		}
+		obj.reply(w, http.StatusOK, result)
+
+	} else if route("POST", "/containers/create") != nil {
+		req := dockerFakeCreate{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			obj.fail(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		name := query.Get("name")
+		if obj.findContainer(name) != nil {
+			obj.fail(w, http.StatusConflict, "the container name /%s is already in use", name)
+			return
+		}
+		image := obj.findImage(req.Image)
+		if image == nil {
+			obj.fail(w, http.StatusNotFound, "No such image: %s", req.Image)
+			return
+		}
+		if req.HostConfig == nil {
+			req.HostConfig = &container.HostConfig{}
+		}
+		mode := string(req.HostConfig.NetworkMode)
+		if mode == "" || mode == "default" {
+			mode = "bridge"
+		}
+		n := obj.findNetwork(mode)
+		if n == nil {
+			obj.fail(w, http.StatusNotFound, "network %s not found", mode)
+			return
+		}
+		for _, x := range req.HostConfig.Binds { // named volumes get created
+			if source := strings.Split(x, ":")[0]; !strings.HasPrefix(source, "/") {
+				if _, exists := obj.volumes[source]; !exists {
+					obj.volumes[source] = &types.Volume{Name: source, Driver: "local"}
+				}
+			}
+		}
+		id := obj.id()
+		obj.containers[id] = &types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:         id,
+				Name:       "/" + name,
+				Image:      image.ID,
+				State:      &types.ContainerState{Status: "created"},
+				HostConfig: req.HostConfig,
+			},
+			Config: req.Config,
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					n.Name: {NetworkID: n.ID},
+				},
+			},
+		}
+		obj.event("container", "create", id)
+		obj.reply(w, http.StatusCreated, container.ContainerCreateCreatedBody{ID: id})
+
+	} else if m := route("GET", "/containers/([^/]+)/json"); m != nil {
+		c := obj.findContainer(m[1])
+		if c == nil {
+			obj.fail(w, http.StatusNotFound, "No such container: %s", m[1])
+			return
+		}
+		obj.reply(w, http.StatusOK, c)
+
+	} else if m := route("POST", "/containers/([^/]+)/(start|stop|wait)"); m != nil {
+		c := obj.findContainer(m[1])
+		if c == nil {
+			if m[2] == "wait" { // it might have just been removed
+				obj.reply(w, http.StatusOK, container.ContainerWaitOKBody{})
+				return
+			}
+			obj.fail(w, http.StatusNotFound, "No such container: %s", m[1])
+			return
+		}
+		switch m[2] {
+		case "start":
+			if c.State.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// The client opens the event stream for the container at
+			// the same time as it starts it, so let it connect first.
+			for i := 0; i < 100 && !obj.watched(c.ID); i++ {
+				obj.mutex.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				obj.mutex.Lock()
+			}
+			c.State.Status, c.State.Running = "running", true
+			obj.event("container", "start", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case "stop":
+			if !c.State.Running {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			c.State.Status, c.State.Running = "exited", false
+			obj.event("container", "die", c.ID)
+			obj.event("container", "stop", c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case "wait": // the state changes are instant, so don't wait
+			obj.reply(w, http.StatusOK, container.ContainerWaitOKBody{})
+		}
+
+	} else if m := route("DELETE", "/containers/([^/]+)"); m != nil {
+		c := obj.findContainer(m[1])
+		if c == nil {
+			obj.fail(w, http.StatusNotFound, "No such container: %s", m[1])
+			return
+		}
+		if c.State.Running && query.Get("force") != "1" {
+			obj.fail(w, http.StatusConflict, "You cannot remove a running container %s", c.ID)
+			return
+		}
+		delete(obj.containers, c.ID)
+		obj.event("container", "destroy", c.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	} else {
+		obj.fail(w, http.StatusNotFound, "page not found: %s %s", r.Method, p)
+	}
+}
+
+// events streams the events which pass through the filters.
+func (obj *dockerFake) events(w http.ResponseWriter, r *http.Request, args filters.Args) {
+	ch := make(chan events.Message, 100)
+	obj.mutex.Lock()
+	obj.subscribers[ch] = args
+	obj.mutex.Unlock()
+	defer func() {
+		obj.mutex.Lock()
+		delete(obj.subscribers, ch)
+		obj.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case msg := <-ch:
+			encoder.Encode(msg)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		case <-obj.done:
+			return
+		}
+	}
+}
+
+// dockerConverge runs the check and apply sequence on a docker resource, and
+// makes sure that it converges.
+func dockerConverge(t *testing.T, msg string, res interface {
+	CheckApply(bool) (bool, error)
+}) {
+	if checkOK, err := res.CheckApply(false); err != nil {
+		t.Errorf("%s: check failed with: %v", msg, err)
+	} else if checkOK {
+		t.Errorf("%s: check should have failed", msg)
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("%s: checkapply failed with: %v", msg, err)
+	}
+	if checkOK, err := res.CheckApply(false); err != nil {
+		t.Errorf("%s: check failed with: %v", msg, err)
+	} else if !checkOK {
+		t.Errorf("%s: check should have passed after apply", msg)
+	}
+}
@@ -0,0 +1,462 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker
+
+package resources
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// dockerContextLabel is the image label which stores the hash of the
+	// build context that an image was built from.
+	dockerContextLabel = "mgmt.context.sha256"
+)
+
+func init() {
+	engine.RegisterResource("docker:image", func() engine.Res { return &DockerImageRes{} })
+}
+
+// DockerImageRes is a docker image resource. The name is the image reference,
+// such as alpine:3.8, and the image is pulled from a registry unless a build
+// context is specified, in which case it is built locally.
+type DockerImageRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+
+	// State of the image must be exists or absent.
+	State string `yaml:"state"`
+	// Digest pins the image to this content digest, such as sha256:abc...
+	// The image is pulled by digest and then tagged with the resource name.
+	Digest string `yaml:"digest"`
+	// Context is the absolute path to a directory containing a build
+	// context. If it is set, the image is built instead of pulled, and it
+	// gets rebuilt whenever the contents of the directory change.
+	Context string `yaml:"context"`
+	// Dockerfile is the path of the dockerfile, relative to the context.
+	Dockerfile string `yaml:"dockerfile"`
+	// BuildArgs are the build time variables passed to the build.
+	BuildArgs map[string]string `yaml:"buildargs"`
+	// APIVersion allows you to override the host's default client API version.
+	APIVersion string `yaml:"apiversion"`
+
+	// Force, if true, will remove the image even if it is still used by a
+	// stopped container.
+	Force bool `yaml:"force"`
+
+	client *client.Client // docker api client
+
+	init *engine.Init
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DockerImageRes) Default() engine.Res {
+	return &DockerImageRes{
+		State: DockerExists,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *DockerImageRes) Validate() error {
+	if obj.State != DockerExists && obj.State != DockerAbsent {
+		return fmt.Errorf("state must be exists or absent")
+	}
+
+	named, err := reference.ParseNormalizedNamed(obj.Name())
+	if err != nil {
+		return errwrap.Wrapf(err, "invalid image name")
+	}
+	if _, ok := named.(reference.Digested); ok && (obj.Digest != "" || obj.Context != "") {
+		return fmt.Errorf("the image name can't contain a digest when digest or context is used")
+	}
+
+	if obj.Digest != "" {
+		if ok, _ := regexp.MatchString(`^sha256:[a-f0-9]{64}$`, obj.Digest); !ok {
+			return fmt.Errorf("invalid digest: %s", obj.Digest)
+		}
+		if obj.Context != "" {
+			return fmt.Errorf("can't pin the digest of an image that is built")
+		}
+	}
+
+	if obj.Context != "" && !strings.HasPrefix(obj.Context, "/") {
+		return fmt.Errorf("the context must be an absolute path")
+	}
+	if obj.Context == "" && (obj.Dockerfile != "" || len(obj.BuildArgs) > 0) {
+		return fmt.Errorf("the dockerfile and buildargs can only be used with a context")
+	}
+	if strings.HasPrefix(obj.Dockerfile, "/") {
+		return fmt.Errorf("the dockerfile must be relative to the context")
+	}
+
+	return dockerValidateAPIVersion(obj.APIVersion)
+}
+
+// Init runs some startup code for this resource.
+func (obj *DockerImageRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	obj.client, err = dockerClient(obj.APIVersion)
+	return err
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DockerImageRes) Close() error {
+	return obj.client.Close() // close the docker client
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *DockerImageRes) Watch() error {
+	args := filters.NewArgs(filters.KeyValuePair{Key: "type", Value: "image"})
+	return dockerWatch(obj.init, obj.client, args, obj.Context) // rebuild on changes
+}
+
+// pinned returns the canonical reference of the pinned digest.
+func (obj *DockerImageRes) pinned() (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(obj.Name())
+	if err != nil {
+		return nil, err
+	}
+	return reference.ParseNormalizedNamed(named.Name() + "@" + obj.Digest)
+}
+
+// CheckApply method for Docker image resource.
+func (obj *DockerImageRes) CheckApply(apply bool) (checkOK bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkApplyCtxTimeout*time.Second)
+	defer cancel()
+
+	exists := true
+	inspect, _, err := obj.client.ImageInspectWithRaw(ctx, obj.Name())
+	if client.IsErrNotFound(err) {
+		exists = false
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "error inspecting image")
+	}
+
+	if obj.State == DockerAbsent {
+		if !exists {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		opts := types.ImageRemoveOptions{
+			Force:         obj.Force,
+			PruneChildren: true,
+		}
+		if _, err := obj.client.ImageRemove(ctx, obj.Name(), opts); err != nil {
+			return false, errwrap.Wrapf(err, "error removing image")
+		}
+		return false, nil
+	}
+
+	if obj.Context != "" {
+		hash, err := dockerContextHash(obj.Context)
+		if err != nil {
+			return false, err
+		}
+		if exists && inspect.Config != nil && inspect.Config.Labels[dockerContextLabel] == hash {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		return false, obj.imageBuild(ctx, hash)
+	}
+
+	if obj.Digest == "" {
+		if exists {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		return false, obj.imagePull(ctx, obj.Name())
+	}
+
+	pinned, err := obj.pinned()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "invalid digest")
+	}
+	for _, x := range inspect.RepoDigests { // empty if it doesn't exist
+		if named, err := reference.ParseNormalizedNamed(x); err == nil && named.String() == pinned.String() {
+			return true, nil
+		}
+	}
+	if !apply {
+		return false, nil
+	}
+	if err := obj.imagePull(ctx, pinned.String()); err != nil {
+		return false, err
+	}
+	// the tag might point elsewhere, so move it to the pinned image
+	if err := obj.client.ImageTag(ctx, pinned.String(), obj.Name()); err != nil {
+		return false, errwrap.Wrapf(err, "error tagging image")
+	}
+	return false, nil
+}
+
+// imagePull pulls the image and waits for the download to finish.
+func (obj *DockerImageRes) imagePull(ctx context.Context, ref string) error {
+	obj.init.Logf("pulling %s", ref)
+	p, err := obj.client.ImagePull(ctx, ref, types.ImagePullOptions{})
+	if err != nil {
+		return errwrap.Wrapf(err, "error pulling image")
+	}
+	defer p.Close()
+	return errwrap.Wrapf(dockerStreamError(p), "error pulling image")
+}
+
+// imageBuild builds the image from the build context and waits for the build
+// to finish. The hash of the context is stored in a label on the image.
+func (obj *DockerImageRes) imageBuild(ctx context.Context, hash string) error {
+	obj.init.Logf("building %s", obj.Name())
+	buildContext := dockerBuildContext(obj.Context)
+	defer buildContext.Close() // stops the archiving if the build failed
+	buildArgs := make(map[string]*string)
+	for k, v := range obj.BuildArgs {
+		v := v // copy
+		buildArgs[k] = &v
+	}
+	opts := types.ImageBuildOptions{
+		Tags:        []string{obj.Name()},
+		Dockerfile:  obj.Dockerfile,
+		BuildArgs:   buildArgs,
+		Labels:      map[string]string{dockerContextLabel: hash},
+		Remove:      true,
+		ForceRemove: true,
+	}
+	resp, err := obj.client.ImageBuild(ctx, buildContext, opts)
+	if err != nil {
+		return errwrap.Wrapf(err, "error building image")
+	}
+	defer resp.Body.Close()
+	return errwrap.Wrapf(dockerStreamError(resp.Body), "error building image")
+}
+
+// dockerContextHash returns a hash of the contents of the build context
+// directory. The hash only covers the names, modes and contents of the files, so
+// that touching a file doesn't cause a rebuild.
+func dockerContextHash(dir string) (string, error) {
+	h := sha256.New()
+	fn := func(name string, info os.FileInfo, link string, r io.Reader) error {
+		fmt.Fprintf(h, "%s\x00%o\x00%s\x00", name, info.Mode(), link)
+		if r == nil {
+			return nil
+		}
+		_, err := io.Copy(h, r)
+		return err
+	}
+	if err := dockerWalkContext(dir, fn); err != nil {
+		return "", errwrap.Wrapf(err, "error reading build context")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dockerBuildContext returns a tar archive of the build context directory. It
+// is written as it is read, so that the whole context is never in memory. The
+// caller must close it when done.
+func dockerBuildContext(dir string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		fn := func(name string, info os.FileInfo, link string, r io.Reader) error {
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = name
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if r == nil {
+				return nil
+			}
+			_, err = io.Copy(tw, r)
+			return err
+		}
+		err := dockerWalkContext(dir, fn)
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(errwrap.Wrapf(err, "error archiving build context")) // nil is EOF
+	}()
+	return r
+}
+
+// dockerWalkContext runs fn on each entry of the build context directory, in
+// lexical order, with its slash separated name relative to the directory. The
+// reader has the contents of the entry if it is a regular file, or is nil.
+func dockerWalkContext(dir string, fn func(name string, info os.FileInfo, link string, r io.Reader) error) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return fn(name, info, link, nil)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(name, info, link, f)
+	})
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DockerImageRes) Cmp(r engine.Res) error {
+	// we can only compare DockerImageRes to others of the same resource kind
+	res, ok := r.(*DockerImageRes)
+	if !ok {
+		return fmt.Errorf("error casting r to *DockerImageRes")
+	}
+	if obj.Name() != res.Name() {
+		return fmt.Errorf("names differ")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("states differ")
+	}
+	if obj.Digest != res.Digest {
+		return fmt.Errorf("digests differ")
+	}
+	if obj.Context != res.Context {
+		return fmt.Errorf("contexts differ")
+	}
+	if obj.Dockerfile != res.Dockerfile {
+		return fmt.Errorf("dockerfiles differ")
+	}
+	if len(obj.BuildArgs) != len(res.BuildArgs) {
+		return fmt.Errorf("buildargs differ")
+	}
+	for k, v := range obj.BuildArgs {
+		if x, exists := res.BuildArgs[k]; !exists || x != v {
+			return fmt.Errorf("buildargs differ")
+		}
+	}
+	if obj.APIVersion != res.APIVersion {
+		return fmt.Errorf("apiversions differ")
+	}
+	if obj.Force != res.Force {
+		return fmt.Errorf("forces differ")
+	}
+	return nil
+}
+
+// DockerImageUID is the UID struct for DockerImageRes.
+type DockerImageUID struct {
+	engine.BaseUID
+	image string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *DockerImageUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*DockerImageUID)
+	if !ok {
+		return false
+	}
+	return obj.image == res.image
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *DockerImageRes) UIDs() []engine.ResUID {
+	image, err := dockerImageRef(obj.Name())
+	if err != nil { // caught in Validate
+		image = obj.Name()
+	}
+	x := &DockerImageUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		image:   image,
+	}
+	return []engine.ResUID{x}
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the build context.
+func (obj *DockerImageRes) AutoEdges() (engine.AutoEdge, error) {
+	if obj.Context == "" {
+		return nil, nil
+	}
+	var reversed = true
+	return &FileResAutoEdges{
+		data: []engine.ResUID{
+			&FileUID{
+				BaseUID: engine.BaseUID{
+					Name:     obj.Name(),
+					Kind:     obj.Kind(),
+					Reversed: &reversed,
+				},
+				path: strings.TrimSuffix(obj.Context, "/") + "/", // it's a dir
+			},
+		},
+		pointer: 0,
+		found:   false,
+	}, nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *DockerImageRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DockerImageRes // indirection to avoid infinite recursion
+
+	def := obj.Default()             // get the default
+	res, ok := def.(*DockerImageRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DockerImageRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DockerImageRes(raw) // restore from indirection with type conversion!
+	return nil
+}
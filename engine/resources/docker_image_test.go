@@ -0,0 +1,189 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker,!root
+
+package resources
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDockerImageValidate(t *testing.T) {
+	valid := []*DockerImageRes{
+		{State: "exists"},
+		{State: "absent"},
+		{State: "exists", Digest: dockerTestDigest(1)},
+		{State: "exists", Context: "/srv/app/", Dockerfile: "build/Dockerfile"},
+	}
+	invalid := []*DockerImageRes{
+		{State: "present"},
+		{State: "exists", Digest: "sha256:nope"},
+		{State: "exists", Digest: dockerTestDigest(1), Context: "/srv/app/"},
+		{State: "exists", Context: "srv/app/"},
+		{State: "exists", Dockerfile: "Dockerfile"},
+		{State: "exists", Context: "/srv/app/", Dockerfile: "/srv/app/Dockerfile"},
+	}
+	for i, x := range valid {
+		x.SetName("alpine:3.8")
+		if err := x.Validate(); err != nil {
+			t.Errorf("valid res %d failed validate with: %v", i, err)
+		}
+	}
+	for i, x := range invalid {
+		x.SetName("alpine:3.8")
+		if err := x.Validate(); err == nil {
+			t.Errorf("invalid res %d passed validate", i)
+		}
+	}
+}
+
+func TestDockerBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-docker-")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "src"), 0755); err != nil {
+		t.Fatalf("error creating dir: %v", err)
+	}
+	for name, data := range map[string]string{"Dockerfile": "FROM alpine:3.8\n", "src/app": "hello"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	hash, err := dockerContextHash(dir)
+	if err != nil {
+		t.Fatalf("hash failed with: %v", err)
+	}
+	if err := os.Chtimes(path.Join(dir, "src/app"), time.Now(), time.Now()); err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	if h, err := dockerContextHash(dir); err != nil || h != hash {
+		t.Errorf("touching a file should not change the hash: %v", err)
+	}
+
+	r := dockerBuildContext(dir)
+	defer r.Close()
+	tr := tar.NewReader(r)
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("error reading archive: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if s := fmt.Sprintf("%v", names); s != "[Dockerfile src src/app]" {
+		t.Errorf("unexpected archive: %s", s)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "src/app"), []byte("world"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if h, err := dockerContextHash(dir); err != nil || h == hash {
+		t.Errorf("changing a file should change the hash: %v", err)
+	}
+}
+
+func TestDockerImageCheckApply(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	image := func(name string, fn func(*DockerImageRes)) *DockerImageRes {
+		x := &DockerImageRes{State: DockerExists}
+		x.SetName(name)
+		fn(x)
+		if err := x.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+		}
+		if err := x.Init(fakeInit(t)); err != nil {
+			t.Errorf("init failed with: %v", err)
+		}
+		return x
+	}
+	id := func(name string) string {
+		inspect, _, err := res.client.ImageInspectWithRaw(ctx, name)
+		if err != nil {
+			t.Errorf("error inspecting image %s: %v", name, err)
+		}
+		return inspect.ID
+	}
+
+	r1 := image("alpine:3.8", func(x *DockerImageRes) {})
+	defer r1.Close()
+	dockerConverge(t, "pull", r1)
+
+	// the tag gets pinned to the digest, and then moved to a new one
+	r2 := image("busybox:stable", func(x *DockerImageRes) { x.Digest = dockerTestDigest(3) })
+	defer r2.Close()
+	dockerConverge(t, "pinned", r2)
+	if s := id("busybox:stable"); s != dockerTestDigest(3) {
+		t.Errorf("unexpected image: %s", s)
+	}
+	r2.Digest = dockerTestDigest(4)
+	dockerConverge(t, "repinned", r2)
+	if s := id("busybox:stable"); s != dockerTestDigest(4) {
+		t.Errorf("unexpected image: %s", s)
+	}
+
+	// a rebuild only happens when the build context changes
+	dir, err := ioutil.TempDir("", "mgmt-docker-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dockerfile := path.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(dockerfile, []byte("FROM alpine:3.8\n"), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+	r3 := image("mgmt-app:1", func(x *DockerImageRes) { x.Context = dir })
+	defer r3.Close()
+	dockerConverge(t, "build", r3)
+	built := id("mgmt-app:1")
+	now := time.Now()
+	if err := os.Chtimes(dockerfile, now, now); err != nil {
+		t.Errorf("error touching file: %v", err)
+	}
+	if checkOK, err := r3.CheckApply(false); err != nil || !checkOK {
+		t.Errorf("touching the context should not cause a rebuild: %v", err)
+	}
+	if err := ioutil.WriteFile(dockerfile, []byte("FROM alpine:3.8\nRUN true\n"), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+	dockerConverge(t, "rebuild", r3)
+	if id("mgmt-app:1") == built {
+		t.Errorf("the image should have been rebuilt")
+	}
+
+	r1.State = DockerAbsent
+	dockerConverge(t, "absent", r1)
+}
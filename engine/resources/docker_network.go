@@ -0,0 +1,332 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker
+
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	engine.RegisterResource("docker:network", func() engine.Res { return &DockerNetworkRes{} })
+}
+
+// DockerNetworkRes is a docker network resource. The name is the name of the
+// network.
+type DockerNetworkRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+
+	// State of the network must be exists or absent.
+	State string `yaml:"state"`
+	// Driver is the network driver. It defaults to bridge.
+	Driver string `yaml:"driver"`
+	// Subnet is the subnet of the network in CIDR format. If it is empty,
+	// docker picks one.
+	Subnet string `yaml:"subnet"`
+	// Gateway is the gateway address of the subnet.
+	Gateway string `yaml:"gateway"`
+	// Internal, if true, restricts external access to the network.
+	Internal bool `yaml:"internal"`
+	// Labels are the labels to set on the network.
+	Labels map[string]string `yaml:"labels"`
+	// Options are the driver specific options.
+	Options map[string]string `yaml:"options"`
+	// APIVersion allows you to override the host's default client API version.
+	APIVersion string `yaml:"apiversion"`
+
+	// Force, if true, will destroy and recreate the network if it doesn't
+	// have the right configuration.
+	Force bool `yaml:"force"`
+
+	client *client.Client // docker api client
+
+	init *engine.Init
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DockerNetworkRes) Default() engine.Res {
+	return &DockerNetworkRes{
+		State:  DockerExists,
+		Driver: "bridge",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *DockerNetworkRes) Validate() error {
+	if obj.State != DockerExists && obj.State != DockerAbsent {
+		return fmt.Errorf("state must be exists or absent")
+	}
+	if obj.Driver == "" {
+		return fmt.Errorf("the driver must not be empty")
+	}
+
+	if obj.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(obj.Subnet)
+		if err != nil {
+			return errwrap.Wrapf(err, "invalid subnet")
+		}
+		if obj.Gateway != "" {
+			ip := net.ParseIP(obj.Gateway)
+			if ip == nil {
+				return fmt.Errorf("invalid gateway: %s", obj.Gateway)
+			}
+			if !subnet.Contains(ip) {
+				return fmt.Errorf("the gateway must be inside the subnet")
+			}
+		}
+	} else if obj.Gateway != "" {
+		return fmt.Errorf("the gateway can only be used with a subnet")
+	}
+
+	return dockerValidateAPIVersion(obj.APIVersion)
+}
+
+// Init runs some startup code for this resource.
+func (obj *DockerNetworkRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	obj.client, err = dockerClient(obj.APIVersion)
+	return err
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DockerNetworkRes) Close() error {
+	return obj.client.Close() // close the docker client
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *DockerNetworkRes) Watch() error {
+	args := filters.NewArgs(
+		filters.KeyValuePair{Key: "type", Value: "network"},
+		filters.KeyValuePair{Key: "network", Value: obj.Name()},
+	)
+	return dockerWatch(obj.init, obj.client, args, "")
+}
+
+// check returns an error describing the difference between the network and the
+// one we want.
+func (obj *DockerNetworkRes) check(n types.NetworkResource) error {
+	if n.Driver != obj.Driver {
+		return fmt.Errorf("the driver is %s", n.Driver)
+	}
+	if n.Internal != obj.Internal {
+		return fmt.Errorf("the internal flag is %t", n.Internal)
+	}
+	if obj.Subnet != "" {
+		found := false
+		for _, x := range n.IPAM.Config {
+			if x.Subnet == obj.Subnet && (obj.Gateway == "" || x.Gateway == obj.Gateway) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("the subnet is different")
+		}
+	}
+	if !dockerStrMapContains(n.Labels, obj.Labels) {
+		return fmt.Errorf("the labels are different")
+	}
+	if !dockerStrMapContains(n.Options, obj.Options) {
+		return fmt.Errorf("the options are different")
+	}
+	return nil
+}
+
+// CheckApply method for Docker network resource.
+func (obj *DockerNetworkRes) CheckApply(apply bool) (checkOK bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkApplyCtxTimeout*time.Second)
+	defer cancel()
+
+	// The name filter matches substrings, so look for the exact name.
+	opts := types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.KeyValuePair{Key: "name", Value: obj.Name()}),
+	}
+	networkList, err := obj.client.NetworkList(ctx, opts)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error listing networks")
+	}
+	var existing *types.NetworkResource
+	for i := range networkList {
+		if networkList[i].Name == obj.Name() {
+			existing = &networkList[i]
+			break
+		}
+	}
+
+	if obj.State == DockerAbsent {
+		if existing == nil {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		if err := obj.client.NetworkRemove(ctx, existing.ID); err != nil {
+			return false, errwrap.Wrapf(err, "error removing network")
+		}
+		return false, nil
+	}
+
+	var incorrect error // why the existing network needs to be destroyed
+	if existing != nil {
+		if incorrect = obj.check(*existing); incorrect == nil {
+			return true, nil
+		}
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	if incorrect != nil {
+		if !obj.Force {
+			return false, errwrap.Wrapf(incorrect, "%s exists but is incorrect", obj.Name())
+		}
+		if err := obj.client.NetworkRemove(ctx, existing.ID); err != nil {
+			return false, errwrap.Wrapf(err, "error removing network")
+		}
+	}
+
+	create := types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         obj.Driver,
+		Internal:       obj.Internal,
+		Labels:         obj.Labels,
+		Options:        obj.Options,
+	}
+	if obj.Subnet != "" {
+		create.IPAM = &network.IPAM{
+			Driver: "default",
+			Config: []network.IPAMConfig{
+				{
+					Subnet:  obj.Subnet,
+					Gateway: obj.Gateway,
+				},
+			},
+		}
+	}
+	if _, err := obj.client.NetworkCreate(ctx, obj.Name(), create); err != nil {
+		return false, errwrap.Wrapf(err, "error creating network")
+	}
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DockerNetworkRes) Cmp(r engine.Res) error {
+	// we can only compare DockerNetworkRes to others of the same resource kind
+	res, ok := r.(*DockerNetworkRes)
+	if !ok {
+		return fmt.Errorf("error casting r to *DockerNetworkRes")
+	}
+	if obj.Name() != res.Name() {
+		return fmt.Errorf("names differ")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("states differ")
+	}
+	if obj.Driver != res.Driver {
+		return fmt.Errorf("drivers differ")
+	}
+	if obj.Subnet != res.Subnet {
+		return fmt.Errorf("subnets differ")
+	}
+	if obj.Gateway != res.Gateway {
+		return fmt.Errorf("gateways differ")
+	}
+	if obj.Internal != res.Internal {
+		return fmt.Errorf("internal flags differ")
+	}
+	if len(obj.Labels) != len(res.Labels) || !dockerStrMapContains(obj.Labels, res.Labels) {
+		return fmt.Errorf("labels differ")
+	}
+	if len(obj.Options) != len(res.Options) || !dockerStrMapContains(obj.Options, res.Options) {
+		return fmt.Errorf("options differ")
+	}
+	if obj.APIVersion != res.APIVersion {
+		return fmt.Errorf("apiversions differ")
+	}
+	if obj.Force != res.Force {
+		return fmt.Errorf("forces differ")
+	}
+	return nil
+}
+
+// DockerNetworkUID is the UID struct for DockerNetworkRes.
+type DockerNetworkUID struct {
+	engine.BaseUID
+	name string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *DockerNetworkUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*DockerNetworkUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *DockerNetworkRes) UIDs() []engine.ResUID {
+	x := &DockerNetworkUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		name:    obj.Name(),
+	}
+	return []engine.ResUID{x}
+}
+
+// AutoEdges returns the AutoEdge interface.
+func (obj *DockerNetworkRes) AutoEdges() (engine.AutoEdge, error) {
+	return nil, nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *DockerNetworkRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DockerNetworkRes // indirection to avoid infinite recursion
+
+	def := obj.Default()               // get the default
+	res, ok := def.(*DockerNetworkRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DockerNetworkRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DockerNetworkRes(raw) // restore from indirection with type conversion!
+	return nil
+}
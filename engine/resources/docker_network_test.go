@@ -0,0 +1,74 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker,!root
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestDockerNetworkCheckApply(t *testing.T) {
+	network := func(name string, fn func(*DockerNetworkRes)) *DockerNetworkRes {
+		x := &DockerNetworkRes{State: DockerExists, Driver: "bridge"}
+		x.SetName(name)
+		fn(x)
+		if err := x.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+		}
+		if err := x.Init(fakeInit(t)); err != nil {
+			t.Errorf("init failed with: %v", err)
+		}
+		return x
+	}
+
+	r1 := network("mgmt-net", func(x *DockerNetworkRes) {
+		x.Subnet = "10.42.0.0/24"
+		x.Gateway = "10.42.0.1"
+		x.Labels = map[string]string{"app": "mgmt"}
+	})
+	defer r1.Close()
+	dockerConverge(t, "create", r1)
+
+	// the name filter matches substrings, but that's not this network
+	r2 := network("mgmt", func(x *DockerNetworkRes) { x.State = DockerAbsent })
+	defer r2.Close()
+	if checkOK, err := r2.CheckApply(false); err != nil || !checkOK {
+		t.Errorf("a network with a similar name should not match: %v", err)
+	}
+
+	r1.Subnet = "10.43.0.0/24"
+	r1.Gateway = ""
+	if checkOK, err := r1.CheckApply(false); err != nil || checkOK {
+		t.Errorf("a different subnet should only fail the check: %v", err)
+	}
+	if _, err := r1.CheckApply(true); err == nil {
+		t.Errorf("a different subnet should be an error without force")
+	}
+	r1.Force = true
+	dockerConverge(t, "recreate", r1)
+
+	r1.State = DockerAbsent
+	dockerConverge(t, "absent", r1)
+
+	r3 := &DockerNetworkRes{State: DockerExists, Driver: "bridge", Gateway: "10.42.0.1"}
+	r3.SetName("mgmt-invalid")
+	if err := r3.Validate(); err == nil {
+		t.Errorf("a gateway without a subnet should not validate")
+	}
+}
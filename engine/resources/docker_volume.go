@@ -0,0 +1,259 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker
+
+package resources
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	engine.RegisterResource("docker:volume", func() engine.Res { return &DockerVolumeRes{} })
+}
+
+// DockerVolumeRes is a docker volume resource. The name is the name of the
+// volume.
+type DockerVolumeRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+
+	// State of the volume must be exists or absent.
+	State string `yaml:"state"`
+	// Driver is the volume driver. It defaults to local.
+	Driver string `yaml:"driver"`
+	// Options are the driver specific options.
+	Options map[string]string `yaml:"options"`
+	// Labels are the labels to set on the volume.
+	Labels map[string]string `yaml:"labels"`
+	// APIVersion allows you to override the host's default client API version.
+	APIVersion string `yaml:"apiversion"`
+
+	// Force, if true, will destroy and recreate the volume if it doesn't
+	// have the right configuration, and will remove it even if it's in use.
+	// This loses the data in the volume!
+	Force bool `yaml:"force"`
+
+	client *client.Client // docker api client
+
+	init *engine.Init
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DockerVolumeRes) Default() engine.Res {
+	return &DockerVolumeRes{
+		State:  DockerExists,
+		Driver: "local",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *DockerVolumeRes) Validate() error {
+	if obj.State != DockerExists && obj.State != DockerAbsent {
+		return fmt.Errorf("state must be exists or absent")
+	}
+	if strings.Contains(obj.Name(), "/") {
+		return fmt.Errorf("the volume name must not contain a slash")
+	}
+	if obj.Driver == "" {
+		return fmt.Errorf("the driver must not be empty")
+	}
+	return dockerValidateAPIVersion(obj.APIVersion)
+}
+
+// Init runs some startup code for this resource.
+func (obj *DockerVolumeRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	obj.client, err = dockerClient(obj.APIVersion)
+	return err
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DockerVolumeRes) Close() error {
+	return obj.client.Close() // close the docker client
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *DockerVolumeRes) Watch() error {
+	args := filters.NewArgs(
+		filters.KeyValuePair{Key: "type", Value: "volume"},
+		filters.KeyValuePair{Key: "volume", Value: obj.Name()},
+	)
+	return dockerWatch(obj.init, obj.client, args, "")
+}
+
+// CheckApply method for Docker volume resource.
+func (obj *DockerVolumeRes) CheckApply(apply bool) (checkOK bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkApplyCtxTimeout*time.Second)
+	defer cancel()
+
+	exists := true
+	vol, err := obj.client.VolumeInspect(ctx, obj.Name())
+	if client.IsErrNotFound(err) {
+		exists = false
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "error inspecting volume")
+	}
+
+	if obj.State == DockerAbsent {
+		if !exists {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		if err := obj.client.VolumeRemove(ctx, obj.Name(), obj.Force); err != nil {
+			return false, errwrap.Wrapf(err, "error removing volume")
+		}
+		return false, nil
+	}
+
+	var destroy bool
+	if exists {
+		var err error
+		if vol.Driver != obj.Driver {
+			err = fmt.Errorf("the driver is %s", vol.Driver)
+		} else if !dockerStrMapContains(vol.Options, obj.Options) {
+			err = fmt.Errorf("the options are different")
+		} else if !dockerStrMapContains(vol.Labels, obj.Labels) {
+			err = fmt.Errorf("the labels are different")
+		}
+		if err == nil {
+			return true, nil
+		}
+		if !obj.Force {
+			return false, errwrap.Wrapf(err, "%s exists but is incorrect", obj.Name())
+		}
+		destroy = true
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	if destroy {
+		if err := obj.client.VolumeRemove(ctx, obj.Name(), true); err != nil {
+			return false, errwrap.Wrapf(err, "error removing volume")
+		}
+	}
+
+	create := volumetypes.VolumeCreateBody{
+		Name:       obj.Name(),
+		Driver:     obj.Driver,
+		DriverOpts: obj.Options,
+		Labels:     obj.Labels,
+	}
+	if _, err := obj.client.VolumeCreate(ctx, create); err != nil {
+		return false, errwrap.Wrapf(err, "error creating volume")
+	}
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DockerVolumeRes) Cmp(r engine.Res) error {
+	// we can only compare DockerVolumeRes to others of the same resource kind
+	res, ok := r.(*DockerVolumeRes)
+	if !ok {
+		return fmt.Errorf("error casting r to *DockerVolumeRes")
+	}
+	if obj.Name() != res.Name() {
+		return fmt.Errorf("names differ")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("states differ")
+	}
+	if obj.Driver != res.Driver {
+		return fmt.Errorf("drivers differ")
+	}
+	if len(obj.Options) != len(res.Options) || !dockerStrMapContains(obj.Options, res.Options) {
+		return fmt.Errorf("options differ")
+	}
+	if len(obj.Labels) != len(res.Labels) || !dockerStrMapContains(obj.Labels, res.Labels) {
+		return fmt.Errorf("labels differ")
+	}
+	if obj.APIVersion != res.APIVersion {
+		return fmt.Errorf("apiversions differ")
+	}
+	if obj.Force != res.Force {
+		return fmt.Errorf("forces differ")
+	}
+	return nil
+}
+
+// DockerVolumeUID is the UID struct for DockerVolumeRes.
+type DockerVolumeUID struct {
+	engine.BaseUID
+	name string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *DockerVolumeUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*DockerVolumeUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *DockerVolumeRes) UIDs() []engine.ResUID {
+	x := &DockerVolumeUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		name:    obj.Name(),
+	}
+	return []engine.ResUID{x}
+}
+
+// AutoEdges returns the AutoEdge interface.
+func (obj *DockerVolumeRes) AutoEdges() (engine.AutoEdge, error) {
+	return nil, nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *DockerVolumeRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DockerVolumeRes // indirection to avoid infinite recursion
+
+	def := obj.Default()              // get the default
+	res, ok := def.(*DockerVolumeRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DockerVolumeRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DockerVolumeRes(raw) // restore from indirection with type conversion!
+	return nil
+}
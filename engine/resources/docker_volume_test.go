@@ -0,0 +1,53 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !nodocker,!root
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestDockerVolumeCheckApply(t *testing.T) {
+	r1 := &DockerVolumeRes{
+		State:   DockerExists,
+		Driver:  "local",
+		Options: map[string]string{"type": "tmpfs", "device": "tmpfs"},
+	}
+	r1.SetName("mgmt-data")
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer r1.Close()
+	dockerConverge(t, "create", r1)
+
+	r1.Options["o"] = "size=64m"
+	if _, err := r1.CheckApply(false); err == nil {
+		t.Errorf("different options should be an error without force")
+	}
+	r1.Force = true
+	dockerConverge(t, "recreate", r1)
+
+	r1.State = DockerAbsent
+	dockerConverge(t, "absent", r1)
+}
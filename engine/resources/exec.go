@@ -21,8 +21,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -39,6 +42,11 @@ func init() {
 	engine.RegisterResource("exec", func() engine.Res { return &ExecRes{} })
 }
 
+const (
+	// ExecSystemdRunCmd is the command used to run commands in a machine.
+	ExecSystemdRunCmd = "systemd-run"
+)
+
 // ExecRes is an exec resource for running commands.
 type ExecRes struct {
 	traits.Base // add the base methods without re-implementation
@@ -46,18 +54,43 @@ type ExecRes struct {
 
 	init *engine.Init
 
-	Cmd        string  `yaml:"cmd"`        // the command to run
-	Shell      string  `yaml:"shell"`      // the (optional) shell to use to run the cmd
-	Timeout    int     `yaml:"timeout"`    // the cmd timeout in seconds
-	WatchCmd   string  `yaml:"watchcmd"`   // the watch command to run
-	WatchShell string  `yaml:"watchshell"` // the (optional) shell to use to run the watch cmd
-	IfCmd      string  `yaml:"ifcmd"`      // the if command to run
-	IfShell    string  `yaml:"ifshell"`    // the (optional) shell to use to run the if cmd
-	User       string  `yaml:"user"`       // the (optional) user to use to execute the command
-	Group      string  `yaml:"group"`      // the (optional) group to use to execute the command
-	Output     *string // all cmd output, read only, do not set!
-	Stdout     *string // the cmd stdout, read only, do not set!
-	Stderr     *string // the cmd stderr, read only, do not set!
+	Cmd        string `yaml:"cmd"`        // the command to run
+	Shell      string `yaml:"shell"`      // the (optional) shell to use to run the cmd
+	Timeout    int    `yaml:"timeout"`    // the cmd timeout in seconds
+	WatchCmd   string `yaml:"watchcmd"`   // the watch command to run
+	WatchShell string `yaml:"watchshell"` // the (optional) shell to use to run the watch cmd
+	IfCmd      string `yaml:"ifcmd"`      // the if command to run
+	IfShell    string `yaml:"ifshell"`    // the (optional) shell to use to run the if cmd
+	User       string `yaml:"user"`       // the (optional) user to use to execute the command
+	Group      string `yaml:"group"`      // the (optional) group to use to execute the command
+	// Env is added to the environment of all of the commands.
+	Env map[string]string `yaml:"env"`
+	// Cwd is the working directory of all of the commands.
+	Cwd string `yaml:"cwd"`
+	// Machine is the name of a running nspawn machine to run all of the
+	// commands in, with systemd-run. The Env, Cwd, User and Group are then
+	// used inside of the machine.
+	Machine string `yaml:"machine"`
+	// Stdin is passed to the standard input of the cmd if it is not nil.
+	Stdin *string `yaml:"stdin"`
+	// Creates is a path which the cmd creates. If it exists, then the cmd
+	// doesn't need to run. It gets checked before the IfCmd.
+	Creates string `yaml:"creates"`
+	// SuccessCodes are the exit codes of the cmd which mean that it worked,
+	// but that it didn't change anything, so nothing gets refreshed.
+	SuccessCodes []int `yaml:"successcodes"`
+	// ChangedCodes are the exit codes of the cmd which mean that it worked
+	// and that it changed something. If this is nil, then it is only zero.
+	// Any exit code that isn't in either list is an error.
+	ChangedCodes []int `yaml:"changedcodes"`
+	// OutputLimit is the maximum number of bytes that are kept in each of
+	// Output, Stdout and Stderr. Any more output is discarded. Zero means
+	// that there is no limit.
+	OutputLimit int `yaml:"outputlimit"`
+
+	Output *string // all cmd output, read only, do not set!
+	Stdout *string // the cmd stdout, read only, do not set!
+	Stderr *string // the cmd stderr, read only, do not set!
 
 	wg *sync.WaitGroup
 }
@@ -73,6 +106,34 @@ func (obj *ExecRes) Validate() error {
 		return fmt.Errorf("command can't be empty")
 	}
 
+	if obj.Cwd != "" && !strings.HasPrefix(obj.Cwd, "/") {
+		return fmt.Errorf("the cwd must be an absolute path")
+	}
+	if obj.Creates != "" && !strings.HasPrefix(obj.Creates, "/") {
+		return fmt.Errorf("the creates path must be absolute")
+	}
+	if obj.Creates != "" && obj.Machine != "" {
+		return fmt.Errorf("the creates path can't be checked inside of a machine")
+	}
+	for k := range obj.Env {
+		if k == "" || strings.Contains(k, "=") {
+			return fmt.Errorf("invalid env name: `%s`", k)
+		}
+	}
+	for _, code := range append(obj.SuccessCodes, obj.ChangedCodes...) {
+		if code < 0 || code > 255 {
+			return fmt.Errorf("invalid exit code: %d", code)
+		}
+	}
+	for _, code := range obj.SuccessCodes {
+		if execCodeInList(code, obj.ChangedCodes) {
+			return fmt.Errorf("exit code %d can't mean both success and changed", code)
+		}
+	}
+	if obj.OutputLimit < 0 {
+		return fmt.Errorf("the output limit can't be negative")
+	}
+
 	// check that, if an user or a group is set, we're running as root
 	if obj.User != "" || obj.Group != "" {
 		currentUser, err := user.Current()
@@ -107,32 +168,9 @@ func (obj *ExecRes) Watch() error {
 	defer obj.wg.Wait()
 
 	if obj.WatchCmd != "" {
-		var cmdName string
-		var cmdArgs []string
-		if obj.WatchShell == "" {
-			// call without a shell
-			// FIXME: are there still whitespace splitting issues?
-			split := strings.Fields(obj.WatchCmd)
-			cmdName = split[0]
-			//d, _ := os.Getwd() // TODO: how does this ever error ?
-			//cmdName = path.Join(d, cmdName)
-			cmdArgs = split[1:]
-		} else {
-			cmdName = obj.Shell // usually bash, or sh
-			cmdArgs = []string{"-c", obj.WatchCmd}
-		}
-		cmd := exec.Command(cmdName, cmdArgs...)
-		//cmd.Dir = "" // look for program in pwd ?
-		// ignore signals sent to parent process (we're in our own group)
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
-			Pgid:    0,
-		}
-
-		// if we have a user and group, use them
-		var err error
-		if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
-			return errwrap.Wrapf(err, "error while setting credential")
+		cmd, err := obj.getCmd(obj.WatchCmd, obj.WatchShell)
+		if err != nil {
+			return err
 		}
 
 		cmdReader, err := cmd.StdoutPipe()
@@ -207,40 +245,24 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	// check and this will run. It is still guarded by the IfCmd, but it can
 	// have a chance to execute, and all without the check of obj.Refresh()!
 
-	if obj.IfCmd != "" { // if there is no onlyif check, we should just run
-
-		var cmdName string
-		var cmdArgs []string
-		if obj.IfShell == "" {
-			// call without a shell
-			// FIXME: are there still whitespace splitting issues?
-			split := strings.Fields(obj.IfCmd)
-			cmdName = split[0]
-			//d, _ := os.Getwd() // TODO: how does this ever error ?
-			//cmdName = path.Join(d, cmdName)
-			cmdArgs = split[1:]
-		} else {
-			cmdName = obj.IfShell // usually bash, or sh
-			cmdArgs = []string{"-c", obj.IfCmd}
-		}
-		cmd := exec.Command(cmdName, cmdArgs...)
-		// ignore signals sent to parent process (we're in our own group)
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
-			Pgid:    0,
+	// if the file that the cmd creates exists, then it doesn't need to run
+	if obj.Creates != "" {
+		if _, err := os.Stat(obj.Creates); err == nil {
+			return true, nil // don't run
+		} else if !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "error checking the creates path")
 		}
+	}
 
-		// if we have an user and group, use them
-		var err error
-		if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
-			return false, errwrap.Wrapf(err, "error while setting credential")
+	if obj.IfCmd != "" { // if there is no onlyif check, we should just run
+		cmd, err := obj.getCmd(obj.IfCmd, obj.IfShell)
+		if err != nil {
+			return false, err
 		}
-
 		if err := cmd.Run(); err != nil {
 			// TODO: check exit value
 			return true, nil // don't run
 		}
-
 	}
 
 	// state is not okay, no work done, exit, but without error
@@ -250,37 +272,16 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 
 	// apply portion
 	obj.init.Logf("Apply")
-	var cmdName string
-	var cmdArgs []string
-	if obj.Shell == "" {
-		// call without a shell
-		// FIXME: are there still whitespace splitting issues?
-		// TODO: we could make the split character user selectable...!
-		split := strings.Fields(obj.Cmd)
-		cmdName = split[0]
-		//d, _ := os.Getwd() // TODO: how does this ever error ?
-		//cmdName = path.Join(d, cmdName)
-		cmdArgs = split[1:]
-	} else {
-		cmdName = obj.Shell // usually bash, or sh
-		cmdArgs = []string{"-c", obj.Cmd}
-	}
-	cmd := exec.Command(cmdName, cmdArgs...)
-	//cmd.Dir = "" // look for program in pwd ?
-	// ignore signals sent to parent process (we're in our own group)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
-		Pgid:    0,
+	cmd, err := obj.getCmd(obj.Cmd, obj.Shell)
+	if err != nil {
+		return false, err
 	}
-
-	// if we have a user and group, use them
-	var err error
-	if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
-		return false, errwrap.Wrapf(err, "error while setting credential")
+	if obj.Stdin != nil {
+		cmd.Stdin = strings.NewReader(*obj.Stdin)
 	}
 
 	var out splitWriter
-	out.Init()
+	out.Init(obj.OutputLimit)
 	// from the docs: "If Stdout and Stderr are the same writer, at most one
 	// goroutine at a time will call Write." so we trick it here!
 	cmd.Stdout = out.Stdout
@@ -322,6 +323,7 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	}
 
 	// process the err result from cmd, we process non-zero exits here too!
+	exitCode := 0
 	exitErr, ok := err.(*exec.ExitError) // embeds an os.ProcessState
 	if err != nil && ok {
 		pStateSys := exitErr.Sys() // (*os.ProcessState) Sys
@@ -329,12 +331,26 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 		if !ok {
 			return false, errwrap.Wrapf(err, "error running cmd")
 		}
-		return false, fmt.Errorf("cmd error, exit status: %d", wStatus.ExitStatus())
+		exitCode = wStatus.ExitStatus()
 
 	} else if err != nil {
 		return false, errwrap.Wrapf(err, "general cmd error")
 	}
 
+	changedCodes := obj.ChangedCodes
+	if changedCodes == nil {
+		changedCodes = []int{0}
+	}
+	// the success codes win, in case zero is in there, but the changed
+	// codes were left undefined
+	success := execCodeInList(exitCode, obj.SuccessCodes)
+	if !success && !execCodeInList(exitCode, changedCodes) {
+		return false, fmt.Errorf("cmd error, exit status: %d", exitCode)
+	}
+
+	if out.Truncated() {
+		obj.init.Logf("Command output was truncated to %d bytes!", obj.OutputLimit)
+	}
 	// TODO: if we printed the stdout while the command is running, this
 	// would be nice, but it would require terminal log output that doesn't
 	// interleave all the parallel parts which would mix it all up...
@@ -351,6 +367,10 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	// If we apply state successfully, we should reset it here so that we
 	// know that we have applied since the state was set not ok by event!
 	// This now happens automatically after the engine runs CheckApply().
+	if success {
+		obj.init.Logf("Command exited with %d, nothing changed", exitCode)
+		return true, nil // success, so don't refresh anything
+	}
 	return false, nil // success
 }
 
@@ -397,6 +417,41 @@ func (obj *ExecRes) Compare(r engine.Res) bool {
 	if obj.Group != res.Group {
 		return false
 	}
+	if len(obj.Env) != len(res.Env) {
+		return false
+	}
+	for k, v := range obj.Env {
+		if x, exists := res.Env[k]; !exists || x != v {
+			return false
+		}
+	}
+	if obj.Cwd != res.Cwd {
+		return false
+	}
+	if obj.Machine != res.Machine {
+		return false
+	}
+	if (obj.Stdin == nil) != (res.Stdin == nil) {
+		return false
+	}
+	if obj.Stdin != nil && *obj.Stdin != *res.Stdin {
+		return false
+	}
+	if obj.Creates != res.Creates {
+		return false
+	}
+	if fmt.Sprintf("%v", obj.SuccessCodes) != fmt.Sprintf("%v", res.SuccessCodes) {
+		return false
+	}
+	if (obj.ChangedCodes == nil) != (res.ChangedCodes == nil) {
+		return false
+	}
+	if fmt.Sprintf("%v", obj.ChangedCodes) != fmt.Sprintf("%v", res.ChangedCodes) {
+		return false
+	}
+	if obj.OutputLimit != res.OutputLimit {
+		return false
+	}
 
 	return true
 }
@@ -425,9 +480,24 @@ func (obj *ExecResAutoEdges) Test(input []bool) bool {
 	// TODO: we could return false if we find as many edges as the number of different path's in cmdFiles()
 }
 
-// AutoEdges returns the AutoEdge interface. In this case the systemd units.
+// AutoEdges returns the AutoEdge interface. In this case the systemd units, or
+// the machine that the commands run in.
 func (obj *ExecRes) AutoEdges() (engine.AutoEdge, error) {
 	var data []engine.ResUID
+	if obj.Machine != "" { // the files are all inside of the machine
+		var reversed = true
+		data = append(data, &NspawnUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			name: obj.Machine, // what matters
+		})
+		return &ExecResAutoEdges{
+			edges: data,
+		}, nil
+	}
 	for _, x := range obj.cmdFiles() {
 		var reversed = true
 		data = append(data, &PkgFileUID{
@@ -439,6 +509,17 @@ func (obj *ExecRes) AutoEdges() (engine.AutoEdge, error) {
 			path: x, // what matters
 		})
 	}
+	if obj.Cwd != "" { // the working directory has to exist first
+		var reversed = true
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: path.Clean(obj.Cwd) + "/", // directories end in a slash
+		})
+	}
 	return &ExecResAutoEdges{
 		edges: data,
 	}, nil
@@ -507,6 +588,87 @@ func (obj *ExecRes) getCredential() (*syscall.Credential, error) {
 	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
 }
 
+// getCmd builds the command to run with the optional shell. It sets all of the
+// things that are common to each of the commands, such as the credential, the
+// environment and the working directory.
+func (obj *ExecRes) getCmd(command, shell string) (*exec.Cmd, error) {
+	var cmdName string
+	var cmdArgs []string
+	if shell == "" {
+		// call without a shell
+		// FIXME: are there still whitespace splitting issues?
+		// TODO: we could make the split character user selectable...!
+		split := strings.Fields(command)
+		cmdName = split[0]
+		cmdArgs = split[1:]
+	} else {
+		cmdName = shell // usually bash, or sh
+		cmdArgs = []string{"-c", command}
+	}
+
+	keys := []string{}
+	for k := range obj.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // deterministic order
+
+	if obj.Machine != "" {
+		// systemd-run sets everything up inside of the machine
+		args := []string{"--machine=" + obj.Machine, "--quiet", "--wait", "--pipe"}
+		for _, k := range keys {
+			args = append(args, fmt.Sprintf("--setenv=%s=%s", k, obj.Env[k]))
+		}
+		if obj.Cwd != "" {
+			args = append(args, "--property=WorkingDirectory="+obj.Cwd)
+		}
+		if obj.User != "" {
+			args = append(args, "--uid="+obj.User)
+		}
+		if obj.Group != "" {
+			args = append(args, "--gid="+obj.Group)
+		}
+		args = append(args, "--", cmdName)
+		cmd := exec.Command(ExecSystemdRunCmd, append(args, cmdArgs...)...)
+		// ignore signals sent to parent process (we're in our own group)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+			Pgid:    0,
+		}
+		return cmd, nil
+	}
+
+	cmd := exec.Command(cmdName, cmdArgs...)
+	cmd.Dir = obj.Cwd // empty means the cwd of mgmt
+	if len(keys) > 0 {
+		cmd.Env = os.Environ()
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, obj.Env[k]))
+		}
+	}
+	// ignore signals sent to parent process (we're in our own group)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Pgid:    0,
+	}
+
+	// if we have a user and group, use them
+	var err error
+	if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
+		return nil, errwrap.Wrapf(err, "error while setting credential")
+	}
+	return cmd, nil
+}
+
+// execCodeInList returns true if the exit code is in the list.
+func execCodeInList(code int, list []int) bool {
+	for _, x := range list {
+		if x == code {
+			return true
+		}
+	}
+	return false
+}
+
 // cmdFiles returns all the potential files/commands this command might need.
 func (obj *ExecRes) cmdFiles() []string {
 	var paths []string
@@ -567,8 +729,9 @@ type splitWriter struct {
 	initialized bool // is this initialized?
 }
 
-// Init initializes the splitWriter.
-func (obj *splitWriter) Init() {
+// Init initializes the splitWriter. If the limit is greater than zero, then
+// each buffer only keeps that many bytes, and discards the rest.
+func (obj *splitWriter) Init(limit int) {
 	if obj.initialized {
 		panic("splitWriter is already initialized")
 	}
@@ -577,11 +740,13 @@ func (obj *splitWriter) Init() {
 		Mutex:  obj.mutex,
 		Buffer: &obj.stdout,
 		Output: &obj.output,
+		Limit:  limit,
 	}
 	obj.Stderr = &wrapWriter{
 		Mutex:  obj.mutex,
 		Buffer: &obj.stderr,
 		Output: &obj.output,
+		Limit:  limit,
 	}
 	obj.initialized = true
 }
@@ -594,25 +759,55 @@ func (obj *splitWriter) String() string {
 	return obj.output.String()
 }
 
+// Truncated returns true if any of the output was discarded.
+func (obj *splitWriter) Truncated() bool {
+	if !obj.initialized {
+		panic("splitWriter is not initialized")
+	}
+	return obj.Stdout.Truncated || obj.Stderr.Truncated
+}
+
 // wrapWriter is a simple writer which is used internally by splitWriter.
 type wrapWriter struct {
-	Mutex    *sync.Mutex
-	Buffer   *bytes.Buffer // stdout or stderr
-	Output   *bytes.Buffer // combined output
-	Activity bool          // did we get any writes?
+	Mutex     *sync.Mutex
+	Buffer    *bytes.Buffer // stdout or stderr
+	Output    *bytes.Buffer // combined output
+	Limit     int           // max size of each buffer, zero means no limit
+	Activity  bool          // did we get any writes?
+	Truncated bool          // did we discard anything?
 }
 
 // Write writes to both bytes buffers with a parent lock to mix output safely.
+// Anything past the limit is discarded, but the write still succeeds, so that
+// the command doesn't fail because it has too much output.
 func (obj *wrapWriter) Write(p []byte) (int, error) {
 	// TODO: can we move the lock to only guard around the Output.Write ?
 	obj.Mutex.Lock()
 	defer obj.Mutex.Unlock()
 	obj.Activity = true
-	i, err := obj.Buffer.Write(p) // first write
-	if err != nil {
-		return i, err
+	if _, err := obj.Buffer.Write(obj.limit(obj.Buffer, p)); err != nil { // first write
+		return 0, err
+	}
+	if _, err := obj.Output.Write(obj.limit(obj.Output, p)); err != nil { // shared write
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// limit returns the part of the input which still fits in the buffer.
+func (obj *wrapWriter) limit(buffer *bytes.Buffer, p []byte) []byte {
+	if obj.Limit <= 0 {
+		return p
+	}
+	free := obj.Limit - buffer.Len()
+	if free < 0 {
+		free = 0
+	}
+	if len(p) > free {
+		obj.Truncated = true
+		return p[:free]
 	}
-	return obj.Output.Write(p) // shared write
+	return p
 }
 
 // String returns the contents of the unshared buffer.
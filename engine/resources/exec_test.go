@@ -20,6 +20,10 @@
 package resources
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/purpleidea/mgmt/engine"
@@ -188,3 +192,194 @@ func TestExecSendRecv3(t *testing.T) {
 		}
 	}
 }
+
+func TestExecEnvCwdStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-exec-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	stdin := "hello from stdin\n"
+	r1 := &ExecRes{
+		Cmd:   "pwd; echo $GREETING; cat",
+		Shell: "/bin/sh",
+		Env: map[string]string{
+			"GREETING": "hello from env",
+		},
+		Cwd:   dir,
+		Stdin: &stdin,
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return
+	}
+	if r1.Stdout == nil {
+		t.Errorf("stdout is nil")
+	} else if exp := dir + "\nhello from env\nhello from stdin\n"; *r1.Stdout != exp {
+		t.Errorf("got wrong stdout: %s", *r1.Stdout)
+	}
+}
+
+func TestExecCreates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-exec-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "created")
+
+	r1 := &ExecRes{
+		Cmd:     "touch " + p,
+		Creates: p,
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if checkOK, err := r1.CheckApply(false); err != nil || checkOK {
+		t.Errorf("check should have failed: %v", err)
+	}
+	if checkOK, err := r1.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply should have run the cmd: %v", err)
+	}
+	if checkOK, err := r1.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("the cmd should not run once the file exists: %v", err)
+	}
+}
+
+func TestExecExitCodes(t *testing.T) {
+	tests := []struct {
+		cmd          string
+		successCodes []int
+		changedCodes []int
+		checkOK      bool
+		fail         bool
+	}{
+		{"true", nil, nil, false, false},
+		{"false", nil, nil, false, true},
+		{"true", []int{0}, nil, true, false},
+		{"false", []int{0}, []int{1}, false, false},
+		{"false", []int{1}, nil, true, false},
+		{"exit 2", []int{0}, []int{1}, false, true},
+	}
+	for i, tt := range tests {
+		r1 := &ExecRes{
+			Cmd:          tt.cmd,
+			Shell:        "/bin/sh",
+			SuccessCodes: tt.successCodes,
+			ChangedCodes: tt.changedCodes,
+		}
+		if err := r1.Validate(); err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+			continue
+		}
+		if err := r1.Init(fakeInit(t)); err != nil {
+			t.Errorf("test #%d: init failed with: %v", i, err)
+			continue
+		}
+		checkOK, err := r1.CheckApply(true)
+		if tt.fail && err == nil {
+			t.Errorf("test #%d: checkapply should have failed", i)
+		} else if !tt.fail && err != nil {
+			t.Errorf("test #%d: checkapply failed with: %v", i, err)
+		} else if !tt.fail && checkOK != tt.checkOK {
+			t.Errorf("test #%d: expected checkOK to be: %t", i, tt.checkOK)
+		}
+	}
+
+	r2 := &ExecRes{
+		Cmd:          "true",
+		SuccessCodes: []int{0},
+		ChangedCodes: []int{0},
+	}
+	if err := r2.Validate(); err == nil {
+		t.Errorf("an exit code should not be both success and changed")
+	}
+}
+
+func TestExecOutputLimit(t *testing.T) {
+	r1 := &ExecRes{
+		Cmd:         "echo hello world && echo goodbye world 1>&2",
+		Shell:       "/bin/bash",
+		OutputLimit: 5,
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return
+	}
+	if r1.Stdout == nil || *r1.Stdout != "hello" {
+		t.Errorf("got wrong stdout: %v", r1.Stdout)
+	}
+	if r1.Stderr == nil || *r1.Stderr != "goodb" {
+		t.Errorf("got wrong stderr: %v", r1.Stderr)
+	}
+	if r1.Output == nil || len(*r1.Output) != 5 {
+		t.Errorf("got wrong output: %v", r1.Output)
+	}
+}
+
+func TestExecMachineCmd(t *testing.T) {
+	r1 := &ExecRes{
+		Cmd:   "echo $GREETING",
+		Shell: "/bin/sh",
+		Env: map[string]string{
+			"GREETING": "hello from the machine",
+		},
+		Cwd:     "/srv",
+		User:    "nobody",
+		Machine: "web1",
+	}
+	cmd, err := r1.getCmd(r1.Cmd, r1.Shell)
+	if err != nil {
+		t.Errorf("getcmd failed with: %v", err)
+		return
+	}
+	exp := []string{
+		ExecSystemdRunCmd,
+		"--machine=web1",
+		"--quiet",
+		"--wait",
+		"--pipe",
+		"--setenv=GREETING=hello from the machine",
+		"--property=WorkingDirectory=/srv",
+		"--uid=nobody",
+		"--",
+		"/bin/sh",
+		"-c",
+		"echo $GREETING",
+	}
+	if strings.Join(cmd.Args, "\x00") != strings.Join(exp, "\x00") {
+		t.Errorf("got wrong args: %q", cmd.Args)
+	}
+	if cmd.Dir != "" || cmd.Env != nil {
+		t.Errorf("the cwd and env must only be used inside of the machine")
+	}
+
+	r1.Creates = "/srv/done"
+	if err := r1.Validate(); err == nil {
+		t.Errorf("validate should have failed with creates")
+	}
+}
@@ -19,6 +19,7 @@ package resources
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -44,6 +45,10 @@ func init() {
 	engine.RegisterResource("file", func() engine.Res { return &FileRes{} })
 }
 
+// fileSecretMode is the mode of a file with a Secret when no Mode is given, so
+// that no other local user can read it.
+const fileSecretMode = os.FileMode(0600)
+
 // FileRes is a file and directory resource. Dirs are defined by names ending
 // in a slash.
 type FileRes struct {
@@ -69,6 +74,12 @@ type FileRes struct {
 	Recurse  bool    `yaml:"recurse"`
 	Force    bool    `yaml:"force"`
 
+	// Secret is the name of a secret in the world, which is decrypted and
+	// used as the content. Unlike with Content, the value never appears in
+	// the graph, so it can't get logged or exported with it. The file gets
+	// a mode of 0600 unless the Mode is set.
+	Secret string `yaml:"secret"`
+
 	path       string // computed path
 	isDir      bool   // computed isDir
 	sha256sum  string
@@ -108,6 +119,14 @@ func (obj *FileRes) Validate() error {
 		return fmt.Errorf("can't specify Content when creating a Dir")
 	}
 
+	if obj.Secret != "" && (obj.Content != nil || obj.Source != "") {
+		return fmt.Errorf("can't specify Secret with Content or Source")
+	}
+
+	if obj.isDir && obj.Secret != "" { // makes no sense
+		return fmt.Errorf("can't specify Secret when creating a Dir")
+	}
+
 	if obj.Mode != "" {
 		if _, err := obj.mode(); err != nil {
 			return err
@@ -131,9 +150,12 @@ func (obj *FileRes) Validate() error {
 }
 
 // mode returns the file permission specified on the graph. It doesn't handle
-// the case where the mode is not specified. The caller should check obj.Mode is
-// not empty.
+// the case where the mode is not specified, except for secrets, which default
+// to fileSecretMode. The caller should check obj.Mode is not empty.
 func (obj *FileRes) mode() (os.FileMode, error) {
+	if obj.Mode == "" && obj.Secret != "" {
+		return fileSecretMode, nil
+	}
 	m, err := strconv.ParseInt(obj.Mode, 8, 32)
 	if err != nil {
 		return os.FileMode(0), errwrap.Wrapf(err, "Mode should be an octal number (%s)", obj.Mode)
@@ -199,6 +221,13 @@ func (obj *FileRes) Watch() error {
 		return err // exit if requested
 	}
 
+	var secretChan chan error // nil chans block forever
+	if obj.Secret != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel() // removes the watch
+		secretChan = obj.init.World.SecretWatch(ctx, obj.Secret)
+	}
+
 	var send = false // send event?
 	for {
 		if obj.init.Debug {
@@ -219,6 +248,19 @@ func (obj *FileRes) Watch() error {
 			send = true
 			obj.init.Dirty() // dirty
 
+		case err, ok := <-secretChan:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "unknown %s secret watcher error", obj)
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event(secret): %s", obj.Secret)
+			}
+			send = true
+			obj.init.Dirty() // dirty
+
 		case event, ok := <-obj.init.Events:
 			if !ok {
 				return nil
@@ -247,8 +289,12 @@ func (obj *FileRes) Watch() error {
 func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sha256sum string) (string, bool, error) {
 	// TODO: does it make sense to switch dst to an io.Writer ?
 	// TODO: use obj.Force when dealing with symlinks and other file types!
+	var srcName interface{} = src
+	if obj.Secret != "" {
+		srcName = "<secret>" // the value must never be logged
+	}
 	if obj.init.Debug {
-		obj.init.Logf("fileCheckApply: %s -> %s", src, dst)
+		obj.init.Logf("fileCheckApply: %s -> %s", srcName, dst)
 	}
 
 	srcFile, isFile := src.(*os.File)
@@ -345,11 +391,16 @@ func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sh
 		return sha256sum, false, nil
 	}
 	if obj.init.Debug {
-		obj.init.Logf("fileCheckApply: Apply: %s -> %s", src, dst)
+		obj.init.Logf("fileCheckApply: Apply: %s -> %s", srcName, dst)
 	}
 
 	dstClose() // unlock file usage so we can write to it
-	dstFile, err = os.Create(dst)
+	// create it with the same perm as os.Create, unless it's a secret
+	perm := os.FileMode(0666)
+	if obj.Secret != "" {
+		perm = fileSecretMode // don't let anyone read it before the chmod
+	}
+	dstFile, err = os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return sha256sum, false, err
 	}
@@ -366,7 +417,7 @@ func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sh
 
 	// TODO: should we offer a way to cancel the copy on ^C ?
 	if obj.init.Debug {
-		obj.init.Logf("fileCheckApply: Copy: %s -> %s", src, dst)
+		obj.init.Logf("fileCheckApply: Copy: %s -> %s", srcName, dst)
 	}
 	if n, err := io.Copy(dstFile, src); err != nil {
 		return sha256sum, false, err
@@ -615,10 +666,23 @@ func (obj *FileRes) contentCheckApply(apply bool) (checkOK bool, _ error) {
 	}
 
 	// content is not defined, leave it alone...
-	if obj.Content == nil && obj.Source == "" {
+	if obj.Content == nil && obj.Source == "" && obj.Secret == "" {
 		return true, nil
 	}
 
+	if obj.Secret != "" {
+		value, err := obj.init.World.SecretGet(obj.Secret)
+		if err != nil {
+			return false, err // this never includes the value
+		}
+		// don't cache the hash, since the secret can change at any time
+		_, checkOK, err := obj.fileCheckApply(apply, bytes.NewReader([]byte(value)), obj.path, "")
+		if err != nil {
+			return false, err
+		}
+		return checkOK, nil
+	}
+
 	if obj.Source == "" { // do the obj.Content checks first...
 		bufferSrc := bytes.NewReader([]byte(*obj.Content))
 		sha256sum, checkOK, err := obj.fileCheckApply(apply, bufferSrc, obj.path, obj.sha256sum)
@@ -651,7 +715,7 @@ func (obj *FileRes) chmodCheckApply(apply bool) (checkOK bool, _ error) {
 		return true, nil
 	}
 
-	if obj.Mode == "" {
+	if obj.Mode == "" && obj.Secret == "" {
 		// No mode specified, everything is ok
 		return true, nil
 	}
@@ -817,6 +881,9 @@ func (obj *FileRes) Compare(r engine.Res) bool {
 	if obj.Source != res.Source {
 		return false
 	}
+	if obj.Secret != res.Secret {
+		return false
+	}
 	if obj.State != res.State {
 		return false
 	}
@@ -885,7 +952,8 @@ func (obj *FileResAutoEdges) Test(input []bool) bool {
 }
 
 // AutoEdges generates a simple linear sequence of each parent directory from
-// the bottom up!
+// the bottom up! If an Owner or a Group is specified, then there are also edges
+// from the user and group resources which manage them.
 func (obj *FileRes) AutoEdges() (engine.AutoEdge, error) {
 	var data []engine.ResUID // store linear result chain here...
 	// build it, but don't use obj.path because this gets called before Init
@@ -902,11 +970,42 @@ func (obj *FileRes) AutoEdges() (engine.AutoEdge, error) {
 			path: x, // what matters
 		}) // build list
 	}
-	return &FileResAutoEdges{
+	fileEdges := &FileResAutoEdges{
 		data:    data,
 		pointer: 0,
 		found:   false,
-	}, nil
+	}
+
+	var uids []engine.ResUID
+	var reversed = true // the user and the group must exist before the file
+	if obj.Owner != "" {
+		uid := &UserUID{BaseUID: engine.BaseUID{Reversed: &reversed}}
+		if x, err := strconv.ParseUint(obj.Owner, 10, 32); err == nil {
+			id := uint32(x)
+			uid.uid = &id
+		} else {
+			uid.name = obj.Owner
+		}
+		uids = append(uids, uid)
+	}
+	if obj.Group != "" {
+		uid := &GroupUID{BaseUID: engine.BaseUID{Reversed: &reversed}}
+		if x, err := strconv.ParseUint(obj.Group, 10, 32); err == nil {
+			id := uint32(x)
+			uid.gid = &id
+		} else {
+			uid.name = obj.Group
+		}
+		uids = append(uids, uid)
+	}
+	if len(uids) == 0 {
+		return fileEdges, nil
+	}
+	userEdges := &UserResAutoEdges{
+		UIDs:    uids,
+		pointer: 0,
+	}
+	return engineUtil.AutoEdgeCombiner(userEdges, fileEdges)
 }
 
 // UIDs includes all params to make a unique identification of this object.
@@ -23,12 +23,18 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/graph/autoedge"
 	engineUtil "github.com/purpleidea/mgmt/engine/util"
 	"github.com/purpleidea/mgmt/pgraph"
+	"github.com/purpleidea/mgmt/world/memory"
 )
 
 func TestFileAutoEdge1(t *testing.T) {
@@ -162,3 +168,82 @@ func TestFileAbsolute1(t *testing.T) {
 		t.Errorf("file res should have failed validate")
 	}
 }
+
+func TestFileSecret(t *testing.T) {
+	tests := []struct {
+		res *FileRes
+		ok  bool
+	}{
+		{&FileRes{Path: "/tmp/password", Secret: "db"}, true},
+		{&FileRes{Path: "/tmp/password", Secret: "db", Content: new(string)}, false},
+		{&FileRes{Path: "/tmp/password", Secret: "db", Source: "/tmp/other"}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.res.Validate(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "mgmt-file-secret-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := memory.NewStore()
+	init := fakeInit(t)
+	init.World = &memory.World{Hostname: "h1", Store: store}
+	init.Debug = true
+	logs := []string{}
+	init.Logf = func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+
+	r1 := &FileRes{
+		Path:   path.Join(dir, "password"),
+		State:  "exists",
+		Secret: "db",
+	}
+	if err := r1.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r1.contentCheckApply(true); err == nil {
+		t.Errorf("a missing secret should have failed")
+	}
+
+	for _, value := range []string{"hunter2", "correct horse"} {
+		if err := store.SecretSet("db", value, []string{"h1"}); err != nil {
+			t.Errorf("could not set secret: %v", err)
+			return
+		}
+		if checkOK, err := r1.contentCheckApply(true); err != nil || checkOK {
+			t.Errorf("secret apply returned: %t, %v", checkOK, err)
+		}
+		if checkOK, err := r1.contentCheckApply(false); err != nil || !checkOK {
+			t.Errorf("secret did not converge: %t, %v", checkOK, err)
+		}
+		if b, err := ioutil.ReadFile(r1.path); err != nil || string(b) != value {
+			t.Errorf("got wrong content: %q, %v", string(b), err)
+		}
+		if checkOK, err := r1.chmodCheckApply(false); err != nil || !checkOK {
+			t.Errorf("secret file has the wrong mode: %t, %v", checkOK, err)
+		}
+		for _, line := range logs {
+			if strings.Contains(line, value) {
+				t.Errorf("the secret was logged: %s", line)
+			}
+		}
+	}
+
+	if err := store.SecretSet("db", "hunter2", []string{"h2"}); err != nil {
+		t.Errorf("could not set secret: %v", err)
+		return
+	}
+	if _, err := r1.contentCheckApply(false); err == nil {
+		t.Errorf("a secret for another host should have failed")
+	}
+}
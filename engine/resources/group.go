@@ -288,7 +288,8 @@ func (obj *GroupUID) IFF(uid engine.ResUID) bool {
 			return false
 		}
 	}
-	return true
+	// at least one of the two identifiers must have been compared
+	return (obj.gid != nil && res.gid != nil) || (obj.name != "" && res.name != "")
 }
 
 // UIDs includes all params to make a unique identification of this object.
@@ -0,0 +1,656 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// HTTPServerAddress is the default address that the http server listens
+	// on if none is specified.
+	HTTPServerAddress = ":80"
+	// HTTPServerLinger is the number of seconds that an unused listener is
+	// kept open for, so that the http:server resource which replaces the
+	// old one during a graph switch can take it over without dropping any
+	// of the connections.
+	HTTPServerLinger = 5
+	// HTTPServerShutdownTimeout is the maximum number of seconds to wait
+	// for the http server to shutdown gracefully.
+	HTTPServerShutdownTimeout = 30
+)
+
+func init() {
+	engine.RegisterResource("http:server", func() engine.Res { return &HTTPServerRes{} })
+	engine.RegisterResource("http:file", func() engine.Res { return &HTTPFileRes{} })
+}
+
+// HTTPServerRes is an http server resource. It listens on an address, and it
+// serves the content of every http:file resource which is grouped into it. When
+// the graph changes, the listener is kept, and only the routes get swapped, so
+// that the existing connections are not dropped.
+type HTTPServerRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Groupable
+
+	init *engine.Init
+
+	// Address is the listen address of the server, in the usual host:port
+	// form. It defaults to listening on port 80 on every interface.
+	Address string `yaml:"address"`
+
+	listener *httpListener
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *HTTPServerRes) Default() engine.Res {
+	return &HTTPServerRes{
+		Address: HTTPServerAddress,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *HTTPServerRes) Validate() error {
+	if _, _, err := net.SplitHostPort(obj.Address); err != nil {
+		return errwrap.Wrapf(err, "the Address is invalid")
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *HTTPServerRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *HTTPServerRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// takes over the listener for our address, and it only returns an error if the
+// server fails while it is serving.
+func (obj *HTTPServerRes) Watch() error {
+	listener, err := httpServers.Acquire(obj.Address)
+	if err != nil {
+		return err
+	}
+	obj.listener = listener
+	defer httpServers.Release(listener)
+
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	// the routes only change with the graph, so we never send any events
+	for {
+		select {
+		case <-listener.done:
+			if err := listener.err; err != nil {
+				return errwrap.Wrapf(err, "the server failed")
+			}
+			return fmt.Errorf("the server stopped unexpectedly")
+
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// routes returns the map of url paths to routes that this server should serve.
+// This is built from all of the http:file resources that are grouped into it.
+func (obj *HTTPServerRes) routes() (map[string]*httpRoute, error) {
+	result := make(map[string]*httpRoute)
+	for _, x := range obj.GetGroup() {
+		res, ok := x.(*HTTPFileRes) // convert from Res
+		if !ok {
+			panic(fmt.Sprintf("grouped member %v is not an http:file", x))
+		}
+		p := res.getPath()
+		if _, exists := result[p]; exists {
+			return nil, fmt.Errorf("the path `%s` is served by more than one resource", p)
+		}
+		result[p] = &httpRoute{
+			filename: res.Filename,
+			data:     res.Data,
+		}
+	}
+	return result, nil
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+// The state is the set of routes that the running server uses.
+func (obj *HTTPServerRes) CheckApply(apply bool) (bool, error) {
+	if obj.listener == nil {
+		return false, fmt.Errorf("the server is not running")
+	}
+	routes, err := obj.routes()
+	if err != nil {
+		return false, err
+	}
+	if obj.listener.Cmp(routes) {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	paths := []string{}
+	for p := range routes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths) // deterministic order for the logs
+	obj.init.Logf("serving: %s", strings.Join(paths, ", "))
+	obj.listener.Swap(routes)
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *HTTPServerRes) Cmp(r engine.Res) error {
+	res, ok := r.(*HTTPServerRes)
+	if !ok {
+		return fmt.Errorf("not an %s", obj.Kind())
+	}
+
+	if obj.Address != res.Address {
+		return fmt.Errorf("the Address differs")
+	}
+
+	return nil
+}
+
+// HTTPServerUID is the UID struct for HTTPServerRes.
+type HTTPServerUID struct {
+	engine.BaseUID
+
+	address string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *HTTPServerUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*HTTPServerUID)
+	if !ok {
+		return false
+	}
+	return obj.address == res.address
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *HTTPServerRes) UIDs() []engine.ResUID {
+	x := &HTTPServerUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		address: obj.Address,
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Unlike
+// most resources, this only groups with a different kind, the http:file, which
+// must name us as its server.
+func (obj *HTTPServerRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*HTTPFileRes)
+	if !ok {
+		return fmt.Errorf("resource is not an http:file")
+	}
+	if res.Server != obj.Name() {
+		return fmt.Errorf("resource is served by a different server")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *HTTPServerRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes HTTPServerRes // indirection to avoid infinite recursion
+
+	def := obj.Default()            // get the default
+	res, ok := def.(*HTTPServerRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to HTTPServerRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = HTTPServerRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// HTTPFileRes is a file which is served by an http:server resource. It must be
+// grouped into the server that it names, and it does nothing on its own. Its
+// content is either specified directly, or it is read from a file on disk each
+// time that it is requested.
+type HTTPFileRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Groupable
+
+	init *engine.Init
+
+	// Server is the name of the http:server resource to serve this from.
+	Server string `yaml:"server"`
+	// Path is the absolute url path that the file is served at. If it is
+	// not specified, then the resource name is used.
+	Path string `yaml:"path"`
+
+	// Filename is the absolute path of a local file to serve. If this is
+	// used, then Data must be empty.
+	Filename string `yaml:"filename"`
+	// Data is the content to serve if no Filename is specified.
+	Data string `yaml:"data"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *HTTPFileRes) Default() engine.Res {
+	return &HTTPFileRes{}
+}
+
+// getPath returns the actual url path to use for this resource. It computes
+// this after analysis of the Path and Name.
+func (obj *HTTPFileRes) getPath() string {
+	if obj.Path == "" { // use the name as the path default if missing
+		return obj.Name()
+	}
+	return obj.Path
+}
+
+// Validate if the params passed in are valid data.
+func (obj *HTTPFileRes) Validate() error {
+	if obj.Server == "" {
+		return fmt.Errorf("the Server must be specified")
+	}
+	if !strings.HasPrefix(obj.getPath(), "/") {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	if obj.Filename != "" && obj.Data != "" {
+		return fmt.Errorf("only one of Filename or Data can be used")
+	}
+	if obj.Filename != "" && !strings.HasPrefix(obj.Filename, "/") {
+		return fmt.Errorf("the Filename must be absolute")
+	}
+	if strings.HasSuffix(obj.Filename, "/") {
+		return fmt.Errorf("the Filename must not be a directory")
+	}
+	if obj.AutoGroupMeta().Disabled {
+		return fmt.Errorf("the file must be grouped into its server, so autogroup can't be disabled")
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *HTTPFileRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *HTTPFileRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// only runs if the resource was not grouped into a server, and since there is
+// nothing to watch, it never sends any events.
+func (obj *HTTPFileRes) Watch() error {
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	for {
+		select {
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CheckApply is only run if this resource was not grouped into a server, which
+// happens when the server isn't in the graph. There is nothing to apply, since
+// the file gets served as soon as a graph with the server groups it.
+func (obj *HTTPFileRes) CheckApply(apply bool) (bool, error) {
+	obj.init.Logf("not served, since the `%s` http:server is not in the graph", obj.Server)
+	return true, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *HTTPFileRes) Cmp(r engine.Res) error {
+	res, ok := r.(*HTTPFileRes)
+	if !ok {
+		return fmt.Errorf("not an %s", obj.Kind())
+	}
+
+	if obj.Server != res.Server {
+		return fmt.Errorf("the Server differs")
+	}
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Filename != res.Filename {
+		return fmt.Errorf("the Filename differs")
+	}
+	if obj.Data != res.Data {
+		return fmt.Errorf("the Data differs")
+	}
+
+	return nil
+}
+
+// HTTPFileUID is the UID struct for HTTPFileRes.
+type HTTPFileUID struct {
+	engine.BaseUID
+
+	server string
+	path   string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *HTTPFileUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*HTTPFileUID)
+	if !ok {
+		return false
+	}
+	return obj.server == res.server && obj.path == res.path
+}
+
+// AutoEdges returns the AutoEdge interface. When serving a local file, this adds
+// an edge from the file resource which manages it, or the nearest parent of it.
+func (obj *HTTPFileRes) AutoEdges() (engine.AutoEdge, error) {
+	if obj.Filename == "" {
+		return nil, nil
+	}
+	var data []engine.ResUID
+	for _, x := range util.PathSplitFullReversed(obj.Filename) {
+		var reversed = true // cheat by passing a pointer
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x, // what matters
+		})
+	}
+	return &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}, nil
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *HTTPFileRes) UIDs() []engine.ResUID {
+	x := &HTTPFileUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		server:  obj.Server,
+		path:    obj.getPath(),
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Files
+// don't accept anything into them, since they can only be grouped into servers.
+func (obj *HTTPFileRes) GroupCmp(r engine.GroupableRes) error {
+	return fmt.Errorf("nothing can be grouped into an http:file")
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *HTTPFileRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes HTTPFileRes // indirection to avoid infinite recursion
+
+	def := obj.Default()          // get the default
+	res, ok := def.(*HTTPFileRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to HTTPFileRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = HTTPFileRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// httpRoute is the content that is served at a single url path.
+type httpRoute struct {
+	filename string
+	data     string
+}
+
+// ServeHTTP serves the route, either from the local file, or from the data. The
+// modtime is used for the data, since it has no modification time of its own.
+func (obj *httpRoute) ServeHTTP(w http.ResponseWriter, req *http.Request, modtime time.Time) {
+	if obj.filename == "" {
+		http.ServeContent(w, req, req.URL.Path, modtime, strings.NewReader(obj.data))
+		return
+	}
+	f, err := os.Open(obj.filename)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	http.ServeContent(w, req, obj.filename, fi.ModTime(), f)
+}
+
+// httpListener is a running http server, and the routes that it is serving. It
+// implements http.Handler, and its routes can be swapped at any time.
+type httpListener struct {
+	address  string
+	server   *http.Server
+	listener net.Listener
+
+	mutex   *sync.RWMutex
+	routes  map[string]*httpRoute
+	modtime time.Time // when the routes were last swapped
+
+	owned bool        // is a resource using this right now?
+	timer *time.Timer // pending shutdown, if not owned
+
+	done chan struct{} // closes when the server stops serving
+	err  error         // the reason that the server stopped, if it did
+}
+
+// ServeHTTP looks up the route for the request and serves it.
+func (obj *httpListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	obj.mutex.RLock()
+	route, exists := obj.routes[req.URL.Path]
+	modtime := obj.modtime
+	obj.mutex.RUnlock()
+
+	if !exists {
+		http.NotFound(w, req)
+		return
+	}
+	route.ServeHTTP(w, req, modtime)
+}
+
+// Cmp returns true if the listener is already serving exactly these routes.
+func (obj *httpListener) Cmp(routes map[string]*httpRoute) bool {
+	obj.mutex.RLock()
+	defer obj.mutex.RUnlock()
+	if len(obj.routes) != len(routes) {
+		return false
+	}
+	for p, route := range routes {
+		r, exists := obj.routes[p]
+		if !exists || *r != *route {
+			return false
+		}
+	}
+	return true
+}
+
+// Swap replaces the routes that the listener is serving. Requests which are in
+// progress finish with the route that they started with.
+func (obj *httpListener) Swap(routes map[string]*httpRoute) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	obj.routes = routes
+	obj.modtime = time.Now()
+}
+
+// httpRegistry tracks the running http servers by address. These outlive the
+// resources that use them, so that a graph switch doesn't need to restart them.
+type httpRegistry struct {
+	mutex     *sync.Mutex
+	listeners map[string]*httpListener
+	wait      time.Duration // how long to wait for a listener to be released
+}
+
+// httpServers is the registry that is shared by all of the http:server
+// resources.
+var httpServers = &httpRegistry{
+	mutex:     &sync.Mutex{},
+	listeners: make(map[string]*httpListener),
+	wait:      HTTPServerLinger * time.Second,
+}
+
+// Acquire returns the listener for an address, and starts it if it isn't
+// already running. Only one resource can use each listener at a time. During a
+// graph switch, the new resource might start before the old one is done, so if
+// the listener is in use, then this waits for a little while for it to be
+// released. When the listener is no longer needed, then Release must be called.
+func (obj *httpRegistry) Acquire(address string) (*httpListener, error) {
+	deadline := time.Now().Add(obj.wait)
+	for {
+		listener, err := obj.acquire(address)
+		if err != nil || listener != nil {
+			return listener, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the address `%s` is already used by another server", address)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// acquire is the non-blocking part of Acquire. It returns nil if the listener
+// is in use.
+func (obj *httpRegistry) acquire(address string) (*httpListener, error) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+
+	if listener, exists := obj.listeners[address]; exists {
+		if listener.owned {
+			return nil, nil // try again
+		}
+		select {
+		case <-listener.done: // it failed, so start over with a new one
+			delete(obj.listeners, address)
+		default:
+			// the shutdown only happens while it's registered and not
+			// owned, so taking it over here always stops it in time
+			listener.timer.Stop()
+			listener.owned = true
+			return listener, nil
+		}
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not listen on `%s`", address)
+	}
+	listener := &httpListener{
+		address: address,
+		mutex:   &sync.RWMutex{},
+		routes:  make(map[string]*httpRoute),
+		modtime: time.Now(),
+		owned:   true,
+		done:    make(chan struct{}),
+	}
+	listener.server = &http.Server{
+		Handler: listener,
+	}
+	listener.listener = l
+	go func() {
+		defer close(listener.done)
+		if err := listener.server.Serve(l); err != http.ErrServerClosed {
+			listener.err = err // it wasn't a clean shutdown
+		}
+	}()
+	obj.listeners[address] = listener
+	return listener, nil
+}
+
+// Release gives up the use of a listener. If no other resource acquires it in
+// the next little while, then it gets shutdown gracefully.
+func (obj *httpRegistry) Release(listener *httpListener) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+
+	listener.owned = false
+	listener.timer = time.AfterFunc(HTTPServerLinger*time.Second, func() {
+		obj.mutex.Lock()
+		if listener.owned || obj.listeners[listener.address] != listener {
+			obj.mutex.Unlock() // it was taken over, or it already failed
+			return
+		}
+		delete(obj.listeners, listener.address)
+		// stop listening before we unlock, so the address is free for
+		// the next Acquire, while the open connections get to finish
+		listener.listener.Close() // ignore the error
+		obj.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), HTTPServerShutdownTimeout*time.Second)
+		defer cancel()
+		listener.server.Shutdown(ctx) // errors if it was forced to close
+	})
+}
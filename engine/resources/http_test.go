@@ -0,0 +1,176 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestHTTPGroupCmp(t *testing.T) {
+	s1, _ := engine.NewNamedResource("http:server", "server1")
+	s2, _ := engine.NewNamedResource("http:server", "server2")
+	f1, _ := engine.NewNamedResource("http:file", "/index.html")
+	f1.(*HTTPFileRes).Server = "server1"
+
+	server1 := s1.(engine.GroupableRes)
+	server2 := s2.(engine.GroupableRes)
+	file1 := f1.(engine.GroupableRes)
+
+	if err := server1.GroupCmp(file1); err != nil {
+		t.Errorf("file should group into its server: %v", err)
+	}
+	if err := server2.GroupCmp(file1); err == nil {
+		t.Errorf("file should not group into a different server")
+	}
+	if err := file1.GroupCmp(server1); err == nil {
+		t.Errorf("server should not group into a file")
+	}
+	if err := server1.GroupCmp(server2); err == nil {
+		t.Errorf("servers should not group together")
+	}
+}
+
+// httpGet returns the status code and body from a request to the handler.
+func httpGet(handler http.Handler, p string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHTTPServerSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-http-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(filename, []byte("hello from disk\n"), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+
+	// the server we'd have before a graph switch...
+	r1 := &HTTPServerRes{Address: "127.0.0.1:0"}
+	r1.SetName("server1")
+	f1 := &HTTPFileRes{Server: "server1", Path: "/index.html", Data: "hello world\n"}
+	if err := r1.GroupRes(f1); err != nil {
+		t.Errorf("grouping failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	listener, err := httpServers.Acquire(r1.Address)
+	if err != nil {
+		t.Errorf("acquire failed with: %v", err)
+		return
+	}
+	r1.listener = listener
+
+	if checkOK, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	} else if checkOK {
+		t.Errorf("checkapply should have swapped the routes")
+	}
+	if checkOK, err := r1.CheckApply(false); err != nil {
+		t.Errorf("check failed with: %v", err)
+	} else if !checkOK {
+		t.Errorf("check should have passed after apply")
+	}
+	if code, body := httpGet(listener, "/index.html"); code != http.StatusOK || body != "hello world\n" {
+		t.Errorf("unexpected response: %d: %s", code, body)
+	}
+
+	// ...and the server we'd have after it, which takes over the listener
+	httpServers.Release(listener)
+	r2 := &HTTPServerRes{Address: "127.0.0.1:0"}
+	r2.SetName("server1")
+	f2 := &HTTPFileRes{Server: "server1", Path: "/hello.txt", Filename: filename}
+	if err := r2.GroupRes(f2); err != nil {
+		t.Errorf("grouping failed with: %v", err)
+		return
+	}
+	if err := r2.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	l, err := httpServers.Acquire(r2.Address)
+	if err != nil {
+		t.Errorf("acquire failed with: %v", err)
+		return
+	}
+	defer httpServers.Release(l)
+	if l != listener {
+		t.Errorf("the listener should have been reused")
+	}
+	wait := httpServers.wait
+	httpServers.wait = 200 * time.Millisecond
+	if _, err := httpServers.Acquire(r2.Address); err == nil {
+		t.Errorf("the listener should not be acquired twice")
+	}
+	httpServers.wait = wait
+	r2.listener = l
+
+	if _, err := r2.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	if code, body := httpGet(l, "/hello.txt"); code != http.StatusOK || body != "hello from disk\n" {
+		t.Errorf("unexpected response: %d: %s", code, body)
+	}
+	if code, _ := httpGet(l, "/index.html"); code != http.StatusNotFound {
+		t.Errorf("the old route should have been removed, got: %d", code)
+	}
+}
+
+func TestHTTPServerAcquireWait(t *testing.T) {
+	address := "localhost:0"
+	old, err := httpServers.Acquire(address)
+	if err != nil {
+		t.Errorf("acquire failed with: %v", err)
+		return
+	}
+
+	// the old server is released a little after the new one starts
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		httpServers.Release(old)
+	}()
+	l, err := httpServers.Acquire(address)
+	if err != nil {
+		t.Errorf("acquire should have waited for the release: %v", err)
+		return
+	}
+	defer httpServers.Release(l)
+	if l != old {
+		t.Errorf("the listener should have been reused")
+	}
+}
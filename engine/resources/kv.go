@@ -18,7 +18,10 @@
 package resources
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
 
 	"github.com/purpleidea/mgmt/engine"
@@ -48,11 +51,16 @@ const (
 // which have monotonically increasing state values that represent progression.
 // The one exception is that when this resource receives a refresh signal, then
 // it will set the value to be the exact one if they are not identical already.
+// The value can be attached to the lease of this host with a TTL, so that it
+// gets removed when the host dies, and it can be set with a compare-and-swap on
+// the previous value. Together these can be used for leader markers and for
+// ephemeral registration. The effective stored value is sent via Send/Recv.
 type KVRes struct {
 	traits.Base // add the base methods without re-implementation
 	//traits.Groupable // TODO: it could be useful to group our writes and watches!
 	traits.Refreshable
 	traits.Recvable
+	traits.Sendable
 
 	init *engine.Init
 
@@ -62,6 +70,22 @@ type KVRes struct {
 	SkipLessThan bool              `yaml:"skiplessthan"` // skip updates as long as stored value is greater
 	SkipCmpStyle KVResSkipCmpStyle `yaml:"skipcmpstyle"` // how to do the less than cmp
 	// TODO: does it make sense to have different backends here? (eg: local)
+
+	// Global stores the value in the global namespace which is shared by
+	// all the hosts, instead of under the identity of this host.
+	Global bool `yaml:"global"`
+	// TTL is the number of seconds that the value outlives this host. Zero
+	// keeps it forever.
+	TTL uint32 `yaml:"ttl"`
+	// Prev is the value which must be stored for the value to be set. An
+	// empty string requires the key to be absent. If another value is stored
+	// then this resource leaves it alone, and sends that value instead.
+	Prev *string `yaml:"prev"`
+	// JSON specifies that the values are JSON documents, which are compared
+	// by their content instead of their formatting.
+	JSON bool `yaml:"json"`
+
+	leased bool // did we attach the stored value to our lease?
 }
 
 // Default returns some sensible defaults for this resource.
@@ -84,6 +108,20 @@ func (obj *KVRes) Validate() error {
 				return fmt.Errorf("the set value of %v can't convert to int", v)
 			}
 		}
+		if obj.Prev != nil {
+			return fmt.Errorf("the SkipLessThan and Prev params can't be combined")
+		}
+		if obj.JSON {
+			return fmt.Errorf("the SkipLessThan and JSON params can't be combined")
+		}
+	}
+	if obj.JSON {
+		if v := obj.Value; v != nil && !json.Valid([]byte(*v)) {
+			return fmt.Errorf("the value is not valid JSON")
+		}
+		if v := obj.Prev; v != nil && *v != "" && !json.Valid([]byte(*v)) {
+			return fmt.Errorf("the prev value is not valid JSON")
+		}
 	}
 	return nil
 }
@@ -91,6 +129,7 @@ func (obj *KVRes) Validate() error {
 // Init initializes the resource.
 func (obj *KVRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
+	obj.leased = false
 
 	return nil
 }
@@ -108,7 +147,14 @@ func (obj *KVRes) Watch() error {
 		return err // exit if requested
 	}
 
-	ch := obj.init.World.StrMapWatch(obj.Key) // get possible events!
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
+	var ch chan error
+	if obj.Global {
+		ch = obj.init.World.StrWatch(ctx, obj.Key) // get possible events!
+	} else {
+		ch = obj.init.World.StrMapWatch(ctx, obj.Key) // get possible events!
+	}
 
 	var send = false // send event?
 	for {
@@ -184,7 +230,93 @@ func (obj *KVRes) lessThanCheck(value string) (checkOK bool, err error) {
 	return false, nil
 }
 
-// CheckApply method for Password resource. Does nothing, returns happy!
+// get returns the stored value, and whether it exists.
+func (obj *KVRes) get() (string, bool, error) {
+	if obj.Global {
+		value, err := obj.init.World.StrGet(obj.Key)
+		if obj.init.World.StrIsNotExist(err) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, errwrap.Wrapf(err, "check error during StrGet")
+		}
+		return value, true, nil
+	}
+
+	hostname := obj.init.Hostname // me
+	keyMap, err := obj.init.World.StrMapGet(obj.Key)
+	if err != nil {
+		return "", false, errwrap.Wrapf(err, "check error during StrGet")
+	}
+	value, exists := keyMap[hostname]
+	return value, exists, nil
+}
+
+// set stores the value with the given previous value for the compare-and-swap.
+// It returns false if the comparison failed.
+func (obj *KVRes) set(value string, prev *string) (bool, error) {
+	opts := &engine.StrOpts{
+		TTL:  int64(obj.TTL),
+		Prev: prev,
+	}
+	if obj.Global {
+		ok, err := obj.init.World.StrSetOpts(obj.Key, value, opts)
+		return ok, errwrap.Wrapf(err, "apply error during StrSet")
+	}
+	ok, err := obj.init.World.StrMapSetOpts(obj.Key, value, opts)
+	return ok, errwrap.Wrapf(err, "apply error during StrSet")
+}
+
+// del deletes the stored value.
+func (obj *KVRes) del() error {
+	if obj.Global {
+		return errwrap.Wrapf(obj.init.World.StrDel(obj.Key), "apply error during StrDel")
+	}
+	return errwrap.Wrapf(obj.init.World.StrMapDel(obj.Key), "apply error during StrDel")
+}
+
+// value returns the value to store. JSON values are stored in their compact
+// form, with the keys of each object in sorted order.
+func (obj *KVRes) value() (string, error) {
+	if !obj.JSON {
+		return *obj.Value, nil
+	}
+	var x interface{}
+	if err := json.Unmarshal([]byte(*obj.Value), &x); err != nil {
+		return "", errwrap.Wrapf(err, "the value is not valid JSON")
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "could not encode the value")
+	}
+	return string(b), nil
+}
+
+// equal returns true if the two values are the same. JSON values are compared
+// by their content.
+func (obj *KVRes) equal(x, y string) bool {
+	if x == y || !obj.JSON {
+		return x == y
+	}
+	var a, b interface{}
+	if err := json.Unmarshal([]byte(x), &a); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(y), &b); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// send sends the effective stored value, which is nil if there isn't one.
+func (obj *KVRes) send(value string, exists bool) error {
+	if !exists {
+		return obj.init.Send(&KVSends{Value: nil})
+	}
+	return obj.init.Send(&KVSends{Value: &value})
+}
+
+// CheckApply method for KV resource. It sets the stored value to the requested
+// one, and sends the effective stored value.
 func (obj *KVRes) CheckApply(apply bool) (checkOK bool, err error) {
 	obj.init.Logf("CheckApply(%t)", apply)
 
@@ -193,40 +325,74 @@ func (obj *KVRes) CheckApply(apply bool) (checkOK bool, err error) {
 		obj.init.Logf("CheckApply: `Value` was updated!")
 	}
 
-	hostname := obj.init.Hostname // me
-	keyMap, err := obj.init.World.StrMapGet(obj.Key)
+	stored, exists, err := obj.get()
 	if err != nil {
-		return false, errwrap.Wrapf(err, "check error during StrGet")
+		return false, err
 	}
 
-	if value, ok := keyMap[hostname]; ok && obj.Value != nil {
-		if value == *obj.Value {
-			return true, nil
+	if obj.Value == nil { // delete
+		if !exists {
+			return true, obj.send("", false) // nothing to delete, we're good!
+		}
+		if !apply {
+			return false, nil
 		}
+		if err := obj.del(); err != nil {
+			return false, err
+		}
+		obj.leased = false
+		return false, obj.send("", false)
+	}
 
-		if c, err := obj.lessThanCheck(value); err != nil {
+	value, err := obj.value()
+	if err != nil {
+		return false, err
+	}
+
+	// with a TTL, the stored value might not be attached to our lease yet
+	var prev = obj.Prev
+	if exists && obj.equal(stored, value) {
+		if obj.TTL == 0 || obj.leased {
+			return true, obj.send(stored, true)
+		}
+		prev = &stored // only attach it to our lease
+
+	} else if exists && obj.Prev == nil {
+		if c, err := obj.lessThanCheck(stored); err != nil {
 			return false, err
 		} else if c {
-			return true, nil
+			return true, obj.send(stored, true)
 		}
 
-	} else if !ok && obj.Value == nil {
-		return true, nil // nothing to delete, we're good!
-
-	} else if ok && obj.Value == nil { // delete
-		err := obj.init.World.StrMapDel(obj.Key)
-		return false, errwrap.Wrapf(err, "apply error during StrDel")
+	} else if p := obj.Prev; p != nil {
+		if exists && !obj.equal(stored, *p) || !exists && *p != "" {
+			// someone else owns the key, so we can't change it
+			obj.init.Logf("CheckApply: the stored value doesn't match prev")
+			return true, obj.send(stored, exists)
+		}
+		if exists {
+			prev = &stored // it might be formatted differently
+		}
 	}
 
 	if !apply {
 		return false, nil
 	}
 
-	if err := obj.init.World.StrMapSet(obj.Key, *obj.Value); err != nil {
-		return false, errwrap.Wrapf(err, "apply error during StrSet")
+	ok, err := obj.set(value, prev)
+	if err != nil {
+		return false, err
+	}
+	if !ok { // we lost a race with someone else who set it
+		obj.init.Logf("CheckApply: the compare-and-swap failed")
+		if stored, exists, err = obj.get(); err != nil {
+			return false, err
+		}
+		return true, obj.send(stored, exists)
 	}
+	obj.leased = obj.TTL > 0
 
-	return false, nil
+	return false, obj.send(value, true)
 }
 
 // Cmp compares two resources and returns an error if they are not equivalent.
@@ -262,6 +428,23 @@ func (obj *KVRes) Compare(r engine.Res) bool {
 	if obj.SkipCmpStyle != res.SkipCmpStyle {
 		return false
 	}
+	if obj.Global != res.Global {
+		return false
+	}
+	if obj.TTL != res.TTL {
+		return false
+	}
+	if (obj.Prev == nil) != (res.Prev == nil) { // xor
+		return false
+	}
+	if obj.Prev != nil && res.Prev != nil {
+		if *obj.Prev != *res.Prev {
+			return false
+		}
+	}
+	if obj.JSON != res.JSON {
+		return false
+	}
 
 	return true
 }
@@ -282,6 +465,19 @@ func (obj *KVRes) UIDs() []engine.ResUID {
 	return []engine.ResUID{x}
 }
 
+// KVSends is the struct of data which is sent after a successful Apply.
+type KVSends struct {
+	// Value is the effective stored value, which is nil if there isn't one.
+	Value *string
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *KVRes) Sends() interface{} {
+	return &KVSends{
+		Value: nil,
+	}
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct.
 // It is primarily useful for setting the defaults.
 func (obj *KVRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -0,0 +1,243 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+// kvFakeWorld is an in memory world which only implements the string methods.
+type kvFakeWorld struct {
+	engine.World // panic on the other methods
+
+	hostname string
+	strings  map[string]string
+	ttls     map[string]int64 // keys which are attached to a lease
+}
+
+func (obj *kvFakeWorld) StrIsNotExist(err error) bool {
+	return err == errKVFakeNotExist
+}
+
+var errKVFakeNotExist = fmt.Errorf("errNotExist")
+
+func (obj *kvFakeWorld) StrGet(namespace string) (string, error) {
+	value, exists := obj.strings[namespace]
+	if !exists {
+		return "", errKVFakeNotExist
+	}
+	return value, nil
+}
+
+func (obj *kvFakeWorld) StrSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	stored, exists := obj.strings[namespace]
+	if p := opts.Prev; p != nil && (*p == "" && exists || *p != "" && *p != stored) {
+		return false, nil
+	}
+	obj.strings[namespace] = value
+	delete(obj.ttls, namespace)
+	if opts.TTL > 0 {
+		obj.ttls[namespace] = opts.TTL
+	}
+	return true, nil
+}
+
+func (obj *kvFakeWorld) StrDel(namespace string) error {
+	delete(obj.strings, namespace)
+	delete(obj.ttls, namespace)
+	return nil
+}
+
+func (obj *kvFakeWorld) StrMapGet(namespace string) (map[string]string, error) {
+	result := make(map[string]string)
+	if value, exists := obj.strings[namespace+"/"+obj.hostname]; exists {
+		result[obj.hostname] = value
+	}
+	return result, nil
+}
+
+func (obj *kvFakeWorld) StrMapSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	return obj.StrSetOpts(namespace+"/"+obj.hostname, value, opts)
+}
+
+func (obj *kvFakeWorld) StrMapDel(namespace string) error {
+	return obj.StrDel(namespace + "/" + obj.hostname)
+}
+
+// kvFakeInit returns an init with the world and with a way to see what we sent.
+func kvFakeInit(t *testing.T, world *kvFakeWorld, sent **KVSends) *engine.Init {
+	init := fakeInit(t)
+	init.Hostname = world.hostname
+	init.World = world
+	init.Refresh = func() bool { return false }
+	init.Recv = func() map[string]*engine.Send { return nil }
+	init.Send = func(st interface{}) error {
+		x, ok := st.(*KVSends)
+		if !ok {
+			return fmt.Errorf("unexpected sends: %T", st)
+		}
+		*sent = x
+		return nil
+	}
+	return init
+}
+
+func kvStrPtr(s string) *string { return &s }
+
+func TestKVValidate(t *testing.T) {
+	tests := []struct {
+		res *KVRes
+		ok  bool
+	}{
+		{&KVRes{Key: "hello", Value: kvStrPtr("world")}, true},
+		{&KVRes{Key: "leader", Value: kvStrPtr("h1"), Global: true, TTL: 10, Prev: kvStrPtr("")}, true},
+		{&KVRes{Key: "list", Value: kvStrPtr(`["a", "b"]`), JSON: true}, true},
+		{&KVRes{Value: kvStrPtr("world")}, false},
+		{&KVRes{Key: "count", Value: kvStrPtr("x"), SkipLessThan: true}, false},
+		{&KVRes{Key: "count", Value: kvStrPtr("42"), SkipLessThan: true, Prev: kvStrPtr("41")}, false},
+		{&KVRes{Key: "list", Value: kvStrPtr(`["a", `), JSON: true}, false},
+		{&KVRes{Key: "list", Value: kvStrPtr(`[]`), Prev: kvStrPtr("{"), JSON: true}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.res.Validate(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestKVCheckApply(t *testing.T) {
+	world := &kvFakeWorld{
+		hostname: "h1",
+		strings:  make(map[string]string),
+		ttls:     make(map[string]int64),
+	}
+	var sent *KVSends
+	res := &KVRes{
+		Key:   "config",
+		Value: kvStrPtr(`{"b": [1, 2], "a": true}`),
+		TTL:   10,
+		JSON:  true,
+	}
+	if err := res.Init(kvFakeInit(t, world, &sent)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	if s := world.strings["config/h1"]; s != `{"a":true,"b":[1,2]}` {
+		t.Errorf("the json value was not stored compactly: %s", s)
+	}
+	if world.ttls["config/h1"] != 10 {
+		t.Errorf("the value was not attached to a lease")
+	}
+	if sent == nil || sent.Value == nil || *sent.Value != `{"a":true,"b":[1,2]}` {
+		t.Errorf("the stored value was not sent: %+v", sent)
+	}
+
+	world.strings["config/h1"] = `{ "a": true, "b": [1, 2] }` // same content
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("checkapply did not converge: %t, %v", checkOK, err)
+	}
+
+	// after a restart, the value must be attached to our new lease
+	delete(world.ttls, "config/h1")
+	if err := res.Init(kvFakeInit(t, world, &sent)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	if world.ttls["config/h1"] != 10 {
+		t.Errorf("the value was not attached to the lease")
+	}
+
+	res.Value = nil
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	if _, exists := world.strings["config/h1"]; exists || sent.Value != nil {
+		t.Errorf("the value was not deleted")
+	}
+}
+
+func TestKVCompareAndSwap(t *testing.T) {
+	world := &kvFakeWorld{
+		hostname: "h1",
+		strings:  make(map[string]string),
+		ttls:     make(map[string]int64),
+	}
+	var sent *KVSends
+	leader := func(hostname string) *KVRes {
+		res := &KVRes{
+			Key:    "leader",
+			Value:  kvStrPtr(hostname),
+			Global: true,
+			TTL:    10,
+			Prev:   kvStrPtr(""), // only if there isn't one
+		}
+		world.hostname = hostname
+		if err := res.Init(kvFakeInit(t, world, &sent)); err != nil {
+			t.Fatalf("init failed with: %v", err)
+		}
+		return res
+	}
+
+	h1 := leader("h1")
+	if checkOK, err := h1.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	h2 := leader("h2")
+	for _, apply := range []bool{false, true} {
+		if checkOK, err := h2.CheckApply(apply); err != nil || !checkOK {
+			t.Errorf("checkapply(%t) returned: %t, %v", apply, checkOK, err)
+		}
+	}
+	if world.strings["leader"] != "h1" {
+		t.Errorf("the leader was replaced: %s", world.strings["leader"])
+	}
+	if sent == nil || sent.Value == nil || *sent.Value != "h1" {
+		t.Errorf("the effective value was not sent: %+v", sent)
+	}
+
+	delete(world.strings, "leader") // the lease of h1 expired
+	if checkOK, err := h2.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	if world.strings["leader"] != "h2" {
+		t.Errorf("the leader was not taken over: %s", world.strings["leader"])
+	}
+
+	// swap on a specific previous value
+	h2.Value = kvStrPtr("h3")
+	h2.Prev = kvStrPtr("h2")
+	if checkOK, err := h2.CheckApply(true); err != nil || checkOK {
+		t.Errorf("checkapply returned: %t, %v", checkOK, err)
+	}
+	if world.strings["leader"] != "h3" {
+		t.Errorf("the value was not swapped: %s", world.strings["leader"])
+	}
+}
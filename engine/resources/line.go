@@ -0,0 +1,564 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// LineMarkerDefault is the default marker used to delimit a managed
+	// block. The {mark} string gets replaced with the begin and end words,
+	// and the {name} string gets replaced with the resource name.
+	LineMarkerDefault = "# {mark} MGMT MANAGED BLOCK {name}"
+	// LineMarkerBegin is the word that starts a managed block.
+	LineMarkerBegin = "BEGIN"
+	// LineMarkerEnd is the word that ends a managed block.
+	LineMarkerEnd = "END"
+)
+
+func init() {
+	engine.RegisterResource("line", func() engine.Res { return &LineRes{} })
+}
+
+// LineRes is a resource which manages individual lines, or blocks of lines,
+// inside of a file which is otherwise owned by someone else. It can ensure that
+// a line exists or is absent, that the lines matching a regular expression are
+// replaced, or that a block which is delimited by a pair of marker lines has the
+// requested contents. Everything else in the file is left alone.
+type LineRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Recvable
+
+	init *engine.Init
+
+	// Path is the absolute path of the file to edit.
+	Path string `yaml:"path"`
+	// State is either "exists" or "absent". It defaults to "exists".
+	State string `yaml:"state"`
+
+	// Line is the line to manage. If Match is not specified, then lines
+	// which are identical to this one are considered to match.
+	Line string `yaml:"line"`
+	// Match is a regular expression which selects the lines to manage. When
+	// the state is "exists", the last matching line gets replaced by Line.
+	// When the state is "absent", all the matching lines get removed.
+	Match string `yaml:"match"`
+	// Replace specifies that Line is a replacement template, which can use
+	// submatch references such as $1, and that every line which matches is
+	// rewritten with it. No line is ever inserted when this is used.
+	Replace bool `yaml:"replace"`
+
+	// Block is the content of a managed block. If it is specified, then the
+	// resource manages a block instead of a single line. The block is found
+	// by searching for the lines generated from Marker.
+	Block *string `yaml:"block"`
+	// Marker is the template for the lines which delimit a managed block.
+	// The {mark} string is replaced with BEGIN and END, and the {name}
+	// string is replaced with the resource name.
+	Marker string `yaml:"marker"`
+
+	// After is a regular expression, and new content is inserted after the
+	// last line which matches it. If nothing matches, then it is appended.
+	After string `yaml:"after"`
+	// Before is a regular expression, and new content is inserted before
+	// the first line which matches it. If nothing matches, then it is
+	// appended. It can't be used together with After.
+	Before string `yaml:"before"`
+
+	// Create specifies that the file should be created if it is missing. If
+	// it is false, then a missing file is an error, unless we are absent.
+	Create bool `yaml:"create"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *LineRes) Default() engine.Res {
+	return &LineRes{
+		State:  "exists",
+		Marker: LineMarkerDefault,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *LineRes) Validate() error {
+	if !strings.HasPrefix(obj.Path, "/") {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	if strings.HasSuffix(obj.Path, "/") {
+		return fmt.Errorf("the Path must be a file")
+	}
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("the State must be either `exists` or `absent`")
+	}
+	if strings.Contains(obj.Line, "\n") {
+		return fmt.Errorf("the Line must not contain newlines")
+	}
+	if obj.After != "" && obj.Before != "" {
+		return fmt.Errorf("can't specify both After and Before")
+	}
+
+	if obj.Block != nil {
+		if obj.Line != "" || obj.Match != "" || obj.Replace {
+			return fmt.Errorf("can't specify Line, Match or Replace with Block")
+		}
+		if !strings.Contains(obj.Marker, "{mark}") {
+			return fmt.Errorf("the Marker must contain `{mark}`")
+		}
+		if strings.Contains(obj.Marker, "\n") {
+			return fmt.Errorf("the Marker must not contain newlines")
+		}
+	} else if obj.Match == "" && obj.Line == "" {
+		return fmt.Errorf("must specify at least one of Line, Match or Block")
+	}
+
+	if obj.Replace && obj.Match == "" {
+		return fmt.Errorf("must specify Match when using Replace")
+	}
+	if obj.Replace && obj.State == "absent" {
+		return fmt.Errorf("can't use Replace when absent")
+	}
+
+	for _, x := range []string{obj.Match, obj.After, obj.Before} {
+		if x == "" {
+			continue
+		}
+		if _, err := regexp.Compile(x); err != nil {
+			return errwrap.Wrapf(err, "invalid regular expression `%s`", x)
+		}
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *LineRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *LineRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *LineRes) Watch() error {
+	recWatcher, err := recwatch.NewRecWatcher(obj.Path, false)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	var send = false // send event?
+	for {
+		if obj.init.Debug {
+			obj.init.Logf("Watching: %s", obj.Path) // attempting to watch...
+		}
+
+		select {
+		case event, ok := <-recWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+			obj.init.Dirty() // dirty
+
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			if err := obj.init.Event(); err != nil {
+				return err // exit if requested
+			}
+		}
+	}
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *LineRes) CheckApply(apply bool) (bool, error) {
+	b, err := ioutil.ReadFile(obj.Path)
+	exists := !os.IsNotExist(err)
+	if err != nil && exists {
+		return false, errwrap.Wrapf(err, "could not read file")
+	}
+	if !exists {
+		if obj.State == "absent" || obj.Replace {
+			return true, nil // nothing to remove or to rewrite
+		}
+		if !obj.Create {
+			return false, fmt.Errorf("the file `%s` does not exist", obj.Path)
+		}
+	}
+
+	data, err := obj.edit(string(b))
+	if err != nil {
+		return false, err
+	}
+	if exists && data == string(b) {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("editing: %s", obj.Path)
+	if !exists {
+		return false, ioutil.WriteFile(obj.Path, []byte(data), 0644)
+	}
+	// reuse the existing file so that the permissions and owner are kept
+	f, err := os.OpenFile(obj.Path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not open file")
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return false, errwrap.Wrapf(err, "could not write file")
+	}
+	return false, f.Close()
+}
+
+// edit takes the current file contents and returns the desired contents.
+func (obj *LineRes) edit(data string) (string, error) {
+	lines := lineSplit(data)
+
+	var after, before *regexp.Regexp
+	var err error
+	if obj.After != "" {
+		if after, err = regexp.Compile(obj.After); err != nil {
+			return "", err
+		}
+	}
+	if obj.Before != "" {
+		if before, err = regexp.Compile(obj.Before); err != nil {
+			return "", err
+		}
+	}
+
+	if obj.Block != nil {
+		begin, end := obj.markers()
+		block := lineSplit(*obj.Block)
+		lines, err = lineBlockEdit(lines, begin, end, block, obj.State == "exists", after, before)
+		if err != nil {
+			return "", err
+		}
+		return lineJoin(lines), nil
+	}
+
+	var match *regexp.Regexp
+	if obj.Match != "" {
+		if match, err = regexp.Compile(obj.Match); err != nil {
+			return "", err
+		}
+	}
+	lines = lineEdit(lines, obj.Line, match, obj.Replace, obj.State == "exists", after, before)
+	return lineJoin(lines), nil
+}
+
+// markers returns the begin and end marker lines for this resource.
+func (obj *LineRes) markers() (string, string) {
+	marker := strings.Replace(obj.Marker, "{name}", obj.Name(), -1)
+	begin := strings.Replace(marker, "{mark}", LineMarkerBegin, -1)
+	end := strings.Replace(marker, "{mark}", LineMarkerEnd, -1)
+	return strings.TrimSpace(begin), strings.TrimSpace(end)
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *LineRes) Cmp(r engine.Res) error {
+	res, ok := r.(*LineRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.Path != res.Path {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Line != res.Line {
+		return fmt.Errorf("the Line differs")
+	}
+	if obj.Match != res.Match {
+		return fmt.Errorf("the Match differs")
+	}
+	if obj.Replace != res.Replace {
+		return fmt.Errorf("the Replace param differs")
+	}
+	if (obj.Block == nil) != (res.Block == nil) { // xor
+		return fmt.Errorf("the Block differs")
+	}
+	if obj.Block != nil && res.Block != nil && *obj.Block != *res.Block {
+		return fmt.Errorf("the Block differs")
+	}
+	if obj.Marker != res.Marker {
+		return fmt.Errorf("the Marker differs")
+	}
+	if obj.After != res.After {
+		return fmt.Errorf("the After param differs")
+	}
+	if obj.Before != res.Before {
+		return fmt.Errorf("the Before param differs")
+	}
+	if obj.Create != res.Create {
+		return fmt.Errorf("the Create param differs")
+	}
+
+	return nil
+}
+
+// LineUID is the UID struct for LineRes.
+type LineUID struct {
+	engine.BaseUID
+
+	path string
+	name string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *LineUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*LineUID)
+	if !ok {
+		return false
+	}
+	return obj.path == res.path && obj.name == res.name
+}
+
+// AutoEdges returns the AutoEdge interface. It adds an edge from the file
+// resource which manages the same path, so that the file gets created first,
+// and the lines get edited afterwards. If there is no such file resource, then
+// it looks for the nearest parent directory instead.
+func (obj *LineRes) AutoEdges() (engine.AutoEdge, error) {
+	var data []engine.ResUID
+	for _, x := range util.PathSplitFullReversed(obj.Path) {
+		var reversed = true // cheat by passing a pointer
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x, // what matters
+		})
+	}
+	return &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}, nil
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *LineRes) UIDs() []engine.ResUID {
+	x := &LineUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    obj.Path,
+		name:    obj.Name(),
+	}
+	return []engine.ResUID{x}
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *LineRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes LineRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*LineRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to LineRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = LineRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// lineSplit splits file contents into a list of lines. The trailing newline is
+// not significant, and an empty string has no lines.
+func lineSplit(data string) []string {
+	if data == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+}
+
+// lineJoin is the inverse of lineSplit. Every line ends with a newline.
+func lineJoin(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// lineInsertIndex returns the index where new content should be inserted. It is
+// after the last line that matches after, or before the first line that matches
+// before. If neither of them is given or matches, the end of the list is used.
+func lineInsertIndex(lines []string, after, before *regexp.Regexp) int {
+	if after != nil {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if after.MatchString(lines[i]) {
+				return i + 1
+			}
+		}
+	}
+	if before != nil {
+		for i, x := range lines {
+			if before.MatchString(x) {
+				return i
+			}
+		}
+	}
+	return len(lines)
+}
+
+// lineInsert inserts the new lines at the index into a copy of the list.
+func lineInsert(lines []string, index int, insert ...string) []string {
+	result := []string{}
+	result = append(result, lines[:index]...)
+	result = append(result, insert...)
+	result = append(result, lines[index:]...)
+	return result
+}
+
+// lineEdit performs the single line edit on a list of lines and returns the
+// new list. If match is nil, then lines which are identical to line match.
+func lineEdit(lines []string, line string, match *regexp.Regexp, replace, exists bool, after, before *regexp.Regexp) []string {
+	matches := func(x string) bool {
+		if match == nil {
+			return x == line
+		}
+		return match.MatchString(x)
+	}
+
+	if !exists { // remove every match
+		result := []string{}
+		for _, x := range lines {
+			if !matches(x) {
+				result = append(result, x)
+			}
+		}
+		return result
+	}
+
+	if replace { // rewrite every match with the template
+		result := []string{}
+		for _, x := range lines {
+			if matches(x) {
+				x = match.ReplaceAllString(x, line)
+			}
+			result = append(result, x)
+		}
+		return result
+	}
+
+	for _, x := range lines { // is the exact line present already?
+		if x == line {
+			return lines
+		}
+	}
+
+	for i := len(lines) - 1; i >= 0; i-- { // replace the last match
+		if matches(lines[i]) {
+			result := append([]string{}, lines...)
+			result[i] = line
+			return result
+		}
+	}
+
+	return lineInsert(lines, lineInsertIndex(lines, after, before), line)
+}
+
+// lineBlockEdit performs the block edit on a list of lines and returns the new
+// list. An existing block is replaced in place, otherwise a new one is inserted.
+// If the begin marker is found without an end marker, then this errors, since
+// we can't know where the block stops, and we mustn't eat the rest of the file.
+func lineBlockEdit(lines []string, begin, end string, block []string, exists bool, after, before *regexp.Regexp) ([]string, error) {
+	start, stop := -1, -1
+	for i, x := range lines {
+		if start == -1 && strings.TrimSpace(x) == begin {
+			start = i
+			continue
+		}
+		if start != -1 && strings.TrimSpace(x) == end {
+			stop = i
+			break
+		}
+	}
+	if start != -1 && stop == -1 {
+		return nil, fmt.Errorf("found the begin marker `%s` without the end marker `%s`", begin, end)
+	}
+
+	insert := []string{}
+	if exists {
+		insert = append(insert, begin)
+		insert = append(insert, block...)
+		insert = append(insert, end)
+	}
+
+	if start == -1 { // not found
+		if !exists {
+			return lines, nil
+		}
+		return lineInsert(lines, lineInsertIndex(lines, after, before), insert...), nil
+	}
+
+	result := []string{}
+	result = append(result, lines[:start]...)
+	result = append(result, insert...)
+	result = append(result, lines[stop+1:]...)
+	return result, nil
+}
@@ -0,0 +1,237 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine/graph/autoedge"
+	"github.com/purpleidea/mgmt/pgraph"
+)
+
+func TestLineEdit(t *testing.T) {
+	block := "a\nb"
+	tests := []struct {
+		res  *LineRes
+		data string
+		out  string
+	}{
+		{ // append a missing line
+			res:  &LineRes{State: "exists", Line: "foo"},
+			data: "one\ntwo",
+			out:  "one\ntwo\nfoo\n",
+		},
+		{ // the line is already present
+			res:  &LineRes{State: "exists", Line: "two"},
+			data: "one\ntwo\nthree\n",
+			out:  "one\ntwo\nthree\n",
+		},
+		{ // remove all the identical lines
+			res:  &LineRes{State: "absent", Line: "two"},
+			data: "one\ntwo\nthree\ntwo\n",
+			out:  "one\nthree\n",
+		},
+		{ // replace the last matching line
+			res:  &LineRes{State: "exists", Line: "PermitRootLogin no", Match: "^#?PermitRootLogin "},
+			data: "#PermitRootLogin yes\nPort 22\nPermitRootLogin yes\n",
+			out:  "#PermitRootLogin yes\nPort 22\nPermitRootLogin no\n",
+		},
+		{ // remove all the matching lines
+			res:  &LineRes{State: "absent", Match: "^foo="},
+			data: "foo=1\nbar=2\nfoo=3\n",
+			out:  "bar=2\n",
+		},
+		{ // rewrite with a replacement template
+			res:  &LineRes{State: "exists", Line: "${1}=42", Match: "^(\\w+)=1$", Replace: true},
+			data: "foo=1\nbar=2\nbaz=1\n",
+			out:  "foo=42\nbar=2\nbaz=42\n",
+		},
+		{ // insert after the last anchor
+			res:  &LineRes{State: "exists", Line: "new", After: "^\\[main\\]$"},
+			data: "[main]\nx=1\n[main]\ny=2\n",
+			out:  "[main]\nx=1\n[main]\nnew\ny=2\n",
+		},
+		{ // insert before the first anchor
+			res:  &LineRes{State: "exists", Line: "new", Before: "^exit"},
+			data: "echo hi\nexit 0\n",
+			out:  "echo hi\nnew\nexit 0\n",
+		},
+		{ // add a new block
+			res:  &LineRes{State: "exists", Block: &block, Marker: "# {mark} {name}"},
+			data: "one\n",
+			out:  "one\n# BEGIN test\na\nb\n# END test\n",
+		},
+		{ // replace an existing block
+			res:  &LineRes{State: "exists", Block: &block, Marker: "# {mark} {name}"},
+			data: "one\n# BEGIN test\nold\n# END test\ntwo\n",
+			out:  "one\n# BEGIN test\na\nb\n# END test\ntwo\n",
+		},
+		{ // remove an existing block
+			res:  &LineRes{State: "absent", Block: &block, Marker: "# {mark} {name}"},
+			data: "one\n# BEGIN test\nold\n# END test\ntwo\n",
+			out:  "one\ntwo\n",
+		},
+	}
+	for i, test := range tests {
+		test.res.SetKind("line")
+		test.res.SetName("test")
+		test.res.Path = "/tmp/test"
+		if err := test.res.Validate(); err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+			continue
+		}
+		out, err := test.res.edit(test.data)
+		if err != nil {
+			t.Errorf("test #%d: edit failed with: %v", i, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("test #%d: unexpected output:\n%s", i, out)
+		}
+	}
+}
+
+func TestLineCheckApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-line-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "hosts")
+	if err := ioutil.WriteFile(p, []byte("127.0.0.1 localhost\n"), 0600); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+
+	r1 := &LineRes{
+		Path:  p,
+		State: "exists",
+		Line:  "192.168.1.1 router",
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	if checkOK, err := r1.CheckApply(false); err != nil {
+		t.Errorf("check failed with: %v", err)
+	} else if !checkOK {
+		t.Errorf("check should have passed after apply")
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Errorf("error reading file: %v", err)
+	} else if s := string(b); s != "127.0.0.1 localhost\n192.168.1.1 router\n" {
+		t.Errorf("unexpected file contents:\n%s", s)
+	}
+	if st, err := os.Stat(p); err != nil {
+		t.Errorf("error running stat: %v", err)
+	} else if m := st.Mode(); m != 0600 {
+		t.Errorf("file mode was changed to: %v", m)
+	}
+}
+
+func TestLineBlockNoEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-line-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "conf")
+	data := "one\n# BEGIN test\nold\ntwo\nthree\n" // no end marker
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+
+	block := "a"
+	for _, state := range []string{"exists", "absent"} {
+		r1 := &LineRes{
+			Path:   p,
+			State:  state,
+			Block:  &block,
+			Marker: "# {mark} {name}",
+		}
+		r1.SetKind("line")
+		r1.SetName("test")
+		if err := r1.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+		if err := r1.Init(fakeInit(t)); err != nil {
+			t.Errorf("init failed with: %v", err)
+			return
+		}
+		if _, err := r1.CheckApply(true); err == nil {
+			t.Errorf("checkapply with state %s should have failed without the end marker", state)
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("error reading file: %v", err)
+		} else if s := string(b); s != data {
+			t.Errorf("file was changed with state %s:\n%s", state, s)
+		}
+	}
+}
+
+func TestLineAutoEdge1(t *testing.T) {
+	g, err := pgraph.NewGraph("TestGraph")
+	if err != nil {
+		t.Errorf("error creating graph: %v", err)
+		return
+	}
+
+	r1 := &FileRes{
+		Path: "/etc/hosts",
+	}
+	r2 := &LineRes{
+		Path: "/etc/hosts",
+		Line: "192.168.1.1 router",
+	}
+	g.AddVertex(r1, r2)
+
+	debug := testing.Verbose() // set via the -test.v flag to `go test`
+	logf := func(format string, v ...interface{}) {
+		t.Logf("test: "+format, v...)
+	}
+	// run artificially without the entire engine
+	if err := autoedge.AutoEdge(g, debug, logf); err != nil {
+		t.Errorf("error running autoedges: %v", err)
+	}
+
+	if i := g.NumEdges(); i != 1 {
+		t.Errorf("should have 1 edge instead of: %d", i)
+	}
+}
@@ -23,7 +23,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unsafe"
@@ -52,6 +55,9 @@ const (
 	procFilesystems = "/proc/filesystems"
 	// procPath is the path to /proc/mounts which contains all active mounts.
 	procPath = "/proc/mounts"
+	// procMountInfo is the path to the mountinfo file, which also contains
+	// the source directory of bind mounts.
+	procMountInfo = "/proc/self/mountinfo"
 	// fstabPath is the path to the fstab file which defines mounts.
 	fstabPath = "/etc/fstab"
 	// fstabUmask is the umask (permissions) used to edit /etc/fstab.
@@ -83,6 +89,9 @@ const (
 	dbusSystemd1Interface = "org.freedesktop.systemd1"
 	// dbusMountInterface is used as an argument to filter dbus messages.
 	dbusMountInterface = dbusSystemd1Interface + ".Mount"
+	// dbusAutomountInterface is used as an argument to filter dbus messages
+	// from automount units.
+	dbusAutomountInterface = dbusSystemd1Interface + ".Automount"
 	// dbusManagerInterface is the systemd manager interface used for
 	// interfacing with systemd units.
 	dbusManagerInterface = dbusSystemd1Interface + ".Manager"
@@ -96,11 +105,17 @@ const (
 	dbusSignalJobRemoved = "JobRemoved"
 )
 
+// mountNetworkTypes are the filesystem types which need the network, so they
+// are mounted by remote-fs.target instead of local-fs.target.
+var mountNetworkTypes = []string{"nfs", "nfs4", "cifs", "smb3", "ceph", "glusterfs", "sshfs"}
+
 // MountRes is a systemd mount resource that adds/removes entries from
 // /etc/fstab, and makes sure the defined device is mounted or unmounted
-// accordingly. The mount point is set according to the resource's name.
+// accordingly. The mount point is set according to the resource's name. It can
+// also write native systemd mount units instead of the fstab entry.
 type MountRes struct {
 	traits.Base
+	traits.Edgeable
 
 	init *engine.Init
 
@@ -112,6 +127,28 @@ type MountRes struct {
 	Freq    int               `yaml:"freq"`    // dump frequency
 	PassNo  int               `yaml:"passno"`  // verification order
 
+	// Bind makes this a bind mount of the Device, which is a directory. The
+	// Type should be left empty.
+	Bind bool `yaml:"bind"`
+	// Size is the maximum size of a tmpfs mount, eg: 512m or 10%.
+	Size string `yaml:"size"`
+	// Mode is the permissions of the root directory of a tmpfs mount, eg:
+	// 1777.
+	Mode string `yaml:"mode"`
+
+	// Automount mounts the filesystem on the first access to the mount
+	// point, with a systemd automount unit.
+	Automount bool `yaml:"automount"`
+	// IdleTimeout is the number of seconds after which an unused automount
+	// gets unmounted again. Zero means never.
+	IdleTimeout int `yaml:"idletimeout"`
+
+	// Units writes native systemd mount units instead of an fstab entry.
+	Units bool `yaml:"units"`
+	// UnitDir is the directory where the units go. It is mostly useful for
+	// testing. It defaults to SvcUnitDir.
+	UnitDir string `yaml:"unitdir"`
+
 	mount *fstab.Mount // struct representing the mount
 }
 
@@ -142,10 +179,18 @@ func (obj *MountRes) Validate() error {
 			fsSlice = append(fsSlice[:i], fsSlice[i+1:]...)
 		}
 	}
-	if obj.State != "absent" && !util.StrInList(obj.Type, fsSlice) {
+	if obj.Bind {
+		if obj.Type != "" && obj.Type != "none" {
+			return fmt.Errorf("a bind mount can't have a type")
+		}
+	} else if obj.State != "absent" && !util.StrInList(obj.Type, fsSlice) {
 		return fmt.Errorf("type must be a valid filesystem type (see /proc/filesystems)")
 	}
 
+	if err := obj.validateOptions(); err != nil {
+		return err
+	}
+
 	// validate mountpoint
 	if strings.Contains(obj.Name(), "//") {
 		return fmt.Errorf("double slashes are not allowed in resource name")
@@ -154,7 +199,10 @@ func (obj *MountRes) Validate() error {
 		return errwrap.Wrapf(err, "error validating mount point: %s", obj.Name())
 	}
 
-	// validate device
+	// validate device, but a tmpfs doesn't have one
+	if obj.Type == "tmpfs" && (obj.Device == "" || obj.Device == "tmpfs") {
+		return nil
+	}
 	device, err := evalSpec(obj.Device) // eval symlink
 	if err != nil {
 		return errwrap.Wrapf(err, "error evaluating spec: %s", obj.Device)
@@ -165,19 +213,163 @@ func (obj *MountRes) Validate() error {
 	return nil
 }
 
+// validateOptions checks the params which don't depend on the system.
+func (obj *MountRes) validateOptions() error {
+	if obj.Bind && !strings.HasPrefix(obj.Device, "/") {
+		return fmt.Errorf("the device of a bind mount must be an absolute path")
+	}
+	if obj.Type != "tmpfs" && (obj.Size != "" || obj.Mode != "") {
+		return fmt.Errorf("only a tmpfs mount can have a size or a mode")
+	}
+	if obj.Mode != "" {
+		if _, err := strconv.ParseUint(obj.Mode, 8, 32); err != nil || len(obj.Mode) < 3 || len(obj.Mode) > 4 {
+			return fmt.Errorf("the mode must be octal, eg: 1777")
+		}
+	}
+	if obj.IdleTimeout < 0 {
+		return fmt.Errorf("the idle timeout can't be negative")
+	}
+	if obj.IdleTimeout > 0 && !obj.Automount {
+		return fmt.Errorf("only an automount can have an idle timeout")
+	}
+	if obj.Units && (obj.Freq != 0 || obj.PassNo != 0) {
+		return fmt.Errorf("freq and passno are only used in fstab")
+	}
+	if obj.UnitDir != "" && !strings.HasPrefix(obj.UnitDir, "/") {
+		return fmt.Errorf("unit dir must be absolute")
+	}
+	return nil
+}
+
 // Init runs some startup code for this resource.
 func (obj *MountRes) Init(init *engine.Init) error {
 	obj.init = init //save for later
 
-	obj.mount = &fstab.Mount{
-		Spec:    obj.Device,
+	obj.mount = obj.fstabMount()
+	return nil
+}
+
+// fstabMount builds the fstab entry of the mount from the definition.
+func (obj *MountRes) fstabMount() *fstab.Mount {
+	spec := obj.Device
+	if spec == "" && obj.Type == "tmpfs" {
+		spec = "tmpfs"
+	}
+	vfsType := obj.Type
+	if obj.Bind {
+		vfsType = "none"
+	}
+	return &fstab.Mount{
+		Spec:    spec,
 		File:    obj.Name(),
-		VfsType: obj.Type,
-		MntOps:  obj.Options,
+		VfsType: vfsType,
+		MntOps:  obj.mntOps(!obj.Units),
 		Freq:    obj.Freq,
 		PassNo:  obj.PassNo,
 	}
-	return nil
+}
+
+// mntOps returns the mount options with the ones that the other params add.
+// The automount options are only used in fstab, since the units have their own
+// automount unit.
+func (obj *MountRes) mntOps(fstab bool) map[string]string {
+	if !obj.Bind && obj.Size == "" && obj.Mode == "" && !(fstab && obj.Automount) {
+		return obj.Options
+	}
+	ops := make(map[string]string)
+	for k, v := range obj.Options {
+		ops[k] = v
+	}
+	if obj.Bind {
+		ops["bind"] = ""
+	}
+	if obj.Size != "" {
+		ops["size"] = obj.Size
+	}
+	if obj.Mode != "" {
+		ops["mode"] = obj.Mode
+	}
+	if fstab && obj.Automount {
+		ops["x-systemd.automount"] = ""
+		if obj.IdleTimeout > 0 {
+			ops["x-systemd.idle-timeout"] = strconv.Itoa(obj.IdleTimeout)
+		}
+	}
+	return ops
+}
+
+// unitName returns the name of the systemd unit of the mount point, with the
+// given suffix, eg: .mount or .automount.
+func (obj *MountRes) unitName(suffix string) string {
+	return unit.UnitNamePathEscape(obj.Name()) + suffix
+}
+
+// unitDir returns the directory that contains the units.
+func (obj *MountRes) unitDir() string {
+	if obj.UnitDir != "" {
+		return obj.UnitDir
+	}
+	return SvcUnitDir
+}
+
+// target returns the systemd target that the mount is wanted by.
+func (obj *MountRes) target() string {
+	if _, exists := obj.Options["_netdev"]; exists || util.StrInList(obj.Type, mountNetworkTypes) {
+		return "remote-fs.target"
+	}
+	return "local-fs.target"
+}
+
+// unitFiles returns the contents of the units, indexed by path. It's empty
+// unless the units are used, and the mount exists.
+func (obj *MountRes) unitFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	if !obj.Units || obj.State != "exists" {
+		return files, nil
+	}
+	m := obj.fstabMount()
+	what, err := specPath(m.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if m.Spec == "tmpfs" {
+		what = m.Spec // not a path
+	}
+	u := "# This file is managed by mgmt.\n\n"
+	u += "[Mount]\n"
+	u += fmt.Sprintf("What=%s\n", what)
+	u += fmt.Sprintf("Where=%s\n", m.File)
+	if m.VfsType != "" {
+		u += fmt.Sprintf("Type=%s\n", m.VfsType)
+	}
+	if len(m.MntOps) > 0 {
+		u += fmt.Sprintf("Options=%s\n", mntOpsString(m.MntOps))
+	}
+	if !obj.Automount { // the automount unit gets enabled instead
+		u += fmt.Sprintf("\n[Install]\nWantedBy=%s\n", obj.target())
+	}
+	files[path.Join(obj.unitDir(), obj.unitName(".mount"))] = u
+
+	if obj.Automount {
+		u := "# This file is managed by mgmt.\n\n"
+		u += "[Automount]\n"
+		u += fmt.Sprintf("Where=%s\n", m.File)
+		if obj.IdleTimeout > 0 {
+			u += fmt.Sprintf("TimeoutIdleSec=%d\n", obj.IdleTimeout)
+		}
+		u += fmt.Sprintf("\n[Install]\nWantedBy=%s\n", obj.target())
+		files[path.Join(obj.unitDir(), obj.unitName(".automount"))] = u
+	}
+	return files, nil
+}
+
+// primaryUnit returns the unit which gets enabled and started, which is the
+// automount unit if there is one.
+func (obj *MountRes) primaryUnit() string {
+	if obj.Automount {
+		return obj.unitName(".automount")
+	}
+	return obj.unitName(".mount")
 }
 
 // Close is run by the engine to clean up after the resource is done.
@@ -210,14 +402,30 @@ func (obj *MountRes) Watch() error {
 	}
 	defer conn.BusObject().Call(engineUtil.DBusRemoveMatch, 0, args) // ignore the error
 
+	// and from the automount unit, if there is one
+	if obj.Automount {
+		args := fmt.Sprintf("type='signal', path='%s', arg0='%s'",
+			dbusUnitPath+sdbus.PathBusEscape(obj.unitName(".automount")),
+			dbusAutomountInterface,
+		)
+		if call := conn.BusObject().Call(engineUtil.DBusAddMatch, 0, args); call.Err != nil {
+			return errwrap.Wrapf(call.Err, "error creating dbus call")
+		}
+		defer conn.BusObject().Call(engineUtil.DBusRemoveMatch, 0, args) // ignore the error
+	}
+
 	ch := make(chan *dbus.Signal)
 	defer close(ch)
 
 	conn.Signal(ch)
 	defer conn.RemoveSignal(ch)
 
-	// watch the fstab file
-	recWatcher, err := recwatch.NewRecWatcher(fstabPath, false)
+	// watch the fstab file, or the unit dir
+	watchPath := fstabPath
+	if obj.Units {
+		watchPath = obj.unitDir()
+	}
+	recWatcher, err := recwatch.NewRecWatcher(watchPath, false)
 	if err != nil {
 		return err
 	}
@@ -244,6 +452,9 @@ func (obj *MountRes) Watch() error {
 			if err := event.Error; err != nil {
 				return errwrap.Wrapf(err, "unknown recwatcher error")
 			}
+			if name := path.Base(event.Body.Name); obj.Units && name != obj.unitName(".mount") && name != obj.unitName(".automount") {
+				continue // some other unit
+			}
 			if obj.init.Debug {
 				obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
 			}
@@ -315,10 +526,129 @@ func (obj *MountRes) fstabCheckApply(apply bool) (checkOK bool, err error) {
 	return false, nil
 }
 
+// unitsCheckApply writes or removes the native systemd units, and makes sure
+// that they are enabled, so that the mount comes back after a reboot.
+func (obj *MountRes) unitsCheckApply(apply bool) (bool, error) {
+	files, err := obj.unitFiles()
+	if err != nil {
+		return false, err
+	}
+	paths := []string{
+		path.Join(obj.unitDir(), obj.unitName(".mount")),
+		path.Join(obj.unitDir(), obj.unitName(".automount")),
+	}
+
+	checkOK := true
+	changed := []string{} // the units that have to be disabled or reloaded
+	for _, p := range paths {
+		content, wanted := files[p]
+		b, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "could not read %s", p)
+		}
+		if (wanted && err == nil && string(b) == content) || (!wanted && err != nil) {
+			continue
+		}
+		checkOK = false
+		if !apply {
+			continue
+		}
+		changed = append(changed, path.Base(p))
+		if !wanted { // the removed unit is only disabled here
+			continue
+		}
+		obj.init.Logf("writing: %s", p)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return false, err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return false, errwrap.Wrapf(err, "could not write %s", p)
+		}
+	}
+	if !apply && !checkOK {
+		return false, nil
+	}
+
+	conn, err := sdbus.New()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "failed to connect to systemd")
+	}
+	defer conn.Close()
+
+	for _, name := range changed {
+		p := path.Join(obj.unitDir(), name)
+		if _, wanted := files[p]; wanted {
+			continue
+		}
+		obj.init.Logf("removing: %s", p)
+		if _, err := conn.DisableUnitFiles([]string{name}, false); err != nil {
+			return false, errwrap.Wrapf(err, "unable to disable unit: %s", name)
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "could not remove %s", p)
+		}
+	}
+	if len(changed) > 0 {
+		obj.init.Logf("daemon reload")
+		if err := conn.Reload(); err != nil {
+			return false, errwrap.Wrapf(err, "failed to reload the manager")
+		}
+	}
+	if obj.State != "exists" {
+		return checkOK, nil
+	}
+
+	// the mount unit has to be disabled if the automount unit replaced it
+	for _, name := range []string{obj.unitName(".mount"), obj.primaryUnit()} {
+		filestate, err := conn.GetUnitProperty(name, "UnitFileState")
+		if err != nil {
+			return false, errwrap.Wrapf(err, "failed to get unit file state")
+		}
+		enabled := filestate.Value == dbus.MakeVariant("enabled")
+		if enabled == (name == obj.primaryUnit()) {
+			continue
+		}
+		checkOK = false
+		if !apply {
+			return false, nil
+		}
+		if enabled {
+			obj.init.Logf("disabling: %s", name)
+			_, err = conn.DisableUnitFiles([]string{name}, false)
+		} else {
+			obj.init.Logf("enabling: %s", name)
+			_, _, err = conn.EnableUnitFiles([]string{name}, false, true)
+		}
+		if err != nil {
+			return false, errwrap.Wrapf(err, "unable to change startup status of %s", name)
+		}
+	}
+	return checkOK, nil
+}
+
+// mounted returns true if the defined mount is active. An automount counts as
+// mounted when the autofs mount point is there, even if nothing accessed it.
+func (obj *MountRes) mounted() (bool, error) {
+	switch {
+	case obj.Automount:
+		return mountTypeExists(procPath, obj.Name(), "autofs")
+	case obj.Bind:
+		src, err := evalSpec(obj.Device)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "error evaluating spec: %s", obj.Device)
+		}
+		return bindMountExists(procMountInfo, src, obj.Name())
+	case obj.Type == "tmpfs":
+		// the options get rewritten by the kernel, so skip those
+		return mountTypeExists(procPath, obj.Name(), "tmpfs")
+	}
+	return mountExists(procPath, obj.mount)
+}
+
 // mountCheckApply checks if the defined resource is mounted, and mounts or
 // unmounts it according to the defined state.
 func (obj *MountRes) mountCheckApply(apply bool) (bool, error) {
-	exists, err := mountExists(procPath, obj.mount)
+	exists, err := obj.mounted()
 	if err != nil {
 		return false, errwrap.Wrapf(err, "error checking if mount exists")
 	}
@@ -333,7 +663,7 @@ func (obj *MountRes) mountCheckApply(apply bool) (bool, error) {
 	}
 	obj.init.Logf("mountCheckApply(%t)", apply)
 
-	if obj.State == "exists" {
+	if obj.State == "exists" && !obj.Units {
 		// Reload mounts from /etc/fstab by performing a `daemon-reload` and
 		// restarting `local-fs.target` and `remote-fs.target` units.
 		if err := mountReload(); err != nil {
@@ -341,6 +671,38 @@ func (obj *MountRes) mountCheckApply(apply bool) (bool, error) {
 		}
 		return false, nil // we're done
 	}
+
+	if obj.Units || obj.Automount {
+		conn, err := sdbus.New()
+		if err != nil {
+			return false, errwrap.Wrapf(err, "failed to connect to systemd")
+		}
+		defer conn.Close()
+
+		if obj.State == "exists" {
+			if err := mountUnitJob(conn.StartUnit, obj.primaryUnit()); err != nil {
+				return false, err
+			}
+			return false, nil
+		}
+		// stop the automount first, or it could mount it again
+		for _, name := range []string{obj.unitName(".automount"), obj.unitName(".mount")} {
+			activestate, err := conn.GetUnitProperty(name, "ActiveState")
+			if err != nil {
+				return false, errwrap.Wrapf(err, "failed to get active state")
+			}
+			if activestate.Value != dbus.MakeVariant("active") {
+				continue
+			}
+			if err := mountUnitJob(conn.StopUnit, name); err != nil {
+				return false, err
+			}
+		}
+		if exists, err = obj.mounted(); err != nil || !exists {
+			return false, err
+		}
+	}
+
 	// unmount the device
 	if err := unix.Unmount(obj.Name(), 0); err != nil { // 0 means no flags
 		return false, errwrap.Wrapf(err, "error unmounting %s", obj.Name())
@@ -354,16 +716,35 @@ func (obj *MountRes) mountCheckApply(apply bool) (bool, error) {
 func (obj *MountRes) CheckApply(apply bool) (checkOK bool, err error) {
 	checkOK = true
 
-	if c, err := obj.fstabCheckApply(apply); err != nil {
-		return false, err
-	} else if !c {
-		checkOK = false
+	// the units are removed after the unmount, since the unmount uses them
+	if obj.Units && obj.State == "absent" {
+		if c, err := obj.mountCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
 	}
 
-	if c, err := obj.mountCheckApply(apply); err != nil {
-		return false, err
-	} else if !c {
-		checkOK = false
+	if obj.Units {
+		if c, err := obj.unitsCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+	} else {
+		if c, err := obj.fstabCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+	}
+
+	if !obj.Units || obj.State == "exists" {
+		if c, err := obj.mountCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
 	}
 
 	return checkOK, nil
@@ -391,6 +772,27 @@ func (obj *MountRes) Cmp(r engine.Res) error {
 	if obj.PassNo != res.PassNo {
 		return fmt.Errorf("the PassNo differs")
 	}
+	if obj.Bind != res.Bind {
+		return fmt.Errorf("the Bind differs")
+	}
+	if obj.Size != res.Size {
+		return fmt.Errorf("the Size differs")
+	}
+	if obj.Mode != res.Mode {
+		return fmt.Errorf("the Mode differs")
+	}
+	if obj.Automount != res.Automount {
+		return fmt.Errorf("the Automount differs")
+	}
+	if obj.IdleTimeout != res.IdleTimeout {
+		return fmt.Errorf("the IdleTimeout differs")
+	}
+	if obj.Units != res.Units {
+		return fmt.Errorf("the Units differs")
+	}
+	if obj.UnitDir != res.UnitDir {
+		return fmt.Errorf("the UnitDir differs")
+	}
 
 	return nil
 }
@@ -410,6 +812,63 @@ func (obj *MountUID) IFF(uid engine.ResUID) bool {
 	return obj.name == res.name
 }
 
+// MountResAutoEdges holds the state of the auto edge generator.
+type MountResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *MountResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue!
+func (obj *MountResAutoEdges) Test(input []bool) bool {
+	return false // we only ever return one batch of edges
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the mount point
+// directory, the source of a bind mount, and the nearest parent mount point,
+// so that nested mounts happen in the right order.
+func (obj *MountRes) AutoEdges() (engine.AutoEdge, error) {
+	var reversed = true // these all have to happen before the mount
+	base := engine.BaseUID{
+		Name:     obj.Name(),
+		Kind:     obj.Kind(),
+		Reversed: &reversed,
+	}
+	dirify := func(p string) string {
+		if strings.HasSuffix(p, "/") {
+			return p
+		}
+		return p + "/"
+	}
+	edges := []engine.ResUID{
+		&FileUID{BaseUID: base, path: dirify(obj.Name())},
+	}
+	if obj.Bind && strings.HasPrefix(obj.Device, "/") {
+		edges = append(edges, &FileUID{BaseUID: base, path: dirify(obj.Device)})
+		edges = append(edges, &MountUID{BaseUID: base, name: path.Clean(obj.Device)})
+	}
+	fileEdges := &MountResAutoEdges{
+		edges: edges,
+	}
+
+	// walk up until the first parent mount point that is managed
+	var data []engine.ResUID
+	for p := path.Clean(obj.Name()); p != "/"; {
+		p = path.Dir(p)
+		data = append(data, &MountUID{BaseUID: base, name: p})
+	}
+	parentEdges := &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}
+	return engineUtil.AutoEdgeCombiner(fileEdges, parentEdges)
+}
+
 // UIDs includes all params to make a unique identification of this object.
 // Most resources only return one although some resources can return multiple.
 func (obj *MountRes) UIDs() []engine.ResUID {
@@ -452,7 +911,7 @@ func strMapEq(x, y map[string]string) bool {
 		return false
 	}
 	for k, v := range x {
-		if val, ok := x[k]; !ok || v != val {
+		if val, ok := y[k]; !ok || v != val {
 			return false
 		}
 	}
@@ -548,6 +1007,98 @@ func mountExists(file string, mount *fstab.Mount) (bool, error) {
 	return false, nil
 }
 
+// mountTypeExists returns true if a mount of the given filesystem type exists
+// at the mount point, according to the given file (typically /proc/mounts.)
+func mountTypeExists(file, mountPoint, vfsType string) (bool, error) {
+	mounts, err := fstab.ParseFile(file)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error parsing file: %s", file)
+	}
+	for _, m := range mounts {
+		if m.File == mountPoint && m.VfsType == vfsType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bindMountExists returns true if the source directory is bind mounted at the
+// mount point, according to the given file (typically /proc/self/mountinfo.)
+// A bind mount looks like any other mount of the same device in /proc/mounts,
+// so the mountinfo root of the mount point is compared with the path of the
+// source inside of the mount that it's on.
+func bindMountExists(file, src, mountPoint string) (bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error reading file: %s", file)
+	}
+	type mountInfo struct {
+		dev, root, point string
+	}
+	var target, source *mountInfo
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		m := &mountInfo{
+			dev:   fields[2],
+			root:  mountInfoUnescape(fields[3]),
+			point: mountInfoUnescape(fields[4]),
+		}
+		if m.point == mountPoint {
+			target = m // the last one is on top
+		}
+		if util.HasPathPrefix(src, m.point) && (source == nil || len(m.point) >= len(source.point)) && m.point != mountPoint {
+			source = m
+		}
+	}
+	if target == nil || source == nil {
+		return false, nil
+	}
+	rel, err := filepath.Rel(source.point, src)
+	if err != nil {
+		return false, err
+	}
+	return target.dev == source.dev && target.root == path.Join(source.root, rel), nil
+}
+
+// mountInfoUnescape decodes the octal escapes of spaces and other whitespace
+// in the paths of the mountinfo file. Each escape is only decoded once, and
+// anything which isn't a valid escape is kept as it is.
+func mountInfoUnescape(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3 // skip past the digits
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// mntOpsString returns the mount options in the usual comma separated format,
+// in a stable order.
+func mntOpsString(ops map[string]string) string {
+	keys := []string{}
+	for k := range ops {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := []string{}
+	for _, k := range keys {
+		if v := ops[k]; v != "" {
+			k = k + "=" + v
+		}
+		s = append(s, k)
+	}
+	return strings.Join(s, ",")
+}
+
 // mountCompare compares two mounts. It is assumed that the first comes from
 // a resource definition, and the second comes from /proc/mounts. It compares
 // the two after resolving the loopback device's file path (if necessary,) and
@@ -596,13 +1147,26 @@ func mountReload() error {
 	}
 
 	// systemctl restart remote-fs.target
-	if err := restartUnit(conn, "local-fs.target"); err != nil {
+	if err := restartUnit(conn, "remote-fs.target"); err != nil {
 		return errwrap.Wrapf(err, "error restarting unit")
 	}
 
 	return nil
 }
 
+// mountUnitJob runs a systemd job, such as a start or a stop, on the unit and
+// waits for the result.
+func mountUnitJob(job func(string, string, chan<- string) (int, error), name string) error {
+	result := make(chan string, 1) // catch result information
+	if _, err := job(name, "fail", result); err != nil {
+		return errwrap.Wrapf(err, "failed to run job on unit: %s", name)
+	}
+	if status := <-result; status != "done" {
+		return fmt.Errorf("unexpected job status for %s: %s", name, status)
+	}
+	return nil
+}
+
 // restartUnit restarts the given dbus unit and waits for it to finish
 // starting up. If restartTimeout is exceeded, it will return an error.
 func restartUnit(conn *dbus.Conn, unit string) error {
@@ -654,6 +1218,16 @@ func restartUnit(conn *dbus.Conn, unit string) error {
 // evalSpec resolves the device from the supplied spec, i.e. it follows the
 // symlink, if any, from the provided uuid, label, or path.
 func evalSpec(spec string) (string, error) {
+	path, err := specPath(spec)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// specPath returns the path of the device from the supplied spec, without
+// following the symlink.
+func specPath(spec string) (string, error) {
 	var path string
 	m := &fstab.Mount{}
 	m.Spec = spec
@@ -673,7 +1247,7 @@ func evalSpec(spec string) (string, error) {
 		return "", fmt.Errorf("unexpected spec type: %v", m.SpecType())
 	}
 
-	return filepath.EvalSymlinks(path)
+	return path, nil
 }
 
 // loopFilePath returns the file path of the mounted filesystem image, backing
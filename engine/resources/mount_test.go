@@ -22,6 +22,7 @@ package resources
 import (
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 
 	fstab "github.com/deniswernert/go-fstab"
@@ -296,6 +297,61 @@ func TestMountCompare(t *testing.T) {
 	}
 }
 
+func TestStrMapEq(t *testing.T) {
+	tests := []struct {
+		x, y map[string]string
+		out  bool
+	}{
+		{nil, nil, true},
+		{nil, map[string]string{}, true},
+		{map[string]string{"size": "1G"}, map[string]string{"size": "1G"}, true},
+		{map[string]string{"size": "1G"}, map[string]string{"size": "2G"}, false},
+		{map[string]string{"size": "1G"}, map[string]string{"mode": "1G"}, false},
+		{map[string]string{"ro": ""}, map[string]string{}, false},
+	}
+	for i, test := range tests {
+		if out := strMapEq(test.x, test.y); out != test.out {
+			t.Errorf("test #%d: strMapEq(%v, %v) wanted: %t, got: %t", i, test.x, test.y, test.out, out)
+		}
+	}
+}
+
+// test that MountRes.Cmp sees a changed option value, which it used to miss
+// when strMapEq compared each value with itself
+func TestMountResCompareOptions(t *testing.T) {
+	r1 := &MountRes{State: "exists", Device: "tmpfs", Type: "tmpfs", Options: map[string]string{"size": "1G"}}
+	r2 := &MountRes{State: "exists", Device: "tmpfs", Type: "tmpfs", Options: map[string]string{"size": "2G"}}
+	r1.SetName("/mnt/test")
+	r2.SetName("/mnt/test")
+	if err := r1.Cmp(r2); err == nil {
+		t.Errorf("mounts with different option values should not compare")
+	}
+	r2.Options["size"] = "1G"
+	if err := r1.Cmp(r2); err != nil {
+		t.Errorf("mounts with the same options should compare: %v", err)
+	}
+}
+
+func TestMountInfoUnescape(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"/mnt/plain", "/mnt/plain"},
+		{"/mnt/my\\040disk", "/mnt/my disk"},
+		{"/mnt/a\\011b\\012c", "/mnt/a\tb\nc"},
+		{"/mnt/a\\134101", "/mnt/a\\101"}, // a decoded backslash isn't decoded again
+		{"/mnt/a\\xyz\\040b", "/mnt/a\\xyz b"},
+		{"/mnt/a\\04", "/mnt/a\\04"},
+		{"/mnt/a\\999", "/mnt/a\\999"},
+	}
+	for _, test := range tests {
+		if out := mountInfoUnescape(test.in); out != test.out {
+			t.Errorf("mountInfoUnescape(%q) wanted: %q, got: %q", test.in, test.out, out)
+		}
+	}
+}
+
 var mountExistsTests = []struct {
 	procMock []byte
 	in       *fstab.Mount
@@ -341,3 +397,219 @@ func TestMountExists(t *testing.T) {
 		}
 	}
 }
+
+func TestMountValidateOptions(t *testing.T) {
+	tests := []struct {
+		res *MountRes
+		ok  bool
+	}{
+		{&MountRes{Device: "/srv/data", Bind: true}, true},
+		{&MountRes{Type: "tmpfs", Size: "512m", Mode: "1777"}, true},
+		{&MountRes{Type: "nfs4", Automount: true, IdleTimeout: 300}, true},
+		{&MountRes{Type: "ext4", Units: true, UnitDir: "/run/systemd/system/"}, true},
+		{&MountRes{Device: "data", Bind: true}, false},
+		{&MountRes{Type: "ext4", Size: "512m"}, false},
+		{&MountRes{Type: "tmpfs", Mode: "rwx"}, false},
+		{&MountRes{Type: "tmpfs", Mode: "17777"}, false},
+		{&MountRes{Type: "ext4", IdleTimeout: 300}, false},
+		{&MountRes{Type: "ext4", Automount: true, IdleTimeout: -1}, false},
+		{&MountRes{Type: "ext4", Units: true, PassNo: 2}, false},
+		{&MountRes{Type: "ext4", Units: true, UnitDir: "units/"}, false},
+	}
+	for i, tt := range tests {
+		tt.res.SetName("/mnt/test")
+		if err := tt.res.validateOptions(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestMountFstabMount(t *testing.T) {
+	tests := []struct {
+		res *MountRes
+		out *fstab.Mount
+	}{
+		{
+			&MountRes{Device: "/srv/data", Bind: true, Options: defaultMntOps()},
+			&fstab.Mount{Spec: "/srv/data", File: "/mnt/test", VfsType: "none", MntOps: map[string]string{"defaults": "", "bind": ""}},
+		},
+		{
+			&MountRes{Type: "tmpfs", Size: "512m", Mode: "1777", Options: map[string]string{"nosuid": ""}},
+			&fstab.Mount{Spec: "tmpfs", File: "/mnt/test", VfsType: "tmpfs", MntOps: map[string]string{"nosuid": "", "size": "512m", "mode": "1777"}},
+		},
+		{
+			&MountRes{Device: "server:/export", Type: "nfs4", Automount: true, IdleTimeout: 300, Options: defaultMntOps()},
+			&fstab.Mount{Spec: "server:/export", File: "/mnt/test", VfsType: "nfs4", MntOps: map[string]string{"defaults": "", "x-systemd.automount": "", "x-systemd.idle-timeout": "300"}},
+		},
+		{
+			&MountRes{Device: "/dev/sdb1", Type: "ext4", Options: defaultMntOps(), Freq: 1, PassNo: 2},
+			&fstab.Mount{Spec: "/dev/sdb1", File: "/mnt/test", VfsType: "ext4", MntOps: defaultMntOps(), Freq: 1, PassNo: 2},
+		},
+	}
+	for i, tt := range tests {
+		tt.res.SetName("/mnt/test")
+		if m := tt.res.fstabMount(); !reflect.DeepEqual(m, tt.out) {
+			t.Errorf("test #%d: got wrong entry: %+v", i, m)
+		}
+	}
+}
+
+func TestMountUnitFiles(t *testing.T) {
+	res := &MountRes{
+		State:       "exists",
+		Device:      "server:/export",
+		Type:        "nfs4",
+		Options:     map[string]string{"ro": "", "vers": "4.2"},
+		Automount:   true,
+		IdleTimeout: 300,
+		Units:       true,
+		UnitDir:     "/etc/systemd/system/",
+	}
+	res.SetName("/srv/nfs/export")
+	files, err := res.unitFiles()
+	if err != nil {
+		t.Errorf("unit files failed with: %v", err)
+		return
+	}
+	mount := `# This file is managed by mgmt.
+
+[Mount]
+What=server:/export
+Where=/srv/nfs/export
+Type=nfs4
+Options=ro,vers=4.2
+`
+	if s := files["/etc/systemd/system/srv-nfs-export.mount"]; s != mount {
+		t.Errorf("got wrong mount unit:\n%s", s)
+	}
+	automount := `# This file is managed by mgmt.
+
+[Automount]
+Where=/srv/nfs/export
+TimeoutIdleSec=300
+
+[Install]
+WantedBy=remote-fs.target
+`
+	if s := files["/etc/systemd/system/srv-nfs-export.automount"]; s != automount {
+		t.Errorf("got wrong automount unit:\n%s", s)
+	}
+
+	res = &MountRes{
+		State:   "exists",
+		Type:    "tmpfs",
+		Options: defaultMntOps(),
+		Size:    "1g",
+		Units:   true,
+		UnitDir: "/etc/systemd/system/",
+	}
+	res.SetName("/var/cache/build")
+	if files, err = res.unitFiles(); err != nil {
+		t.Errorf("unit files failed with: %v", err)
+		return
+	}
+	mount = `# This file is managed by mgmt.
+
+[Mount]
+What=tmpfs
+Where=/var/cache/build
+Type=tmpfs
+Options=defaults,size=1g
+
+[Install]
+WantedBy=local-fs.target
+`
+	if len(files) != 1 || files["/etc/systemd/system/var-cache-build.mount"] != mount {
+		t.Errorf("got wrong units: %+v", files)
+	}
+
+	res.State = "absent"
+	if files, err = res.unitFiles(); err != nil || len(files) != 0 {
+		t.Errorf("an absent mount must not have units: %+v, %v", files, err)
+	}
+}
+
+const mountInfoMock1 = `22 1 253:0 / / rw,relatime shared:1 - ext4 /dev/mapper/root rw
+40 22 253:1 / /srv rw,relatime shared:2 - xfs /dev/mapper/srv rw
+41 22 253:1 /data /mnt/data rw,relatime shared:2 - xfs /dev/mapper/srv rw
+42 22 253:0 /home/my\040files /mnt/files rw,relatime shared:1 - ext4 /dev/mapper/root rw
+`
+
+func TestBindMountExists(t *testing.T) {
+	file, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Errorf("error creating temp file: %v", err)
+		return
+	}
+	defer os.Remove(file.Name())
+	if err := ioutil.WriteFile(file.Name(), []byte(mountInfoMock1), 0664); err != nil {
+		t.Errorf("error writing mountinfo file: %s: %v", file.Name(), err)
+		return
+	}
+
+	tests := []struct {
+		src, mountPoint string
+		out             bool
+	}{
+		{"/srv/data", "/mnt/data", true},
+		{"/home/my files", "/mnt/files", true},
+		{"/srv/other", "/mnt/data", false},
+		{"/data", "/mnt/data", false}, // on the root device
+		{"/srv/data", "/mnt/missing", false},
+	}
+	for i, tt := range tests {
+		result, err := bindMountExists(file.Name(), tt.src, tt.mountPoint)
+		if err != nil {
+			t.Errorf("test #%d: error checking bind mount: %v", i, err)
+			continue
+		}
+		if result != tt.out {
+			t.Errorf("test #%d: bindMountExists wanted: %t, got: %t", i, tt.out, result)
+		}
+	}
+}
+
+func TestMountAutoEdges(t *testing.T) {
+	res := &MountRes{Device: "/srv/data", Bind: true}
+	res.SetName("/mnt/nested/data")
+	ae, err := res.AutoEdges()
+	if err != nil {
+		t.Errorf("autoedges failed with: %v", err)
+		return
+	}
+
+	uids := ae.Next()
+	names := []string{}
+	for _, uid := range uids {
+		if !uid.IsReversed() {
+			t.Errorf("unexpected uid: %+v", uid)
+		}
+		switch x := uid.(type) {
+		case *FileUID:
+			names = append(names, "file:"+x.path)
+		case *MountUID:
+			names = append(names, "mount:"+x.name)
+		}
+	}
+	exp := []string{"file:/mnt/nested/data/", "file:/srv/data/", "mount:/srv/data"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("got wrong edges: %v", names)
+	}
+
+	// walk up the parent mount points until one is found
+	names = []string{}
+	for ae.Test(make([]bool, len(uids))) {
+		uids = ae.Next()
+		for _, uid := range uids {
+			if x, ok := uid.(*MountUID); ok {
+				names = append(names, x.name)
+			}
+		}
+	}
+	exp = []string{"/mnt/nested", "/mnt", "/"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("got wrong parent mounts: %v", names)
+	}
+}
@@ -21,11 +21,16 @@ package resources
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -56,6 +61,9 @@ const (
 	networkdUnitFileDir = "/etc/systemd/network/"
 	// networkdUnitFileExt is the file extension for networkd unit files.
 	networkdUnitFileExt = ".network"
+	// networkdNetdevFileExt is the file extension for networkd netdev files,
+	// which define the virtual network devices.
+	networkdNetdevFileExt = ".netdev"
 	// networkdUnitFileUmask sets the permissions on the systemd unit file.
 	networkdUnitFileUmask = 0644
 
@@ -79,13 +87,18 @@ const (
 	rtProtoStatic = 4 // static
 
 	socketFile = "pipe.sock" // path in vardir to store our socket file
+
+	// NetWireguardCmd is the command used to configure wireguard links.
+	NetWireguardCmd = "wg"
 )
 
 // NetRes is a network interface resource based on netlink. It manages the
-// state of a network link. Configuration is also stored in a networkd
-// configuration file, so the network is available upon reboot.
+// state of a network link, and it can create virtual links such as bridges,
+// bonds and vlans. Configuration is also stored in networkd configuration
+// files, so the network is available upon reboot.
 type NetRes struct {
 	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
 
 	init *engine.Init
 
@@ -93,12 +106,76 @@ type NetRes struct {
 	Addrs   []string `yaml:"addrs"`   // list of addresses in cidr format
 	Gateway string   `yaml:"gateway"` // gateway address
 
+	// Type is the kind of virtual link to create, which is bridge, vlan,
+	// bond, dummy or wireguard. If it's empty, then the link must exist.
+	Type string `yaml:"type"`
+	// Parent is the link that a vlan is on top of.
+	Parent string `yaml:"parent"`
+	// VLANID is the id of a vlan.
+	VLANID int `yaml:"vlanid"`
+	// BondMode is the mode of a bond, such as active-backup or 802.3ad. It
+	// defaults to balance-rr.
+	BondMode string `yaml:"bondmode"`
+	// Master is the bridge or the bond that this link is a member of.
+	Master string `yaml:"master"`
+	// MTU is the maximum transmission unit of the link. Zero leaves it
+	// alone.
+	MTU int `yaml:"mtu"`
+	// DNS are the dns servers for the link. They're only put in the
+	// networkd file, so they're used when networkd sets up the link.
+	DNS []string `yaml:"dns"`
+	// Domains are the search domains for the link. Like the dns servers,
+	// they're only put in the networkd file.
+	Domains []string `yaml:"domains"`
+	// Routes are the static routes through the link. Other routes are
+	// left alone.
+	Routes []NetRoute `yaml:"routes"`
+	// Rules are the routing policy rules which the link needs. Other rules
+	// are left alone.
+	Rules []NetRule `yaml:"rules"`
+
+	// PrivateKeyFile is the file with the private key of a wireguard link.
+	PrivateKeyFile string `yaml:"privatekeyfile"`
+	// ListenPort is the port that a wireguard link listens on.
+	ListenPort int `yaml:"listenport"`
+	// Peers are the peers of a wireguard link.
+	Peers []NetWireguardPeer `yaml:"peers"`
+
 	iface        *iface // a struct containing the net.Interface and netlink.Link
 	unitFilePath string // the interface unit file path
+	unitFileDir  string // the networkd dir, which can be changed in tests
+	masterKind   string // the kind of the master link, either bridge or bond
 
 	socketFile string // path for storing the pipe socket file
 }
 
+// NetRoute is a static route.
+type NetRoute struct {
+	Dst     string `yaml:"dst"`     // destination in cidr format
+	Gateway string `yaml:"gateway"` // optional gateway address
+	Metric  int    `yaml:"metric"`  // optional route metric
+	Table   int    `yaml:"table"`   // routing table, zero means the main one
+}
+
+// NetRule is a routing policy rule.
+type NetRule struct {
+	From     string `yaml:"from"`     // source in cidr format
+	To       string `yaml:"to"`       // destination in cidr format
+	Table    int    `yaml:"table"`    // routing table to look up
+	Priority int    `yaml:"priority"` // the priority of the rule
+}
+
+// NetWireguardPeer is a peer of a wireguard link.
+type NetWireguardPeer struct {
+	PublicKey           string   `yaml:"publickey"`
+	AllowedIPs          []string `yaml:"allowedips"`
+	Endpoint            string   `yaml:"endpoint"` // host:port
+	PersistentKeepalive int      `yaml:"persistentkeepalive"`
+}
+
+// netDomainRegexp matches a search domain, or a routing domain with a tilde.
+var netDomainRegexp = regexp.MustCompile(`^~?[a-zA-Z0-9.-]+$`)
+
 // nlChanStruct defines the channel used to send netlink messages and errors
 // to the event processing loop in Watch.
 type nlChanStruct struct {
@@ -132,15 +209,113 @@ func (obj *NetRes) Validate() error {
 		}
 	}
 
-	// validate the interface name
-	_, err := net.InterfaceByName(obj.Name())
-	if err != nil {
-		return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
+	if err := obj.validateNetdev(); err != nil {
+		return err
+	}
+
+	// validate the interface name, unless we create it
+	if obj.Type == "" {
+		if _, err := net.InterfaceByName(obj.Name()); err != nil {
+			return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
+		}
 	}
 
 	return nil
 }
 
+// validateNetdev checks the params which don't need the link to exist.
+func (obj *NetRes) validateNetdev() error {
+	switch obj.Type {
+	case "", "bridge", "bond", "dummy":
+	case "vlan":
+		if obj.Parent == "" {
+			return fmt.Errorf("a vlan needs a parent")
+		}
+		if obj.VLANID < 1 || obj.VLANID > 4094 {
+			return fmt.Errorf("the vlan id must be between 1 and 4094")
+		}
+	case "wireguard":
+		if !strings.HasPrefix(obj.PrivateKeyFile, "/") {
+			return fmt.Errorf("a wireguard link needs an absolute private key file")
+		}
+		if obj.ListenPort < 0 || obj.ListenPort > 65535 {
+			return fmt.Errorf("invalid listen port: %d", obj.ListenPort)
+		}
+		for _, peer := range obj.Peers {
+			if peer.PublicKey == "" {
+				return fmt.Errorf("a wireguard peer needs a public key")
+			}
+			for _, x := range peer.AllowedIPs {
+				if _, _, err := net.ParseCIDR(x); err != nil {
+					return errwrap.Wrapf(err, "error parsing allowed ip: %s", x)
+				}
+			}
+			if peer.Endpoint != "" {
+				if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+					return errwrap.Wrapf(err, "error parsing endpoint: %s", peer.Endpoint)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("invalid kind: %s", obj.Type)
+	}
+	if obj.Type != "vlan" && (obj.Parent != "" || obj.VLANID != 0) {
+		return fmt.Errorf("only a vlan can have a parent and a vlan id")
+	}
+	if obj.Type != "wireguard" && (obj.PrivateKeyFile != "" || obj.ListenPort != 0 || len(obj.Peers) > 0) {
+		return fmt.Errorf("only a wireguard link can have wireguard params")
+	}
+	if obj.BondMode != "" {
+		if obj.Type != "bond" {
+			return fmt.Errorf("only a bond can have a bond mode")
+		}
+		if netlink.StringToBondMode(obj.BondMode) == netlink.BOND_MODE_UNKNOWN {
+			return fmt.Errorf("invalid bond mode: %s", obj.BondMode)
+		}
+	}
+	if obj.Master == obj.Name() || (obj.Parent == obj.Name() && obj.Parent != "") {
+		return fmt.Errorf("a link can't be on top of itself")
+	}
+	if obj.MTU < 0 {
+		return fmt.Errorf("the mtu can't be negative")
+	}
+	for _, x := range obj.DNS {
+		if net.ParseIP(x) == nil {
+			return fmt.Errorf("error parsing dns server: %s", x)
+		}
+	}
+	for _, x := range obj.Domains {
+		if !netDomainRegexp.MatchString(x) {
+			return fmt.Errorf("invalid domain: %s", x)
+		}
+	}
+	for _, r := range obj.Routes {
+		if _, _, err := net.ParseCIDR(r.Dst); err != nil {
+			return errwrap.Wrapf(err, "error parsing route destination: %s", r.Dst)
+		}
+		if r.Gateway != "" && net.ParseIP(r.Gateway) == nil {
+			return fmt.Errorf("error parsing route gateway: %s", r.Gateway)
+		}
+		if r.Metric < 0 || r.Table < 0 {
+			return fmt.Errorf("the route metric and table can't be negative")
+		}
+	}
+	for _, r := range obj.Rules {
+		if r.From == "" && r.To == "" {
+			return fmt.Errorf("a rule needs a from or a to")
+		}
+		for _, x := range []string{r.From, r.To} {
+			if _, _, err := net.ParseCIDR(x); x != "" && err != nil {
+				return errwrap.Wrapf(err, "error parsing rule address: %s", x)
+			}
+		}
+		if r.Table <= 0 || r.Priority < 0 {
+			return fmt.Errorf("a rule needs a table, and the priority can't be negative")
+		}
+	}
+	return nil
+}
+
 // Init runs some startup code for this resource.
 func (obj *NetRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
@@ -154,7 +329,25 @@ func (obj *NetRes) Init(init *engine.Init) error {
 	}
 	obj.socketFile = path.Join(dir, socketFile) // return a unique file
 
-	// store the network interface in the struct
+	// a virtual link gets looked up after it's created in CheckApply
+	if obj.Type == "" {
+		if err := obj.lookup(); err != nil {
+			return err
+		}
+	}
+
+	// build the path to the networkd configuration file
+	if obj.unitFileDir == "" {
+		obj.unitFileDir = networkdUnitFileDir
+	}
+	obj.unitFilePath = path.Join(obj.unitFileDir, IfacePrefix+obj.Name()+networkdUnitFileExt)
+
+	return nil
+}
+
+// lookup stores the network interface and the netlink link in the struct.
+func (obj *NetRes) lookup() error {
+	var err error
 	obj.iface = &iface{}
 	if obj.iface.iface, err = net.InterfaceByName(obj.Name()); err != nil {
 		return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
@@ -163,10 +356,6 @@ func (obj *NetRes) Init(init *engine.Init) error {
 	if obj.iface.link, err = netlink.LinkByName(obj.Name()); err != nil {
 		return errwrap.Wrapf(err, "error finding link: %s", obj.Name())
 	}
-
-	// build the path to the networkd configuration file
-	obj.unitFilePath = networkdUnitFileDir + IfacePrefix + obj.Name() + networkdUnitFileExt
-
 	return nil
 }
 
@@ -201,14 +390,25 @@ func (obj *NetRes) Watch() error {
 	}
 	defer conn.shutdown() // close the netlink socket and unblock conn.receive()
 
-	// watch the systemd-networkd configuration file
-	recWatcher, err := recwatch.NewRecWatcher(obj.unitFilePath, false)
+	// watch the systemd-networkd configuration files
+	recWatcher, err := recwatch.NewRecWatcher(obj.unitFileDir, false)
 	if err != nil {
 		return err
 	}
 	// close the recwatcher when we're done
 	defer recWatcher.Close()
 
+	// watch the private key, since its hash is part of the netdev file
+	var keyEvents chan recwatch.Event // nil unless it's wireguard
+	if obj.Type == "wireguard" {
+		keyWatcher, err := recwatch.NewRecWatcher(obj.PrivateKeyFile, false)
+		if err != nil {
+			return err
+		}
+		defer keyWatcher.Close()
+		keyEvents = keyWatcher.Events()
+	}
+
 	// channel for netlink messages
 	nlChan := make(chan *nlChanStruct) // closed from goroutine
 
@@ -281,6 +481,23 @@ func (obj *NetRes) Watch() error {
 			if err := event.Error; err != nil {
 				return errwrap.Wrapf(err, "unknown recwatcher error")
 			}
+			if !obj.ownsFile(event.Body.Name) {
+				continue // some other link's file
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+
+			send = true
+			obj.init.Dirty() // dirty
+
+		case event, ok := <-keyEvents:
+			if !ok {
+				return fmt.Errorf("the private key watcher closed unexpectedly")
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown private key watcher error")
+			}
 			if obj.init.Debug {
 				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
 			}
@@ -435,77 +652,436 @@ func (obj *NetRes) gatewayCheckApply(apply bool) (bool, error) {
 	return false, nil
 }
 
-// fileCheckApply checks and maintains the systemd-networkd unit file contents.
-func (obj *NetRes) fileCheckApply(apply bool) (bool, error) {
-	// check if the unit file exists
-	_, err := os.Stat(obj.unitFilePath)
+// netdevCheckApply creates the virtual link if it's missing, and recreates it
+// if it doesn't match the definition.
+func (obj *NetRes) netdevCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	link, err := netlink.LinkByName(obj.Name())
+	if _, ok := err.(netlink.LinkNotFoundError); err != nil && !ok {
+		return false, errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	}
+	if err != nil || !obj.netdevMatch(link) {
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("netdevCheckApply(%t)", apply)
+		checkOK = false
+
+		if err == nil { // it's the wrong link, so start over
+			if err := netlink.LinkDel(link); err != nil {
+				return false, errwrap.Wrapf(err, "error deleting link: %s", obj.Name())
+			}
+		}
+		newLink, err := obj.netdevLink()
+		if err != nil {
+			return false, err
+		}
+		if err := netlink.LinkAdd(newLink); err != nil {
+			return false, errwrap.Wrapf(err, "error adding link: %s", obj.Name())
+		}
+	}
+	if obj.iface == nil || !checkOK {
+		if err := obj.lookup(); err != nil {
+			return false, err
+		}
+	}
+
+	if obj.Type != "wireguard" {
+		return checkOK, nil
+	}
+	// the kernel has no persistent wireguard config, so we configure it
+	// when the link is new, or when the netdev file is out of date, which
+	// includes a change to the private key, since its hash is in the file
+	b, err := ioutil.ReadFile(obj.netdevFilePath())
 	if err != nil && !os.IsNotExist(err) {
-		return false, errwrap.Wrapf(err, "error checking file")
+		return false, errwrap.Wrapf(err, "error reading file")
+	}
+	if checkOK && err == nil && bytes.Equal(b, obj.netdevFileContents()) {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("netdevCheckApply(%t): wireguard", apply)
+	conf, err := obj.wireguardConf()
+	if err != nil {
+		return false, err
+	}
+	cmd := exec.Command(NetWireguardCmd, "setconf", obj.Name(), "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(conf)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return false, errwrap.Wrapf(err, "error configuring wireguard: %s", strings.TrimSpace(string(out)))
 	}
-	// build the unit file contents from the definition
-	contents := obj.unitFileContents()
-	// check the file contents
-	if err == nil {
-		unitFile, err := ioutil.ReadFile(obj.unitFilePath)
+	return false, nil
+}
+
+// netdevMatch returns true if the link matches the netdev in the definition.
+func (obj *NetRes) netdevMatch(link netlink.Link) bool {
+	if link.Type() != obj.Type {
+		return false
+	}
+	switch x := link.(type) {
+	case *netlink.Vlan:
+		parent, err := netlink.LinkByName(obj.Parent)
 		if err != nil {
-			return false, errwrap.Wrapf(err, "error reading file")
+			return false
+		}
+		return x.ParentIndex == parent.Attrs().Index && x.VlanId == obj.VLANID
+	case *netlink.Bond:
+		return x.Mode == obj.bondMode()
+	}
+	return true
+}
+
+// netdevLink builds the netlink link which gets added for the definition.
+func (obj *NetRes) netdevLink() (netlink.Link, error) {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = obj.Name()
+	attrs.MTU = obj.MTU
+	switch obj.Type {
+	case "bridge":
+		return &netlink.Bridge{LinkAttrs: attrs}, nil
+	case "dummy":
+		return &netlink.Dummy{LinkAttrs: attrs}, nil
+	case "bond":
+		bond := netlink.NewLinkBond(attrs)
+		bond.Mode = obj.bondMode()
+		return bond, nil
+	case "vlan":
+		parent, err := netlink.LinkByName(obj.Parent)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error finding parent: %s", obj.Parent)
+		}
+		attrs.ParentIndex = parent.Attrs().Index
+		return &netlink.Vlan{LinkAttrs: attrs, VlanId: obj.VLANID}, nil
+	case "wireguard":
+		return &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}, nil
+	}
+	return nil, fmt.Errorf("invalid kind: %s", obj.Type)
+}
+
+// bondMode returns the bond mode, which is balance-rr if it's unspecified.
+func (obj *NetRes) bondMode() netlink.BondMode {
+	if obj.BondMode == "" {
+		return netlink.BOND_MODE_BALANCE_RR
+	}
+	return netlink.StringToBondMode(obj.BondMode)
+}
+
+// wireguardConf builds the config for the wg command. Unlike the netdev file,
+// it has to contain the private key itself.
+func (obj *NetRes) wireguardConf() ([]byte, error) {
+	key, err := ioutil.ReadFile(obj.PrivateKeyFile)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error reading private key")
+	}
+	u := []string{"[Interface]"}
+	u = append(u, fmt.Sprintf("PrivateKey = %s", strings.TrimSpace(string(key))))
+	if obj.ListenPort != 0 {
+		u = append(u, fmt.Sprintf("ListenPort = %d", obj.ListenPort))
+	}
+	for _, peer := range obj.Peers {
+		u = append(u, "[Peer]")
+		u = append(u, fmt.Sprintf("PublicKey = %s", peer.PublicKey))
+		if len(peer.AllowedIPs) > 0 {
+			u = append(u, fmt.Sprintf("AllowedIPs = %s", strings.Join(peer.AllowedIPs, ", ")))
+		}
+		if peer.Endpoint != "" {
+			u = append(u, fmt.Sprintf("Endpoint = %s", peer.Endpoint))
 		}
-		// return if the file is good
-		if bytes.Equal(unitFile, contents) {
-			return true, nil
+		if peer.PersistentKeepalive != 0 {
+			u = append(u, fmt.Sprintf("PersistentKeepalive = %d", peer.PersistentKeepalive))
 		}
 	}
+	return []byte(strings.Join(u, "\n") + "\n"), nil
+}
+
+// masterCheckApply checks that the link is a member of the right bridge or
+// bond, and adds it if it isn't.
+func (obj *NetRes) masterCheckApply(apply bool) (bool, error) {
+	if obj.Master == "" {
+		return true, nil
+	}
+	master, err := netlink.LinkByName(obj.Master)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error finding master: %s", obj.Master)
+	}
+	if kind := master.Type(); kind != "bridge" && kind != "bond" {
+		return false, fmt.Errorf("master %s is a %s, not a bridge or a bond", obj.Master, kind)
+	}
+	obj.masterKind = master.Type()
+
+	link, err := netlink.LinkByName(obj.Name())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	}
+	obj.iface.link = link
+	if link.Attrs().MasterIndex == master.Attrs().Index {
+		return true, nil
+	}
 
 	if !apply {
 		return false, nil
 	}
-	obj.init.Logf("fileCheckApply(%t)", apply)
+	obj.init.Logf("masterCheckApply(%t)", apply)
 
-	// write the file
-	if err := ioutil.WriteFile(obj.unitFilePath, contents, networkdUnitFileUmask); err != nil {
-		return false, errwrap.Wrapf(err, "error writing configuration file")
+	// the kernel only adds links to a bond while they are down, and the
+	// state gets set again afterwards
+	if obj.masterKind == "bond" {
+		if err := netlink.LinkSetDown(link); err != nil {
+			return false, errwrap.Wrapf(err, "error setting link down")
+		}
+	}
+	if err := netlink.LinkSetMasterByIndex(link, master.Attrs().Index); err != nil {
+		return false, errwrap.Wrapf(err, "error setting master: %s", obj.Master)
 	}
 	return false, nil
 }
 
+// mtuCheckApply checks the mtu of the link and changes it if needed.
+func (obj *NetRes) mtuCheckApply(apply bool) (bool, error) {
+	if obj.MTU == 0 {
+		return true, nil
+	}
+	link, err := netlink.LinkByName(obj.Name())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	}
+	if link.Attrs().MTU == obj.MTU {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("mtuCheckApply(%t)", apply)
+
+	if err := netlink.LinkSetMTU(link, obj.MTU); err != nil {
+		return false, errwrap.Wrapf(err, "error setting mtu")
+	}
+	return false, nil
+}
+
+// routesCheckApply checks the static routes of the link. Routes to the same
+// destination which don't match are replaced, and the rest are left alone.
+func (obj *NetRes) routesCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	for _, r := range obj.Routes {
+		ip, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "error parsing route destination")
+		}
+		if ones, _ := dst.Mask.Size(); ones == 0 {
+			dst = nil // netlink has no destination for default routes
+		}
+		route := netlink.Route{
+			LinkIndex: obj.iface.iface.Index,
+			Dst:       dst,
+			Gw:        net.ParseIP(r.Gateway), // nil if empty
+			Priority:  r.Metric,
+			Table:     r.Table,
+			Protocol:  rtProtoStatic,
+		}
+		filter := &netlink.Route{
+			LinkIndex: obj.iface.iface.Index,
+			Dst:       dst,
+			Table:     r.Table,
+		}
+		if filter.Table == 0 {
+			filter.Table = unix.RT_TABLE_MAIN
+		}
+		mask := netlink.RT_FILTER_OIF | netlink.RT_FILTER_TABLE | netlink.RT_FILTER_DST
+		routes, err := netlink.RouteListFiltered(netFamily(ip), filter, mask)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "error getting routes")
+		}
+		if len(routes) == 1 && routes[0].Gw.Equal(route.Gw) && routes[0].Priority == route.Priority {
+			continue
+		}
+		checkOK = false
+
+		if !apply {
+			continue
+		}
+		obj.init.Logf("routesCheckApply(%t): %s", apply, r.Dst)
+
+		for i := range routes {
+			if err := netlink.RouteDel(&routes[i]); err != nil {
+				return false, errwrap.Wrapf(err, "error deleting route: %+v", routes[i])
+			}
+		}
+		if err := netlink.RouteReplace(&route); err != nil {
+			return false, errwrap.Wrapf(err, "error replacing route: %s", r.Dst)
+		}
+	}
+	return checkOK, nil
+}
+
+// rulesCheckApply checks that the routing policy rules exist and adds the
+// missing ones.
+func (obj *NetRes) rulesCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	for _, r := range obj.Rules {
+		rule := netlink.NewRule()
+		rule.Table = r.Table
+		if r.Priority != 0 {
+			rule.Priority = r.Priority
+		}
+		var ip net.IP
+		if r.From != "" {
+			if ip, rule.Src, _ = net.ParseCIDR(r.From); rule.Src == nil {
+				return false, fmt.Errorf("error parsing rule source: %s", r.From)
+			}
+		}
+		if r.To != "" {
+			if ip, rule.Dst, _ = net.ParseCIDR(r.To); rule.Dst == nil {
+				return false, fmt.Errorf("error parsing rule destination: %s", r.To)
+			}
+		}
+		rule.Family = netFamily(ip)
+
+		rules, err := netlink.RuleList(rule.Family)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "error getting rules")
+		}
+		found := false
+		for _, x := range rules {
+			if x.Table != rule.Table || (rule.Priority >= 0 && x.Priority != rule.Priority) {
+				continue
+			}
+			if netIPNetEqual(x.Src, rule.Src) && netIPNetEqual(x.Dst, rule.Dst) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		checkOK = false
+
+		if !apply {
+			continue
+		}
+		obj.init.Logf("rulesCheckApply(%t): %+v", apply, r)
+
+		if err := netlink.RuleAdd(rule); err != nil {
+			return false, errwrap.Wrapf(err, "error adding rule: %+v", r)
+		}
+	}
+	return checkOK, nil
+}
+
+// fileCheckApply checks and maintains the systemd-networkd unit file contents.
+func (obj *NetRes) fileCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	files := obj.unitFiles()
+	keys := []string{}
+	for p := range files {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+
+	for _, p := range keys {
+		contents := files[p]
+		// check the file contents
+		unitFile, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "error reading file")
+		}
+		// skip the file if it's good
+		if err == nil && bytes.Equal(unitFile, contents) {
+			continue
+		}
+		checkOK = false
+
+		if !apply {
+			continue
+		}
+		obj.init.Logf("fileCheckApply(%t): %s", apply, p)
+
+		// write the file
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return false, errwrap.Wrapf(err, "error making configuration dir")
+		}
+		if err := ioutil.WriteFile(p, contents, networkdUnitFileUmask); err != nil {
+			return false, errwrap.Wrapf(err, "error writing configuration file")
+		}
+	}
+	return checkOK, nil
+}
+
 // CheckApply is run to check the state and, if apply is true, to apply the
 // necessary changes to reach the desired state. This is run before Watch and
 // again if Watch finds a change occurring to the state.
 func (obj *NetRes) CheckApply(apply bool) (checkOK bool, err error) {
 	checkOK = true
 
-	// check the network device
-	if c, err := obj.ifaceCheckApply(apply); err != nil {
+	// check the virtual link
+	if obj.Type != "" {
+		if c, err := obj.netdevCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+		// the remaining checks need the link
+		if obj.iface == nil {
+			return false, nil
+		}
+	}
+
+	// check the bridge or bond which the link is a member of
+	if c, err := obj.masterCheckApply(apply); err != nil {
 		return false, err
 	} else if !c {
 		checkOK = false
 	}
 
-	// if the interface is supposed to be down, we're done
-	if obj.State == ifaceDown {
-		return checkOK, nil
-	}
-
-	// check the addresses
-	if c, err := obj.addrCheckApply(apply); err != nil {
+	// check the mtu
+	if c, err := obj.mtuCheckApply(apply); err != nil {
 		return false, err
 	} else if !c {
 		checkOK = false
 	}
 
-	// check the gateway
-	if c, err := obj.gatewayCheckApply(apply); err != nil {
+	// check the network device
+	if c, err := obj.ifaceCheckApply(apply); err != nil {
 		return false, err
 	} else if !c {
 		checkOK = false
 	}
 
-	// if the state is unspecified, we're done
-	if obj.State == "" {
-		return checkOK, nil
+	// if the interface is supposed to be down, only the files are left
+	if obj.State != ifaceDown {
+		// check the addresses
+		if c, err := obj.addrCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+
+		// check the gateway
+		if c, err := obj.gatewayCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+
+		// check the static routes
+		if c, err := obj.routesCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+
+		// check the routing policy rules
+		if c, err := obj.rulesCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
 	}
 
-	// check the networkd unit file
+	// check the networkd unit files
 	if c, err := obj.fileCheckApply(apply); err != nil {
 		return false, err
 	} else if !c {
@@ -543,6 +1119,24 @@ func (obj *NetRes) Compare(r engine.Res) bool {
 	if obj.Gateway != res.Gateway {
 		return false
 	}
+	if obj.Type != res.Type || obj.Parent != res.Parent || obj.VLANID != res.VLANID {
+		return false
+	}
+	if obj.BondMode != res.BondMode || obj.Master != res.Master || obj.MTU != res.MTU {
+		return false
+	}
+	if !reflect.DeepEqual(obj.DNS, res.DNS) || !reflect.DeepEqual(obj.Domains, res.Domains) {
+		return false
+	}
+	if !reflect.DeepEqual(obj.Routes, res.Routes) || !reflect.DeepEqual(obj.Rules, res.Rules) {
+		return false
+	}
+	if obj.PrivateKeyFile != res.PrivateKeyFile || obj.ListenPort != res.ListenPort {
+		return false
+	}
+	if !reflect.DeepEqual(obj.Peers, res.Peers) {
+		return false
+	}
 
 	return true
 }
@@ -567,6 +1161,54 @@ func (obj *NetUID) IFF(uid engine.ResUID) bool {
 	return obj.name == res.name
 }
 
+// NetResAutoEdges holds the state of the auto edge generator.
+type NetResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *NetResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue!
+func (obj *NetResAutoEdges) Test(input []bool) bool {
+	return false // we only ever return one batch of edges
+}
+
+// AutoEdges returns the links that this link is on top of, and the private key
+// file of a wireguard link. A vlan needs its parent, and a member of a bridge
+// or a bond needs its master.
+func (obj *NetRes) AutoEdges() (engine.AutoEdge, error) {
+	var reversed = true
+	edges := []engine.ResUID{}
+	for _, name := range []string{obj.Parent, obj.Master} {
+		if name == "" {
+			continue
+		}
+		edges = append(edges, &NetUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			name: name,
+		})
+	}
+	if obj.PrivateKeyFile != "" {
+		edges = append(edges, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: obj.PrivateKeyFile,
+		})
+	}
+	return &NetResAutoEdges{edges: edges}, nil
+}
+
 // UIDs includes all params to make a unique identification of this object.
 // Most resources only return one although some resources can return multiple.
 func (obj *NetRes) UIDs() []engine.ResUID {
@@ -597,11 +1239,35 @@ func (obj *NetRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// unitFiles returns the contents of all the networkd files for the definition,
+// indexed by path.
+func (obj *NetRes) unitFiles() map[string][]byte {
+	files := make(map[string][]byte)
+	if obj.Type != "" {
+		files[obj.netdevFilePath()] = obj.netdevFileContents()
+	}
+	// the .network file is only used for links that are up
+	if obj.State == ifaceUp {
+		files[obj.unitFilePath] = obj.unitFileContents()
+	}
+	// a vlan gets added to the .network file of its parent with a drop-in
+	if obj.Type == "vlan" {
+		dir := path.Join(obj.unitFileDir, IfacePrefix+obj.Parent+networkdUnitFileExt+".d")
+		c := fmt.Sprintf("[Network]\nVLAN=%s", obj.Name())
+		files[path.Join(dir, IfacePrefix+obj.Name()+".conf")] = []byte(c)
+	}
+	return files
+}
+
 // unitFileContents builds the unit file contents from the definition.
 func (obj *NetRes) unitFileContents() []byte {
 	// build the unit file contents
 	u := []string{"[Match]"}
 	u = append(u, fmt.Sprintf("Name=%s", obj.Name()))
+	if obj.MTU != 0 {
+		u = append(u, "[Link]")
+		u = append(u, fmt.Sprintf("MTUBytes=%d", obj.MTU))
+	}
 	u = append(u, "[Network]")
 	for _, addr := range obj.Addrs {
 		u = append(u, fmt.Sprintf("Address=%s", addr))
@@ -609,10 +1275,133 @@ func (obj *NetRes) unitFileContents() []byte {
 	if obj.Gateway != "" {
 		u = append(u, fmt.Sprintf("Gateway=%s", obj.Gateway))
 	}
+	for _, dns := range obj.DNS {
+		u = append(u, fmt.Sprintf("DNS=%s", dns))
+	}
+	if len(obj.Domains) > 0 {
+		u = append(u, fmt.Sprintf("Domains=%s", strings.Join(obj.Domains, " ")))
+	}
+	switch obj.masterKind {
+	case "bridge":
+		u = append(u, fmt.Sprintf("Bridge=%s", obj.Master))
+	case "bond":
+		u = append(u, fmt.Sprintf("Bond=%s", obj.Master))
+	}
+	for _, r := range obj.Routes {
+		u = append(u, "[Route]")
+		u = append(u, fmt.Sprintf("Destination=%s", r.Dst))
+		if r.Gateway != "" {
+			u = append(u, fmt.Sprintf("Gateway=%s", r.Gateway))
+		}
+		if r.Metric != 0 {
+			u = append(u, fmt.Sprintf("Metric=%d", r.Metric))
+		}
+		if r.Table != 0 {
+			u = append(u, fmt.Sprintf("Table=%d", r.Table))
+		}
+	}
+	for _, r := range obj.Rules {
+		u = append(u, "[RoutingPolicyRule]")
+		if r.From != "" {
+			u = append(u, fmt.Sprintf("From=%s", r.From))
+		}
+		if r.To != "" {
+			u = append(u, fmt.Sprintf("To=%s", r.To))
+		}
+		u = append(u, fmt.Sprintf("Table=%d", r.Table))
+		if r.Priority != 0 {
+			u = append(u, fmt.Sprintf("Priority=%d", r.Priority))
+		}
+	}
 	c := strings.Join(u, "\n")
 	return []byte(c)
 }
 
+// ownsFile returns true if the networkd file or dir at the path is one of ours.
+func (obj *NetRes) ownsFile(p string) bool {
+	if strings.HasPrefix(path.Base(p), IfacePrefix+obj.Name()+".") {
+		return true
+	}
+	// the vlan drop-in dir of the parent
+	return obj.Type == "vlan" && path.Base(p) == IfacePrefix+obj.Parent+networkdUnitFileExt+".d"
+}
+
+// netdevFilePath returns the path of the networkd netdev file.
+func (obj *NetRes) netdevFilePath() string {
+	return path.Join(obj.unitFileDir, IfacePrefix+obj.Name()+networkdNetdevFileExt)
+}
+
+// netdevFileContents builds the netdev file contents from the definition.
+func (obj *NetRes) netdevFileContents() []byte {
+	u := []string{"[NetDev]"}
+	u = append(u, fmt.Sprintf("Name=%s", obj.Name()))
+	u = append(u, fmt.Sprintf("Kind=%s", obj.Type))
+	if obj.MTU != 0 {
+		u = append(u, fmt.Sprintf("MTUBytes=%d", obj.MTU))
+	}
+	switch obj.Type {
+	case "bond":
+		if obj.BondMode != "" {
+			u = append(u, "[Bond]")
+			u = append(u, fmt.Sprintf("Mode=%s", obj.BondMode))
+		}
+	case "vlan":
+		u = append(u, "[VLAN]")
+		u = append(u, fmt.Sprintf("Id=%d", obj.VLANID))
+	case "wireguard":
+		u = append(u, "[WireGuard]")
+		u = append(u, fmt.Sprintf("PrivateKeyFile=%s", obj.PrivateKeyFile))
+		if hash := obj.wireguardKeyHash(); hash != "" {
+			u = append(u, fmt.Sprintf("# PrivateKeyHash=%s", hash))
+		}
+		if obj.ListenPort != 0 {
+			u = append(u, fmt.Sprintf("ListenPort=%d", obj.ListenPort))
+		}
+		for _, peer := range obj.Peers {
+			u = append(u, "[WireGuardPeer]")
+			u = append(u, fmt.Sprintf("PublicKey=%s", peer.PublicKey))
+			if len(peer.AllowedIPs) > 0 {
+				u = append(u, fmt.Sprintf("AllowedIPs=%s", strings.Join(peer.AllowedIPs, ",")))
+			}
+			if peer.Endpoint != "" {
+				u = append(u, fmt.Sprintf("Endpoint=%s", peer.Endpoint))
+			}
+			if peer.PersistentKeepalive != 0 {
+				u = append(u, fmt.Sprintf("PersistentKeepalive=%d", peer.PersistentKeepalive))
+			}
+		}
+	}
+	c := strings.Join(u, "\n")
+	return []byte(c)
+}
+
+// wireguardKeyHash returns the hash of the private key of a wireguard link, or
+// an empty string if it can't be read. Networkd reads the key file itself, so
+// the hash is only in the netdev file to make a changed key change the file.
+func (obj *NetRes) wireguardKeyHash() string {
+	key, err := ioutil.ReadFile(obj.PrivateKeyFile)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(key))
+}
+
+// netFamily returns the netlink family of the ip, which is ipv4 if it's nil.
+func netFamily(ip net.IP) int {
+	if ip == nil || ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// netIPNetEqual returns true if both networks are nil or equal.
+func netIPNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
 // iface wraps net.Interface to add additional methods.
 type iface struct {
 	iface *net.Interface
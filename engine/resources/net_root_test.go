@@ -0,0 +1,150 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build root,!darwin
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// netTestNamespace runs fn inside a new network namespace, so that the links
+// which the test makes don't touch the host.
+func netTestNamespace(t *testing.T, fn func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatalf("could not get the network namespace: %v", err)
+	}
+	defer orig.Close()
+	ns, err := netns.New() // this also switches to it
+	if err != nil {
+		t.Fatalf("could not make a network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	fn()
+}
+
+// netConverge runs Init and CheckApply on each resource in order until they
+// converge, and then checks that they stay that way.
+func netConverge(t *testing.T, dir string, resources ...*NetRes) {
+	for _, res := range resources {
+		res.unitFileDir = dir
+		if err := res.Validate(); err != nil {
+			t.Fatalf("validate of %s failed with: %v", res.Name(), err)
+		}
+		init := &engine.Init{
+			Debug: testing.Verbose(),
+			Logf: func(format string, v ...interface{}) {
+				t.Logf("test: "+format, v...)
+			},
+			VarDir: func(p string) (string, error) {
+				return path.Join(dir, "var", p), nil
+			},
+		}
+		if err := res.Init(init); err != nil {
+			t.Fatalf("init of %s failed with: %v", res.Name(), err)
+		}
+		if _, err := res.CheckApply(true); err != nil {
+			t.Fatalf("checkapply of %s failed with: %v", res.Name(), err)
+		}
+	}
+	for _, res := range resources {
+		checkOK, err := res.CheckApply(false)
+		if err != nil {
+			t.Fatalf("checkapply of %s failed with: %v", res.Name(), err)
+		}
+		if !checkOK {
+			t.Errorf("%s did not converge", res.Name())
+		}
+	}
+}
+
+func TestNetNetdevs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-net-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	netTestNamespace(t, func() {
+		// a vlan on top of a bond on top of two nics
+		bond := &NetRes{State: "up", Type: "bond", BondMode: "active-backup", MTU: 1400}
+		bond.SetName("bond0")
+		nic1 := &NetRes{State: "up", Type: "dummy", Master: "bond0"}
+		nic1.SetName("nic1")
+		nic2 := &NetRes{State: "up", Type: "dummy", Master: "bond0"}
+		nic2.SetName("nic2")
+		vlan := &NetRes{
+			State:  "up",
+			Type:   "vlan",
+			Parent: "bond0",
+			VLANID: 42,
+			Addrs:  []string{"10.42.0.13/24"},
+			Routes: []NetRoute{
+				{Dst: "10.43.0.0/16", Gateway: "10.42.0.1", Metric: 100},
+				{Dst: "0.0.0.0/0", Gateway: "10.42.0.254", Table: 42},
+			},
+			Rules: []NetRule{
+				{From: "10.42.0.0/24", Table: 42, Priority: 1042},
+			},
+		}
+		vlan.SetName("bond0.42")
+		netConverge(t, dir, bond, nic1, nic2, vlan)
+
+		link, err := netlink.LinkByName("bond0.42")
+		if err != nil {
+			t.Fatalf("the vlan is missing: %v", err)
+		}
+		if x, ok := link.(*netlink.Vlan); !ok || x.VlanId != 42 || x.MTU != 1400 {
+			t.Errorf("unexpected vlan: %+v", link)
+		}
+		master, err := netlink.LinkByName("bond0")
+		if err != nil {
+			t.Fatalf("the bond is missing: %v", err)
+		}
+		if link, err := netlink.LinkByName("nic2"); err != nil || link.Attrs().MasterIndex != master.Attrs().Index {
+			t.Errorf("nic2 is not in the bond: %v", err)
+		}
+		for _, f := range []string{"mgmt-bond0.netdev", "mgmt-nic1.network", "mgmt-bond0.network.d/mgmt-bond0.42.conf"} {
+			if _, err := os.Stat(path.Join(dir, f)); err != nil {
+				t.Errorf("missing file: %v", err)
+			}
+		}
+
+		// a vlan with a different id has to be recreated
+		vlan.VLANID = 43
+		netConverge(t, dir, vlan)
+		if link, err := netlink.LinkByName("bond0.42"); err != nil || link.(*netlink.Vlan).VlanId != 43 {
+			t.Errorf("the vlan was not recreated: %v", err)
+		}
+	})
+}
@@ -19,6 +19,9 @@ package resources
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 
@@ -70,6 +73,68 @@ var unitFileContentsTests = []struct {
 				"\n"),
 		),
 	},
+	{
+		"bond0",
+		&NetRes{
+			State:   "up",
+			Addrs:   []string{"10.0.3.13/24"},
+			MTU:     9000,
+			DNS:     []string{"10.0.3.1", "10.0.3.2"},
+			Domains: []string{"example.com", "~corp"},
+			Routes: []NetRoute{
+				{Dst: "10.1.0.0/16", Gateway: "10.0.3.254", Metric: 100},
+				{Dst: "0.0.0.0/0", Gateway: "10.0.3.253", Table: 10},
+			},
+			Rules: []NetRule{
+				{From: "10.0.3.0/24", Table: 10, Priority: 1000},
+			},
+		},
+		[]byte(
+			strings.Join(
+				[]string{
+					"[Match]",
+					"Name=bond0",
+					"[Link]",
+					"MTUBytes=9000",
+					"[Network]",
+					"Address=10.0.3.13/24",
+					"DNS=10.0.3.1",
+					"DNS=10.0.3.2",
+					"Domains=example.com ~corp",
+					"[Route]",
+					"Destination=10.1.0.0/16",
+					"Gateway=10.0.3.254",
+					"Metric=100",
+					"[Route]",
+					"Destination=0.0.0.0/0",
+					"Gateway=10.0.3.253",
+					"Table=10",
+					"[RoutingPolicyRule]",
+					"From=10.0.3.0/24",
+					"Table=10",
+					"Priority=1000",
+				},
+				"\n"),
+		),
+	},
+	{
+		"eth1",
+		&NetRes{
+			State:      "up",
+			Master:     "br0",
+			masterKind: "bridge",
+		},
+		[]byte(
+			strings.Join(
+				[]string{
+					"[Match]",
+					"Name=eth1",
+					"[Network]",
+					"Bridge=br0",
+				},
+				"\n"),
+		),
+	},
 }
 
 // test NetRes.unitFileContents()
@@ -83,6 +148,176 @@ func TestUnitFileContents(t *testing.T) {
 	}
 }
 
+// test NetRes.netdevFileContents()
+func TestNetdevFileContents(t *testing.T) {
+	tests := []struct {
+		dev string
+		in  *NetRes
+		out []string
+	}{
+		{"br0", &NetRes{Type: "bridge"}, []string{"[NetDev]", "Name=br0", "Kind=bridge"}},
+		{"bond0", &NetRes{Type: "bond", BondMode: "802.3ad", MTU: 9000}, []string{"[NetDev]", "Name=bond0", "Kind=bond", "MTUBytes=9000", "[Bond]", "Mode=802.3ad"}},
+		{"bond0.42", &NetRes{Type: "vlan", Parent: "bond0", VLANID: 42}, []string{"[NetDev]", "Name=bond0.42", "Kind=vlan", "[VLAN]", "Id=42"}},
+		{
+			"wg0",
+			&NetRes{
+				Type:           "wireguard",
+				PrivateKeyFile: "/etc/wireguard/wg0.key",
+				ListenPort:     51820,
+				Peers: []NetWireguardPeer{
+					{PublicKey: "cGVlcg==", AllowedIPs: []string{"10.9.0.2/32", "10.10.0.0/16"}, Endpoint: "203.0.113.7:51820", PersistentKeepalive: 25},
+				},
+			},
+			[]string{"[NetDev]", "Name=wg0", "Kind=wireguard", "[WireGuard]", "PrivateKeyFile=/etc/wireguard/wg0.key", "ListenPort=51820", "[WireGuardPeer]", "PublicKey=cGVlcg==", "AllowedIPs=10.9.0.2/32,10.10.0.0/16", "Endpoint=203.0.113.7:51820", "PersistentKeepalive=25"},
+		},
+	}
+	for _, test := range tests {
+		test.in.SetName(test.dev)
+		result := test.in.netdevFileContents()
+		if out := []byte(strings.Join(test.out, "\n")); !bytes.Equal(out, result) {
+			t.Errorf("netdev test wanted:\n %s, got:\n %s", out, result)
+		}
+	}
+}
+
+// test that a changed wireguard key changes NetRes.netdevFileContents()
+func TestNetdevFileContentsKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-test-net-")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "wg0.key")
+
+	res := &NetRes{Type: "wireguard", PrivateKeyFile: keyFile}
+	res.SetName("wg0")
+	if err := ioutil.WriteFile(keyFile, []byte("key1\n"), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	c1 := res.netdevFileContents()
+	if bytes.Contains(c1, []byte("key1")) {
+		t.Errorf("the netdev file must not contain the key itself:\n %s", c1)
+	}
+	if !bytes.Equal(c1, res.netdevFileContents()) {
+		t.Errorf("the netdev file must be stable for the same key")
+	}
+	if err := ioutil.WriteFile(keyFile, []byte("key2\n"), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	if c2 := res.netdevFileContents(); bytes.Equal(c1, c2) {
+		t.Errorf("the netdev file must change with the key:\n %s", c2)
+	}
+}
+
+// test NetRes.unitFiles() for the vlan drop-in
+func TestNetUnitFilesVlan(t *testing.T) {
+	res := &NetRes{
+		State:       "up",
+		Type:        "vlan",
+		Parent:      "eth0",
+		VLANID:      42,
+		unitFileDir: "/etc/systemd/network/",
+	}
+	res.SetName("eth0.42")
+	res.unitFilePath = "/etc/systemd/network/mgmt-eth0.42.network"
+	files := res.unitFiles()
+	if len(files) != 3 {
+		t.Errorf("expected three files, got: %d", len(files))
+	}
+	for _, p := range []string{"/etc/systemd/network/mgmt-eth0.42.netdev", "/etc/systemd/network/mgmt-eth0.42.network"} {
+		if _, exists := files[p]; !exists {
+			t.Errorf("missing file: %s", p)
+		}
+	}
+	dropIn := "/etc/systemd/network/mgmt-eth0.network.d/mgmt-eth0.42.conf"
+	if c := string(files[dropIn]); c != "[Network]\nVLAN=eth0.42" {
+		t.Errorf("wrong drop-in: %q", c)
+	}
+	if !res.ownsFile("/etc/systemd/network/mgmt-eth0.network.d") || res.ownsFile("/etc/systemd/network/mgmt-eth0.network") {
+		t.Errorf("the vlan watches the wrong files")
+	}
+}
+
+// test NetRes.validateNetdev()
+func TestNetValidateNetdev(t *testing.T) {
+	tests := []struct {
+		res *NetRes
+		ok  bool
+	}{
+		{&NetRes{Type: "bridge", MTU: 1500}, true},
+		{&NetRes{Type: "bond", BondMode: "active-backup"}, true},
+		{&NetRes{Type: "vlan", Parent: "bond0", VLANID: 42}, true},
+		{&NetRes{Type: "dummy", Master: "br0", DNS: []string{"10.0.0.1", "fd00::1"}, Domains: []string{"~."}}, true},
+		{&NetRes{Type: "wireguard", PrivateKeyFile: "/etc/wg.key", Peers: []NetWireguardPeer{{PublicKey: "x", AllowedIPs: []string{"10.9.0.0/24"}, Endpoint: "[fd00::1]:51820"}}}, true},
+		{&NetRes{Routes: []NetRoute{{Dst: "10.1.0.0/16", Gateway: "10.0.0.1"}}, Rules: []NetRule{{To: "10.2.0.0/16", Table: 10}}}, true},
+		{&NetRes{Type: "macvlan"}, false},
+		{&NetRes{Type: "vlan", Parent: "bond0"}, false},
+		{&NetRes{Type: "vlan", VLANID: 42}, false},
+		{&NetRes{Type: "bridge", Parent: "bond0"}, false},
+		{&NetRes{Type: "bond", BondMode: "fastest"}, false},
+		{&NetRes{Type: "bridge", BondMode: "802.3ad"}, false},
+		{&NetRes{Type: "wireguard", PrivateKeyFile: "wg.key"}, false},
+		{&NetRes{Type: "dummy", ListenPort: 51820}, false},
+		{&NetRes{Master: "test"}, false}, // itself
+		{&NetRes{MTU: -1}, false},
+		{&NetRes{DNS: []string{"dns.example.com"}}, false},
+		{&NetRes{Routes: []NetRoute{{Dst: "10.1.0.0"}}}, false},
+		{&NetRes{Rules: []NetRule{{From: "10.0.0.0/8"}}}, false},
+		{&NetRes{Rules: []NetRule{{Table: 10}}}, false},
+	}
+	for i, tt := range tests {
+		tt.res.SetName("test")
+		if err := tt.res.validateNetdev(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+// test NetRes.AutoEdges()
+func TestNetAutoEdges(t *testing.T) {
+	res := &NetRes{
+		Type:   "vlan",
+		Parent: "bond0",
+		VLANID: 42,
+		Master: "br0",
+	}
+	res.SetName("bond0.42")
+	ae, err := res.AutoEdges()
+	if err != nil {
+		t.Errorf("autoedges failed with: %v", err)
+		return
+	}
+	names := []string{}
+	for _, uid := range ae.Next() {
+		x, ok := uid.(*NetUID)
+		if !ok || !uid.IsReversed() {
+			t.Errorf("unexpected uid: %+v", uid)
+			continue
+		}
+		names = append(names, x.name)
+	}
+	if s := strings.Join(names, " "); s != "bond0 br0" {
+		t.Errorf("got wrong links: %s", s)
+	}
+
+	res = &NetRes{Type: "wireguard", PrivateKeyFile: "/etc/wireguard/wg0.key"}
+	res.SetName("wg0")
+	if ae, err = res.AutoEdges(); err != nil {
+		t.Errorf("autoedges failed with: %v", err)
+		return
+	}
+	uids := ae.Next()
+	if len(uids) != 1 {
+		t.Errorf("expected one edge, got: %d", len(uids))
+		return
+	}
+	if x, ok := uids[0].(*FileUID); !ok || x.path != "/etc/wireguard/wg0.key" {
+		t.Errorf("the link must depend on the key: %+v", uids[0])
+	}
+}
+
 // test cases for socketSet.fdSet()
 var fdSetTests = []struct {
 	in  *socketSet
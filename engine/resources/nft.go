@@ -0,0 +1,597 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// NftCmd is the default path of the nft command.
+	NftCmd = "nft"
+	// NftFamily is the default address family of the table.
+	NftFamily = "inet"
+	// NftPolicy is the default policy of a base chain.
+	NftPolicy = "accept"
+	// NftPoll is the default interval in seconds between each check of the
+	// running rule set. It changes without any notification that we watch.
+	NftPoll = 10
+	// NftCommentPrefix is prepended to the comment which we add to each rule
+	// that we manage. This is how each rule gets identified when it is read
+	// back, since nft doesn't return the rules in the same syntax we used.
+	NftCommentPrefix = "mgmt:"
+)
+
+func init() {
+	engine.RegisterResource("nft", func() engine.Res { return &NftRes{} })
+}
+
+// NftRes is a firewall resource which manages a chain, and the list of rules in
+// it, in the nftables rule set. The chain is owned completely by us, and so any
+// rules which are added to it by someone else will get removed. The running rule
+// set is compared against the rules, and any changes are applied atomically in a
+// single transaction. Multiple nft resources get grouped together, so that the
+// changes for all of them are applied in that same transaction.
+type NftRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Groupable
+
+	init *engine.Init
+
+	// State is either exists or absent. If absent, then the chain and all
+	// of its rules are removed, but the table is left alone.
+	State string `yaml:"state"`
+
+	// Family is the address family of the table, eg: inet, ip or ip6.
+	Family string `yaml:"family"`
+	// Table is the name of the table which contains the chain. It gets
+	// created if it doesn't exist, but it is never removed.
+	Table string `yaml:"table"`
+	// Chain is the name of the chain. If it is not specified, then the
+	// resource name is used.
+	Chain string `yaml:"chain"`
+
+	// Type is the type of the chain, eg: filter, nat or route. If this is
+	// empty, then this is a regular chain instead of a base chain, and the
+	// Hook, Priority and Policy are not used.
+	Type string `yaml:"type"`
+	// Hook is the netfilter hook of the base chain, eg: input or forward.
+	Hook string `yaml:"hook"`
+	// Priority is the priority of the base chain.
+	Priority int `yaml:"priority"`
+	// Policy is the policy of the base chain. It defaults to accept.
+	Policy string `yaml:"policy"`
+
+	// Rules is the list of rules in the chain, in order, using the usual nft
+	// syntax, eg: `tcp dport 22 accept`. A rule must not have a comment,
+	// since we use that to identify it.
+	Rules []string `yaml:"rules"`
+
+	// Poll is the number of seconds between checks of the running rule set.
+	// If it is zero, then the rule set is not watched at all.
+	Poll uint32 `yaml:"poll"`
+
+	runner nftRunner // runs the nft commands, and can be replaced in tests
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NftRes) Default() engine.Res {
+	return &NftRes{
+		State:  "exists",
+		Family: NftFamily,
+		Policy: NftPolicy,
+		Poll:   NftPoll,
+	}
+}
+
+// getChain returns the actual chain name to use for this resource. It computes
+// this after analysis of the Chain and Name.
+func (obj *NftRes) getChain() string {
+	if obj.Chain == "" { // use the name as the chain default if missing
+		return obj.Name()
+	}
+	return obj.Chain
+}
+
+// spec returns the chain that this resource specifies.
+func (obj *NftRes) spec() *nftChain {
+	chain := &nftChain{
+		Family: obj.Family,
+		Table:  obj.Table,
+		Name:   obj.getChain(),
+	}
+	if obj.Type != "" { // base chain
+		chain.Type = obj.Type
+		chain.Hook = obj.Hook
+		chain.Prio = obj.Priority
+		chain.Policy = obj.Policy
+	}
+	return chain
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NftRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("the State is invalid")
+	}
+	switch obj.Family {
+	case "ip", "ip6", "inet", "arp", "bridge", "netdev":
+	default:
+		return fmt.Errorf("the Family `%s` is invalid", obj.Family)
+	}
+	if err := nftIdentifier(obj.Table); err != nil {
+		return errwrap.Wrapf(err, "the Table is invalid")
+	}
+	if err := nftIdentifier(obj.getChain()); err != nil {
+		return errwrap.Wrapf(err, "the Chain is invalid")
+	}
+	if obj.Type == "" && obj.Hook != "" {
+		return fmt.Errorf("the Hook can only be used with a Type")
+	}
+	if obj.Type != "" && obj.Hook == "" {
+		return fmt.Errorf("the Hook must be specified with a Type")
+	}
+	if obj.Type != "" && obj.Policy != "accept" && obj.Policy != "drop" {
+		return fmt.Errorf("the Policy must be either accept or drop")
+	}
+	for _, rule := range obj.Rules {
+		if strings.TrimSpace(rule) == "" {
+			return fmt.Errorf("a rule must not be empty")
+		}
+		if strings.ContainsAny(rule, "\n;") {
+			return fmt.Errorf("the rule `%s` must be a single statement", rule)
+		}
+		if strings.Contains(rule, "comment") {
+			return fmt.Errorf("the rule `%s` must not have a comment", rule)
+		}
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *NftRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	if obj.runner == nil {
+		obj.runner = &nftCmdRunner{cmd: NftCmd}
+	}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *NftRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. Since
+// there is nothing to watch, the running rule set gets polled for changes.
+func (obj *NftRes) Watch() error {
+	var tick <-chan time.Time // nil channels block forever
+	var last []byte
+	if obj.Poll > 0 {
+		ticker := time.NewTicker(time.Duration(obj.Poll) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+		last, _ = obj.runner.List() // errors show in CheckApply
+	}
+
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	var send = false // send event?
+	for {
+		select {
+		case <-tick:
+			b, _ := obj.runner.List() // errors show in CheckApply
+			if bytes.Equal(b, last) {
+				continue
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event: the rule set changed")
+			}
+			last = b
+			send = true
+			obj.init.Dirty() // dirty
+
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			if err := obj.init.Event(); err != nil {
+				return err // exit if requested
+			}
+		}
+	}
+}
+
+// members returns this resource and all of the resources grouped into it.
+func (obj *NftRes) members() []*NftRes {
+	result := []*NftRes{obj}
+	for _, x := range obj.GetGroup() {
+		res, ok := x.(*NftRes) // convert from Res
+		if !ok {
+			panic(fmt.Sprintf("grouped member %v is not a %s", x, obj.Kind()))
+		}
+		result = append(result, res)
+	}
+	return result
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+// All of the changes for the grouped resources are applied in one transaction.
+func (obj *NftRes) CheckApply(apply bool) (bool, error) {
+	b, err := obj.runner.List()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not list the rule set")
+	}
+	ruleset, err := nftParse(b)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not parse the rule set")
+	}
+
+	changes := &nftChanges{}
+	for _, res := range obj.members() {
+		if !ruleset.changes(changes, res.spec(), res.State == "exists", res.Rules) {
+			continue
+		}
+		if obj.init.Debug || !apply {
+			obj.init.Logf("chain `%s` differs", res.spec())
+		}
+	}
+	script := changes.script()
+	if len(script) == 0 {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	data := strings.Join(script, "\n") + "\n"
+	if obj.init.Debug {
+		obj.init.Logf("applying:\n%s", data)
+	}
+	if err := obj.runner.Apply(data); err != nil {
+		return false, errwrap.Wrapf(err, "could not apply the rule set")
+	}
+	obj.init.Logf("applied %d change(s)", len(script))
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *NftRes) Cmp(r engine.Res) error {
+	res, ok := r.(*NftRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if *obj.spec() != *res.spec() {
+		return fmt.Errorf("the chain differs")
+	}
+	if len(obj.Rules) != len(res.Rules) {
+		return fmt.Errorf("the number of Rules differs")
+	}
+	for i, x := range obj.Rules {
+		if x != res.Rules[i] {
+			return fmt.Errorf("the rule at index %d differs", i)
+		}
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("the Poll param differs")
+	}
+
+	return nil
+}
+
+// NftUID is the UID struct for NftRes.
+type NftUID struct {
+	engine.BaseUID
+
+	family string
+	table  string
+	chain  string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *NftUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*NftUID)
+	if !ok {
+		return false
+	}
+	return obj.family == res.family && obj.table == res.table && obj.chain == res.chain
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *NftRes) UIDs() []engine.ResUID {
+	x := &NftUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		family:  obj.Family,
+		table:   obj.Table,
+		chain:   obj.getChain(),
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Any
+// two nft resources can be grouped, as long as they are watched the same way.
+func (obj *NftRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*NftRes)
+	if !ok {
+		return fmt.Errorf("resource is not the same kind")
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("resource uses a different poll interval")
+	}
+	if obj.runner != res.runner {
+		return fmt.Errorf("resource uses a different runner")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *NftRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NftRes // indirection to avoid infinite recursion
+
+	def := obj.Default()     // get the default
+	res, ok := def.(*NftRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NftRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NftRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// nftRunner runs the nft commands that the resource needs. This is an interface
+// so that a fake nft can be used in the tests.
+type nftRunner interface {
+	// List returns the running rule set, in the json format which is used
+	// by `nft -j list ruleset`.
+	List() ([]byte, error)
+
+	// Apply atomically applies a script of nft commands, as `nft -f` does.
+	Apply(script string) error
+}
+
+// nftCmdRunner is the nftRunner which runs the real nft command.
+type nftCmdRunner struct {
+	cmd string
+}
+
+// List returns the running rule set in the json format.
+func (obj *nftCmdRunner) List() ([]byte, error) {
+	return obj.run(nil, "-j", "list", "ruleset")
+}
+
+// Apply applies the script in a single transaction by reading it from stdin.
+func (obj *nftCmdRunner) Apply(script string) error {
+	_, err := obj.run(strings.NewReader(script), "-f", "-")
+	return err
+}
+
+// run runs the nft command and returns the stdout, or the stderr as an error.
+func (obj *nftCmdRunner) run(stdin *strings.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command(obj.cmd, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errwrap.Wrapf(err, "%s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// nftChain is a chain, as found in the json output of nft. The regular chains
+// have empty values for all of the base chain fields.
+type nftChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+
+	Type   string `json:"type"`
+	Hook   string `json:"hook"`
+	Prio   int    `json:"prio"`
+	Policy string `json:"policy"`
+}
+
+// String returns the family, table and name of the chain as used by nft.
+func (obj *nftChain) String() string {
+	return fmt.Sprintf("%s %s %s", obj.Family, obj.Table, obj.Name)
+}
+
+// nftRule is a rule, as found in the json output of nft. The expressions are
+// ignored, and only the comment is used to identify the rule.
+type nftRule struct {
+	Family  string `json:"family"`
+	Table   string `json:"table"`
+	Chain   string `json:"chain"`
+	Comment string `json:"comment"`
+}
+
+// nftRuleset is the part of the running rule set that we care about.
+type nftRuleset struct {
+	tables   map[string]bool      // the existing tables
+	chains   map[string]*nftChain // the existing chains
+	comments map[string][]string  // the comments of the rules in each chain
+}
+
+// nftParse parses the json output of `nft -j list ruleset`.
+func nftParse(b []byte) (*nftRuleset, error) {
+	output := struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}{}
+	if err := json.Unmarshal(b, &output); err != nil {
+		return nil, err
+	}
+
+	ruleset := &nftRuleset{
+		tables:   make(map[string]bool),
+		chains:   make(map[string]*nftChain),
+		comments: make(map[string][]string),
+	}
+	for _, x := range output.Nftables {
+		if data, exists := x["table"]; exists {
+			table := &nftChain{}
+			if err := json.Unmarshal(data, table); err != nil {
+				return nil, errwrap.Wrapf(err, "could not parse table")
+			}
+			ruleset.tables[fmt.Sprintf("%s %s", table.Family, table.Name)] = true
+		}
+		if data, exists := x["chain"]; exists {
+			chain := &nftChain{}
+			if err := json.Unmarshal(data, chain); err != nil {
+				return nil, errwrap.Wrapf(err, "could not parse chain")
+			}
+			ruleset.chains[chain.String()] = chain
+		}
+		if data, exists := x["rule"]; exists {
+			rule := &nftRule{}
+			if err := json.Unmarshal(data, rule); err != nil {
+				return nil, errwrap.Wrapf(err, "could not parse rule")
+			}
+			key := fmt.Sprintf("%s %s %s", rule.Family, rule.Table, rule.Chain)
+			ruleset.comments[key] = append(ruleset.comments[key], rule.Comment)
+		}
+	}
+	return ruleset, nil
+}
+
+// nftChanges are the nft commands which change the rule set. The commands for
+// every chain are collected first, and then they are run in this order, so that
+// the chains which jump to each other can be changed in the same transaction.
+type nftChanges struct {
+	prepare []string // add the chains, and flush the existing ones
+	create  []string // create again the chains which can't be changed
+	rules   []string // add the rules
+	remove  []string // delete the chains which should not exist
+}
+
+// script returns all of the nft commands in the order that they should be run.
+func (obj *nftChanges) script() []string {
+	result := []string{}
+	result = append(result, obj.prepare...)
+	result = append(result, obj.create...)
+	result = append(result, obj.rules...)
+	result = append(result, obj.remove...)
+	return result
+}
+
+// changes adds the nft commands which are needed to make the chain match the
+// spec, and returns true if there were any. If the chain should not exist, then
+// the rules are ignored.
+func (obj *nftRuleset) changes(changes *nftChanges, spec *nftChain, exists bool, rules []string) bool {
+	key := spec.String()
+	chain := obj.chains[key]
+	if !exists {
+		if chain == nil {
+			return false
+		}
+		changes.prepare = append(changes.prepare, fmt.Sprintf("flush chain %s", key))
+		changes.remove = append(changes.remove, fmt.Sprintf("delete chain %s", key))
+		return true
+	}
+
+	comments := []string{}
+	for _, rule := range rules {
+		comments = append(comments, nftComment(rule))
+	}
+	if chain != nil && *chain == *spec && strings.Join(obj.comments[key], "\n") == strings.Join(comments, "\n") {
+		return false // already correct
+	}
+
+	add := fmt.Sprintf("add chain %s", key)
+	if spec.Type != "" {
+		add = fmt.Sprintf("%s { type %s hook %s priority %d; policy %s; }", add, spec.Type, spec.Hook, spec.Prio, spec.Policy)
+	}
+	changes.prepare = append(changes.prepare, fmt.Sprintf("add table %s %s", spec.Family, spec.Table)) // idempotent
+	if chain == nil {
+		changes.prepare = append(changes.prepare, add)
+	} else if chain.Type != spec.Type || chain.Hook != spec.Hook || chain.Prio != spec.Prio {
+		// these can't be changed, so the chain must be created again
+		changes.prepare = append(changes.prepare, fmt.Sprintf("flush chain %s", key))
+		changes.create = append(changes.create, fmt.Sprintf("delete chain %s", key), add)
+	} else {
+		changes.prepare = append(changes.prepare, add) // this can change the policy
+		changes.prepare = append(changes.prepare, fmt.Sprintf("flush chain %s", key))
+	}
+	for i, rule := range rules {
+		changes.rules = append(changes.rules, fmt.Sprintf("add rule %s %s comment \"%s\"", key, strings.TrimSpace(rule), comments[i]))
+	}
+	return true
+}
+
+// nftComment returns the comment which identifies a rule. It is a hash of the
+// rule, so that a rule which changes gets a different comment.
+func nftComment(rule string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(rule), " ")))
+	return NftCommentPrefix + hex.EncodeToString(sum[:])[:16]
+}
+
+// nftIdentifier returns an error if the name can't be used as a table or chain
+// name without quoting.
+func nftIdentifier(name string) error {
+	if name == "" {
+		return fmt.Errorf("the name must not be empty")
+	}
+	for i, c := range name {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' {
+			continue
+		}
+		if i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.') {
+			continue
+		}
+		return fmt.Errorf("the name `%s` contains an invalid character", name)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// nftFakeTable is a table in the rule set of the fake nft.
+type nftFakeTable struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+}
+
+// nftFake is a fake nft which records the rule set in a file. It understands
+// the commands that the nft resource uses, and applies each script atomically.
+type nftFake struct {
+	filename     string
+	transactions int // number of scripts applied
+}
+
+// load reads the rule set from the file.
+func (obj *nftFake) load() ([]nftFakeTable, []*nftChain, []*nftRule, error) {
+	tables := []nftFakeTable{}
+	chains := []*nftChain{}
+	rules := []*nftRule{}
+	b, err := ioutil.ReadFile(obj.filename)
+	if os.IsNotExist(err) {
+		return tables, chains, rules, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	output := struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}{}
+	if err := json.Unmarshal(b, &output); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, x := range output.Nftables {
+		if data, exists := x["table"]; exists {
+			table := nftFakeTable{}
+			if err := json.Unmarshal(data, &table); err != nil {
+				return nil, nil, nil, err
+			}
+			tables = append(tables, table)
+		}
+		if data, exists := x["chain"]; exists {
+			chain := &nftChain{}
+			if err := json.Unmarshal(data, chain); err != nil {
+				return nil, nil, nil, err
+			}
+			chains = append(chains, chain)
+		}
+		if data, exists := x["rule"]; exists {
+			rule := &nftRule{}
+			if err := json.Unmarshal(data, rule); err != nil {
+				return nil, nil, nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return tables, chains, rules, nil
+}
+
+// List returns the rule set in the json format.
+func (obj *nftFake) List() ([]byte, error) {
+	tables, chains, rules, err := obj.load()
+	if err != nil {
+		return nil, err
+	}
+	output := []interface{}{
+		map[string]interface{}{"metainfo": map[string]string{"json_schema_version": "1"}},
+	}
+	for _, x := range tables {
+		output = append(output, map[string]interface{}{"table": x})
+	}
+	for _, x := range chains {
+		output = append(output, map[string]interface{}{"chain": x})
+	}
+	for _, x := range rules {
+		output = append(output, map[string]interface{}{"rule": x})
+	}
+	return json.Marshal(map[string]interface{}{"nftables": output})
+}
+
+// Apply runs the script and only records the result if every command worked.
+func (obj *nftFake) Apply(script string) error {
+	tables, chains, rules, err := obj.load()
+	if err != nil {
+		return err
+	}
+	findChain := func(key string) int {
+		for i, x := range chains {
+			if x.String() == key {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			return fmt.Errorf("invalid command: %s", line)
+		}
+		cmd := f[0] + " " + f[1]
+		if cmd == "add table" {
+			found := false
+			for _, x := range tables {
+				found = found || (x.Family == f[2] && x.Name == f[3])
+			}
+			if !found {
+				tables = append(tables, nftFakeTable{Family: f[2], Name: f[3]})
+			}
+			continue
+		}
+		if len(f) < 5 {
+			return fmt.Errorf("invalid command: %s", line)
+		}
+		key := strings.Join(f[2:5], " ")
+		i := findChain(key)
+
+		switch cmd {
+		case "add chain":
+			chain := &nftChain{Family: f[2], Table: f[3], Name: f[4]}
+			if len(f) > 5 { // { type filter hook input priority 0; policy accept; }
+				chain.Type = f[7]
+				chain.Hook = f[9]
+				chain.Prio, _ = strconv.Atoi(strings.TrimSuffix(f[11], ";"))
+				chain.Policy = strings.TrimSuffix(f[13], ";")
+			}
+			if i < 0 {
+				chains = append(chains, chain)
+			} else if chains[i].Type != chain.Type || chains[i].Hook != chain.Hook || chains[i].Prio != chain.Prio {
+				return fmt.Errorf("could not change chain: %s", key)
+			} else {
+				chains[i].Policy = chain.Policy
+			}
+
+		case "flush chain", "delete chain":
+			if i < 0 {
+				return fmt.Errorf("no such chain: %s", key)
+			}
+			kept := []*nftRule{}
+			for _, x := range rules {
+				if fmt.Sprintf("%s %s %s", x.Family, x.Table, x.Chain) == key {
+					if cmd == "delete chain" {
+						return fmt.Errorf("chain is not empty: %s", key)
+					}
+					continue
+				}
+				kept = append(kept, x)
+			}
+			rules = kept
+			if cmd == "delete chain" {
+				chains = append(chains[:i], chains[i+1:]...)
+			}
+
+		case "add rule":
+			if i < 0 {
+				return fmt.Errorf("no such chain: %s", key)
+			}
+			for j, x := range f { // jumps must be to a chain which exists
+				if x == "jump" && j+1 < len(f) && findChain(strings.Join([]string{f[2], f[3], f[j+1]}, " ")) < 0 {
+					return fmt.Errorf("no such chain to jump to: %s", f[j+1])
+				}
+			}
+			rule := &nftRule{Family: f[2], Table: f[3], Chain: f[4]}
+			if j := strings.Index(line, " comment "); j >= 0 {
+				rule.Comment = strings.Trim(line[j+len(" comment "):], "\"")
+			}
+			rules = append(rules, rule)
+
+		default:
+			return fmt.Errorf("unknown command: %s", line)
+		}
+	}
+
+	output := []interface{}{}
+	for _, x := range tables {
+		output = append(output, map[string]interface{}{"table": x})
+	}
+	for _, x := range chains {
+		output = append(output, map[string]interface{}{"chain": x})
+	}
+	for _, x := range rules {
+		output = append(output, map[string]interface{}{"rule": x})
+	}
+	b, err := json.Marshal(map[string]interface{}{"nftables": output})
+	if err != nil {
+		return err
+	}
+	obj.transactions++
+	return ioutil.WriteFile(obj.filename, b, 0600)
+}
+
+func TestNftParse(t *testing.T) {
+	// this is trimmed from the real output of `nft -j list ruleset`
+	data := `{"nftables": [{"metainfo": {"version": "0.9.6", "release_name": "Capital Idea #2", "json_schema_version": 1}}, {"table": {"family": "inet", "name": "filter", "handle": 1}}, {"chain": {"family": "inet", "table": "filter", "name": "input", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "drop"}}, {"chain": {"family": "inet", "table": "filter", "name": "ssh", "handle": 2}}, {"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 4, "comment": "mgmt:0123456789abcdef", "expr": [{"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 22}}, {"accept": null}]}}, {"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 5, "expr": [{"drop": null}]}}]}`
+
+	ruleset, err := nftParse([]byte(data))
+	if err != nil {
+		t.Errorf("parse failed with: %v", err)
+		return
+	}
+	if !ruleset.tables["inet filter"] {
+		t.Errorf("missing table")
+	}
+	exp := nftChain{Family: "inet", Table: "filter", Name: "input", Type: "filter", Hook: "input", Policy: "drop"}
+	if chain := ruleset.chains["inet filter input"]; chain == nil || *chain != exp {
+		t.Errorf("unexpected chain: %+v", chain)
+	}
+	if chain := ruleset.chains["inet filter ssh"]; chain == nil || chain.Type != "" {
+		t.Errorf("unexpected chain: %+v", chain)
+	}
+	if c := ruleset.comments["inet filter input"]; len(c) != 2 || c[0] != "mgmt:0123456789abcdef" || c[1] != "" {
+		t.Errorf("unexpected comments: %+v", c)
+	}
+}
+
+func TestNftCheckApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-nft-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fake := &nftFake{filename: path.Join(dir, "ruleset.json")}
+
+	r1 := &NftRes{
+		State:  "exists",
+		Family: "inet",
+		Table:  "filter",
+		Chain:  "input",
+		Type:   "filter",
+		Hook:   "input",
+		Policy: "drop",
+		Rules: []string{
+			"ct state established,related accept",
+			"tcp dport 22 jump ssh",
+		},
+		runner: fake,
+	}
+	r2 := &NftRes{
+		State:  "exists",
+		Family: "inet",
+		Table:  "filter",
+		Chain:  "ssh",
+		Rules: []string{
+			"ip saddr 192.168.0.0/16 accept",
+		},
+		runner: fake,
+	}
+	for _, res := range []*NftRes{r1, r2} {
+		if err := res.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+	}
+	if err := r1.GroupCmp(r2); err != nil {
+		t.Errorf("resources should group: %v", err)
+		return
+	}
+	if err := r1.GroupRes(r2); err != nil {
+		t.Errorf("grouping failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	converge := func(msg string) {
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if checkOK {
+			t.Errorf("%s: check should have failed", msg)
+		}
+		if _, err := r1.CheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", msg, err)
+		}
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if !checkOK {
+			t.Errorf("%s: check should have passed after apply", msg)
+		}
+	}
+
+	converge("create")
+	if fake.transactions != 1 {
+		t.Errorf("expected a single transaction, got: %d", fake.transactions)
+	}
+	_, chains, rules, err := fake.load()
+	if err != nil {
+		t.Errorf("error loading fake rule set: %v", err)
+		return
+	}
+	if len(chains) != 2 || len(rules) != 3 {
+		t.Errorf("unexpected rule set: %d chains, %d rules", len(chains), len(rules))
+	}
+
+	// someone else adds a rule, which must get removed
+	if err := fake.Apply("add rule inet filter input tcp dport 23 accept"); err != nil {
+		t.Errorf("error changing fake rule set: %v", err)
+		return
+	}
+	converge("foreign rule")
+	if _, _, rules, _ := fake.load(); len(rules) != 3 {
+		t.Errorf("unexpected number of rules: %d", len(rules))
+	}
+
+	// the policy can change in place
+	r1.Policy = "accept"
+	converge("policy")
+
+	// the chain gets removed, along with the jump to it
+	r1.Rules = r1.Rules[:1]
+	r2.State = "absent"
+	converge("absent")
+	if _, chains, _, _ := fake.load(); len(chains) != 1 {
+		t.Errorf("unexpected number of chains: %d", len(chains))
+	}
+}
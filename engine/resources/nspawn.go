@@ -20,7 +20,13 @@ package resources
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"unicode"
 
 	"github.com/purpleidea/mgmt/engine"
@@ -42,21 +48,69 @@ const (
 	machineNew        = dbusMachine1Iface + ".MachineNew"
 	machineRemoved    = dbusMachine1Iface + ".MachineRemoved"
 	nspawnServiceTmpl = "systemd-nspawn@%s"
+
+	// NspawnSettingsDir is the default directory of the .nspawn files.
+	NspawnSettingsDir = "/etc/systemd/nspawn/"
+	// NspawnMachinesDir is the directory where the machines are stored.
+	NspawnMachinesDir = "/var/lib/machines/"
+	// NspawnMachinectlCmd is the command used to bootstrap the machines.
+	NspawnMachinectlCmd = "machinectl"
 )
 
 func init() {
 	engine.RegisterResource("nspawn", func() engine.Res { return &NspawnRes{} })
 }
 
-// NspawnRes is an nspawn container resource.
+// NspawnRes is an nspawn container resource. It can bootstrap the machine from
+// a tarball or from another image, and it can manage the .nspawn settings file
+// of the machine. The machine is restarted when the settings change.
 type NspawnRes struct {
 	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
 	//traits.Groupable // TODO: this would be quite useful for this resource
 	traits.Refreshable // needed because we embed a svc res
 
 	init *engine.Init
 
 	State string `yaml:"state"`
+
+	// Tarball is the absolute path of a tar archive to bootstrap the
+	// machine from if it doesn't exist yet.
+	Tarball string `yaml:"tarball"`
+	// Image is the name of a local machine image to clone to bootstrap the
+	// machine if it doesn't exist yet.
+	Image string `yaml:"image"`
+
+	// Bind are the directories to bind mount into the machine, in the same
+	// format as the Bind= setting, eg: /srv/data:/data.
+	Bind []string `yaml:"bind"`
+	// BindReadOnly are like Bind, but they are mounted read only.
+	BindReadOnly []string `yaml:"bindreadonly"`
+	// Zone is the name of the network zone to connect the machine to. This
+	// implies a virtual ethernet link.
+	Zone string `yaml:"zone"`
+	// VirtualEthernet adds a virtual ethernet link between the host and
+	// the machine.
+	VirtualEthernet bool `yaml:"virtualethernet"`
+	// PrivateUsers is the user namespacing mode, which is yes, no, pick,
+	// identity, or a uid range such as 65536:65536.
+	PrivateUsers string `yaml:"privateusers"`
+	// Capability are the extra capabilities to give to the machine.
+	Capability []string `yaml:"capability"`
+	// DropCapability are the capabilities to take away from the machine.
+	DropCapability []string `yaml:"dropcapability"`
+	// SettingsDir is the directory of the .nspawn file. It is mostly useful
+	// for testing. It defaults to NspawnSettingsDir. If none of the settings
+	// are set, then the file isn't managed.
+	SettingsDir string `yaml:"settingsdir"`
+
+	machinesDir string       // where the machines are, can be changed in tests
+	runner      nspawnRunner // runs the bootstrap commands, and can be replaced in tests
+
+	// restartPending is true when the settings file was written, but the
+	// running machine hasn't been restarted to use it yet.
+	restartPending bool
+
 	// We're using the svc resource to start and stop the machine because
 	// that's what machinectl does. We're not using svc.Watch because then we
 	// would have two watches potentially racing each other and producing
@@ -107,6 +161,10 @@ func (obj *NspawnRes) Validate() error {
 		return fmt.Errorf("invalid state: %s", obj.State)
 	}
 
+	if err := obj.validateSettings(); err != nil {
+		return err
+	}
+
 	svc, err := obj.makeComposite()
 	if err != nil {
 		return errwrap.Wrapf(err, "makeComposite failed in validate")
@@ -117,10 +175,57 @@ func (obj *NspawnRes) Validate() error {
 	return nil
 }
 
+// validateSettings checks the bootstrap and the .nspawn file settings.
+func (obj *NspawnRes) validateSettings() error {
+	if obj.Tarball != "" && obj.Image != "" {
+		return fmt.Errorf("only one of tarball or image can be used")
+	}
+	if obj.Tarball != "" && !strings.HasPrefix(obj.Tarball, "/") {
+		return fmt.Errorf("the tarball must be an absolute path")
+	}
+	if obj.Image == obj.Name() && obj.Image != "" {
+		return fmt.Errorf("the machine can't be cloned from itself")
+	}
+	for _, x := range append(obj.Bind, obj.BindReadOnly...) {
+		if !strings.HasPrefix(x, "/") && !strings.HasPrefix(x, "+/") {
+			return fmt.Errorf("the bind `%s` must start with an absolute path", x)
+		}
+		if strings.ContainsAny(x, "\n ") {
+			return fmt.Errorf("the bind `%s` must not contain whitespace", x)
+		}
+	}
+	if obj.Zone != "" && !regexp.MustCompile(`^[a-zA-Z0-9_-]{1,12}$`).MatchString(obj.Zone) {
+		return fmt.Errorf("invalid zone name: %s", obj.Zone)
+	}
+	switch obj.PrivateUsers {
+	case "", "yes", "no", "pick", "identity":
+	default:
+		if !regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`).MatchString(obj.PrivateUsers) {
+			return fmt.Errorf("invalid privateusers value: %s", obj.PrivateUsers)
+		}
+	}
+	for _, x := range append(obj.Capability, obj.DropCapability...) {
+		if x != "all" && !regexp.MustCompile(`^CAP_[A-Z_]+$`).MatchString(x) {
+			return fmt.Errorf("invalid capability: %s", x)
+		}
+	}
+	if obj.SettingsDir != "" && !strings.HasPrefix(obj.SettingsDir, "/") {
+		return fmt.Errorf("the settings dir must be absolute")
+	}
+	return nil
+}
+
 // Init runs some startup code for this resource.
 func (obj *NspawnRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
+	if obj.machinesDir == "" {
+		obj.machinesDir = NspawnMachinesDir
+	}
+	if obj.runner == nil {
+		obj.runner = &nspawnCmdRunner{cmd: NspawnMachinectlCmd}
+	}
+
 	svc, err := obj.makeComposite()
 	if err != nil {
 		return errwrap.Wrapf(err, "makeComposite failed in init")
@@ -218,6 +323,33 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 		return false, errors.New("systemd is not running")
 	}
 
+	checkOK = true
+
+	// the settings have to be right before the machine starts
+	settingsOK, err := obj.settingsCheckApply(apply)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not manage the settings file")
+	}
+	if !settingsOK {
+		checkOK = false
+		if apply { // it was written, but the running machine has the old one
+			obj.restartPending = true
+		}
+	}
+	if obj.restartPending { // a previous restart might have failed
+		checkOK = false
+	}
+	bootstrapOK, err := obj.bootstrapCheckApply(apply)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not bootstrap the machine")
+	}
+	if !bootstrapOK {
+		checkOK = false
+	}
+	if !apply && !checkOK {
+		return false, nil
+	}
+
 	// connect to org.freedesktop.machine1.Manager
 	conn, err := machined.New()
 	if err != nil {
@@ -246,13 +378,24 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 	if obj.init.Debug {
 		obj.init.Logf("properties: %v", properties)
 	}
+	// a machine which isn't running gets the new settings when it starts
+	if !exists || properties["State"] != running {
+		obj.restartPending = false
+	}
 	// if the machine doesn't exist and is supposed to
 	// be stopped or the state matches we're done
 	if !exists && obj.State == stopped || properties["State"] == obj.State {
-		if obj.init.Debug {
+		// a running machine only sees the new settings after a restart
+		if obj.restartPending && exists && obj.State == running {
+			if err := obj.restart(); err != nil {
+				return false, err
+			}
+			obj.restartPending = false
+		}
+		if obj.init.Debug && checkOK {
 			obj.init.Logf("CheckApply() in valid state")
 		}
-		return true, nil
+		return checkOK, nil
 	}
 
 	// end of state checking. if we're here, checkOK is false
@@ -269,6 +412,139 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 	return false, nil
 }
 
+// restart restarts the machine, so that it gets the new settings.
+func (obj *NspawnRes) restart() error {
+	conn, err := systemdDbus.NewSystemdConnection()
+	if err != nil {
+		return errwrap.Wrapf(err, "failed to connect to systemd")
+	}
+	defer conn.Close()
+
+	obj.init.Logf("restarting, so that the settings are used")
+	result := make(chan string, 1) // catch result information
+	unit := fmt.Sprintf(nspawnServiceTmpl, obj.Name()) + ".service"
+	if _, err := conn.TryRestartUnit(unit, "fail", result); err != nil {
+		return errwrap.Wrapf(err, "failed to restart unit")
+	}
+	if status := <-result; status != "done" {
+		return fmt.Errorf("unknown systemd return string: %v", status)
+	}
+	return nil
+}
+
+// settingsPath returns the path of the .nspawn file of the machine.
+func (obj *NspawnRes) settingsPath() string {
+	dir := obj.SettingsDir
+	if dir == "" {
+		dir = NspawnSettingsDir
+	}
+	return path.Join(dir, obj.Name()+".nspawn")
+}
+
+// settings returns the content of the .nspawn file, or nil if none of the
+// settings are set, in which case the file isn't managed.
+func (obj *NspawnRes) settings() *string {
+	execs := []string{}
+	if obj.PrivateUsers != "" {
+		execs = append(execs, "PrivateUsers="+obj.PrivateUsers)
+	}
+	if len(obj.Capability) > 0 {
+		execs = append(execs, "Capability="+strings.Join(obj.Capability, " "))
+	}
+	if len(obj.DropCapability) > 0 {
+		execs = append(execs, "DropCapability="+strings.Join(obj.DropCapability, " "))
+	}
+	files := []string{}
+	for _, x := range obj.Bind {
+		files = append(files, "Bind="+x)
+	}
+	for _, x := range obj.BindReadOnly {
+		files = append(files, "BindReadOnly="+x)
+	}
+	network := []string{}
+	if obj.VirtualEthernet {
+		network = append(network, "VirtualEthernet=yes")
+	}
+	if obj.Zone != "" {
+		network = append(network, "Zone="+obj.Zone)
+	}
+
+	sections := []string{}
+	for _, x := range []struct {
+		name  string
+		lines []string
+	}{
+		{"Exec", execs},
+		{"Files", files},
+		{"Network", network},
+	} {
+		if len(x.lines) == 0 {
+			continue
+		}
+		sections = append(sections, fmt.Sprintf("[%s]\n%s\n", x.name, strings.Join(x.lines, "\n")))
+	}
+	if len(sections) == 0 {
+		return nil
+	}
+	content := "# This file is managed by mgmt.\n\n" + strings.Join(sections, "\n")
+	return &content
+}
+
+// settingsCheckApply checks the .nspawn file, and writes it if the apply bool
+// is true. It returns true if nothing had to change.
+func (obj *NspawnRes) settingsCheckApply(apply bool) (bool, error) {
+	content := obj.settings()
+	if content == nil {
+		return true, nil
+	}
+	p := obj.settingsPath()
+	b, err := ioutil.ReadFile(p)
+	if err == nil && string(b) == *content {
+		return true, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read %s", p)
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("writing: %s", p)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(p, []byte(*content), 0644); err != nil {
+		return false, errwrap.Wrapf(err, "could not write %s", p)
+	}
+	return false, nil
+}
+
+// bootstrapCheckApply creates the machine from the tarball or the image if it
+// doesn't exist yet. It returns true if nothing had to change.
+func (obj *NspawnRes) bootstrapCheckApply(apply bool) (bool, error) {
+	if obj.Tarball == "" && obj.Image == "" {
+		return true, nil
+	}
+	// a machine is either a directory or a raw disk image
+	for _, x := range []string{obj.Name(), obj.Name() + ".raw"} {
+		if _, err := os.Stat(path.Join(obj.machinesDir, x)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if obj.Tarball != "" {
+		obj.init.Logf("importing from: %s", obj.Tarball)
+		return false, obj.runner.ImportTar(obj.Tarball, obj.Name())
+	}
+	obj.init.Logf("cloning from: %s", obj.Image)
+	return false, obj.runner.Clone(obj.Image, obj.Name())
+}
+
 // Cmp compares two resources and returns an error if they are not equivalent.
 func (obj *NspawnRes) Cmp(r engine.Res) error {
 	if !obj.Compare(r) {
@@ -288,6 +564,19 @@ func (obj *NspawnRes) Compare(r engine.Res) bool {
 	if obj.State != res.State {
 		return false
 	}
+	if obj.Tarball != res.Tarball || obj.Image != res.Image {
+		return false
+	}
+	// the settings are all compared by the content of the settings file
+	if (obj.settings() == nil) != (res.settings() == nil) {
+		return false
+	}
+	if obj.settings() != nil && *obj.settings() != *res.settings() {
+		return false
+	}
+	if obj.settingsPath() != res.settingsPath() {
+		return false
+	}
 
 	// TODO: why is res.svc ever nil?
 	if (obj.svc == nil) != (res.svc == nil) { // xor
@@ -332,6 +621,51 @@ func (obj *NspawnRes) UIDs() []engine.ResUID {
 	return append([]engine.ResUID{x}, obj.svc.UIDs()...)
 }
 
+// NspawnResAutoEdges holds the state of the auto edge generator.
+type NspawnResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *NspawnResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *NspawnResAutoEdges) Test(input []bool) bool {
+	return false // never keep going
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the tarball and the
+// directories which get bind mounted into the machine.
+func (obj *NspawnRes) AutoEdges() (engine.AutoEdge, error) {
+	var edges []engine.ResUID
+	add := func(p string) {
+		var reversed = true // these have to exist first
+		edges = append(edges, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: p, // what matters
+		})
+	}
+	if obj.Tarball != "" {
+		add(obj.Tarball)
+	}
+	for _, x := range append(obj.Bind, obj.BindReadOnly...) {
+		if strings.HasPrefix(x, "+") { // this is inside the machine
+			continue
+		}
+		source := strings.SplitN(x, ":", 2)[0]
+		add(path.Clean(source) + "/") // directories end in a slash
+	}
+	return &NspawnResAutoEdges{
+		edges: edges,
+	}, nil
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct.
 // It is primarily useful for setting the defaults.
 func (obj *NspawnRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -380,3 +714,37 @@ func systemdVersion() (uint16, error) {
 	}
 	return uint16(ver), nil
 }
+
+// nspawnRunner runs the commands which bootstrap a machine. This is an
+// interface so that they can be replaced in the tests.
+type nspawnRunner interface {
+	// ImportTar creates the machine from a tar archive.
+	ImportTar(tarball, name string) error
+
+	// Clone creates the machine as a copy of an existing image.
+	Clone(image, name string) error
+}
+
+// nspawnCmdRunner is the nspawnRunner which runs the real machinectl command.
+type nspawnCmdRunner struct {
+	cmd string
+}
+
+// ImportTar runs machinectl import-tar.
+func (obj *nspawnCmdRunner) ImportTar(tarball, name string) error {
+	return obj.run("import-tar", tarball, name)
+}
+
+// Clone runs machinectl clone.
+func (obj *nspawnCmdRunner) Clone(image, name string) error {
+	return obj.run("clone", image, name)
+}
+
+// run runs the command, and returns the output as the error if it fails.
+func (obj *nspawnCmdRunner) run(args ...string) error {
+	out, err := exec.Command(obj.cmd, args...).CombinedOutput()
+	if err != nil {
+		return errwrap.Wrapf(err, "%s %s failed: %s", obj.cmd, args[0], strings.TrimSpace(string(out)))
+	}
+	return nil
+}
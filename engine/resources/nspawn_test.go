@@ -0,0 +1,258 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// nspawnFakeRunner bootstraps machines by making an empty directory.
+type nspawnFakeRunner struct {
+	dir   string
+	calls []string
+}
+
+func (obj *nspawnFakeRunner) ImportTar(tarball, name string) error {
+	obj.calls = append(obj.calls, fmt.Sprintf("import-tar %s %s", tarball, name))
+	return os.Mkdir(path.Join(obj.dir, name), 0755)
+}
+
+func (obj *nspawnFakeRunner) Clone(image, name string) error {
+	obj.calls = append(obj.calls, fmt.Sprintf("clone %s %s", image, name))
+	return os.Mkdir(path.Join(obj.dir, name), 0755)
+}
+
+func TestNspawnValidateSettings(t *testing.T) {
+	tests := []struct {
+		res *NspawnRes
+		ok  bool
+	}{
+		{&NspawnRes{}, true},
+		{&NspawnRes{Tarball: "/srv/fedora.tar.xz", Bind: []string{"/srv/data:/data", "+/var/cache"}}, true},
+		{&NspawnRes{Image: "fedora", Zone: "web", PrivateUsers: "pick"}, true},
+		{&NspawnRes{PrivateUsers: "65536:65536", Capability: []string{"CAP_NET_ADMIN"}, DropCapability: []string{"CAP_SYS_TIME"}}, true},
+		{&NspawnRes{Tarball: "/srv/fedora.tar.xz", Image: "fedora"}, false},
+		{&NspawnRes{Tarball: "fedora.tar.xz"}, false},
+		{&NspawnRes{Image: "test"}, false}, // itself
+		{&NspawnRes{Bind: []string{"data:/data"}}, false},
+		{&NspawnRes{BindReadOnly: []string{"/srv/my data"}}, false},
+		{&NspawnRes{Zone: "this-zone-is-too-long"}, false},
+		{&NspawnRes{PrivateUsers: "maybe"}, false},
+		{&NspawnRes{Capability: []string{"NET_ADMIN"}}, false},
+		{&NspawnRes{SettingsDir: "relative/"}, false},
+	}
+	for i, tt := range tests {
+		tt.res.SetName("test")
+		if err := tt.res.validateSettings(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestNspawnSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-nspawn-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r1 := &NspawnRes{
+		State:           running,
+		Bind:            []string{"/srv/data:/data"},
+		BindReadOnly:    []string{"/srv/static"},
+		Zone:            "web",
+		PrivateUsers:    "pick",
+		Capability:      []string{"CAP_NET_ADMIN", "CAP_SYS_PTRACE"},
+		DropCapability:  []string{"CAP_SYS_TIME"},
+		VirtualEthernet: true,
+		SettingsDir:     dir,
+	}
+	r1.SetName("web1")
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if checkOK, err := r1.settingsCheckApply(false); err != nil || checkOK {
+		t.Errorf("settings check returned: %t, %v", checkOK, err)
+	}
+	if checkOK, err := r1.settingsCheckApply(true); err != nil || checkOK {
+		t.Errorf("settings apply returned: %t, %v", checkOK, err)
+	}
+	if checkOK, err := r1.settingsCheckApply(false); err != nil || !checkOK {
+		t.Errorf("settings did not converge: %t, %v", checkOK, err)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(dir, "web1.nspawn"))
+	if err != nil {
+		t.Errorf("could not read the settings: %v", err)
+		return
+	}
+	exp := `# This file is managed by mgmt.
+
+[Exec]
+PrivateUsers=pick
+Capability=CAP_NET_ADMIN CAP_SYS_PTRACE
+DropCapability=CAP_SYS_TIME
+
+[Files]
+Bind=/srv/data:/data
+BindReadOnly=/srv/static
+
+[Network]
+VirtualEthernet=yes
+Zone=web
+`
+	if string(b) != exp {
+		t.Errorf("got wrong settings:\n%s", string(b))
+	}
+
+	r2 := &NspawnRes{State: running, SettingsDir: dir}
+	r2.SetName("web2")
+	if r2.settings() != nil {
+		t.Errorf("the settings file must not be managed without settings")
+	}
+	if r1.Compare(r2) {
+		t.Errorf("resources with different settings must not compare")
+	}
+}
+
+func TestNspawnBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-nspawn-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	runner := &nspawnFakeRunner{dir: dir}
+
+	r1 := &NspawnRes{
+		State:       running,
+		Tarball:     "/srv/fedora.tar.xz",
+		machinesDir: dir,
+		runner:      runner,
+	}
+	r1.SetName("web1")
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		checkOK, err := r1.bootstrapCheckApply(true)
+		if err != nil {
+			t.Errorf("bootstrap failed with: %v", err)
+			return
+		}
+		if checkOK != (i > 0) {
+			t.Errorf("bootstrap #%d returned: %t", i, checkOK)
+		}
+	}
+
+	// a raw image counts as an existing machine too
+	if err := ioutil.WriteFile(path.Join(dir, "web2.raw"), []byte{}, 0600); err != nil {
+		t.Errorf("could not write image: %v", err)
+		return
+	}
+	r2 := &NspawnRes{
+		State:       running,
+		Image:       "fedora",
+		machinesDir: dir,
+		runner:      runner,
+	}
+	r2.SetName("web2")
+	if err := r2.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if checkOK, err := r2.bootstrapCheckApply(true); err != nil || !checkOK {
+		t.Errorf("bootstrap returned: %t, %v", checkOK, err)
+	}
+
+	r3 := &NspawnRes{
+		State:       stopped,
+		Image:       "fedora",
+		machinesDir: dir,
+		runner:      runner,
+	}
+	r3.SetName("web3")
+	if err := r3.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if checkOK, err := r3.bootstrapCheckApply(false); err != nil || checkOK {
+		t.Errorf("bootstrap check returned: %t, %v", checkOK, err)
+	}
+	if checkOK, err := r3.bootstrapCheckApply(true); err != nil || checkOK {
+		t.Errorf("bootstrap apply returned: %t, %v", checkOK, err)
+	}
+
+	exp := "[import-tar /srv/fedora.tar.xz web1 clone fedora web3]"
+	if s := fmt.Sprintf("%v", runner.calls); s != exp {
+		t.Errorf("got wrong calls: %s", s)
+	}
+}
+
+func TestNspawnAutoEdges(t *testing.T) {
+	r1 := &NspawnRes{
+		Tarball:      "/srv/fedora.tar.xz",
+		Bind:         []string{"/srv/data:/data", "+/var/cache"},
+		BindReadOnly: []string{"/srv/static/"},
+	}
+	r1.SetName("web1")
+	ae, err := r1.AutoEdges()
+	if err != nil {
+		t.Errorf("autoedges failed with: %v", err)
+		return
+	}
+	paths := []string{}
+	for _, uid := range ae.Next() {
+		x, ok := uid.(*FileUID)
+		if !ok || !uid.IsReversed() {
+			t.Errorf("unexpected uid: %+v", uid)
+			continue
+		}
+		paths = append(paths, x.path)
+	}
+	if s := fmt.Sprintf("%v", paths); s != "[/srv/fedora.tar.xz /srv/data/ /srv/static/]" {
+		t.Errorf("got wrong paths: %s", s)
+	}
+
+	r2 := &ExecRes{Cmd: "dnf -y update", Machine: "web1"}
+	ae, err = r2.AutoEdges()
+	if err != nil {
+		t.Errorf("autoedges failed with: %v", err)
+		return
+	}
+	uids := ae.Next()
+	if len(uids) != 1 {
+		t.Errorf("expected one edge, got: %d", len(uids))
+		return
+	}
+	if x, ok := uids[0].(*NspawnUID); !ok || x.name != "web1" || !x.IsReversed() {
+		t.Errorf("the exec must depend on the machine: %+v", uids[0])
+	}
+}
@@ -186,6 +186,22 @@ func (obj *Conn) Close() error {
 	return obj.conn.Close()
 }
 
+// IsAvailable returns true if the PackageKit service is running, or if the bus
+// knows how to start it when it is first used.
+func (obj *Conn) IsAvailable() (bool, error) {
+	bus := obj.GetBus().BusObject()
+	for _, method := range []string{"ListNames", "ListActivatableNames"} {
+		names := []string{}
+		if err := bus.Call(engineUtil.DBusInterface+"."+method, 0).Store(&names); err != nil {
+			return false, err
+		}
+		if util.StrInList(PkIface, names) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // internal helper to add signal matches to the bus, should only be called once
 func (obj *Conn) matchSignal(ch chan *dbus.Signal, path dbus.ObjectPath, iface string, signals []string) (func() error, error) {
 	if obj.Debug {
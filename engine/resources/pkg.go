@@ -23,7 +23,6 @@ import (
 	"strings"
 
 	"github.com/purpleidea/mgmt/engine"
-	"github.com/purpleidea/mgmt/engine/resources/packagekit"
 	"github.com/purpleidea/mgmt/engine/traits"
 	"github.com/purpleidea/mgmt/util"
 
@@ -34,7 +33,8 @@ func init() {
 	engine.RegisterResource("pkg", func() engine.Res { return &PkgRes{} })
 }
 
-// PkgRes is a package resource for packagekit.
+// PkgRes is a package resource. It uses PackageKit if it is available, and
+// otherwise it runs the native package manager commands.
 type PkgRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Edgeable
@@ -46,8 +46,12 @@ type PkgRes struct {
 	AllowUntrusted   bool   `yaml:"allowuntrusted"`   // allow untrusted packages to be installed?
 	AllowNonFree     bool   `yaml:"allownonfree"`     // allow nonfree packages to be found?
 	AllowUnsupported bool   `yaml:"allowunsupported"` // allow unsupported packages to be found?
-	//bus              *packagekit.Conn    // pk bus connection
-	fileList []string // FIXME: update if pkg changes
+	// Backend is the package backend to use. It can be packagekit, dnf or
+	// apt. If it is empty, then the first one that is available is used.
+	Backend string `yaml:"backend"`
+
+	backend  pkgBackend // opened in Init, unless it's set already (for tests)
+	fileList []string   // FIXME: update if pkg changes
 }
 
 // Default returns some sensible defaults for this resource.
@@ -63,6 +67,11 @@ func (obj *PkgRes) Validate() error {
 		return fmt.Errorf("state cannot be empty")
 	}
 
+	backends := []string{PkgBackendPackageKit, PkgBackendDnf, PkgBackendApt}
+	if obj.Backend != "" && !util.StrInList(obj.Backend, backends) {
+		return fmt.Errorf("backend must be one of: %s", strings.Join(backends, ", "))
+	}
+
 	return nil
 }
 
@@ -70,6 +79,14 @@ func (obj *PkgRes) Validate() error {
 func (obj *PkgRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
+	if obj.backend == nil { // the connection is kept until Close
+		backend, err := obj.newBackend()
+		if err != nil {
+			return errwrap.Wrapf(err, "can't open the package backend")
+		}
+		obj.backend = backend
+	}
+
 	if obj.fileList == nil {
 		if err := obj.populateFileList(); err != nil {
 			return errwrap.Wrapf(err, "error populating file list in init")
@@ -81,27 +98,38 @@ func (obj *PkgRes) Init(init *engine.Init) error {
 
 // Close is run by the engine to clean up after the resource is done.
 func (obj *PkgRes) Close() error {
-	return nil
+	if obj.backend == nil {
+		return nil
+	}
+	err := obj.backend.Close()
+	obj.backend = nil
+	return err
 }
 
-// Watch is the primary listener for this resource and it outputs events.
-// It uses the PackageKit UpdatesChanged signal to watch for changes.
-// TODO: https://github.com/hughsie/PackageKit/issues/109
-// TODO: https://github.com/hughsie/PackageKit/issues/110
-func (obj *PkgRes) Watch() error {
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return fmt.Errorf("can't connect to PackageKit bus")
+// newBackend returns a new connection to the package backend. The caller must
+// close it when done.
+func (obj *PkgRes) newBackend() (pkgBackend, error) {
+	opts := &pkgOptions{
+		allowUntrusted:   obj.AllowUntrusted,
+		allowNonFree:     obj.AllowNonFree,
+		allowUnsupported: obj.AllowUnsupported,
+		logf:             func(format string, v ...interface{}) {}, // AutoEdges runs before Init
 	}
-	defer bus.Close()
-	bus.Debug = obj.init.Debug
-	bus.Logf = func(format string, v ...interface{}) {
-		obj.init.Logf("packagekit: "+format, v...)
+	if obj.init != nil {
+		opts.debug = obj.init.Debug
+		opts.logf = obj.init.Logf
 	}
+	return newPkgBackend(obj.Backend, opts)
+}
 
-	ch, err := bus.WatchChanges()
+// Watch is the primary listener for this resource and it outputs events. The
+// backend decides how to watch for changes to the installed packages.
+func (obj *PkgRes) Watch() error {
+	done := make(chan struct{})
+	defer close(done)
+	ch, err := obj.backend.Watch(done)
 	if err != nil {
-		return errwrap.Wrapf(err, "error adding signal match")
+		return err
 	}
 
 	// notify engine that we're running
@@ -116,22 +144,20 @@ func (obj *PkgRes) Watch() error {
 		}
 
 		select {
-		case event := <-ch:
-			// FIXME: ask packagekit for info on what packages changed
-			if obj.init.Debug {
-				obj.init.Logf("Event(%s): %s", event.Name, obj.fmtNames(obj.getNames()))
+		case err := <-ch:
+			if err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
 			}
-
-			// since the chan is buffered, remove any supplemental
-			// events since they would just be duplicates anyways!
-			for len(ch) > 0 { // we can detect pending count here!
-				<-ch // discard
+			if obj.init.Debug {
+				obj.init.Logf("Event: %s", obj.fmtNames(obj.getNames()))
 			}
-
 			send = true
 			obj.init.Dirty() // dirty
 
-		case event := <-obj.init.Events:
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
 			if err := obj.init.Read(event); err != nil {
 				return err
 			}
@@ -170,78 +196,23 @@ func (obj *PkgRes) fmtNames(names []string) string {
 	return obj.String()
 }
 
-func (obj *PkgRes) groupMappingHelper() map[string]string {
-	var result = make(map[string]string)
-	if g := obj.GetGroup(); len(g) > 0 { // add any grouped elements
-		for _, x := range g {
-			pkg, ok := x.(*PkgRes) // convert from Res
-			if !ok {
-				panic(fmt.Sprintf("grouped member %v is not a %s", x, obj.Kind()))
-			}
-			result[pkg.Name()] = pkg.State
-		}
-	}
-	return result
-}
-
-func (obj *PkgRes) pkgMappingHelper(bus *packagekit.Conn) (map[string]*packagekit.PkPackageIDActionData, error) {
-	packageMap := obj.groupMappingHelper() // get the grouped values
-	packageMap[obj.Name()] = obj.State     // key is pkg name, value is pkg state
-	var filter uint64                      // initializes at the "zero" value of 0
-	filter += packagekit.PkFilterEnumArch  // always search in our arch (optional!)
-	// we're requesting latest version, or to narrow down install choices!
-	if obj.State == "newest" || obj.State == "installed" {
-		// if we add this, we'll still see older packages if installed
-		// this is an optimization, and is *optional*, this logic is
-		// handled inside of PackagesToPackageIDs now automatically!
-		filter += packagekit.PkFilterEnumNewest // only search for newest packages
-	}
-	if !obj.AllowNonFree {
-		filter += packagekit.PkFilterEnumFree
-	}
-	if !obj.AllowUnsupported {
-		filter += packagekit.PkFilterEnumSupported
-	}
-	result, err := bus.PackagesToPackageIDs(packageMap, filter)
-	if err != nil {
-		return nil, errwrap.Wrapf(err, "Can't run PackagesToPackageIDs")
-	}
-	return result, nil
-}
-
 // populateFileList fills in the fileList structure with what is in the package.
 // TODO: should this work properly if pkg has been autogrouped ?
 func (obj *PkgRes) populateFileList() error {
-
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return fmt.Errorf("can't connect to PackageKit bus")
-	}
-	defer bus.Close()
-	if obj.init != nil {
-		bus.Debug = obj.init.Debug
-		bus.Logf = func(format string, v ...interface{}) {
-			obj.init.Logf("packagekit: "+format, v...)
+	backend := obj.backend
+	if backend == nil { // AutoEdges runs before Init
+		var err error
+		if backend, err = obj.newBackend(); err != nil {
+			return err
 		}
+		defer backend.Close()
 	}
 
-	result, err := obj.pkgMappingHelper(bus)
-	if err != nil {
-		return errwrap.Wrapf(err, "the pkgMappingHelper failed")
-	}
-
-	data, ok := result[obj.Name()] // lookup single package (init does just one)
-	// package doesn't exist, this is an error!
-	if !ok || !data.Found {
-		return fmt.Errorf("can't find package named '%s'", obj.Name())
-	}
-
-	packageIDs := []string{data.PackageID} // just one for now
-	filesMap, err := bus.GetFilesByPackageID(packageIDs)
+	filesMap, err := backend.GetFilesByPackageID([]string{obj.Name()}) // just one for now
 	if err != nil {
-		return errwrap.Wrapf(err, "can't run GetFilesByPackageID")
+		return errwrap.Wrapf(err, "can't get the files in package '%s'", obj.Name())
 	}
-	if files, ok := filesMap[data.PackageID]; ok {
+	if files, ok := filesMap[obj.Name()]; ok {
 		obj.fileList = util.DirifyFileList(files, false)
 	}
 
@@ -253,51 +224,47 @@ func (obj *PkgRes) populateFileList() error {
 func (obj *PkgRes) CheckApply(apply bool) (checkOK bool, err error) {
 	obj.init.Logf("Check: %s", obj.fmtNames(obj.getNames()))
 
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return false, fmt.Errorf("can't connect to PackageKit bus")
-	}
-	defer bus.Close()
-	bus.Debug = obj.init.Debug
-	bus.Logf = func(format string, v ...interface{}) {
-		obj.init.Logf("packagekit: "+format, v...)
-	}
-
-	result, err := obj.pkgMappingHelper(bus)
+	backend := obj.backend
+	packageList := obj.getNames()
+	statuses, err := backend.IsInstalledList(packageList)
 	if err != nil {
-		return false, errwrap.Wrapf(err, "the pkgMappingHelper failed")
+		return false, errwrap.Wrapf(err, "the IsInstalledList method failed")
 	}
 
-	packageMap := obj.groupMappingHelper() // map[string]string
-	packageList := []string{obj.Name()}
-	packageList = append(packageList, util.StrMapKeys(packageMap)...)
-	//stateList := []string{obj.State}
-	//stateList = append(stateList, util.StrMapValues(packageMap)...)
-
+	// these are the packages that actually need their states applied!
 	// TODO: at the moment, all the states are the same, but
 	// eventually we might be able to drop this constraint!
-	states, err := packagekit.FilterState(result, packageList, obj.State)
-	if err != nil {
-		return false, errwrap.Wrapf(err, "the FilterState method failed")
-	}
-	data, _ := result[obj.Name()] // if above didn't error, we won't either!
-	validState := util.BoolMapTrue(util.BoolMapValues(states))
+	applyPackages := []string{}
+	installed := []string{} // the subset of these that are installed
+	for i, status := range statuses {
+		// package doesn't exist, this is an error!
+		if !status.Found {
+			return false, fmt.Errorf("can't find package named '%s'", packageList[i])
+		}
 
-	// obj.State == "installed" || "uninstalled" || "newest" || "4.2-1.fc23"
-	switch obj.State {
-	case "installed":
-		fallthrough
-	case "uninstalled":
-		fallthrough
-	case "newest":
-		if validState {
-			return true, nil // state is correct, exit!
+		var ok bool
+		// obj.State == "installed" || "uninstalled" || "newest" || "4.2-1.fc23"
+		switch obj.State {
+		case "installed":
+			ok = status.Installed
+		case "uninstalled":
+			ok = !status.Installed
+		case "newest":
+			ok = status.Newest
+		default: // version string
+			ok = status.Installed && status.Version == obj.State
 		}
-	default: // version string
-		if obj.State == data.Version && data.Version != "" {
-			return true, nil
+		if ok {
+			continue
+		}
+		applyPackages = append(applyPackages, packageList[i])
+		if status.Installed {
+			installed = append(installed, packageList[i])
 		}
 	}
+	if len(applyPackages) == 0 {
+		return true, nil // state is correct, exit!
+	}
 
 	// state is not okay, no work done, exit, but without error
 	if !apply {
@@ -306,41 +273,47 @@ func (obj *PkgRes) CheckApply(apply bool) (checkOK bool, err error) {
 
 	// apply portion
 	obj.init.Logf("Apply: %s", obj.fmtNames(obj.getNames()))
-	readyPackages, err := packagekit.FilterPackageState(result, packageList, obj.State)
-	if err != nil {
-		return false, err // fail
-	}
-	// these are the packages that actually need their states applied!
-	applyPackages := util.StrFilterElementsInList(readyPackages, packageList)
-	packageIDs, _ := packagekit.FilterPackageIDs(result, applyPackages) // would be same err as above
-
-	var transactionFlags uint64 // initializes at the "zero" value of 0
-	if !obj.AllowUntrusted {    // allow
-		transactionFlags += packagekit.PkTransactionFlagEnumOnlyTrusted
-	}
 	// apply correct state!
-	obj.init.Logf("Set(%s): %s...", obj.State, obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())))
+	obj.init.Logf("Set(%s): %s...", obj.State, obj.fmtNames(applyPackages))
 	switch obj.State {
 	case "uninstalled": // run remove
-		// NOTE: packageID is different than when installed, because now
-		// it has the "installed" flag added to the data portion if it!!
-		err = bus.RemovePackages(packageIDs, transactionFlags)
+		err = backend.Remove(applyPackages)
 
-	case "newest": // TODO: isn't this the same operation as install, below?
-		err = bus.UpdatePackages(packageIDs, transactionFlags)
+	case "newest":
+		// the installed packages get updated, and the others get
+		// installed, which always picks the newest version anyways
+		if len(installed) > 0 {
+			if err = backend.Update(installed); err != nil {
+				break
+			}
+		}
+		if missing := util.StrFilterElementsInList(installed, applyPackages); len(missing) > 0 {
+			err = backend.Install(pkgVersionMap(missing, ""))
+		}
 
 	case "installed":
-		fallthrough // same method as for "set specific version", below
+		err = backend.Install(pkgVersionMap(applyPackages, ""))
+
 	default: // version string
-		err = bus.InstallPackages(packageIDs, transactionFlags)
+		err = backend.Install(pkgVersionMap(applyPackages, obj.State))
 	}
 	if err != nil {
 		return false, err // fail
 	}
-	obj.init.Logf("Set(%s) success: %s", obj.State, obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())))
+	obj.init.Logf("Set(%s) success: %s", obj.State, obj.fmtNames(applyPackages))
 	return false, nil // success
 }
 
+// pkgVersionMap returns the map of package names to the version, which is the
+// input format of the Install method of the pkgBackend.
+func pkgVersionMap(packages []string, version string) map[string]string {
+	result := make(map[string]string)
+	for _, name := range packages {
+		result[name] = version
+	}
+	return result
+}
+
 // Cmp compares two resources and returns an error if they are not equivalent.
 func (obj *PkgRes) Cmp(r engine.Res) error {
 	if !obj.Compare(r) {
@@ -373,6 +346,9 @@ func (obj *PkgRes) Compare(r engine.Res) bool {
 	if obj.AllowUnsupported != res.AllowUnsupported {
 		return false
 	}
+	if obj.Backend != res.Backend {
+		return false
+	}
 
 	return true
 }
@@ -562,6 +538,13 @@ func (obj *PkgRes) GroupCmp(r engine.GroupableRes) error {
 	if obj.State != res.State {
 		return fmt.Errorf("resource is of a different state")
 	}
+	// the whole group uses the backend and the options of this resource
+	if obj.Backend != res.Backend {
+		return fmt.Errorf("resource uses a different backend")
+	}
+	if obj.AllowUntrusted != res.AllowUntrusted || obj.AllowNonFree != res.AllowNonFree || obj.AllowUnsupported != res.AllowUnsupported {
+		return fmt.Errorf("resource uses different options")
+	}
 	return nil
 }
 
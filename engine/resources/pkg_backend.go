@@ -0,0 +1,635 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine/resources/packagekit"
+	"github.com/purpleidea/mgmt/recwatch"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// PkgBackendPackageKit talks to PackageKit over dbus.
+	PkgBackendPackageKit = "packagekit"
+	// PkgBackendDnf runs the dnf and rpm commands.
+	PkgBackendDnf = "dnf"
+	// PkgBackendApt runs the apt-get, apt-cache and dpkg commands.
+	PkgBackendApt = "apt"
+
+	// pkgRpmDB is the directory which contains the rpm database.
+	pkgRpmDB = "/var/lib/rpm/"
+	// pkgDpkgStatus is the file which contains the dpkg database.
+	pkgDpkgStatus = "/var/lib/dpkg/status"
+)
+
+// pkgBackend is the interface that the pkg resource uses to query and change
+// the installed packages. Each method takes a list of package names, so that a
+// group of pkg resources can be changed in a single transaction.
+type pkgBackend interface {
+	// IsInstalledList returns the status of each package, in the same
+	// order as the list of names that it was given.
+	IsInstalledList(packages []string) ([]*pkgStatus, error)
+
+	// Install installs the packages. The map has the package names as keys
+	// and the requested versions as values. An empty version installs the
+	// newest one that is available.
+	Install(packages map[string]string) error
+
+	// Remove removes the packages.
+	Remove(packages []string) error
+
+	// Update updates the installed packages to the newest version.
+	Update(packages []string) error
+
+	// GetFilesByPackageID returns the list of files in each package, with
+	// the package names as keys.
+	GetFilesByPackageID(packages []string) (map[string][]string, error)
+
+	// Watch returns a channel which gets an event whenever the installed
+	// packages might have changed, or an error if the watch failed. It
+	// stops when the done channel closes.
+	Watch(done <-chan struct{}) (<-chan error, error)
+
+	// Close cleans up after the backend.
+	Close() error
+}
+
+// pkgStatus is the status of a single package as returned by a pkgBackend.
+type pkgStatus struct {
+	Found     bool   // the package is installed or available
+	Installed bool   // the package is installed
+	Version   string // the installed version, eg: 4.2-1.fc23
+	Newest    bool   // the package is installed and there's no update
+}
+
+// pkgOptions are the options from the pkg resource which get passed to each
+// backend. Not every backend supports all of them.
+type pkgOptions struct {
+	allowUntrusted   bool // allow untrusted packages to be installed?
+	allowNonFree     bool // allow nonfree packages to be found? (packagekit)
+	allowUnsupported bool // allow unsupported packages to be found? (packagekit)
+
+	debug bool
+	logf  func(format string, v ...interface{})
+}
+
+// newPkgBackend returns the backend with this name. If the name is empty, then
+// it picks the first one that is available from PackageKit, dnf and apt.
+func newPkgBackend(name string, opts *pkgOptions) (pkgBackend, error) {
+	if name == "" {
+		var err error
+		if name, err = pkgBackendAuto(); err != nil {
+			return nil, err
+		}
+		if opts.debug {
+			opts.logf("using the %s backend", name)
+		}
+	}
+
+	switch name {
+	case PkgBackendPackageKit:
+		bus := packagekit.NewBus()
+		if bus == nil {
+			return nil, fmt.Errorf("can't connect to PackageKit bus")
+		}
+		bus.Debug = opts.debug
+		bus.Logf = func(format string, v ...interface{}) {
+			opts.logf("packagekit: "+format, v...)
+		}
+		return &pkgPackageKitBackend{bus: bus, opts: opts}, nil
+
+	case PkgBackendDnf:
+		return &pkgDnfBackend{opts: opts}, nil
+
+	case PkgBackendApt:
+		return &pkgAptBackend{opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown backend: %s", name)
+}
+
+// pkgBackendAuto returns the name of the first backend which is available.
+func pkgBackendAuto() (string, error) {
+	if bus := packagekit.NewBus(); bus != nil {
+		available, err := bus.IsAvailable()
+		bus.Close() // ignore the error
+		if err == nil && available {
+			return PkgBackendPackageKit, nil
+		}
+	}
+	if _, err := exec.LookPath("dnf"); err == nil {
+		return PkgBackendDnf, nil
+	}
+	if _, err := exec.LookPath("apt-get"); err == nil {
+		return PkgBackendApt, nil
+	}
+	return "", fmt.Errorf("no package backend is available")
+}
+
+// pkgCmd runs the command and returns the stdout. The error includes the
+// stderr. The stdout is returned even if the command failed, because some of
+// the query commands exit with an error if any one of the packages is missing.
+func pkgCmd(env []string, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), errwrap.Wrapf(err, "%s: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// pkgCmdExitError returns true if the error is from a command which ran, but
+// which exited with a non-zero status.
+func pkgCmdExitError(err error) bool {
+	_, ok := errwrap.Cause(err).(*exec.ExitError)
+	return ok
+}
+
+// pkgLines runs the function on every line of output which isn't empty.
+func pkgLines(output []byte, fn func(line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fn(line)
+		}
+	}
+}
+
+// pkgWatchFile returns a channel which gets an event whenever the file changes.
+// It is used by the backends which don't have a way to signal their changes.
+func pkgWatchFile(filename string, done <-chan struct{}) (<-chan error, error) {
+	recWatcher, err := recwatch.NewRecWatcher(filename, false)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan error)
+	go func() {
+		defer recWatcher.Close()
+		for {
+			select {
+			case event, ok := <-recWatcher.Events():
+				if !ok {
+					return
+				}
+				select {
+				case ch <- event.Error:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// pkgPackageKitBackend is the pkgBackend which uses PackageKit.
+type pkgPackageKitBackend struct {
+	bus  *packagekit.Conn
+	opts *pkgOptions
+}
+
+// resolve returns the PackageKit data for each package, where the map values
+// are the states which are used to pick the package ids.
+func (obj *pkgPackageKitBackend) resolve(packageMap map[string]string, newest bool) (map[string]*packagekit.PkPackageIDActionData, error) {
+	var filter uint64                     // initializes at the "zero" value of 0
+	filter += packagekit.PkFilterEnumArch // always search in our arch (optional!)
+	if newest {
+		// if we add this, we'll still see older packages if installed
+		// this is an optimization, and is *optional*, this logic is
+		// handled inside of PackagesToPackageIDs now automatically!
+		filter += packagekit.PkFilterEnumNewest // only search for newest packages
+	}
+	if !obj.opts.allowNonFree {
+		filter += packagekit.PkFilterEnumFree
+	}
+	if !obj.opts.allowUnsupported {
+		filter += packagekit.PkFilterEnumSupported
+	}
+	result, err := obj.bus.PackagesToPackageIDs(packageMap, filter)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't run PackagesToPackageIDs")
+	}
+	return result, nil
+}
+
+// packageIDs returns the package ids for the packages in the requested states.
+func (obj *pkgPackageKitBackend) packageIDs(packageMap map[string]string, newest bool) ([]string, error) {
+	result, err := obj.resolve(packageMap, newest)
+	if err != nil {
+		return nil, err
+	}
+	packages := []string{}
+	for name := range packageMap {
+		packages = append(packages, name)
+	}
+	return packagekit.FilterPackageIDs(result, packages)
+}
+
+// transactionFlags returns the flags that each transaction uses.
+func (obj *pkgPackageKitBackend) transactionFlags() uint64 {
+	var transactionFlags uint64 // initializes at the "zero" value of 0
+	if !obj.opts.allowUntrusted {
+		transactionFlags += packagekit.PkTransactionFlagEnumOnlyTrusted
+	}
+	return transactionFlags
+}
+
+// IsInstalledList returns the status of each package.
+func (obj *pkgPackageKitBackend) IsInstalledList(packages []string) ([]*pkgStatus, error) {
+	packageMap := make(map[string]string)
+	for _, name := range packages {
+		packageMap[name] = "installed"
+	}
+	result, err := obj.resolve(packageMap, false)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []*pkgStatus{}
+	for _, name := range packages {
+		status := &pkgStatus{}
+		if data, exists := result[name]; exists {
+			status.Found = data.Found
+			status.Installed = data.Installed
+			status.Version = data.Version
+			status.Newest = data.Newest
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Install installs the packages in a single transaction.
+func (obj *pkgPackageKitBackend) Install(packages map[string]string) error {
+	packageMap := make(map[string]string)
+	newest := true
+	for name, version := range packages {
+		if version == "" {
+			version = "installed"
+		} else {
+			newest = false // we need to search through the older ones
+		}
+		packageMap[name] = version
+	}
+	packageIDs, err := obj.packageIDs(packageMap, newest)
+	if err != nil {
+		return err
+	}
+	return obj.bus.InstallPackages(packageIDs, obj.transactionFlags())
+}
+
+// Remove removes the packages in a single transaction.
+func (obj *pkgPackageKitBackend) Remove(packages []string) error {
+	packageMap := make(map[string]string)
+	for _, name := range packages {
+		packageMap[name] = "uninstalled"
+	}
+	// NOTE: packageID is different than when installed, because now it
+	// has the "installed" flag added to the data portion if it!!
+	packageIDs, err := obj.packageIDs(packageMap, false)
+	if err != nil {
+		return err
+	}
+	return obj.bus.RemovePackages(packageIDs, obj.transactionFlags())
+}
+
+// Update updates the packages in a single transaction.
+func (obj *pkgPackageKitBackend) Update(packages []string) error {
+	packageMap := make(map[string]string)
+	for _, name := range packages {
+		packageMap[name] = "newest"
+	}
+	packageIDs, err := obj.packageIDs(packageMap, true)
+	if err != nil {
+		return err
+	}
+	return obj.bus.UpdatePackages(packageIDs, obj.transactionFlags())
+}
+
+// GetFilesByPackageID returns the list of files in each package.
+func (obj *pkgPackageKitBackend) GetFilesByPackageID(packages []string) (map[string][]string, error) {
+	packageMap := make(map[string]string)
+	for _, name := range packages {
+		packageMap[name] = "installed"
+	}
+	result, err := obj.resolve(packageMap, true)
+	if err != nil {
+		return nil, err
+	}
+	packageIDs, err := packagekit.FilterPackageIDs(result, packages)
+	if err != nil {
+		return nil, err
+	}
+	filesMap, err := obj.bus.GetFilesByPackageID(packageIDs)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't run GetFilesByPackageID")
+	}
+	files := make(map[string][]string)
+	for _, name := range packages {
+		files[name] = filesMap[result[name].PackageID]
+	}
+	return files, nil
+}
+
+// Watch uses the PackageKit UpdatesChanged signal to watch for changes.
+// TODO: https://github.com/hughsie/PackageKit/issues/109
+// TODO: https://github.com/hughsie/PackageKit/issues/110
+func (obj *pkgPackageKitBackend) Watch(done <-chan struct{}) (<-chan error, error) {
+	signals, err := obj.bus.WatchChanges()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error adding signal match")
+	}
+	ch := make(chan error)
+	go func() {
+		for {
+			select {
+			case event := <-signals:
+				// FIXME: ask packagekit for info on what packages changed
+				if obj.opts.debug {
+					obj.opts.logf("packagekit: event: %s", event.Name)
+				}
+				// since the chan is buffered, remove any supplemental
+				// events since they would just be duplicates anyways!
+				for len(signals) > 0 { // we can detect pending count here!
+					<-signals // discard
+				}
+				select {
+				case ch <- nil:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Close closes the bus connection.
+func (obj *pkgPackageKitBackend) Close() error {
+	return obj.bus.Close()
+}
+
+// pkgDnfBackend is the pkgBackend which runs the dnf and rpm commands. It works
+// on systems that don't run packagekitd, such as minimal containers.
+type pkgDnfBackend struct {
+	opts *pkgOptions
+}
+
+// dnf runs a dnf command which changes the packages.
+func (obj *pkgDnfBackend) dnf(args ...string) error {
+	args = append([]string{"-y", "-q"}, args...)
+	if obj.opts.allowUntrusted {
+		args = append([]string{"--nogpgcheck"}, args...)
+	}
+	if obj.opts.debug {
+		obj.opts.logf("dnf %s", strings.Join(args, " "))
+	}
+	_, err := pkgCmd(nil, "dnf", args...)
+	return err
+}
+
+// IsInstalledList returns the status of each package, from the rpm database
+// and the newest version that is available in the repositories.
+func (obj *pkgDnfBackend) IsInstalledList(packages []string) ([]*pkgStatus, error) {
+	format := "%{NAME} %{VERSION}-%{RELEASE}\n"
+	args := append([]string{"-q", "--qf", format}, packages...)
+	output, err := pkgCmd(nil, "rpm", args...)
+	if err != nil && !pkgCmdExitError(err) { // exits 1 if any are missing
+		return nil, err
+	}
+	installed := make(map[string]string)
+	pkgLines(output, func(line string) {
+		if fields := strings.Fields(line); len(fields) == 2 { // skip: package foo is not installed
+			installed[fields[0]] = fields[1]
+		}
+	})
+
+	args = append([]string{"-q", "repoquery", "--latest-limit=1", "--qf", format}, packages...)
+	output, err = pkgCmd(nil, "dnf", args...)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[string]string)
+	pkgLines(output, func(line string) {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			available[fields[0]] = fields[1]
+		}
+	})
+
+	statuses := []*pkgStatus{}
+	for _, name := range packages {
+		version, isInstalled := installed[name]
+		newest, isAvailable := available[name]
+		statuses = append(statuses, &pkgStatus{
+			Found:     isInstalled || isAvailable,
+			Installed: isInstalled,
+			Version:   version,
+			Newest:    isInstalled && (!isAvailable || version == newest),
+		})
+	}
+	return statuses, nil
+}
+
+// Install installs the packages in a single transaction.
+func (obj *pkgDnfBackend) Install(packages map[string]string) error {
+	args := []string{"install"}
+	for name, version := range packages {
+		if version != "" {
+			name = name + "-" + version
+		}
+		args = append(args, name)
+	}
+	return obj.dnf(args...)
+}
+
+// Remove removes the packages in a single transaction.
+func (obj *pkgDnfBackend) Remove(packages []string) error {
+	return obj.dnf(append([]string{"remove"}, packages...)...)
+}
+
+// Update updates the packages in a single transaction.
+func (obj *pkgDnfBackend) Update(packages []string) error {
+	return obj.dnf(append([]string{"upgrade"}, packages...)...)
+}
+
+// GetFilesByPackageID returns the list of files in each package. The installed
+// packages are read from the rpm database, and the others from the repos.
+func (obj *pkgDnfBackend) GetFilesByPackageID(packages []string) (map[string][]string, error) {
+	files := make(map[string][]string)
+	for _, name := range packages {
+		output, err := pkgCmd(nil, "rpm", "-q", "-l", name)
+		if err != nil && pkgCmdExitError(err) { // not installed
+			output, err = pkgCmd(nil, "dnf", "-q", "repoquery", "--latest-limit=1", "-l", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[name] = []string{}
+		pkgLines(output, func(line string) {
+			if strings.HasPrefix(line, "/") {
+				files[name] = append(files[name], line)
+			}
+		})
+	}
+	return files, nil
+}
+
+// Watch watches the rpm database for changes.
+func (obj *pkgDnfBackend) Watch(done <-chan struct{}) (<-chan error, error) {
+	return pkgWatchFile(pkgRpmDB, done)
+}
+
+// Close does nothing, since there is nothing to clean up.
+func (obj *pkgDnfBackend) Close() error {
+	return nil
+}
+
+// pkgAptBackend is the pkgBackend which runs the apt-get, apt-cache and dpkg
+// commands. It works on systems that don't run packagekitd.
+type pkgAptBackend struct {
+	opts *pkgOptions
+}
+
+// aptGet runs an apt-get command which changes the packages.
+func (obj *pkgAptBackend) aptGet(args ...string) error {
+	args = append([]string{"-y", "-q"}, args...)
+	if obj.opts.allowUntrusted {
+		args = append([]string{"--allow-unauthenticated"}, args...)
+	}
+	if obj.opts.debug {
+		obj.opts.logf("apt-get %s", strings.Join(args, " "))
+	}
+	env := []string{"DEBIAN_FRONTEND=noninteractive"} // don't ask questions
+	_, err := pkgCmd(env, "apt-get", args...)
+	return err
+}
+
+// IsInstalledList returns the status of each package. The output of apt-cache
+// policy has both the installed and the newest candidate version.
+func (obj *pkgAptBackend) IsInstalledList(packages []string) ([]*pkgStatus, error) {
+	output, err := pkgCmd(nil, "apt-cache", append([]string{"policy"}, packages...)...)
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]string)
+	candidate := make(map[string]string)
+	var name string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":") {
+			name = strings.TrimSuffix(line, ":")
+			if i := strings.Index(name, ":"); i >= 0 { // eg: foo:i386
+				name = name[:i]
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] == "(none)" {
+			continue
+		}
+		switch fields[0] {
+		case "Installed:":
+			installed[name] = fields[1]
+		case "Candidate:":
+			candidate[name] = fields[1]
+		}
+	}
+
+	statuses := []*pkgStatus{}
+	for _, name := range packages {
+		version, isInstalled := installed[name]
+		newest, isAvailable := candidate[name]
+		statuses = append(statuses, &pkgStatus{
+			Found:     isInstalled || isAvailable,
+			Installed: isInstalled,
+			Version:   version,
+			Newest:    isInstalled && (!isAvailable || version == newest),
+		})
+	}
+	return statuses, nil
+}
+
+// Install installs the packages in a single transaction.
+func (obj *pkgAptBackend) Install(packages map[string]string) error {
+	args := []string{"install"}
+	for name, version := range packages {
+		if version != "" {
+			name = name + "=" + version
+		}
+		args = append(args, name)
+	}
+	return obj.aptGet(args...)
+}
+
+// Remove removes the packages in a single transaction.
+func (obj *pkgAptBackend) Remove(packages []string) error {
+	return obj.aptGet(append([]string{"remove"}, packages...)...)
+}
+
+// Update updates the packages in a single transaction.
+func (obj *pkgAptBackend) Update(packages []string) error {
+	return obj.aptGet(append([]string{"install", "--only-upgrade"}, packages...)...)
+}
+
+// GetFilesByPackageID returns the list of files in each package. Since dpkg
+// only knows about the installed packages, the others have an empty list.
+// TODO: use apt-file for the packages which aren't installed, if it exists?
+func (obj *pkgAptBackend) GetFilesByPackageID(packages []string) (map[string][]string, error) {
+	files := make(map[string][]string)
+	for _, name := range packages {
+		files[name] = []string{}
+		output, err := pkgCmd(nil, "dpkg", "-L", name)
+		if err != nil && pkgCmdExitError(err) { // not installed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		pkgLines(output, func(line string) {
+			if strings.HasPrefix(line, "/") && line != "/." {
+				files[name] = append(files[name], line)
+			}
+		})
+	}
+	return files, nil
+}
+
+// Watch watches the dpkg database for changes.
+func (obj *pkgAptBackend) Watch(done <-chan struct{}) (<-chan error, error) {
+	return pkgWatchFile(pkgDpkgStatus, done)
+}
+
+// Close does nothing, since there is nothing to clean up.
+func (obj *pkgAptBackend) Close() error {
+	return nil
+}
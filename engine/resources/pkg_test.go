@@ -20,7 +20,14 @@
 package resources
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/purpleidea/mgmt/util"
 )
 
 func TestNilList1(t *testing.T) {
@@ -33,3 +40,267 @@ func TestNilList1(t *testing.T) {
 		t.Errorf("list should have been empty, was: %+v", x)
 	}
 }
+
+// pkgFakePackage is a package in the database of the fake backend.
+type pkgFakePackage struct {
+	Installed string   `json:"installed"` // the installed version, if any
+	Available []string `json:"available"` // the versions in the repos, oldest first
+	Files     []string `json:"files"`
+}
+
+// pkgFake is a fake pkgBackend which stores its package database in a json
+// file. It counts the transactions that change the database.
+type pkgFake struct {
+	filename     string
+	transactions int // number of changes applied
+}
+
+// load reads the package database from the file.
+func (obj *pkgFake) load() (map[string]*pkgFakePackage, error) {
+	db := make(map[string]*pkgFakePackage)
+	b, err := ioutil.ReadFile(obj.filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// change runs the function on each of the packages, and only saves the result
+// if every one of them worked, so that each call is a single transaction.
+func (obj *pkgFake) change(packages []string, fn func(name string, p *pkgFakePackage) error) error {
+	db, err := obj.load()
+	if err != nil {
+		return err
+	}
+	for _, name := range packages {
+		p, exists := db[name]
+		if !exists {
+			return fmt.Errorf("no package named: %s", name)
+		}
+		if err := fn(name, p); err != nil {
+			return fmt.Errorf("package %s failed: %v", name, err)
+		}
+	}
+	b, err := json.Marshal(db)
+	if err != nil {
+		return err
+	}
+	obj.transactions++
+	return ioutil.WriteFile(obj.filename, b, 0600)
+}
+
+func (obj *pkgFake) IsInstalledList(packages []string) ([]*pkgStatus, error) {
+	db, err := obj.load()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []*pkgStatus{}
+	for _, name := range packages {
+		status := &pkgStatus{}
+		if p, exists := db[name]; exists {
+			newest := p.Installed
+			if len(p.Available) > 0 {
+				newest = p.Available[len(p.Available)-1]
+			}
+			status.Found = true
+			status.Installed = p.Installed != ""
+			status.Version = p.Installed
+			status.Newest = status.Installed && p.Installed == newest
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (obj *pkgFake) Install(packages map[string]string) error {
+	return obj.change(util.StrMapKeys(packages), func(name string, p *pkgFakePackage) error {
+		if len(p.Available) == 0 {
+			return fmt.Errorf("not available")
+		}
+		version := packages[name]
+		if version == "" {
+			version = p.Available[len(p.Available)-1]
+		}
+		if !util.StrInList(version, p.Available) {
+			return fmt.Errorf("version %s is not available", version)
+		}
+		p.Installed = version
+		return nil
+	})
+}
+
+func (obj *pkgFake) Remove(packages []string) error {
+	return obj.change(packages, func(name string, p *pkgFakePackage) error {
+		if p.Installed == "" {
+			return fmt.Errorf("not installed")
+		}
+		p.Installed = ""
+		return nil
+	})
+}
+
+func (obj *pkgFake) Update(packages []string) error {
+	return obj.change(packages, func(name string, p *pkgFakePackage) error {
+		if p.Installed == "" {
+			return fmt.Errorf("not installed")
+		}
+		if len(p.Available) > 0 {
+			p.Installed = p.Available[len(p.Available)-1]
+		}
+		return nil
+	})
+}
+
+func (obj *pkgFake) GetFilesByPackageID(packages []string) (map[string][]string, error) {
+	db, err := obj.load()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	for _, name := range packages {
+		p, exists := db[name]
+		if !exists {
+			return nil, fmt.Errorf("can't find package named '%s'", name)
+		}
+		files[name] = p.Files
+	}
+	return files, nil
+}
+
+func (obj *pkgFake) Watch(done <-chan struct{}) (<-chan error, error) {
+	return pkgWatchFile(obj.filename, done)
+}
+
+func (obj *pkgFake) Close() error {
+	return nil
+}
+
+func TestPkgCheckApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-pkg-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fake := &pkgFake{filename: path.Join(dir, "packages.json")}
+	data := `{
+		"cowsay": {"available": ["3.03-1", "3.04-1"], "files": ["/usr/bin/cowsay", "/usr/share/cowsay/cows", "/usr/share/cowsay/cows/default.cow"]},
+		"drbd-utils": {"available": ["9.1-1", "9.2-1"], "files": ["/usr/lib/systemd/system/drbd.service", "/usr/sbin/drbdadm"]},
+		"tree": {"installed": "1.7-1", "available": ["1.7-1", "1.8-1"]}
+	}`
+	if err := ioutil.WriteFile(fake.filename, []byte(data), 0600); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+
+	resources := []*PkgRes{}
+	for _, name := range []string{"cowsay", "drbd-utils", "tree"} {
+		res := &PkgRes{State: "installed", backend: fake}
+		res.SetName(name)
+		if err := res.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+		resources = append(resources, res)
+	}
+	r1 := resources[0]
+	for _, res := range resources[1:] {
+		if err := r1.GroupCmp(res); err != nil {
+			t.Errorf("resources should group: %v", err)
+			return
+		}
+		if err := r1.GroupRes(res); err != nil {
+			t.Errorf("grouping failed with: %v", err)
+			return
+		}
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if !util.StrInList("/usr/share/cowsay/cows/", r1.fileList) {
+		t.Errorf("unexpected file list: %+v", r1.fileList)
+	}
+
+	installed := func(name string) string {
+		db, err := fake.load()
+		if err != nil {
+			t.Errorf("error loading fake package database: %v", err)
+			return ""
+		}
+		return db[name].Installed
+	}
+	converge := func(msg string, transactions int) {
+		fake.transactions = 0
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if checkOK {
+			t.Errorf("%s: check should have failed", msg)
+		}
+		if _, err := r1.CheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", msg, err)
+		}
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if !checkOK {
+			t.Errorf("%s: check should have passed after apply", msg)
+		}
+		if fake.transactions != transactions {
+			t.Errorf("%s: expected %d transaction(s), got: %d", msg, transactions, fake.transactions)
+		}
+	}
+
+	// the two missing packages get installed together
+	converge("installed", 1)
+	if v := installed("cowsay"); v != "3.04-1" {
+		t.Errorf("unexpected version: %s", v)
+	}
+	if v := installed("tree"); v != "1.7-1" {
+		t.Errorf("the installed package should not have changed: %s", v)
+	}
+
+	// only the old package needs an update
+	for _, res := range resources {
+		res.State = "newest"
+	}
+	converge("newest", 1)
+	if v := installed("tree"); v != "1.8-1" {
+		t.Errorf("unexpected version: %s", v)
+	}
+
+	for _, res := range resources {
+		res.State = "uninstalled"
+	}
+	converge("uninstalled", 1)
+
+	// a specific version can't be grouped, so we use it on its own
+	r2 := &PkgRes{State: "3.03-1", backend: fake}
+	r2.SetName("cowsay")
+	if err := r1.GroupCmp(r2); err == nil {
+		t.Errorf("a version should not group")
+	}
+	if err := r2.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	r1 = r2
+	converge("version", 1)
+	if v := installed("cowsay"); v != "3.03-1" {
+		t.Errorf("unexpected version: %s", v)
+	}
+
+	// a package that doesn't exist is an error
+	r3 := &PkgRes{State: "installed", backend: fake}
+	r3.SetName("nope")
+	r3.fileList = []string{} // skip the lookup in init
+	if err := r3.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r3.CheckApply(false); err == nil {
+		t.Errorf("check should have failed on a missing package")
+	}
+}
@@ -21,12 +21,17 @@ package resources
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/user"
 	"path"
+	"sort"
+	"strings"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
 	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/recwatch"
 	"github.com/purpleidea/mgmt/util"
 
 	systemd "github.com/coreos/go-systemd/dbus" // change namespace
@@ -39,7 +44,15 @@ func init() {
 	engine.RegisterResource("svc", func() engine.Res { return &SvcRes{} })
 }
 
-// SvcRes is a service resource for systemd units.
+const (
+	// SvcUnitDir is the default directory for the unit files of the system
+	// services. The user session services use ~/.config/systemd/user/.
+	SvcUnitDir = "/etc/systemd/system/"
+)
+
+// SvcRes is a service resource for systemd units. It can optionally manage the
+// unit file and some drop-in snippets, in which case the manager is reloaded
+// and the running service is restarted whenever they change.
 type SvcRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Edgeable
@@ -48,9 +61,23 @@ type SvcRes struct {
 
 	init *engine.Init
 
-	State   string `yaml:"state"`   // state: running, stopped, undefined
+	State   string `yaml:"state"`   // state: running, stopped, masked, undefined
 	Startup string `yaml:"startup"` // enabled, disabled, undefined
 	Session bool   `yaml:"session"` // user session (true) or system?
+
+	// Content is the content of the unit file. If this is nil, then the
+	// unit file is not managed.
+	Content *string `yaml:"content"`
+	// DropIns are the drop-in snippets for the unit, keyed by file name,
+	// eg: 10-limits.conf. Any other drop-ins that exist are left alone.
+	DropIns map[string]string `yaml:"dropins"`
+	// UnitDir is the directory where the unit file and drop-ins go. It is
+	// mostly useful for testing. It defaults to SvcUnitDir, or to the user
+	// unit directory for a user session service.
+	UnitDir string `yaml:"unitdir"`
+	// Force replaces an existing unit file with the mask symlink when the
+	// state is masked. Without it, masking such a unit fails.
+	Force bool `yaml:"force"`
 }
 
 // Default returns some sensible defaults for this resource.
@@ -60,12 +87,29 @@ func (obj *SvcRes) Default() engine.Res {
 
 // Validate checks if the resource data structure was populated correctly.
 func (obj *SvcRes) Validate() error {
-	if obj.State != "running" && obj.State != "stopped" && obj.State != "" {
-		return fmt.Errorf("state must be either `running` or `stopped` or undefined")
+	if obj.State != "running" && obj.State != "stopped" && obj.State != "masked" && obj.State != "" {
+		return fmt.Errorf("state must be either `running`, `stopped`, `masked` or undefined")
 	}
 	if obj.Startup != "enabled" && obj.Startup != "disabled" && obj.Startup != "" {
 		return fmt.Errorf("startup must be either `enabled` or `disabled` or undefined")
 	}
+	if obj.State == "masked" {
+		if obj.Startup != "" {
+			return fmt.Errorf("a masked service can't have a startup value")
+		}
+		// the unit file would get in the way of the mask symlink
+		if obj.Content != nil {
+			return fmt.Errorf("a masked service can't have any content")
+		}
+	}
+	for name := range obj.DropIns {
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".conf") {
+			return fmt.Errorf("drop-in name `%s` must be a file name ending in .conf", name)
+		}
+	}
+	if obj.UnitDir != "" && !strings.HasPrefix(obj.UnitDir, "/") {
+		return fmt.Errorf("unit dir must be absolute")
+	}
 	return nil
 }
 
@@ -80,6 +124,87 @@ func (obj *SvcRes) Close() error {
 	return nil
 }
 
+// unitName returns the systemd name of the unit.
+func (obj *SvcRes) unitName() string {
+	return fmt.Sprintf("%s.service", obj.Name())
+}
+
+// unitDir returns the directory that contains the unit file and the drop-ins.
+func (obj *SvcRes) unitDir() (string, error) {
+	if obj.UnitDir != "" {
+		return obj.UnitDir, nil
+	}
+	if !obj.Session {
+		return SvcUnitDir, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", errwrap.Wrapf(err, "error getting current user")
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("user has no home directory")
+	}
+	return path.Join(u.HomeDir, "/.config/systemd/user/") + "/", nil
+}
+
+// unitFiles returns the managed unit file and drop-in paths, with the content
+// that each one should have.
+func (obj *SvcRes) unitFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	if obj.Content == nil && len(obj.DropIns) == 0 {
+		return files, nil
+	}
+	dir, err := obj.unitDir()
+	if err != nil {
+		return nil, err
+	}
+	if obj.Content != nil {
+		files[path.Join(dir, obj.unitName())] = *obj.Content
+	}
+	for name, content := range obj.DropIns {
+		files[path.Join(dir, obj.unitName()+".d", name)] = content
+	}
+	return files, nil
+}
+
+// unitFilesCheckApply checks the managed unit file and drop-ins, and writes
+// them if the apply bool is true. It returns true if nothing had to change.
+func (obj *SvcRes) unitFilesCheckApply(apply bool) (bool, error) {
+	files, err := obj.unitFiles()
+	if err != nil {
+		return false, err
+	}
+	keys := []string{}
+	for p := range files {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys) // deterministic order for the logs
+
+	checkOK := true
+	for _, p := range keys {
+		b, err := ioutil.ReadFile(p)
+		if err == nil && string(b) == files[p] {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "could not read %s", p)
+		}
+		if !apply {
+			return false, nil
+		}
+		checkOK = false
+
+		obj.init.Logf("writing: %s", p)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return false, err
+		}
+		if err := ioutil.WriteFile(p, []byte(files[p]), 0644); err != nil {
+			return false, errwrap.Wrapf(err, "could not write %s", p)
+		}
+	}
+	return checkOK, nil
+}
+
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *SvcRes) Watch() error {
 	// obj.Name: svc name
@@ -120,15 +245,40 @@ func (obj *SvcRes) Watch() error {
 	bus.Signal(buschan)
 	defer bus.RemoveSignal(buschan) // not needed here, but nice for symmetry
 
+	// watch the unit file and drop-ins, if we manage them
+	files, err := obj.unitFiles()
+	if err != nil {
+		return err
+	}
+	fileEvents := make(chan recwatch.Event)
+	done := make(chan struct{})
+	defer close(done)
+	for p := range files {
+		recWatcher, err := recwatch.NewRecWatcher(p, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		go func(ch chan recwatch.Event) {
+			for event := range ch {
+				select {
+				case fileEvents <- event:
+				case <-done:
+					return
+				}
+			}
+		}(recWatcher.Events())
+	}
+
 	// notify engine that we're running
 	if err := obj.init.Running(); err != nil {
 		return err // exit if requested
 	}
 
-	var svc = fmt.Sprintf("%s.service", obj.Name()) // systemd name
-	var send = false                                // send event?
-	var invalid = false                             // does the svc exist or not?
-	var previous bool                               // previous invalid value
+	var svc = obj.unitName() // systemd name
+	var send = false         // send event?
+	var invalid = false      // does the svc exist or not?
+	var previous bool        // previous invalid value
 
 	// TODO: do we first need to call conn.Subscribe() ?
 	set := conn.NewSubscriptionSet() // no error should be returned
@@ -176,6 +326,13 @@ func (obj *SvcRes) Watch() error {
 				// loop so that we can see the changed invalid signal
 				obj.init.Logf("daemon reload")
 
+			case event := <-fileEvents:
+				if err := event.Error; err != nil {
+					return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+				}
+				send = true
+				obj.init.Dirty() // dirty
+
 			case event := <-obj.init.Events:
 				if err := obj.init.Read(event); err != nil {
 					return err
@@ -222,6 +379,13 @@ func (obj *SvcRes) Watch() error {
 			case err := <-subErrors:
 				return errwrap.Wrapf(err, "unknown %s error", obj)
 
+			case event := <-fileEvents:
+				if err := event.Error; err != nil {
+					return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+				}
+				send = true
+				obj.init.Dirty() // dirty
+
 			case event := <-obj.init.Events:
 				if err := obj.init.Read(event); err != nil {
 					return err
@@ -257,7 +421,22 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 	}
 	defer conn.Close()
 
-	var svc = fmt.Sprintf("%s.service", obj.Name()) // systemd name
+	var svc = obj.unitName() // systemd name
+
+	// the unit file and drop-ins come first, since they define the unit
+	filesOK, err := obj.unitFilesCheckApply(apply)
+	if err != nil {
+		return false, err
+	}
+	if !filesOK && !apply {
+		return false, nil
+	}
+	if !filesOK {
+		obj.init.Logf("daemon reload")
+		if err := conn.Reload(); err != nil {
+			return false, errwrap.Wrapf(err, "failed to reload the manager")
+		}
+	}
 
 	loadstate, err := conn.GetUnitProperty(svc, "LoadState")
 	if err != nil {
@@ -266,21 +445,31 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 
 	// NOTE: we have to compare variants with other variants, they are really strings...
 	var notFound = (loadstate.Value == dbus.MakeVariant("not-found"))
-	if notFound {
-		return false, errwrap.Wrapf(err, "failed to find svc: %s", svc)
+	var masked = (loadstate.Value == dbus.MakeVariant("masked"))
+	if notFound && obj.State != "masked" { // we can mask a missing unit
+		return false, fmt.Errorf("failed to find svc: %s", svc)
 	}
 
-	// XXX: check svc "enabled at boot" or not status...
-
 	//conn.GetUnitProperties(svc)
 	activestate, err := conn.GetUnitProperty(svc, "ActiveState")
 	if err != nil {
 		return false, errwrap.Wrapf(err, "failed to get active state")
 	}
+	filestate, err := conn.GetUnitProperty(svc, "UnitFileState")
+	if err != nil {
+		return false, errwrap.Wrapf(err, "failed to get unit file state")
+	}
 
 	var running = (activestate.Value == dbus.MakeVariant("active"))
-	var stateOK = ((obj.State == "") || (obj.State == "running" && running) || (obj.State == "stopped" && !running))
-	var startupOK = true // XXX: DETECT AND SET
+	var stateOK = ((obj.State == "") || (obj.State == "running" && running && !masked) || (obj.State == "stopped" && !running && !masked) || (obj.State == "masked" && !running && masked))
+	var enabled = (filestate.Value == dbus.MakeVariant("enabled"))
+	var fixed = false // these have no install section to enable or disable
+	for _, x := range []string{"static", "alias", "indirect", "generated"} {
+		if filestate.Value == dbus.MakeVariant(x) {
+			fixed = true
+		}
+	}
+	var startupOK = ((obj.Startup == "") || (obj.Startup == "enabled" && (enabled || fixed)) || (obj.Startup == "disabled" && !enabled))
 
 	// NOTE: if this svc resource is embedded as a composite resource inside
 	// of another resource using a technique such as `makeComposite()`, then
@@ -291,7 +480,10 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 	// trait to the parent resource, or we'll panic when we call this line.)
 	// It might not be recommended to use the Watch method without a thought
 	// to what actually happens when we would run Send(), and other methods.
-	var refresh = obj.init.Refresh() // do we have a pending reload to apply?
+	var refresh = obj.init.Refresh() // do we have a pending restart to apply?
+	if !filesOK {
+		refresh = true // the unit changed, so restart it if it's running
+	}
 
 	if stateOK && startupOK && !refresh {
 		return true, nil // we are in the correct state
@@ -305,10 +497,22 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 	// apply portion
 	obj.init.Logf("Apply")
 	var files = []string{svc} // the svc represented in a list
-	if obj.Startup == "enabled" {
+
+	// a masked unit can't be started or enabled, so unmask it first
+	if masked && obj.State != "masked" && obj.State != "" {
+		obj.init.Logf("unmasking")
+		if _, err := conn.UnmaskUnitFiles(files, false); err != nil {
+			return false, errwrap.Wrapf(err, "unable to unmask unit")
+		}
+		if err := conn.Reload(); err != nil {
+			return false, errwrap.Wrapf(err, "failed to reload the manager")
+		}
+	}
+
+	if obj.Startup == "enabled" && !enabled && !fixed {
 		_, _, err = conn.EnableUnitFiles(files, false, true)
 
-	} else if obj.Startup == "disabled" {
+	} else if obj.Startup == "disabled" && enabled {
 		_, err = conn.DisableUnitFiles(files, false)
 	}
 
@@ -316,44 +520,56 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 		return false, errwrap.Wrapf(err, "unable to change startup status")
 	}
 
-	// XXX: do we need to use a buffered channel here?
-	result := make(chan string, 1) // catch result information
+	// wait runs a job and waits for its result
+	wait := func(job func(string, string, chan<- string) (int, error), msg string) error {
+		result := make(chan string, 1) // catch result information
+		if _, err := job(svc, "fail", result); err != nil {
+			return errwrap.Wrapf(err, "failed to %s unit", msg)
+		}
+		if status := <-result; status != "done" {
+			return fmt.Errorf("unknown systemd return string: %v", status)
+		}
+		return nil
+	}
 
-	if obj.State == "running" {
-		_, err = conn.StartUnit(svc, "fail", result)
-		if err != nil {
-			return false, errwrap.Wrapf(err, "failed to start unit")
+	if obj.State == "running" && !running {
+		if err := wait(conn.StartUnit, "start"); err != nil {
+			return false, err
 		}
 		if refresh {
-			obj.init.Logf("Skipping reload, due to pending start")
+			obj.init.Logf("Skipping restart, due to pending start")
 		}
-		refresh = false // we did a start, so a reload is not needed
-	} else if obj.State == "stopped" {
-		_, err = conn.StopUnit(svc, "fail", result)
-		if err != nil {
-			return false, errwrap.Wrapf(err, "failed to stop unit")
+		refresh = false // we did a start, so a restart is not needed
+	} else if (obj.State == "stopped" || obj.State == "masked") && running {
+		if err := wait(conn.StopUnit, "stop"); err != nil {
+			return false, err
 		}
 		if refresh {
-			obj.init.Logf("Skipping reload, due to pending stop")
+			obj.init.Logf("Skipping restart, due to pending stop")
 		}
-		refresh = false // we did a stop, so a reload is not needed
+		refresh = false // we did a stop, so a restart is not needed
 	}
 
-	status := <-result
-	if &status == nil {
-		return false, fmt.Errorf("systemd service action result is nil")
-	}
-	if status != "done" {
-		return false, fmt.Errorf("unknown systemd return string: %v", status)
+	if obj.State == "masked" && !masked {
+		obj.init.Logf("masking")
+		if _, err := conn.MaskUnitFiles(files, false, obj.Force); err != nil {
+			return false, errwrap.Wrapf(err, "unable to mask unit")
+		}
+		if err := conn.Reload(); err != nil {
+			return false, errwrap.Wrapf(err, "failed to reload the manager")
+		}
+		refresh = false // a masked unit can't run
 	}
 
-	if refresh { // we need to reload the service
-		// XXX: run a svc reload here!
-		obj.init.Logf("Reloading...")
+	if refresh { // we need to restart the service
+		obj.init.Logf("Restarting...")
+		// this only restarts the unit if it was already running, which
+		// is what we want when the state is running or undefined
+		if err := wait(conn.TryRestartUnit, "restart"); err != nil {
+			return false, err
+		}
 	}
 
-	// XXX: also set enabled on boot
-
 	return false, nil // success
 }
 
@@ -382,6 +598,26 @@ func (obj *SvcRes) Compare(r engine.Res) bool {
 	if obj.Session != res.Session {
 		return false
 	}
+	if (obj.Content == nil) != (res.Content == nil) {
+		return false
+	}
+	if obj.Content != nil && *obj.Content != *res.Content {
+		return false
+	}
+	if len(obj.DropIns) != len(res.DropIns) {
+		return false
+	}
+	for name, content := range obj.DropIns {
+		if x, exists := res.DropIns[name]; !exists || x != content {
+			return false
+		}
+	}
+	if obj.UnitDir != res.UnitDir {
+		return false
+	}
+	if obj.Force != res.Force {
+		return false
+	}
 
 	return true
 }
@@ -501,6 +737,9 @@ func (obj *SvcRes) AutoEdges() (engine.AutoEdge, error) {
 			path.Join(u.HomeDir, "/.config/systemd/user/", fmt.Sprintf("%s.service", obj.Name())),
 		}
 	}
+	if obj.UnitDir != "" {
+		svcFiles = []string{path.Join(obj.UnitDir, obj.unitName())}
+	}
 	for _, x := range svcFiles {
 		var reversed = true
 		data = append(data, &FileUID{
@@ -0,0 +1,134 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSvcValidate(t *testing.T) {
+	content := "[Service]\nExecStart=/usr/bin/true\n"
+	tests := []struct {
+		res *SvcRes
+		ok  bool
+	}{
+		{&SvcRes{State: "running", Startup: "enabled", Content: &content}, true},
+		{&SvcRes{State: "masked"}, true},
+		{&SvcRes{State: "masked", Startup: "enabled"}, false},
+		{&SvcRes{State: "masked", Content: &content}, false},
+		{&SvcRes{DropIns: map[string]string{"10-limits.conf": "[Service]\n"}}, true},
+		{&SvcRes{DropIns: map[string]string{"10-limits": "[Service]\n"}}, false},
+		{&SvcRes{DropIns: map[string]string{"../10-limits.conf": "[Service]\n"}}, false},
+		{&SvcRes{UnitDir: "relative/"}, false},
+	}
+	for i, tt := range tests {
+		tt.res.SetName("test")
+		if err := tt.res.Validate(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestSvcUnitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-svc-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	content := "[Service]\nExecStart=/usr/bin/sleep infinity\n"
+	r1 := &SvcRes{
+		State:   "running",
+		Content: &content,
+		DropIns: map[string]string{
+			"10-limits.conf": "[Service]\nLimitNOFILE=4096\n",
+		},
+		UnitDir: dir,
+	}
+	r1.SetName("mgmt-test")
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	converge := func(msg string) {
+		if checkOK, err := r1.unitFilesCheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if checkOK {
+			t.Errorf("%s: check should have failed", msg)
+		}
+		if checkOK, err := r1.unitFilesCheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", msg, err)
+		} else if checkOK {
+			t.Errorf("%s: checkapply should have made changes", msg)
+		}
+		if checkOK, err := r1.unitFilesCheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if !checkOK {
+			t.Errorf("%s: check should have passed after apply", msg)
+		}
+	}
+	expect := func(p, exp string) {
+		b, err := ioutil.ReadFile(path.Join(dir, p))
+		if err != nil {
+			t.Errorf("error reading file: %v", err)
+		} else if s := string(b); s != exp {
+			t.Errorf("unexpected contents of %s:\n%s", p, s)
+		}
+	}
+
+	converge("create")
+	expect("mgmt-test.service", content)
+	expect("mgmt-test.service.d/10-limits.conf", "[Service]\nLimitNOFILE=4096\n")
+
+	// someone else changes the drop-in, and another one is left alone
+	other := path.Join(dir, "mgmt-test.service.d/20-other.conf")
+	if err := ioutil.WriteFile(other, []byte("[Unit]\n"), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "mgmt-test.service.d/10-limits.conf"), []byte("[Service]\n"), 0644); err != nil {
+		t.Errorf("error writing file: %v", err)
+		return
+	}
+	converge("drop-in")
+	expect("mgmt-test.service.d/10-limits.conf", "[Service]\nLimitNOFILE=4096\n")
+	expect("mgmt-test.service.d/20-other.conf", "[Unit]\n")
+
+	// without any content or drop-ins, there's nothing to manage
+	r2 := &SvcRes{State: "running", UnitDir: dir}
+	r2.SetName("mgmt-test")
+	if files, err := r2.unitFiles(); err != nil || len(files) != 0 {
+		t.Errorf("unexpected unit files: %+v: %v", files, err)
+	}
+	if r1.Cmp(r2) == nil {
+		t.Errorf("resources with different content should not compare")
+	}
+}
@@ -0,0 +1,559 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// SysctlProcRoot is the default directory which contains the live
+	// kernel tunables.
+	SysctlProcRoot = "/proc/sys/"
+	// SysctlDropIn is the default drop-in file which is used to persist the
+	// kernel tunables across reboots.
+	SysctlDropIn = "/etc/sysctl.d/50-mgmt.conf"
+	// SysctlPoll is the default interval in seconds between each check of
+	// the live kernel tunables. Proc entries can't be watched for changes.
+	SysctlPoll = 10
+)
+
+func init() {
+	engine.RegisterResource("sysctl", func() engine.Res { return &SysctlRes{} })
+}
+
+// SysctlRes is a resource which manages kernel tunables. It can set the live
+// value found in /proc/sys/ and it can also persist that value in a drop-in
+// file which is read by systemd-sysctl on boot. Multiple sysctl resources which
+// share the same settings get grouped together, and as a result, each drop-in
+// file is only written once per group.
+type SysctlRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Groupable
+
+	init *engine.Init
+
+	// Key is the name of the kernel tunable, in either the dotted form (eg:
+	// net.ipv4.ip_forward) or the slashed form (eg: net/ipv4/ip_forward).
+	// If it is not specified, then the resource name is used.
+	Key string `yaml:"key"`
+	// Value is the value that the kernel tunable should have. Values which
+	// contain multiple fields are compared after whitespace normalization.
+	Value string `yaml:"value"`
+
+	// Live specifies that the running value in the proc filesystem should
+	// be managed. It defaults to true.
+	Live bool `yaml:"live"`
+	// Persist specifies that the value should be stored in the drop-in
+	// file so that it is applied again on boot. It defaults to false.
+	Persist bool `yaml:"persist"`
+	// DropIn is the absolute path of the drop-in file used when persisting.
+	// Only the lines for the managed keys in this file are changed.
+	DropIn string `yaml:"dropin"`
+
+	// ProcRoot is the directory which contains the live kernel tunables.
+	// It is only useful to change this for testing.
+	ProcRoot string `yaml:"procroot"`
+	// Poll is the number of seconds between checks of the live values. If
+	// it is zero, then the live values are not watched at all.
+	Poll uint32 `yaml:"poll"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *SysctlRes) Default() engine.Res {
+	return &SysctlRes{
+		Live:     true,
+		DropIn:   SysctlDropIn,
+		ProcRoot: SysctlProcRoot,
+		Poll:     SysctlPoll,
+	}
+}
+
+// getKey returns the canonical form of the key that this resource manages.
+func (obj *SysctlRes) getKey() string {
+	key := obj.Key
+	if key == "" { // use the name as the key default if missing
+		key = obj.Name()
+	}
+	return sysctlKey(key)
+}
+
+// Validate if the params passed in are valid data.
+func (obj *SysctlRes) Validate() error {
+	key := obj.getKey()
+	if key == "" {
+		return fmt.Errorf("the Key must not be empty")
+	}
+	for _, x := range strings.Split(key, "/") {
+		if x == "" || x == "." || x == ".." {
+			return fmt.Errorf("the Key `%s` is invalid", key)
+		}
+	}
+	if strings.ContainsAny(obj.Value, "\n") {
+		return fmt.Errorf("the Value must not contain newlines")
+	}
+	if !obj.Live && !obj.Persist {
+		return fmt.Errorf("at least one of Live or Persist must be true")
+	}
+	if obj.Persist && !strings.HasPrefix(obj.DropIn, "/") {
+		return fmt.Errorf("the DropIn must be an absolute path")
+	}
+	if obj.Persist && strings.HasSuffix(obj.DropIn, "/") {
+		return fmt.Errorf("the DropIn must be a file")
+	}
+	if obj.Live && !strings.HasPrefix(obj.ProcRoot, "/") {
+		return fmt.Errorf("the ProcRoot must be an absolute path")
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *SysctlRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *SysctlRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. The
+// proc entries don't support inotify, so the live values are polled, while the
+// drop-in file is watched normally.
+func (obj *SysctlRes) Watch() error {
+	var recEvents chan recwatch.Event // nil channels block forever
+	if obj.Persist {
+		recWatcher, err := recwatch.NewRecWatcher(obj.DropIn, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		recEvents = recWatcher.Events()
+	}
+
+	var tick <-chan time.Time // nil channels block forever
+	values := make(map[string]string)
+	if obj.Live && obj.Poll > 0 {
+		ticker := time.NewTicker(time.Duration(obj.Poll) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+		for key := range obj.groupMapping() {
+			values[key], _ = obj.readLive(key) // errors show in CheckApply
+		}
+	}
+
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	var send = false // send event?
+	for {
+		select {
+		case <-tick:
+			for key, old := range values {
+				value, _ := obj.readLive(key) // errors show in CheckApply
+				if value == old {
+					continue
+				}
+				if obj.init.Debug {
+					obj.init.Logf("Event(%s): %s -> %s", sysctlDotted(key), old, value)
+				}
+				values[key] = value
+				send = true
+				obj.init.Dirty() // dirty
+			}
+
+		case event, ok := <-recEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+			obj.init.Dirty() // dirty
+
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			if err := obj.init.Event(); err != nil {
+				return err // exit if requested
+			}
+		}
+	}
+}
+
+// groupMapping returns a map of every key to its value that this resource
+// manages. This includes the values of any grouped resources.
+func (obj *SysctlRes) groupMapping() map[string]string {
+	result := map[string]string{
+		obj.getKey(): obj.Value,
+	}
+	for _, x := range obj.GetGroup() {
+		res, ok := x.(*SysctlRes) // convert from Res
+		if !ok {
+			panic(fmt.Sprintf("grouped member %v is not a %s", x, obj.Kind()))
+		}
+		result[res.getKey()] = res.Value
+	}
+	return result
+}
+
+// readLive returns the normalized live value of a key.
+func (obj *SysctlRes) readLive(key string) (string, error) {
+	b, err := ioutil.ReadFile(sysctlPath(obj.ProcRoot, key))
+	if err != nil {
+		return "", err
+	}
+	return sysctlNormalize(string(b)), nil
+}
+
+// liveCheckApply checks and applies the live value of a single key.
+func (obj *SysctlRes) liveCheckApply(apply bool, key, value string) (bool, error) {
+	current, err := obj.readLive(key)
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("the kernel tunable `%s` does not exist", sysctlDotted(key))
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "could not read kernel tunable `%s`", sysctlDotted(key))
+	}
+	if current == sysctlNormalize(value) {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("set(%s): %s -> %s", sysctlDotted(key), current, value)
+	// the proc entries exist already, and we never want to create them
+	f, err := os.OpenFile(sysctlPath(obj.ProcRoot, key), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not open kernel tunable `%s`", sysctlDotted(key))
+	}
+	if _, err := f.WriteString(value + "\n"); err != nil {
+		f.Close()
+		return false, errwrap.Wrapf(err, "could not write kernel tunable `%s`", sysctlDotted(key))
+	}
+	return false, f.Close()
+}
+
+// persistCheckApply checks and applies the values found in the drop-in file.
+func (obj *SysctlRes) persistCheckApply(apply bool, kv map[string]string) (bool, error) {
+	b, err := ioutil.ReadFile(obj.DropIn)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read drop-in file")
+	}
+	data, changed := sysctlDropInUpdate(string(b), kv)
+	if !changed {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("writing drop-in: %s", obj.DropIn)
+	if err := ioutil.WriteFile(obj.DropIn, []byte(data), 0644); err != nil {
+		return false, errwrap.Wrapf(err, "could not write drop-in file")
+	}
+	return false, nil
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *SysctlRes) CheckApply(apply bool) (bool, error) {
+	kv := obj.groupMapping()
+	keys := []string{}
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // deterministic order for the logs
+
+	checkOK := true
+
+	if obj.Live {
+		for _, key := range keys {
+			if c, err := obj.liveCheckApply(apply, key, kv[key]); err != nil {
+				return false, err
+			} else if !c {
+				checkOK = false
+			}
+		}
+	}
+
+	if obj.Persist {
+		if c, err := obj.persistCheckApply(apply, kv); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+	}
+
+	return checkOK, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *SysctlRes) Cmp(r engine.Res) error {
+	res, ok := r.(*SysctlRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getKey() != res.getKey() {
+		return fmt.Errorf("the Key differs")
+	}
+	if sysctlNormalize(obj.Value) != sysctlNormalize(res.Value) {
+		return fmt.Errorf("the Value differs")
+	}
+	if obj.Live != res.Live {
+		return fmt.Errorf("the Live param differs")
+	}
+	if obj.Persist != res.Persist {
+		return fmt.Errorf("the Persist param differs")
+	}
+	if obj.DropIn != res.DropIn {
+		return fmt.Errorf("the DropIn param differs")
+	}
+	if obj.ProcRoot != res.ProcRoot {
+		return fmt.Errorf("the ProcRoot param differs")
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("the Poll param differs")
+	}
+
+	return nil
+}
+
+// SysctlUID is the UID struct for SysctlRes.
+type SysctlUID struct {
+	engine.BaseUID
+
+	key string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *SysctlUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*SysctlUID)
+	if !ok {
+		return false
+	}
+	return obj.key == res.key
+}
+
+// AutoEdges returns the AutoEdge interface. When persisting, this adds an edge
+// from the file resource which manages the nearest parent of the drop-in file.
+func (obj *SysctlRes) AutoEdges() (engine.AutoEdge, error) {
+	if !obj.Persist {
+		return nil, nil
+	}
+	var data []engine.ResUID
+	values := util.PathSplitFullReversed(obj.DropIn)
+	_, values = values[0], values[1:] // the drop-in file is managed by us!
+	for _, x := range values {
+		var reversed = true // cheat by passing a pointer
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x, // what matters
+		})
+	}
+	return &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}, nil
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *SysctlRes) UIDs() []engine.ResUID {
+	x := &SysctlUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		key:     obj.getKey(),
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Only
+// resources which share the same drop-in file and settings can be grouped.
+func (obj *SysctlRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*SysctlRes)
+	if !ok {
+		return fmt.Errorf("resource is not the same kind")
+	}
+	if obj.Live != res.Live {
+		return fmt.Errorf("resource has a different Live param")
+	}
+	if obj.Persist != res.Persist {
+		return fmt.Errorf("resource has a different Persist param")
+	}
+	if obj.Persist && obj.DropIn != res.DropIn {
+		return fmt.Errorf("resource uses a different drop-in file")
+	}
+	if obj.ProcRoot != res.ProcRoot {
+		return fmt.Errorf("resource uses a different proc root")
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("resource uses a different poll interval")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *SysctlRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes SysctlRes // indirection to avoid infinite recursion
+
+	def := obj.Default()        // get the default
+	res, ok := def.(*SysctlRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to SysctlRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = SysctlRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// sysctlKey converts a key in either the dotted or the slashed form into the
+// canonical slashed form, which is the relative path of the proc entry. If the
+// key contains a slash, then any dots are part of an element name, as is common
+// with vlan interface names, and so they are left alone.
+func sysctlKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), "/")
+	if strings.Contains(key, "/") {
+		return key
+	}
+	return strings.Replace(key, ".", "/", -1)
+}
+
+// sysctlDotted returns the conventional dotted form of a canonical key, unless
+// one of the elements contains a dot, in which case the slashed form is kept.
+func sysctlDotted(key string) string {
+	if strings.Contains(key, ".") {
+		return key
+	}
+	return strings.Replace(key, "/", ".", -1)
+}
+
+// sysctlPath returns the path of the proc entry for a canonical key.
+func sysctlPath(root, key string) string {
+	return path.Join(root, key)
+}
+
+// sysctlNormalize removes the insignificant whitespace from a value, so that
+// values with multiple fields, which the kernel separates with tabs, compare
+// equally to the same values separated with spaces.
+func sysctlNormalize(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// sysctlDropInUpdate takes the contents of a drop-in file and a map of keys to
+// values, and returns the updated contents. It only changes the lines for the
+// keys in the map, and preserves everything else, including comments. It also
+// returns true if the contents changed. Since the last occurrence of a key wins,
+// any duplicate entries for the managed keys get removed.
+func sysctlDropInUpdate(data string, kv map[string]string) (string, bool) {
+	lines := []string{}
+	if data != "" {
+		lines = strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	}
+
+	output := []string{}
+	found := make(map[string]bool)
+	changed := false
+	for _, line := range lines {
+		s := strings.TrimSpace(line)
+		if s == "" || strings.HasPrefix(s, "#") || strings.HasPrefix(s, ";") {
+			output = append(output, line) // pass through
+			continue
+		}
+		split := strings.SplitN(s, "=", 2)
+		key := sysctlKey(strings.TrimPrefix(split[0], "-")) // leading dash ignores errors
+		value, exists := kv[key]
+		if !exists {
+			output = append(output, line) // not ours
+			continue
+		}
+		if found[key] { // remove duplicates
+			changed = true
+			continue
+		}
+		found[key] = true
+
+		if len(split) == 2 && sysctlNormalize(split[1]) == sysctlNormalize(value) {
+			output = append(output, line) // already correct
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s = %s", sysctlDotted(key), value))
+		changed = true
+	}
+
+	keys := []string{}
+	for key := range kv {
+		if !found[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys) // deterministic output
+	for _, key := range keys {
+		output = append(output, fmt.Sprintf("%s = %s", sysctlDotted(key), kv[key]))
+		changed = true
+	}
+
+	if len(output) == 0 {
+		return "", changed
+	}
+	return strings.Join(output, "\n") + "\n", changed
+}
@@ -0,0 +1,184 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSysctlKey(t *testing.T) {
+	tests := map[string]string{
+		"net.ipv4.ip_forward":   "net/ipv4/ip_forward",
+		"net/ipv4/ip_forward":   "net/ipv4/ip_forward",
+		" vm.swappiness ":       "vm/swappiness",
+		"/kernel/sysrq":         "kernel/sysrq",
+		"net/ipv4/conf/eth0.42": "net/ipv4/conf/eth0.42",
+	}
+	for in, out := range tests {
+		if s := sysctlKey(in); s != out {
+			t.Errorf("key `%s` converted to `%s`, expected `%s`", in, s, out)
+		}
+	}
+}
+
+func TestSysctlDropInUpdate(t *testing.T) {
+	tests := []struct {
+		data    string
+		kv      map[string]string
+		out     string
+		changed bool
+	}{
+		{
+			data:    "",
+			kv:      map[string]string{"vm/swappiness": "10"},
+			out:     "vm.swappiness = 10\n",
+			changed: true,
+		},
+		{
+			data:    "# comment\nvm.swappiness=10\n",
+			kv:      map[string]string{"vm/swappiness": "10"},
+			out:     "# comment\nvm.swappiness=10\n",
+			changed: false,
+		},
+		{
+			data:    "# comment\nkernel.sysrq = 1\nvm.swappiness = 60\n",
+			kv:      map[string]string{"vm/swappiness": "10", "net/ipv4/ip_forward": "1"},
+			out:     "# comment\nkernel.sysrq = 1\nvm.swappiness = 10\nnet.ipv4.ip_forward = 1\n",
+			changed: true,
+		},
+		{
+			data:    "vm.swappiness = 10\n-vm/swappiness = 60\n",
+			kv:      map[string]string{"vm/swappiness": "10"},
+			out:     "vm.swappiness = 10\n",
+			changed: true,
+		},
+		{
+			data:    "net/ipv4/conf/eth0.42/forwarding = 0\n",
+			kv:      map[string]string{"net/ipv4/conf/eth0.42/forwarding": "1"},
+			out:     "net/ipv4/conf/eth0.42/forwarding = 1\n",
+			changed: true,
+		},
+		{
+			data:    "net.ipv4.tcp_rmem = 4096\t87380   6291456\n",
+			kv:      map[string]string{"net/ipv4/tcp_rmem": "4096 87380 6291456"},
+			out:     "net.ipv4.tcp_rmem = 4096\t87380   6291456\n",
+			changed: false,
+		},
+	}
+	for i, test := range tests {
+		out, changed := sysctlDropInUpdate(test.data, test.kv)
+		if changed != test.changed {
+			t.Errorf("test #%d: expected changed: %t", i, test.changed)
+		}
+		if out != test.out {
+			t.Errorf("test #%d: unexpected output:\n%s", i, out)
+		}
+	}
+}
+
+func TestSysctlCheckApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-sysctl-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	procRoot := path.Join(dir, "proc") + "/"
+	dropIn := path.Join(dir, "99-test.conf")
+	if err := os.MkdirAll(path.Join(procRoot, "vm"), 0755); err != nil {
+		t.Errorf("error creating proc dir: %v", err)
+		return
+	}
+	if err := os.MkdirAll(path.Join(procRoot, "net", "ipv4"), 0755); err != nil {
+		t.Errorf("error creating proc dir: %v", err)
+		return
+	}
+	for p, v := range map[string]string{"vm/swappiness": "60\n", "net/ipv4/tcp_rmem": "4096\t87380\t6291456\n"} {
+		if err := ioutil.WriteFile(path.Join(procRoot, p), []byte(v), 0644); err != nil {
+			t.Errorf("error writing proc entry: %v", err)
+			return
+		}
+	}
+
+	r1 := &SysctlRes{
+		Key:      "vm.swappiness",
+		Value:    "10",
+		Live:     true,
+		Persist:  true,
+		DropIn:   dropIn,
+		ProcRoot: procRoot,
+	}
+	r2 := &SysctlRes{
+		Key:      "net/ipv4/tcp_rmem",
+		Value:    "4096 87380 6291456",
+		Live:     true,
+		Persist:  true,
+		DropIn:   dropIn,
+		ProcRoot: procRoot,
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.GroupCmp(r2); err != nil {
+		t.Errorf("resources should group: %v", err)
+		return
+	}
+	if err := r1.GroupRes(r2); err != nil {
+		t.Errorf("grouping failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if checkOK, err := r1.CheckApply(false); err != nil {
+		t.Errorf("check failed with: %v", err)
+	} else if checkOK {
+		t.Errorf("check should have failed")
+	}
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	if checkOK, err := r1.CheckApply(false); err != nil {
+		t.Errorf("check failed with: %v", err)
+	} else if !checkOK {
+		t.Errorf("check should have passed after apply")
+	}
+
+	b, err := ioutil.ReadFile(path.Join(procRoot, "vm", "swappiness"))
+	if err != nil {
+		t.Errorf("error reading proc entry: %v", err)
+	} else if s := string(b); s != "10\n" {
+		t.Errorf("unexpected live value: %s", s)
+	}
+
+	b, err = ioutil.ReadFile(dropIn)
+	if err != nil {
+		t.Errorf("error reading drop-in: %v", err)
+	} else if s, exp := string(b), "net.ipv4.tcp_rmem = 4096 87380 6291456\nvm.swappiness = 10\n"; s != exp {
+		t.Errorf("unexpected drop-in contents:\n%s", s)
+	}
+}
@@ -19,27 +19,69 @@ package resources
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+
+	errwrap "github.com/pkg/errors"
 )
 
 func init() {
 	engine.RegisterResource("timer", func() engine.Res { return &TimerRes{} })
 }
 
+const (
+	// timerStateFile is the file in VarDir which stores the time of the
+	// last tick, and the number of ticks since the last reset.
+	timerStateFile = "state"
+	// timerCalendarMaxDays is how far ahead we look for the next match of a
+	// calendar expression before giving up.
+	timerCalendarMaxDays = 8 * 366
+)
+
 // TimerRes is a timer resource for time based events. It outputs an event every
-// interval seconds.
+// interval seconds, or whenever a calendar expression elapses. The interval can
+// grow with each tick, and a random jitter can be added, so that many hosts
+// don't all tick at the same second. The time of the last tick is stored, so a
+// restart waits for the remainder of the interval, instead of starting over.
 type TimerRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Refreshable
 
 	init *engine.Init
 
-	Interval uint32 `yaml:"interval"` // interval between runs in seconds
-
-	ticker *time.Ticker
+	Interval uint32 `yaml:"interval"` // interval between runs in seconds, 0 never runs
+
+	// Increment is the algorithm which grows the interval after each tick.
+	// It is either fixed (the default), linear or exponential. A refresh
+	// notification starts it over.
+	Increment string `yaml:"increment"`
+	// MaxInterval is the limit of the interval in seconds when it grows.
+	// Zero means no limit.
+	MaxInterval uint32 `yaml:"maxinterval"`
+	// Jitter is the maximum number of seconds of random delay which gets
+	// added to each tick.
+	Jitter uint32 `yaml:"jitter"`
+	// Calendar is an absolute calendar expression such as `03:15` for every
+	// day at 03:15, `Mon..Fri 09:00`, `*-*-01 00:00` or `hourly`. It is used
+	// instead of the interval.
+	Calendar string `yaml:"calendar"`
+
+	calendar  *timerCalendar
+	stateFile string        // path to the stored state
+	last      time.Time     // the time of the last tick, zero if unknown
+	scheduled time.Time     // the time of the next tick, without the jitter
+	count     uint64        // the number of ticks since the last reset
+	reset     chan struct{} // signals a reset of the timer to Watch
+	rand      *rand.Rand
 }
 
 // Default returns some sensible defaults for this resource.
@@ -49,6 +91,23 @@ func (obj *TimerRes) Default() engine.Res {
 
 // Validate the params that are passed to TimerRes.
 func (obj *TimerRes) Validate() error {
+	if obj.Calendar != "" {
+		if obj.Interval != 0 || obj.Increment != "" || obj.MaxInterval != 0 {
+			return fmt.Errorf("a calendar can't be combined with an interval")
+		}
+		if _, err := parseTimerCalendar(obj.Calendar); err != nil {
+			return errwrap.Wrapf(err, "invalid calendar: %s", obj.Calendar)
+		}
+		return nil
+	}
+	switch obj.Increment {
+	case "", "fixed", "linear", "exponential":
+	default:
+		return fmt.Errorf("increment must be fixed, linear or exponential")
+	}
+	if obj.MaxInterval != 0 && obj.MaxInterval < obj.Interval {
+		return fmt.Errorf("the max interval must not be less than the interval")
+	}
 	return nil
 }
 
@@ -56,7 +115,21 @@ func (obj *TimerRes) Validate() error {
 func (obj *TimerRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
-	return nil
+	if obj.Calendar != "" {
+		var err error
+		if obj.calendar, err = parseTimerCalendar(obj.Calendar); err != nil {
+			return errwrap.Wrapf(err, "invalid calendar: %s", obj.Calendar)
+		}
+	}
+	obj.reset = make(chan struct{}, 1)
+	obj.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.stateFile = path.Join(dir, timerStateFile)
+	return obj.load()
 }
 
 // Close is run by the engine to clean up after the resource is done.
@@ -64,16 +137,113 @@ func (obj *TimerRes) Close() error {
 	return nil
 }
 
-// newTicker creates a new ticker
-func (obj *TimerRes) newTicker() *time.Ticker {
-	return time.NewTicker(time.Duration(obj.Interval) * time.Second)
+// load reads the stored time of the last tick, and the tick count. A missing
+// or broken state file just means that we start over.
+func (obj *TimerRes) load() error {
+	b, err := ioutil.ReadFile(obj.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errwrap.Wrapf(err, "could not read the timer state")
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		obj.init.Logf("ignoring the invalid state: %s", obj.stateFile)
+		return nil
+	}
+	last, err1 := strconv.ParseInt(fields[0], 10, 64)
+	count, err2 := strconv.ParseUint(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		obj.init.Logf("ignoring the invalid state: %s", obj.stateFile)
+		return nil
+	}
+	obj.last = time.Unix(last, 0)
+	obj.count = count
+	return nil
+}
+
+// save stores the time of the last tick, and the tick count.
+func (obj *TimerRes) save() error {
+	s := fmt.Sprintf("%d %d\n", obj.last.Unix(), obj.count)
+	if err := ioutil.WriteFile(obj.stateFile, []byte(s), 0600); err != nil {
+		return errwrap.Wrapf(err, "could not write the timer state")
+	}
+	return nil
+}
+
+// interval returns the interval after the given number of ticks, according to
+// the increment algorithm.
+func (obj *TimerRes) interval(count uint64) time.Duration {
+	interval := uint64(obj.Interval)
+	max := uint64(obj.MaxInterval)
+	if max == 0 {
+		max = 1 << 32 // don't overflow
+	}
+	switch obj.Increment {
+	case "linear":
+		interval *= count + 1
+		if count >= max { // it would overflow
+			interval = max
+		}
+	case "exponential":
+		for i := uint64(0); i < count && interval < max; i++ {
+			interval *= 2
+		}
+	}
+	if interval > max {
+		interval = max
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// next returns the time of the tick that comes after the previous one, without
+// any jitter. It returns the zero time if a calendar expression never elapses
+// again, or if the interval is zero.
+func (obj *TimerRes) next(prev time.Time) time.Time {
+	if obj.calendar != nil {
+		return obj.calendar.Next(prev)
+	}
+	if obj.Interval == 0 {
+		return time.Time{}
+	}
+	return prev.Add(obj.interval(obj.count))
+}
+
+// jitter returns a random delay for a tick, up to the jitter.
+func (obj *TimerRes) jitter() time.Duration {
+	if obj.Jitter == 0 {
+		return 0
+	}
+	return time.Duration(obj.rand.Int63n(int64(obj.Jitter)*int64(time.Second) + 1))
+}
+
+// newTimer returns a timer for the next tick. If there is no next tick, then
+// the timer is stopped, so it never fires.
+func (obj *TimerRes) newTimer() *time.Timer {
+	now := time.Now()
+	prev := obj.last
+	if prev.IsZero() {
+		prev = now
+	}
+	obj.scheduled = obj.next(prev)
+	if obj.scheduled.IsZero() {
+		obj.init.Logf("the timer never ticks again")
+		timer := time.NewTimer(0)
+		timer.Stop()
+		return timer
+	}
+	next := obj.scheduled.Add(obj.jitter())
+	if obj.init.Debug {
+		obj.init.Logf("next tick at: %s", next.Format(time.RFC3339))
+	}
+	return time.NewTimer(next.Sub(now)) // a missed tick fires immediately
 }
 
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *TimerRes) Watch() error {
-	// create a time.Ticker for the given interval
-	obj.ticker = obj.newTicker()
-	defer obj.ticker.Stop()
+	// create a time.Timer for the next tick
+	timer := obj.newTimer()
+	defer func() { timer.Stop() }() // the timer gets replaced
 
 	// notify engine that we're running
 	if err := obj.init.Running(); err != nil {
@@ -83,9 +253,30 @@ func (obj *TimerRes) Watch() error {
 	var send = false // send event?
 	for {
 		select {
-		case <-obj.ticker.C: // received the timer event
+		case now := <-timer.C: // received the timer event
 			send = true
 			obj.init.Logf("received tick")
+			// the next tick follows the schedule and not the jittered
+			// time, so that the jitter doesn't add up, unless this tick
+			// was missed, and then the schedule starts over from now
+			obj.last = obj.scheduled
+			if now.Sub(obj.scheduled) > time.Duration(obj.Jitter+1)*time.Second {
+				obj.last = now
+			}
+			obj.count++
+			if err := obj.save(); err != nil {
+				return err
+			}
+			timer = obj.newTimer()
+
+		case <-obj.reset: // start over
+			timer.Stop()
+			obj.last = time.Now()
+			obj.count = 0
+			if err := obj.save(); err != nil {
+				return err
+			}
+			timer = obj.newTimer()
 
 		case event, ok := <-obj.init.Events:
 			if !ok {
@@ -116,8 +307,10 @@ func (obj *TimerRes) CheckApply(apply bool) (bool, error) {
 	}
 
 	// reset the timer since apply && refresh
-	obj.ticker.Stop()
-	obj.ticker = obj.newTicker()
+	select {
+	case obj.reset <- struct{}{}:
+	default: // a reset is already pending
+	}
 	return false, nil
 }
 
@@ -140,6 +333,18 @@ func (obj *TimerRes) Compare(r engine.Res) bool {
 	if obj.Interval != res.Interval {
 		return false
 	}
+	if obj.Increment != res.Increment {
+		return false
+	}
+	if obj.MaxInterval != res.MaxInterval {
+		return false
+	}
+	if obj.Jitter != res.Jitter {
+		return false
+	}
+	if obj.Calendar != res.Calendar {
+		return false
+	}
 
 	return true
 }
@@ -180,3 +385,242 @@ func (obj *TimerRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*obj = TimerRes(raw) // restore from indirection with type conversion!
 	return nil
 }
+
+// timerCalendar is a parsed calendar expression. It is a subset of the systemd
+// calendar events: `[weekdays] [[year-]month-day] hour:minute[:second]`, where
+// each number can be `*`, a list such as `1,15`, a range such as `1..5`, or a
+// repetition such as `0/15`. The weekdays are lists or ranges of names, such as
+// `Mon..Fri`. A nil list matches everything.
+type timerCalendar struct {
+	weekdays map[time.Weekday]bool
+	years    []int
+	months   []int
+	days     []int
+	hours    []int
+	minutes  []int
+	seconds  []int
+}
+
+// timerCalendarShorthands are the calendar expressions that have a name.
+var timerCalendarShorthands = map[string]string{
+	"minutely": "*-*-* *:*:00",
+	"hourly":   "*-*-* *:00:00",
+	"daily":    "*-*-* 00:00:00",
+	"weekly":   "Mon *-*-* 00:00:00",
+	"monthly":  "*-*-01 00:00:00",
+	"yearly":   "*-01-01 00:00:00",
+	"annually": "*-01-01 00:00:00",
+}
+
+// timerWeekdays are the names of the weekdays.
+var timerWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseTimerCalendar parses a calendar expression.
+func parseTimerCalendar(expr string) (*timerCalendar, error) {
+	if s, exists := timerCalendarShorthands[strings.ToLower(strings.TrimSpace(expr))]; exists {
+		expr = s
+	}
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	cal := &timerCalendar{}
+	var err error
+
+	if strings.IndexAny(strings.ToLower(fields[0]), "abcdefghijklmnopqrstuvwxyz") >= 0 {
+		if cal.weekdays, err = parseTimerWeekdays(fields[0]); err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	}
+
+	date, clock := "*-*-*", "00:00:00"
+	switch {
+	case len(fields) == 2:
+		date, clock = fields[0], fields[1]
+	case len(fields) == 1 && strings.Contains(fields[0], ":"):
+		clock = fields[0]
+	case len(fields) == 1:
+		date = fields[0]
+	case len(fields) == 0 && cal.weekdays != nil: // midnight on those days
+	default:
+		return nil, fmt.Errorf("expected a date and a time")
+	}
+
+	d := strings.Split(date, "-")
+	if len(d) == 2 {
+		d = append([]string{"*"}, d...)
+	}
+	if len(d) != 3 {
+		return nil, fmt.Errorf("invalid date: %s", date)
+	}
+	c := strings.Split(clock, ":")
+	if len(c) == 2 {
+		c = append(c, "00")
+	}
+	if len(c) != 3 {
+		return nil, fmt.Errorf("invalid time: %s", clock)
+	}
+
+	fieldList := []struct {
+		s        string
+		min, max int
+		out      *[]int
+	}{
+		{d[0], 1970, 2199, &cal.years},
+		{d[1], 1, 12, &cal.months},
+		{d[2], 1, 31, &cal.days},
+		{c[0], 0, 23, &cal.hours},
+		{c[1], 0, 59, &cal.minutes},
+		{c[2], 0, 59, &cal.seconds},
+	}
+	for _, x := range fieldList {
+		if *x.out, err = parseTimerCalendarField(x.s, x.min, x.max); err != nil {
+			return nil, err
+		}
+	}
+	return cal, nil
+}
+
+// parseTimerWeekdays parses a list of weekdays such as `Mon,Wed..Fri`.
+func parseTimerWeekdays(s string) (map[time.Weekday]bool, error) {
+	index := func(name string) (int, error) {
+		name = strings.ToLower(name)
+		for i, x := range timerWeekdays {
+			if name == x || name == strings.ToLower(time.Weekday(i).String()) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid weekday: %s", name)
+	}
+	weekdays := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(s, ",") {
+		r := strings.SplitN(item, "..", 2)
+		a, err := index(r[0])
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if len(r) == 2 {
+			if b, err = index(r[1]); err != nil {
+				return nil, err
+			}
+		}
+		for i := a; ; i = (i + 1) % 7 { // Sat..Mon wraps around
+			weekdays[time.Weekday(i)] = true
+			if i == b {
+				break
+			}
+		}
+	}
+	return weekdays, nil
+}
+
+// parseTimerCalendarField parses a numeric field of a calendar expression. It
+// returns the sorted list of values, or nil for `*`.
+func parseTimerCalendarField(s string, min, max int) ([]int, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	atoi := func(x string) (int, error) {
+		i, err := strconv.Atoi(x)
+		if err != nil || i < min || i > max {
+			return 0, fmt.Errorf("invalid value: %s, must be between %d and %d", x, min, max)
+		}
+		return i, nil
+	}
+	set := make(map[int]bool)
+	for _, item := range strings.Split(s, ",") {
+		var a, b, step = 0, 0, 1
+		var err error
+		if r := strings.SplitN(item, "/", 2); len(r) == 2 { // repetition
+			if r[0] == "*" {
+				a = min
+			} else if a, err = atoi(r[0]); err != nil {
+				return nil, err
+			}
+			if step, err = strconv.Atoi(r[1]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid repetition: %s", item)
+			}
+			b = max
+		} else if r := strings.SplitN(item, "..", 2); len(r) == 2 { // range
+			if a, err = atoi(r[0]); err != nil {
+				return nil, err
+			}
+			if b, err = atoi(r[1]); err != nil {
+				return nil, err
+			}
+			if b < a {
+				return nil, fmt.Errorf("invalid range: %s", item)
+			}
+		} else {
+			if a, err = atoi(item); err != nil {
+				return nil, err
+			}
+			b = a
+		}
+		for i := a; i <= b; i += step {
+			set[i] = true
+		}
+	}
+	values := []int{}
+	for i := range set {
+		values = append(values, i)
+	}
+	sort.Ints(values)
+	return values, nil
+}
+
+// timerCalendarMatch returns true if the value is in the list, and a nil list
+// matches everything.
+func timerCalendarMatch(values []int, i int) bool {
+	if values == nil {
+		return true
+	}
+	for _, x := range values {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
+
+// timerCalendarValues returns the list of values, where nil is every value
+// between min and max.
+func timerCalendarValues(values []int, min, max int) []int {
+	if values != nil {
+		return values
+	}
+	for i := min; i <= max; i++ {
+		values = append(values, i)
+	}
+	return values
+}
+
+// Next returns the first time after the given time that matches the calendar,
+// in the local time zone. It returns the zero time if there is no match.
+func (obj *timerCalendar) Next(after time.Time) time.Time {
+	start := after.Truncate(time.Second).Add(time.Second)
+	y, m, d := start.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, start.Location())
+
+	for i := 0; i < timerCalendarMaxDays; i, day = i+1, day.AddDate(0, 0, 1) {
+		if !timerCalendarMatch(obj.years, day.Year()) || !timerCalendarMatch(obj.months, int(day.Month())) || !timerCalendarMatch(obj.days, day.Day()) {
+			continue
+		}
+		if obj.weekdays != nil && !obj.weekdays[day.Weekday()] {
+			continue
+		}
+		for _, h := range timerCalendarValues(obj.hours, 0, 23) {
+			for _, min := range timerCalendarValues(obj.minutes, 0, 59) {
+				for _, sec := range timerCalendarValues(obj.seconds, 0, 59) {
+					t := time.Date(day.Year(), day.Month(), day.Day(), h, min, sec, 0, day.Location())
+					if !t.Before(start) {
+						return t
+					}
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,178 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimerValidate(t *testing.T) {
+	tests := []struct {
+		res *TimerRes
+		ok  bool
+	}{
+		{&TimerRes{Interval: 60}, true},
+		{&TimerRes{Interval: 60, Increment: "exponential", MaxInterval: 3600, Jitter: 30}, true},
+		{&TimerRes{Calendar: "Mon..Fri 03:15", Jitter: 300}, true},
+		{&TimerRes{}, true}, // it never ticks
+		{&TimerRes{Interval: 60, Increment: "quadratic"}, false},
+		{&TimerRes{Interval: 60, Increment: "linear", MaxInterval: 30}, false},
+		{&TimerRes{Interval: 60, Calendar: "daily"}, false},
+		{&TimerRes{Calendar: "25:00"}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.res.Validate(); tt.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestTimerInterval(t *testing.T) {
+	tests := []struct {
+		res *TimerRes
+		exp []uint32 // the intervals after zero, one, two... ticks
+	}{
+		{&TimerRes{Interval: 10}, []uint32{10, 10, 10, 10}},
+		{&TimerRes{Interval: 10, Increment: "fixed"}, []uint32{10, 10, 10, 10}},
+		{&TimerRes{Interval: 10, Increment: "linear"}, []uint32{10, 20, 30, 40}},
+		{&TimerRes{Interval: 10, Increment: "linear", MaxInterval: 25}, []uint32{10, 20, 25, 25}},
+		{&TimerRes{Interval: 10, Increment: "exponential"}, []uint32{10, 20, 40, 80}},
+		{&TimerRes{Interval: 10, Increment: "exponential", MaxInterval: 60}, []uint32{10, 20, 40, 60}},
+	}
+	for i, tt := range tests {
+		for count, exp := range tt.exp {
+			if d := tt.res.interval(uint64(count)); d != time.Duration(exp)*time.Second {
+				t.Errorf("test #%d: interval after %d ticks is %s instead of %ds", i, count, d, exp)
+			}
+		}
+	}
+
+	// a huge number of ticks must not overflow
+	res := &TimerRes{Interval: 10, Increment: "exponential", MaxInterval: 3600}
+	if d := res.interval(1 << 40); d != time.Hour {
+		t.Errorf("interval is %s instead of the max", d)
+	}
+}
+
+func TestTimerCalendar(t *testing.T) {
+	loc := time.Local
+	after := time.Date(2018, time.March, 14, 10, 30, 0, 0, loc) // a wednesday
+	tests := []struct {
+		expr string
+		exp  time.Time
+	}{
+		{"minutely", time.Date(2018, time.March, 14, 10, 31, 0, 0, loc)},
+		{"hourly", time.Date(2018, time.March, 14, 11, 0, 0, 0, loc)},
+		{"daily", time.Date(2018, time.March, 15, 0, 0, 0, 0, loc)},
+		{"weekly", time.Date(2018, time.March, 19, 0, 0, 0, 0, loc)},
+		{"monthly", time.Date(2018, time.April, 1, 0, 0, 0, 0, loc)},
+		{"yearly", time.Date(2019, time.January, 1, 0, 0, 0, 0, loc)},
+		{"03:15", time.Date(2018, time.March, 15, 3, 15, 0, 0, loc)},
+		{"10:30", time.Date(2018, time.March, 15, 10, 30, 0, 0, loc)}, // not now
+		{"10:30:01", time.Date(2018, time.March, 14, 10, 30, 1, 0, loc)},
+		{"*:0/20", time.Date(2018, time.March, 14, 10, 40, 0, 0, loc)},
+		{"9..17:00", time.Date(2018, time.March, 14, 11, 0, 0, 0, loc)},
+		{"Sat,Sun 09:00", time.Date(2018, time.March, 17, 9, 0, 0, 0, loc)},
+		{"Fri..Mon", time.Date(2018, time.March, 16, 0, 0, 0, 0, loc)},
+		{"Monday *-*-01 00:00", time.Date(2018, time.October, 1, 0, 0, 0, 0, loc)},
+		{"02-29 12:00", time.Date(2020, time.February, 29, 12, 0, 0, 0, loc)},
+		{"2017-01-01 00:00", time.Time{}}, // in the past
+	}
+	for _, tt := range tests {
+		cal, err := parseTimerCalendar(tt.expr)
+		if err != nil {
+			t.Errorf("calendar %s failed with: %v", tt.expr, err)
+			continue
+		}
+		if next := cal.Next(after); !next.Equal(tt.exp) {
+			t.Errorf("calendar %s is next at %s instead of %s", tt.expr, next, tt.exp)
+		}
+	}
+
+	for _, expr := range []string{"", "often", "Mon..Funday", "12", "24:00", "*:60", "1-2-3-4 00:00", "*:*/0", "5..3:00"} {
+		if _, err := parseTimerCalendar(expr); err == nil {
+			t.Errorf("calendar %s should have failed", expr)
+		}
+	}
+}
+
+func TestTimerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-timer-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	init := fakeInit(t)
+	init.VarDir = func(string) (string, error) {
+		return dir, nil
+	}
+
+	r1 := &TimerRes{Interval: 3600, Increment: "linear"}
+	if err := r1.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if !r1.last.IsZero() || r1.count != 0 {
+		t.Errorf("a new timer must start without state")
+	}
+	last := time.Now().Add(-90 * time.Minute).Truncate(time.Second)
+	r1.last = last
+	r1.count = 1
+	if err := r1.save(); err != nil {
+		t.Errorf("save failed with: %v", err)
+		return
+	}
+
+	r2 := &TimerRes{Interval: 3600, Increment: "linear"}
+	if err := r2.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if !r2.last.Equal(last) || r2.count != 1 {
+		t.Errorf("the state was not restored: %s, %d", r2.last, r2.count)
+	}
+	// the second tick comes two hours after the first one, not after a restart
+	if next := r2.next(r2.last); !next.Equal(last.Add(2 * time.Hour)) {
+		t.Errorf("the next tick is at: %s", next)
+	}
+
+	// the jitter isn't part of the schedule, and must stay within its limit
+	r2.Jitter = 60
+	if next := r2.next(r2.last); !next.Equal(last.Add(2 * time.Hour)) {
+		t.Errorf("the next tick with jitter is at: %s", next)
+	}
+	for i := 0; i < 100; i++ {
+		if d := r2.jitter(); d < 0 || d > time.Minute {
+			t.Errorf("the jitter is out of range: %s", d)
+			break
+		}
+	}
+
+	r3 := &TimerRes{}
+	if next := r3.next(last); !next.IsZero() {
+		t.Errorf("a zero interval should never tick, but ticks at: %s", next)
+	}
+}
@@ -20,16 +20,21 @@ package resources
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
 	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util"
 
 	errwrap "github.com/pkg/errors"
 )
@@ -38,9 +43,34 @@ func init() {
 	engine.RegisterResource("user", func() engine.Res { return &UserRes{} })
 }
 
-const passwdFile = "/etc/passwd"
+const (
+	passwdFile = "/etc/passwd"
+	shadowFile = "/etc/shadow"
+	// gshadowFile is only changed when the database files are edited
+	// directly, and only if it exists, since some systems don't have one.
+	gshadowFile = "/etc/gshadow"
 
-// UserRes is a user account resource.
+	// UserHomePrefix is the directory which contains the home directory of
+	// a new user if no HomeDir is specified.
+	UserHomePrefix = "/home/"
+	// UserShell is the login shell of a new user if no Shell is specified
+	// and the database files are edited directly.
+	UserShell = "/bin/sh"
+	// UserMinID is the smallest uid or gid which is chosen for a new user
+	// when the database files are edited directly.
+	UserMinID = 1000
+	// UserMaxID is the largest uid or gid which is chosen for a new user
+	// when the database files are edited directly.
+	UserMaxID = 60000
+	// userExpiryFormat is the date format of the Expiry field.
+	userExpiryFormat = "2006-01-02"
+)
+
+// UserRes is a user account resource. It can manage the fields of the passwd
+// and shadow entries of the user, the membership of the user in groups, and the
+// home directory, including the ssh authorized keys. The account is changed with
+// the usual useradd, usermod and userdel commands, unless EditFiles is true, in
+// which case the database files are edited directly.
 type UserRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Edgeable
@@ -53,9 +83,16 @@ type UserRes struct {
 	Group             *string  `yaml:"group"`             // name of the user's primary group
 	Groups            []string `yaml:"groups"`            // list of supplemental groups
 	HomeDir           *string  `yaml:"homedir"`           // path to the user's home directory
+	Shell             *string  `yaml:"shell"`             // path to the user's login shell
+	GECOS             *string  `yaml:"gecos"`             // comment field, usually the full name of the user
+	Password          *string  `yaml:"password"`          // hashed password, as found in the shadow file
+	Expiry            *string  `yaml:"expiry"`            // account expiry date as YYYY-MM-DD, or empty for never
+	Locked            *bool    `yaml:"locked"`            // lock or unlock the password
+	CreateHome        bool     `yaml:"createhome"`        // create the home directory if it is missing
+	AuthorizedKeys    []string `yaml:"authorizedkeys"`    // the ssh public keys in ~/.ssh/authorized_keys
 	AllowDuplicateUID bool     `yaml:"allowduplicateuid"` // allow duplicate uid
-
-	recWatcher *recwatch.RecWatcher
+	EditFiles         bool     `yaml:"editfiles"`         // edit the database files instead of running useradd
+	Root              string   `yaml:"root"`              // directory which contains the database files and homes
 }
 
 // Default returns some sensible defaults for this resource.
@@ -95,6 +132,33 @@ func (obj *UserRes) Validate() error {
 			}
 		}
 	}
+	if obj.HomeDir != nil && !strings.HasPrefix(*obj.HomeDir, "/") {
+		return fmt.Errorf("homedir must be an absolute path")
+	}
+	if obj.Shell != nil && !strings.HasPrefix(*obj.Shell, "/") {
+		return fmt.Errorf("shell must be an absolute path")
+	}
+	for _, s := range []*string{obj.HomeDir, obj.Shell, obj.GECOS, obj.Password} {
+		if s != nil && strings.ContainsAny(*s, ":\n") {
+			return fmt.Errorf("fields cannot contain a colon or a newline")
+		}
+	}
+	if obj.Expiry != nil && *obj.Expiry != "" {
+		if _, err := time.Parse(userExpiryFormat, *obj.Expiry); err != nil {
+			return errwrap.Wrapf(err, "expiry must be a date in the YYYY-MM-DD format")
+		}
+	}
+	for _, key := range obj.AuthorizedKeys {
+		if strings.TrimSpace(key) == "" || strings.Contains(key, "\n") {
+			return fmt.Errorf("each authorized key must be a single line")
+		}
+	}
+	if obj.Root != "" && !strings.HasPrefix(obj.Root, "/") {
+		return fmt.Errorf("root must be an absolute path")
+	}
+	if obj.Root != "" && path.Clean(obj.Root) != "/" && !obj.EditFiles {
+		return fmt.Errorf("a root other than / can only be used with editfiles")
+	}
 	return nil
 }
 
@@ -110,14 +174,67 @@ func (obj *UserRes) Close() error {
 	return nil
 }
 
+// dbPath returns the path of a database file, or of a home directory, after it
+// has been prefixed with the root.
+func (obj *UserRes) dbPath(p string) string {
+	if obj.Root == "" {
+		return p
+	}
+	return path.Join(obj.Root, p)
+}
+
+// needsShadow returns true if the shadow file has to be read.
+func (obj *UserRes) needsShadow() bool {
+	return obj.Password != nil || obj.Expiry != nil || obj.Locked != nil || obj.EditFiles
+}
+
+// getHomeDir returns the home directory that the user should have. If none was
+// specified, then the existing one is used, or the default for a new user.
+func (obj *UserRes) getHomeDir(entry []string) string {
+	if obj.HomeDir != nil {
+		return *obj.HomeDir
+	}
+	if entry != nil {
+		return entry[5]
+	}
+	return UserHomePrefix + obj.Name()
+}
+
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *UserRes) Watch() error {
-	var err error
-	obj.recWatcher, err = recwatch.NewRecWatcher(passwdFile, false)
-	if err != nil {
-		return err
+	files := []string{obj.dbPath(passwdFile), obj.dbPath(groupFile)}
+	if obj.needsShadow() {
+		files = append(files, obj.dbPath(shadowFile))
+	}
+	if obj.AuthorizedKeys != nil {
+		passwd, err := readUserDB(obj.dbPath(passwdFile), passwdFields)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not read passwd file")
+		}
+		home := obj.dbPath(obj.getHomeDir(passwd.Get(obj.Name())))
+		files = append(files, path.Join(home, ".ssh", "authorized_keys"))
+	}
+
+	// merge the events from all of the watched files
+	events := make(chan recwatch.Event)
+	done := make(chan struct{})
+	defer close(done)
+	for _, f := range files {
+		recWatcher, err := recwatch.NewRecWatcher(f, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		go func(ch chan recwatch.Event) {
+			for event := range ch {
+				select {
+				case events <- event:
+				case <-done:
+					return
+				}
+			}
+		}(recWatcher.Events())
 	}
-	defer obj.recWatcher.Close()
 
 	// notify engine that we're running
 	if err := obj.init.Running(); err != nil {
@@ -127,14 +244,11 @@ func (obj *UserRes) Watch() error {
 	var send = false // send event?
 	for {
 		if obj.init.Debug {
-			obj.init.Logf("Watching: %s", passwdFile) // attempting to watch...
+			obj.init.Logf("Watching: %s", strings.Join(files, ", ")) // attempting to watch...
 		}
 
 		select {
-		case event, ok := <-obj.recWatcher.Events():
-			if !ok { // channel shutdown
-				return nil
-			}
+		case event := <-events:
 			if err := event.Error; err != nil {
 				return errwrap.Wrapf(err, "Unknown %s watcher error", obj)
 			}
@@ -163,63 +277,255 @@ func (obj *UserRes) Watch() error {
 	}
 }
 
+// userDBs are the database files which describe the users and groups.
+type userDBs struct {
+	passwd *userDB
+	shadow *userDB // nil if it is not needed
+	group  *userDB
+	// gshadow is nil unless the files are edited, and the file exists
+	gshadow *userDB
+}
+
+// readDBs reads all of the database files that are needed.
+func (obj *UserRes) readDBs() (*userDBs, error) {
+	dbs := &userDBs{}
+	var err error
+	if dbs.passwd, err = readUserDB(obj.dbPath(passwdFile), passwdFields); err != nil {
+		return nil, errwrap.Wrapf(err, "could not read passwd file")
+	}
+	if dbs.group, err = readUserDB(obj.dbPath(groupFile), groupFields); err != nil {
+		return nil, errwrap.Wrapf(err, "could not read group file")
+	}
+	if obj.needsShadow() {
+		if dbs.shadow, err = readUserDB(obj.dbPath(shadowFile), shadowFields); err != nil {
+			return nil, errwrap.Wrapf(err, "could not read shadow file")
+		}
+	}
+	if _, err := os.Stat(obj.dbPath(gshadowFile)); obj.EditFiles && err == nil {
+		if dbs.gshadow, err = readUserDB(obj.dbPath(gshadowFile), gshadowFields); err != nil {
+			return nil, errwrap.Wrapf(err, "could not read gshadow file")
+		}
+	}
+	return dbs, nil
+}
+
+// getGID returns the gid of the primary group that the user should have. If it
+// isn't specified, then this returns nil.
+func (obj *UserRes) getGID(dbs *userDBs) (*uint32, error) {
+	if obj.Group == nil {
+		return obj.GID, nil
+	}
+	entry := dbs.group.Get(*obj.Group)
+	if entry == nil {
+		return nil, fmt.Errorf("the group `%s` does not exist", *obj.Group)
+	}
+	gid, err := strconv.ParseUint(entry[2], 10, 32)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "invalid gid for group `%s`", *obj.Group)
+	}
+	x := uint32(gid)
+	return &x, nil
+}
+
+// getGroups returns the sorted list of supplemental groups that the user is in.
+func (obj *UserRes) getGroups(dbs *userDBs) []string {
+	groups := []string{}
+	dbs.group.Each(func(entry []string) {
+		if util.StrInList(obj.Name(), userDBMembers(entry)) {
+			groups = append(groups, entry[0])
+		}
+	})
+	sort.Strings(groups)
+	return groups
+}
+
+// getPassword returns the password field that the shadow entry should have,
+// given the current one.
+func (obj *UserRes) getPassword(current string) (string, error) {
+	password := current
+	if obj.Password != nil {
+		password = *obj.Password
+	}
+	if obj.Locked == nil {
+		return password, nil
+	}
+	if *obj.Locked {
+		if strings.HasPrefix(password, "!") {
+			return password, nil
+		}
+		return "!" + password, nil
+	}
+	unlocked := strings.TrimLeft(password, "!")
+	if unlocked == "" && password != "" {
+		return "", fmt.Errorf("cannot unlock a user without a password")
+	}
+	return unlocked, nil
+}
+
+// getExpiry returns the expiry field that the shadow entry should have. This is
+// the number of days since the epoch, or empty for never.
+func (obj *UserRes) getExpiry() string {
+	if *obj.Expiry == "" {
+		return ""
+	}
+	t, _ := time.Parse(userExpiryFormat, *obj.Expiry) // checked in Validate
+	return strconv.FormatInt(t.Unix()/86400, 10)
+}
+
+// accountCheck checks the passwd, shadow and group entries for the user. This
+// returns true if they are all correct.
+func (obj *UserRes) accountCheck(dbs *userDBs) (bool, error) {
+	entry := dbs.passwd.Get(obj.Name())
+	if entry == nil {
+		return false, nil
+	}
+	if obj.UID != nil && strconv.FormatUint(uint64(*obj.UID), 10) != entry[2] {
+		return false, nil
+	}
+	gid, err := obj.getGID(dbs)
+	if err != nil {
+		return false, nil // the group might be added before we are applied
+	}
+	if gid != nil && strconv.FormatUint(uint64(*gid), 10) != entry[3] {
+		return false, nil
+	}
+	if obj.GECOS != nil && *obj.GECOS != entry[4] {
+		return false, nil
+	}
+	if obj.HomeDir != nil && *obj.HomeDir != entry[5] {
+		return false, nil
+	}
+	if obj.Shell != nil && *obj.Shell != entry[6] {
+		return false, nil
+	}
+	if obj.Groups != nil {
+		groups := append([]string{}, obj.Groups...)
+		sort.Strings(groups)
+		if strings.Join(groups, ",") != strings.Join(obj.getGroups(dbs), ",") {
+			return false, nil
+		}
+	}
+
+	if dbs.shadow == nil {
+		return true, nil
+	}
+	shadow := dbs.shadow.Get(obj.Name())
+	if shadow == nil {
+		return !(obj.Password != nil || obj.Expiry != nil || obj.Locked != nil), nil
+	}
+	password, err := obj.getPassword(shadow[1])
+	if err != nil {
+		return false, err
+	}
+	if password != shadow[1] {
+		return false, nil
+	}
+	if obj.Expiry != nil && obj.getExpiry() != shadow[7] {
+		return false, nil
+	}
+	return true, nil
+}
+
 // CheckApply method for User resource.
 func (obj *UserRes) CheckApply(apply bool) (checkOK bool, err error) {
 	obj.init.Logf("CheckApply(%t)", apply)
 
-	var exists = true
-	usr, err := user.Lookup(obj.Name())
+	dbs, err := obj.readDBs()
 	if err != nil {
-		if _, ok := err.(user.UnknownUserError); !ok {
-			return false, errwrap.Wrapf(err, "error looking up user")
+		return false, err
+	}
+	exists := dbs.passwd.Get(obj.Name()) != nil
+
+	// the user might come from another nss source, such as ldap, in which
+	// case it isn't in the local database files
+	var nssUser *user.User
+	if !exists && obj.Root == "" {
+		if nssUser, err = user.Lookup(obj.Name()); err != nil {
+			if _, ok := err.(user.UnknownUserError); !ok {
+				return false, errwrap.Wrapf(err, "error looking up user")
+			}
+			nssUser = nil
 		}
-		exists = false
 	}
 
 	if obj.AllowDuplicateUID == false && obj.UID != nil {
-		existingUID, err := user.LookupId(strconv.Itoa(int(*obj.UID)))
-		if err != nil {
-			if _, ok := err.(user.UnknownUserIdError); !ok {
-				return false, errwrap.Wrapf(err, "error looking up UID")
-			}
-		} else if existingUID.Username != obj.Name() {
+		if entry := dbs.passwd.GetID(2, *obj.UID); entry != nil && entry[0] != obj.Name() {
 			return false, fmt.Errorf("the requested UID is already taken")
 		}
+		if obj.Root == "" {
+			existingUID, err := user.LookupId(strconv.Itoa(int(*obj.UID)))
+			if err != nil {
+				if _, ok := err.(user.UnknownUserIdError); !ok {
+					return false, errwrap.Wrapf(err, "error looking up UID")
+				}
+			} else if existingUID.Username != obj.Name() {
+				return false, fmt.Errorf("the requested UID is already taken")
+			}
+		}
+	}
+
+	if nssUser != nil {
+		if err := obj.nssCheck(nssUser); err != nil {
+			return false, err
+		}
+		// the home directory can still be managed
+		entry := []string{nssUser.Username, "x", nssUser.Uid, nssUser.Gid, nssUser.Name, nssUser.HomeDir, ""}
+		return obj.homeCheckApply(apply, entry)
 	}
 
 	if obj.State == "absent" && !exists {
 		return true, nil
 	}
 
-	if usercheck := true; exists && obj.State == "exists" {
-		intUID, err := strconv.Atoi(usr.Uid)
-		if err != nil {
-			return false, errwrap.Wrapf(err, "error casting UID to int")
-		}
-		intGID, err := strconv.Atoi(usr.Gid)
-		if err != nil {
-			return false, errwrap.Wrapf(err, "error casting GID to int")
+	checkOK = true
+	if obj.State == "exists" && exists {
+		if checkOK, err = obj.accountCheck(dbs); err != nil {
+			return false, err
 		}
-		if obj.UID != nil && int(*obj.UID) != intUID {
-			usercheck = false
+	} else {
+		checkOK = false
+	}
+
+	if !checkOK && !apply {
+		return false, nil
+	}
+
+	if !checkOK {
+		if obj.EditFiles {
+			err = obj.editFiles()
+		} else {
+			err = obj.runCmd(dbs, exists)
 		}
-		if obj.GID != nil && int(*obj.GID) != intGID {
-			usercheck = false
+		if err != nil {
+			return false, err
 		}
-		if obj.HomeDir != nil && *obj.HomeDir != usr.HomeDir {
-			usercheck = false
+		if obj.State == "absent" {
+			return false, nil
 		}
-		if usercheck {
-			return true, nil
+		if dbs, err = obj.readDBs(); err != nil { // read the changes back
+			return false, err
 		}
 	}
+	if obj.State == "absent" {
+		return true, nil
+	}
 
-	if !apply {
-		return false, nil
+	// the account exists now, so the home directory can be managed
+	entry := dbs.passwd.Get(obj.Name())
+	if entry == nil {
+		return false, fmt.Errorf("the user does not exist")
 	}
+	homeOK, err := obj.homeCheckApply(apply, entry)
+	if err != nil {
+		return false, err
+	}
+	return checkOK && homeOK, nil
+}
 
+// runCmd changes the account by running the useradd, usermod or userdel command.
+func (obj *UserRes) runCmd(dbs *userDBs, exists bool) error {
 	var cmdName string
-	var args []string
+	args := []string{}
 	if obj.State == "exists" {
 		if exists {
 			cmdName = "usermod"
@@ -246,6 +552,26 @@ func (obj *UserRes) CheckApply(apply bool) (checkOK bool, err error) {
 		if obj.HomeDir != nil {
 			args = append(args, "-d", *obj.HomeDir)
 		}
+		if obj.Shell != nil {
+			args = append(args, "-s", *obj.Shell)
+		}
+		if obj.GECOS != nil {
+			args = append(args, "-c", *obj.GECOS)
+		}
+		if obj.Expiry != nil {
+			args = append(args, "-e", *obj.Expiry)
+		}
+		if obj.Password != nil || obj.Locked != nil {
+			current := "!" // useradd locks new users by default
+			if dbs.shadow != nil && dbs.shadow.Get(obj.Name()) != nil {
+				current = dbs.shadow.Get(obj.Name())[1]
+			}
+			password, err := obj.getPassword(current)
+			if err != nil {
+				return err
+			}
+			args = append(args, "-p", password)
+		}
 	}
 	if obj.State == "absent" {
 		cmdName = "userdel"
@@ -263,23 +589,267 @@ func (obj *UserRes) CheckApply(apply bool) (checkOK bool, err error) {
 	// open a pipe to get error messages from os/exec
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return false, errwrap.Wrapf(err, "failed to initialize stderr pipe")
+		return errwrap.Wrapf(err, "failed to initialize stderr pipe")
 	}
 
 	// start the command
 	if err := cmd.Start(); err != nil {
-		return false, errwrap.Wrapf(err, "cmd failed to start")
+		return errwrap.Wrapf(err, "cmd failed to start")
 	}
 	// capture any error messages
 	slurp, err := ioutil.ReadAll(stderr)
 	if err != nil {
-		return false, errwrap.Wrapf(err, "error slurping error message")
+		return errwrap.Wrapf(err, "error slurping error message")
 	}
 	// wait until cmd exits and return error message if any
 	if err := cmd.Wait(); err != nil {
-		return false, errwrap.Wrapf(err, "%s", slurp)
+		return errwrap.Wrapf(err, "%s", slurp)
 	}
+	return nil
+}
 
+// nssCheck checks a user which isn't in the local database files, but which
+// comes from another nss source, such as ldap. It can't be changed from here,
+// so this errors if it isn't already correct.
+func (obj *UserRes) nssCheck(usr *user.User) error {
+	if obj.State == "absent" {
+		return fmt.Errorf("the user is not in the local database files, so it can't be removed")
+	}
+	if obj.UID != nil && strconv.FormatUint(uint64(*obj.UID), 10) != usr.Uid {
+		return fmt.Errorf("the user is not in the local database files, so its UID can't be changed")
+	}
+	if obj.GID != nil && strconv.FormatUint(uint64(*obj.GID), 10) != usr.Gid {
+		return fmt.Errorf("the user is not in the local database files, so its GID can't be changed")
+	}
+	if obj.GECOS != nil && *obj.GECOS != usr.Name {
+		return fmt.Errorf("the user is not in the local database files, so its GECOS can't be changed")
+	}
+	if obj.HomeDir != nil && *obj.HomeDir != usr.HomeDir {
+		return fmt.Errorf("the user is not in the local database files, so its home can't be changed")
+	}
+	if obj.Group != nil || obj.Groups != nil || obj.Shell != nil || obj.Password != nil || obj.Expiry != nil || obj.Locked != nil {
+		return fmt.Errorf("the user is not in the local database files, so only its ids, GECOS and home can be checked")
+	}
+	return nil
+}
+
+// editFiles changes the account by editing the database files directly. This
+// does what the useradd, usermod and userdel commands would do. The files are
+// locked, and then read again, so that no other change is lost.
+func (obj *UserRes) editFiles() error {
+	unlock, err := lockUserDB(obj.dbPath(userDBLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	dbs, err := obj.readDBs()
+	if err != nil {
+		return err
+	}
+
+	if obj.State == "absent" {
+		entry := dbs.passwd.Get(obj.Name())
+		if entry == nil { // it was removed while we waited for the lock
+			return nil
+		}
+		obj.init.Logf("Deleting user: %s", obj.Name())
+		dbs.passwd.Remove(obj.Name())
+		dbs.shadow.Remove(obj.Name())
+		dbs.group.Each(func(x []string) {
+			x[3] = strings.Join(util.StrFilterElementsInList([]string{obj.Name()}, userDBMembers(x)), ",")
+		})
+		if dbs.gshadow != nil {
+			dbs.gshadow.Each(func(x []string) { // the admins are in the third field
+				x[2] = strings.Join(util.StrFilterElementsInList([]string{obj.Name()}, userDBAdmins(x)), ",")
+				x[3] = strings.Join(util.StrFilterElementsInList([]string{obj.Name()}, userDBMembers(x)), ",")
+			})
+		}
+		// remove the private group of the user, like userdel does
+		if x := dbs.group.Get(obj.Name()); x != nil && x[2] == entry[3] && x[3] == "" {
+			gid, err := strconv.ParseUint(x[2], 10, 32)
+			if err == nil && dbs.passwd.GetID(3, uint32(gid)) == nil { // unused
+				dbs.group.Remove(obj.Name())
+				if dbs.gshadow != nil {
+					dbs.gshadow.Remove(obj.Name())
+				}
+			}
+		}
+		return obj.writeDBs(dbs)
+	}
+
+	entry := dbs.passwd.Get(obj.Name())
+	if entry == nil {
+		obj.init.Logf("Adding user: %s", obj.Name())
+		var uid uint32
+		if obj.UID != nil {
+			uid = *obj.UID
+		} else if uid, err = dbs.passwd.FreeID(2, UserMinID, UserMaxID); err != nil {
+			return err
+		}
+		entry = []string{obj.Name(), "x", strconv.FormatUint(uint64(uid), 10), "", "", UserHomePrefix + obj.Name(), UserShell}
+	} else {
+		obj.init.Logf("Modifying user: %s", obj.Name())
+	}
+
+	if obj.UID != nil {
+		entry[2] = strconv.FormatUint(uint64(*obj.UID), 10)
+	}
+	gid, err := obj.getGID(dbs)
+	if err != nil {
+		return err
+	}
+	if gid == nil && entry[3] == "" { // create a private group, like useradd does
+		group := dbs.group.Get(obj.Name())
+		if group == nil {
+			uid, _ := strconv.ParseUint(entry[2], 10, 32)
+			x := uint32(uid)
+			if dbs.group.GetID(2, x) != nil {
+				if x, err = dbs.group.FreeID(2, UserMinID, UserMaxID); err != nil {
+					return err
+				}
+			}
+			group = []string{obj.Name(), "x", strconv.FormatUint(uint64(x), 10), ""}
+			dbs.group.Set(group)
+			if dbs.gshadow != nil && dbs.gshadow.Get(obj.Name()) == nil {
+				dbs.gshadow.Set([]string{obj.Name(), "!", "", ""})
+			}
+		}
+		entry[3] = group[2]
+	} else if gid != nil {
+		entry[3] = strconv.FormatUint(uint64(*gid), 10)
+	}
+	if obj.GECOS != nil {
+		entry[4] = *obj.GECOS
+	}
+	if obj.HomeDir != nil {
+		entry[5] = *obj.HomeDir
+	}
+	if obj.Shell != nil {
+		entry[6] = *obj.Shell
+	}
+	dbs.passwd.Set(entry)
+
+	if obj.Groups != nil {
+		for _, group := range obj.Groups {
+			if dbs.group.Get(group) == nil {
+				return fmt.Errorf("the group `%s` does not exist", group)
+			}
+		}
+		setMembers := func(x []string) {
+			members := util.StrFilterElementsInList([]string{obj.Name()}, userDBMembers(x))
+			if util.StrInList(x[0], obj.Groups) {
+				members = append(members, obj.Name())
+			}
+			x[3] = strings.Join(members, ",")
+		}
+		dbs.group.Each(setMembers)
+		if dbs.gshadow != nil { // the members are in the same field
+			dbs.gshadow.Each(setMembers)
+		}
+	}
+
+	shadow := dbs.shadow.Get(obj.Name())
+	if shadow == nil { // new users are locked until they get a password
+		days := strconv.FormatInt(time.Now().Unix()/86400, 10)
+		shadow = []string{obj.Name(), "!", days, "0", "99999", "7", "", "", ""}
+	}
+	if shadow[1], err = obj.getPassword(shadow[1]); err != nil {
+		return err
+	}
+	if obj.Expiry != nil {
+		shadow[7] = obj.getExpiry()
+	}
+	dbs.shadow.Set(shadow)
+
+	return obj.writeDBs(dbs)
+}
+
+// writeDBs writes all of the database files. The caller must hold the lock.
+func (obj *UserRes) writeDBs(dbs *userDBs) error {
+	if err := dbs.group.Write(0644); err != nil {
+		return errwrap.Wrapf(err, "could not write group file")
+	}
+	if dbs.gshadow != nil {
+		if err := dbs.gshadow.Write(0640); err != nil {
+			return errwrap.Wrapf(err, "could not write gshadow file")
+		}
+	}
+	if err := dbs.passwd.Write(0644); err != nil {
+		return errwrap.Wrapf(err, "could not write passwd file")
+	}
+	if err := dbs.shadow.Write(0640); err != nil {
+		return errwrap.Wrapf(err, "could not write shadow file")
+	}
+	return nil
+}
+
+// homeCheckApply creates the home directory, and the authorized keys file, of
+// an existing user, from its passwd entry, if they are needed.
+func (obj *UserRes) homeCheckApply(apply bool, entry []string) (bool, error) {
+	if !obj.CreateHome && obj.AuthorizedKeys == nil {
+		return true, nil
+	}
+	uid, err := strconv.Atoi(entry[2])
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error casting UID to int")
+	}
+	gid, err := strconv.Atoi(entry[3])
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error casting GID to int")
+	}
+	home := obj.dbPath(entry[5])
+
+	checkOK := true
+	if _, err := os.Stat(home); os.IsNotExist(err) && obj.CreateHome {
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("Creating home: %s", home)
+		if err := os.Mkdir(home, 0700); err != nil {
+			return false, errwrap.Wrapf(err, "could not create home directory")
+		}
+		if err := os.Chown(home, uid, gid); err != nil {
+			return false, err
+		}
+		checkOK = false
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if obj.AuthorizedKeys == nil {
+		return checkOK, nil
+	}
+	content := ""
+	if len(obj.AuthorizedKeys) > 0 {
+		content = strings.Join(obj.AuthorizedKeys, "\n") + "\n"
+	}
+	sshDir := path.Join(home, ".ssh")
+	keysFile := path.Join(sshDir, "authorized_keys")
+	b, err := ioutil.ReadFile(keysFile)
+	if err == nil && string(b) == content {
+		return checkOK, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read authorized keys")
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("Writing authorized keys: %s", keysFile)
+	if _, err := os.Stat(sshDir); os.IsNotExist(err) {
+		if err := os.Mkdir(sshDir, 0700); err != nil {
+			return false, errwrap.Wrapf(err, "could not create ssh directory")
+		}
+		if err := os.Chown(sshDir, uid, gid); err != nil {
+			return false, err
+		}
+	}
+	if err := ioutil.WriteFile(keysFile, []byte(content), 0600); err != nil {
+		return false, errwrap.Wrapf(err, "could not write authorized keys")
+	}
+	if err := os.Chown(keysFile, uid, gid); err != nil {
+		return false, err
+	}
 	return false, nil
 }
 
@@ -335,17 +905,47 @@ func (obj *UserRes) Compare(r engine.Res) bool {
 			}
 		}
 	}
-	if (obj.HomeDir == nil) != (res.HomeDir == nil) {
+	for _, x := range [][2]*string{
+		{obj.Group, res.Group},
+		{obj.HomeDir, res.HomeDir},
+		{obj.Shell, res.Shell},
+		{obj.GECOS, res.GECOS},
+		{obj.Password, res.Password},
+		{obj.Expiry, res.Expiry},
+	} {
+		if (x[0] == nil) != (x[1] == nil) {
+			return false
+		}
+		if x[0] != nil && x[1] != nil && *x[0] != *x[1] {
+			return false
+		}
+	}
+	if (obj.Locked == nil) != (res.Locked == nil) {
 		return false
 	}
-	if obj.HomeDir != nil && res.HomeDir != nil {
-		if *obj.HomeDir != *obj.HomeDir {
+	if obj.Locked != nil && res.Locked != nil {
+		if *obj.Locked != *res.Locked {
 			return false
 		}
 	}
+	if obj.CreateHome != res.CreateHome {
+		return false
+	}
+	if (obj.AuthorizedKeys == nil) != (res.AuthorizedKeys == nil) {
+		return false
+	}
+	if strings.Join(obj.AuthorizedKeys, "\n") != strings.Join(res.AuthorizedKeys, "\n") {
+		return false
+	}
 	if obj.AllowDuplicateUID != res.AllowDuplicateUID {
 		return false
 	}
+	if obj.EditFiles != res.EditFiles {
+		return false
+	}
+	if obj.dbPath("/") != res.dbPath("/") {
+		return false
+	}
 	return true
 }
 
@@ -353,6 +953,27 @@ func (obj *UserRes) Compare(r engine.Res) bool {
 type UserUID struct {
 	engine.BaseUID
 	name string
+	uid  *uint32
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *UserUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*UserUID)
+	if !ok {
+		return false
+	}
+	if obj.uid != nil && res.uid != nil {
+		if *obj.uid != *res.uid {
+			return false
+		}
+	}
+	if obj.name != "" && res.name != "" {
+		if obj.name != res.name {
+			return false
+		}
+	}
+	// at least one of the two identifiers must have been compared
+	return (obj.uid != nil && res.uid != nil) || (obj.name != "" && res.name != "")
 }
 
 // UserResAutoEdges holds the state of the auto edge generator.
@@ -366,7 +987,9 @@ type UserResAutoEdges struct {
 // (GID, Group and Groups.) If the user exists, reversed ensures the edge
 // goes from group to user, and if the user is absent the edge goes from
 // user to group. This ensures that we don't add users to groups that
-// don't exist or delete groups before we delete their members.
+// don't exist or delete groups before we delete their members. If the home
+// directory gets created, then there is also an edge from the file resource
+// which manages the nearest parent of it.
 func (obj *UserRes) AutoEdges() (engine.AutoEdge, error) {
 	var result []engine.ResUID
 	var reversed bool
@@ -397,10 +1020,37 @@ func (obj *UserRes) AutoEdges() (engine.AutoEdge, error) {
 			name: group,
 		})
 	}
-	return &UserResAutoEdges{
+	groupEdges := &UserResAutoEdges{
 		UIDs:    result,
 		pointer: 0,
-	}, nil
+	}
+	if obj.State != "exists" || !obj.CreateHome {
+		return groupEdges, nil
+	}
+
+	var data []engine.ResUID
+	values := util.PathSplitFullReversed(obj.dbPath(obj.getHomeDir(nil)))
+	_, values = values[0], values[1:] // the home directory is created by us!
+	for _, x := range values {
+		var reversed = true // cheat by passing a pointer
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x, // what matters
+		})
+	}
+	fileEdges := &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}
+	if len(result) == 0 {
+		return fileEdges, nil
+	}
+	return engineUtil.AutoEdgeCombiner(groupEdges, fileEdges)
 }
 
 // Next returns the next automatic edge.
@@ -426,12 +1076,22 @@ func (obj *UserResAutoEdges) Test(input []bool) bool {
 
 // UIDs includes all params to make a unique identification of this object.
 // Most resources only return one, although some resources can return multiple.
+// If the home directory gets created, then this also returns the uid of it, so
+// that the file resources inside of it can depend on this user.
 func (obj *UserRes) UIDs() []engine.ResUID {
 	x := &UserUID{
 		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
 		name:    obj.Name(),
+		uid:     obj.UID,
+	}
+	if obj.State != "exists" || !obj.CreateHome {
+		return []engine.ResUID{x}
+	}
+	y := &FileUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    path.Clean(obj.dbPath(obj.getHomeDir(nil))) + "/", // it's a dir
 	}
-	return []engine.ResUID{x}
+	return []engine.ResUID{x, y}
 }
 
 // UnmarshalYAML is the custom unmarshal handler for this struct.
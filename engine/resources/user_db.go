@@ -0,0 +1,240 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// passwdFields is the number of fields in each entry of /etc/passwd.
+	passwdFields = 7
+	// shadowFields is the number of fields in each entry of /etc/shadow.
+	shadowFields = 9
+	// groupFields is the number of fields in each entry of /etc/group.
+	groupFields = 4
+	// gshadowFields is the number of fields in each entry of /etc/gshadow.
+	gshadowFields = 4
+
+	// userDBLockFile is the lock file which the shadow utils, and anything
+	// else which uses lckpwdf, lock before they change the database files.
+	userDBLockFile = "/etc/.pwd.lock"
+	// userDBLockTimeout is how long to wait for the lock, which is the same
+	// timeout that lckpwdf uses.
+	userDBLockTimeout = 15 * time.Second
+)
+
+// lockUserDB takes the lock of the database files in the same way that lckpwdf
+// does, so that we don't race with useradd, passwd and the other tools which
+// change them. It returns a function which releases the lock.
+func lockUserDB(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not open %s", filename)
+	}
+	lock := &syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: 0, // the whole file
+	}
+	deadline := time.Now().Add(userDBLockTimeout)
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, lock)
+		if err == nil {
+			break
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			f.Close()
+			return nil, errwrap.Wrapf(err, "could not lock %s", filename)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timeout waiting for the lock on %s", filename)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return f.Close, nil // closing the file releases the lock
+}
+
+// userDB is one of the colon separated database files, such as /etc/passwd. It
+// keeps every line that it reads, so that any lines which it doesn't change are
+// written back exactly as they were found.
+type userDB struct {
+	filename string
+	fields   int        // number of fields in each entry
+	entries  [][]string // every line, split into its fields
+}
+
+// readUserDB reads a database file. If it does not exist, then it is empty.
+func readUserDB(filename string, fields int) (*userDB, error) {
+	obj := &userDB{
+		filename: filename,
+		fields:   fields,
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return obj, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		obj.entries = append(obj.entries, strings.Split(line, ":"))
+	}
+	return obj, nil
+}
+
+// valid returns true if the entry is well formed. Other lines are ignored.
+func (obj *userDB) valid(entry []string) bool {
+	return len(entry) == obj.fields && !strings.HasPrefix(entry[0], "#")
+}
+
+// Get returns a copy of the entry with this name, or nil if there is none.
+func (obj *userDB) Get(name string) []string {
+	for _, entry := range obj.entries {
+		if obj.valid(entry) && entry[0] == name {
+			return append([]string{}, entry...)
+		}
+	}
+	return nil
+}
+
+// GetID returns a copy of the first entry which has this numeric id, such as a
+// uid or a gid, in the field at the index. It returns nil if there is none.
+func (obj *userDB) GetID(index int, id uint32) []string {
+	for _, entry := range obj.entries {
+		if !obj.valid(entry) {
+			continue
+		}
+		if i, err := strconv.ParseUint(entry[index], 10, 32); err == nil && uint32(i) == id {
+			return append([]string{}, entry...)
+		}
+	}
+	return nil
+}
+
+// FreeID returns the smallest numeric id in the range which is not used in the
+// field at the index.
+func (obj *userDB) FreeID(index int, min, max uint32) (uint32, error) {
+	for id := min; id <= max; id++ {
+		if obj.GetID(index, id) == nil {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no free id in %s", obj.filename)
+}
+
+// Set replaces the entry with the same name, or adds it to the end.
+func (obj *userDB) Set(entry []string) {
+	for i, x := range obj.entries {
+		if obj.valid(x) && x[0] == entry[0] {
+			obj.entries[i] = entry
+			return
+		}
+	}
+	obj.entries = append(obj.entries, entry)
+}
+
+// Remove removes the entry with this name, and returns true if there was one.
+func (obj *userDB) Remove(name string) bool {
+	for i, x := range obj.entries {
+		if obj.valid(x) && x[0] == name {
+			obj.entries = append(obj.entries[:i], obj.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Each runs the function on every valid entry. The function may change the
+// entry that it is given.
+func (obj *userDB) Each(fn func(entry []string)) {
+	for _, entry := range obj.entries {
+		if obj.valid(entry) {
+			fn(entry)
+		}
+	}
+}
+
+// String returns the contents of the database file.
+func (obj *userDB) String() string {
+	lines := []string{}
+	for _, entry := range obj.entries {
+		lines = append(lines, strings.Join(entry, ":"))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Write replaces the database file. The new contents are written to a temporary
+// file first, which is then renamed over the old one, so that a reader never
+// sees a partial file. The mode and the owner of the old file are kept. The
+// caller must hold the lock from lockUserDB, since the temporary file has the
+// same name that the shadow utils use.
+func (obj *userDB) Write(mode os.FileMode) error {
+	uid, gid := -1, -1
+	if st, err := os.Stat(obj.filename); err == nil {
+		mode = st.Mode().Perm()
+		if stUnix, ok := st.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stUnix.Uid), int(stUnix.Gid)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := obj.filename + "+" // the same name that the shadow utils use
+	if err := ioutil.WriteFile(tmp, []byte(obj.String()), mode); err != nil {
+		return errwrap.Wrapf(err, "could not write %s", tmp)
+	}
+	if err := os.Chmod(tmp, mode); err != nil { // in case it already existed
+		return err
+	}
+	if uid != -1 && gid != -1 {
+		if err := os.Chown(tmp, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, obj.filename)
+}
+
+// userDBMembers returns the list of members in a group or gshadow entry.
+func userDBMembers(entry []string) []string {
+	if entry[3] == "" {
+		return []string{}
+	}
+	return strings.Split(entry[3], ",")
+}
+
+// userDBAdmins returns the list of admins in a gshadow entry.
+func userDBAdmins(entry []string) []string {
+	if entry[2] == "" {
+		return []string{}
+	}
+	return strings.Split(entry[2], ",")
+}
@@ -0,0 +1,264 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine/graph/autoedge"
+	"github.com/purpleidea/mgmt/pgraph"
+)
+
+func TestUserEditFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "mgmt-user-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"etc", "home"} {
+		if err := os.Mkdir(path.Join(root, p), 0755); err != nil {
+			t.Errorf("error creating dir: %v", err)
+			return
+		}
+	}
+
+	// the home directory gets created as the current user, so that this
+	// test doesn't need to be root, but root can use any other user
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if uid == 0 {
+		uid, gid = 1234, 1234
+	}
+	files := map[string]string{
+		passwdFile:  "root:x:0:0:root:/root:/bin/bash\n",
+		shadowFile:  "root:*:17000:0:99999:7:::\n",
+		groupFile:   fmt.Sprintf("root:x:0:\nwheel:x:10:alice\nusers:x:100:\nmgmt:x:%d:\n", gid),
+		gshadowFile: "root:::\nwheel:::alice\nusers:::\nmgmt:!::\n",
+	}
+	for p, data := range files {
+		if err := ioutil.WriteFile(path.Join(root, p), []byte(data), 0600); err != nil {
+			t.Errorf("error writing file: %v", err)
+			return
+		}
+	}
+
+	group := "mgmt"
+	shell := "/bin/zsh"
+	gecos := "James"
+	password := "$6$salt$hash"
+	expiry := "2030-01-01"
+	locked := false
+	r1 := &UserRes{
+		State:          "exists",
+		UID:            &uid,
+		Group:          &group,
+		Groups:         []string{"wheel", "users"},
+		Shell:          &shell,
+		GECOS:          &gecos,
+		Password:       &password,
+		Expiry:         &expiry,
+		Locked:         &locked,
+		CreateHome:     true,
+		AuthorizedKeys: []string{"ssh-ed25519 AAAA james@example.com"},
+		EditFiles:      true,
+		Root:           root,
+	}
+	r1.SetName("james")
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	converge := func(msg string) {
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if checkOK {
+			t.Errorf("%s: check should have failed", msg)
+		}
+		if _, err := r1.CheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", msg, err)
+		}
+		if checkOK, err := r1.CheckApply(false); err != nil {
+			t.Errorf("%s: check failed with: %v", msg, err)
+		} else if !checkOK {
+			t.Errorf("%s: check should have passed after apply", msg)
+		}
+	}
+	expect := func(p, exp string) {
+		b, err := ioutil.ReadFile(path.Join(root, p))
+		if err != nil {
+			t.Errorf("error reading file: %v", err)
+		} else if s := string(b); s != exp {
+			t.Errorf("unexpected contents of %s:\n%s", p, s)
+		}
+	}
+
+	converge("create")
+	expect(passwdFile, fmt.Sprintf("root:x:0:0:root:/root:/bin/bash\njames:x:%d:%d:James:/home/james:/bin/zsh\n", uid, gid))
+	expect(groupFile, fmt.Sprintf("root:x:0:\nwheel:x:10:alice,james\nusers:x:100:james\nmgmt:x:%d:\n", gid))
+	expect(gshadowFile, "root:::\nwheel:::alice,james\nusers:::james\nmgmt:!::\n")
+	shadow, err := readUserDB(path.Join(root, shadowFile), shadowFields)
+	if err != nil {
+		t.Errorf("error reading shadow: %v", err)
+	} else if entry := shadow.Get("james"); entry == nil || entry[1] != password || entry[7] != "21915" {
+		t.Errorf("unexpected shadow entry: %v", entry)
+	}
+	expect("/home/james/.ssh/authorized_keys", "ssh-ed25519 AAAA james@example.com\n")
+	if st, err := os.Stat(path.Join(root, "/home/james")); err != nil || !st.IsDir() || st.Mode().Perm() != 0700 {
+		t.Errorf("unexpected home dir: %v", err)
+	}
+
+	locked = true
+	r1.Groups = []string{"users"}
+	converge("lock")
+	expect(groupFile, fmt.Sprintf("root:x:0:\nwheel:x:10:alice\nusers:x:100:james\nmgmt:x:%d:\n", gid))
+	expect(gshadowFile, "root:::\nwheel:::alice\nusers:::james\nmgmt:!::\n")
+	if shadow, err := readUserDB(path.Join(root, shadowFile), shadowFields); err != nil {
+		t.Errorf("error reading shadow: %v", err)
+	} else if entry := shadow.Get("james"); entry == nil || entry[1] != "!"+password {
+		t.Errorf("unexpected shadow entry: %v", entry)
+	}
+
+	r1.State = "absent"
+	converge("remove")
+	expect(passwdFile, "root:x:0:0:root:/root:/bin/bash\n")
+	expect(shadowFile, "root:*:17000:0:99999:7:::\n")
+	expect(groupFile, fmt.Sprintf("root:x:0:\nwheel:x:10:alice\nusers:x:100:\nmgmt:x:%d:\n", gid))
+	expect(gshadowFile, "root:::\nwheel:::alice\nusers:::\nmgmt:!::\n")
+}
+
+func TestUserEditFilesPrivateGroup(t *testing.T) {
+	root, err := ioutil.TempDir("", "mgmt-user-")
+	if err != nil {
+		t.Errorf("error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(path.Join(root, "etc"), 0755); err != nil {
+		t.Errorf("error creating dir: %v", err)
+		return
+	}
+	files := map[string]string{
+		passwdFile:  "root:x:0:0:root:/root:/bin/bash\n",
+		shadowFile:  "root:*:17000:0:99999:7:::\n",
+		groupFile:   "root:x:0:\nwheel:x:10:\n",
+		gshadowFile: "root:::\nwheel:bob::\n",
+	}
+	for p, data := range files {
+		if err := ioutil.WriteFile(path.Join(root, p), []byte(data), 0600); err != nil {
+			t.Errorf("error writing file: %v", err)
+			return
+		}
+	}
+	expect := func(p, exp string) {
+		b, err := ioutil.ReadFile(path.Join(root, p))
+		if err != nil {
+			t.Errorf("error reading file: %v", err)
+		} else if s := string(b); s != exp {
+			t.Errorf("unexpected contents of %s:\n%s", p, s)
+		}
+	}
+
+	uid := uint32(1500)
+	r1 := &UserRes{
+		State:     "exists",
+		UID:       &uid,
+		Groups:    []string{"wheel"},
+		EditFiles: true,
+		Root:      root,
+	}
+	r1.SetName("bob")
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := r1.Init(fakeInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	expect(groupFile, "root:x:0:\nwheel:x:10:bob\nbob:x:1500:\n")
+	expect(gshadowFile, "root:::\nwheel:bob::bob\nbob:!::\n")
+
+	r1.State = "absent"
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	expect(groupFile, "root:x:0:\nwheel:x:10:\n")
+	expect(gshadowFile, "root:::\nwheel:::\n")
+}
+
+func TestUserAutoEdge1(t *testing.T) {
+	g, err := pgraph.NewGraph("TestGraph")
+	if err != nil {
+		t.Errorf("error creating graph: %v", err)
+		return
+	}
+
+	r1 := &UserRes{
+		State:      "exists",
+		CreateHome: true,
+	}
+	r1.SetName("james")
+	r2 := &GroupRes{
+		State: "exists",
+	}
+	r2.SetName("web")
+	r3 := &FileRes{
+		Path:  "/home/james/.bashrc",
+		Owner: "james",
+	}
+	r4 := &FileRes{
+		Path:  "/srv/www/",
+		Group: "web",
+	}
+	r5 := &FileRes{
+		Path: "/home/",
+	}
+	g.AddVertex(r1, r2, r3, r4, r5)
+
+	debug := testing.Verbose() // set via the -test.v flag to `go test`
+	logf := func(format string, v ...interface{}) {
+		t.Logf("test: "+format, v...)
+	}
+	// run artificially without the entire engine
+	if err := autoedge.AutoEdge(g, debug, logf); err != nil {
+		t.Errorf("error running autoedges: %v", err)
+	}
+
+	// file /home/ -> user james (home), user james -> file .bashrc (owner
+	// and home), group web -> file /srv/www/ (group)
+	if i := g.NumEdges(); i != 3 {
+		t.Errorf("should have 3 edges instead of: %d", i)
+	}
+	if g.FindEdge(r5, r1) == nil || g.FindEdge(r1, r3) == nil || g.FindEdge(r2, r4) == nil {
+		t.Errorf("missing an expected edge")
+	}
+}
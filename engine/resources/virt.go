@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -67,6 +68,7 @@ const (
 // file resource which removes a particular path.
 type VirtRes struct {
 	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
 	traits.Refreshable
 
 	init *engine.Init
@@ -84,6 +86,7 @@ type VirtRes struct {
 	Network    []networkDevice    `yaml:"network"`
 	Filesystem []filesystemDevice `yaml:"filesystem"`
 	Auth       *VirtAuth          `yaml:"auth"`
+	CloudInit  *VirtCloudInit     `yaml:"cloudinit"` // attach a cloud-init seed iso
 
 	HotCPUs bool `yaml:"hotcpus"` // allow hotplug of cpus?
 	// FIXME: values here should be enum's!
@@ -97,8 +100,10 @@ type VirtRes struct {
 	uriScheme           virtURISchemeType
 	processExitWatch    bool // do we want to wait on an explicit process exit?
 	processExitChan     chan struct{}
-	restartScheduled    bool // do we need to schedule a hard restart?
-	guestAgentConnected bool // our tracking of if guest agent is running
+	restartScheduled    bool       // do we need to schedule a hard restart?
+	guestAgentConnected bool       // our tracking of if guest agent is running
+	seedDir             string     // where the cloud-init seed gets built
+	imager              virtImager // builds the seed iso
 }
 
 // VirtAuth is used to pass credentials to libvirt.
@@ -147,6 +152,18 @@ func (obj *VirtRes) Init(init *engine.Init) error {
 
 	obj.absent = (obj.Transient && obj.State == "shutoff") // machine shouldn't exist
 
+	if obj.CloudInit != nil {
+		if obj.seedDir, err = obj.init.VarDir("cloudinit"); err != nil {
+			return errwrap.Wrapf(err, "%s: could not get the cloud-init dir", obj)
+		}
+		if obj.imager == nil {
+			obj.imager = &virtImgCmd{
+				qemuImg: VirtQemuImgCmd,
+				genIso:  VirtGenIsoImageCmd,
+			}
+		}
+	}
+
 	obj.conn, err = obj.connect() // gets closed in Close method of Res API
 	if err != nil {
 		return errwrap.Wrapf(err, "%s: Connection to libvirt failed in init", obj)
@@ -747,6 +764,17 @@ func (obj *VirtRes) CheckApply(apply bool) (bool, error) {
 
 	var checkOK = true
 
+	// the seed has to exist before the domain that uses it gets created
+	if obj.CloudInit != nil && !obj.absent {
+		c, err := virtCloudInitSeed(obj.imager, obj.seedDir, obj.CloudInit.files(obj.Name()), apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not build the cloud-init seed")
+		}
+		if !c {
+			checkOK = false
+		}
+	}
+
 	dom, err := obj.conn.LookupDomainByName(obj.Name())
 	if err == nil {
 		// pass
@@ -937,6 +965,14 @@ func (obj *VirtRes) getDomainXML() string {
 		}
 	}
 
+	if obj.CloudInit != nil {
+		seed := &cdRomDevice{
+			Source: path.Join(obj.seedDir, virtCloudInitISO),
+			Type:   "raw",
+		}
+		b += fmt.Sprintf(seed.GetXML(len(obj.CDRom)))
+	}
+
 	if obj.Network != nil {
 		for i, net := range obj.Network {
 			b += fmt.Sprintf(net.GetXML(i))
@@ -1086,6 +1122,12 @@ func (obj *VirtRes) Compare(r engine.Res) bool {
 	if obj.Memory != res.Memory {
 		return false
 	}
+	if (obj.CloudInit == nil) != (res.CloudInit == nil) {
+		return false
+	}
+	if obj.CloudInit != nil && *obj.CloudInit != *res.CloudInit {
+		return false
+	}
 	// TODO:
 	//if obj.Boot != res.Boot {
 	//	return false
@@ -1121,6 +1163,44 @@ func (obj *VirtRes) UIDs() []engine.ResUID {
 	return []engine.ResUID{x}
 }
 
+// VirtResAutoEdges holds the state of the auto edge generator.
+type VirtResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *VirtResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *VirtResAutoEdges) Test(input []bool) bool {
+	return false // never keep going
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the volumes and files
+// which hold the disk images of the machine.
+func (obj *VirtRes) AutoEdges() (engine.AutoEdge, error) {
+	var edges []engine.ResUID
+	for _, disk := range obj.Disk {
+		source, err := util.ExpandHome(disk.Source)
+		if err != nil {
+			return nil, err
+		}
+		var reversed = true // the image has to exist first
+		base := engine.BaseUID{
+			Name:     obj.Name(),
+			Kind:     obj.Kind(),
+			Reversed: &reversed,
+		}
+		edges = append(edges,
+			&VirtVolumeUID{BaseUID: base, path: source},
+			&FileUID{BaseUID: base, path: source},
+		)
+	}
+	return &VirtResAutoEdges{edges: edges}, nil
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct.
 // It is primarily useful for setting the defaults.
 func (obj *VirtRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -0,0 +1,621 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+	"gopkg.in/fsnotify.v1"
+)
+
+func init() {
+	engine.RegisterResource("virt:volume", func() engine.Res { return &VirtVolumeRes{} })
+}
+
+const (
+	// VirtQemuImgCmd is the command used to create and inspect images.
+	VirtQemuImgCmd = "qemu-img"
+	// VirtGenIsoImageCmd is the command used to build the cloud-init iso.
+	VirtGenIsoImageCmd = "genisoimage"
+
+	// virtCloudInitLabel is the volume label that cloud-init looks for.
+	virtCloudInitLabel = "cidata"
+	// virtCloudInitISO is the file name of the seed iso.
+	virtCloudInitISO = "seed.iso"
+)
+
+// VirtVolumeRes is a virtual machine disk image resource. It can create a qcow2
+// overlay on top of a base image, so that many machines can share one image,
+// and it can grow an image to the size that it should have.
+type VirtVolumeRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+
+	init *engine.Init
+
+	// Path is the absolute path of the image. If it's empty, then the name
+	// of the resource is used instead.
+	Path string `yaml:"path"`
+	// State is either exists or absent.
+	State string `yaml:"state"`
+	// Format is the format of the image, which is qcow2 or raw.
+	Format string `yaml:"format"`
+	// Backing is the path of the image to use as the backing file of a qcow2
+	// overlay. The backing image is only ever read.
+	Backing string `yaml:"backing"`
+	// BackingFormat is the format of the backing image.
+	BackingFormat string `yaml:"backingformat"`
+	// Size is the virtual size of the image, such as 20G. An image which is
+	// smaller gets resized, but an image is never shrunk. It is required
+	// unless there is a backing image, which gives the default size.
+	Size string `yaml:"size"`
+
+	imager virtImager // runs the image commands, and can be replaced in tests
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *VirtVolumeRes) Default() engine.Res {
+	return &VirtVolumeRes{
+		State:         "exists",
+		Format:        "qcow2",
+		BackingFormat: "qcow2",
+	}
+}
+
+// getPath returns the actual path to use for this resource. It computes this
+// after analysis of the Path and Name.
+func (obj *VirtVolumeRes) getPath() string {
+	if obj.Path != "" {
+		return obj.Path
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *VirtVolumeRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("state must be exists or absent")
+	}
+	p := obj.getPath()
+	if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") {
+		return fmt.Errorf("the path must be an absolute file path")
+	}
+	if obj.Format != "qcow2" && obj.Format != "raw" {
+		return fmt.Errorf("the format must be qcow2 or raw")
+	}
+	if obj.Backing != "" {
+		if obj.Format != "qcow2" {
+			return fmt.Errorf("only a qcow2 image can have a base")
+		}
+		if !strings.HasPrefix(obj.Backing, "/") {
+			return fmt.Errorf("the backing image must be an absolute path")
+		}
+		if obj.Backing == p {
+			return fmt.Errorf("the backing image must not be the image itself")
+		}
+		if obj.BackingFormat != "qcow2" && obj.BackingFormat != "raw" {
+			return fmt.Errorf("the backing format must be qcow2 or raw")
+		}
+	}
+	if obj.Size == "" && obj.Backing == "" && obj.State == "exists" {
+		return fmt.Errorf("the size is required without a backing image")
+	}
+	if obj.Size != "" {
+		if _, err := virtParseSize(obj.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *VirtVolumeRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+	if obj.imager == nil {
+		obj.imager = &virtImgCmd{
+			qemuImg: VirtQemuImgCmd,
+			genIso:  VirtGenIsoImageCmd,
+		}
+	}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *VirtVolumeRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *VirtVolumeRes) Watch() error {
+	recWatcher, err := recwatch.NewRecWatcher(obj.getPath(), false)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	// notify engine that we're running
+	if err := obj.init.Running(); err != nil {
+		return err // exit if requested
+	}
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-recWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			// a running machine writes to its image all the time
+			if event.Body.Op == fsnotify.Write {
+				continue
+			}
+			send = true
+			obj.init.Dirty() // dirty
+
+		case event, ok := <-obj.init.Events:
+			if !ok {
+				return nil
+			}
+			if err := obj.init.Read(event); err != nil {
+				return err
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			if err := obj.init.Event(); err != nil {
+				return err // exit if requested
+			}
+		}
+	}
+}
+
+// CheckApply method for virt:volume resource.
+func (obj *VirtVolumeRes) CheckApply(apply bool) (bool, error) {
+	p := obj.getPath()
+	_, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not stat image")
+	}
+	exists := err == nil
+
+	if obj.State == "absent" {
+		if !exists {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("removing %s", p)
+		return false, os.Remove(p)
+	}
+
+	var size uint64 // zero means the size of the base
+	if obj.Size != "" {
+		if size, err = virtParseSize(obj.Size); err != nil {
+			return false, err
+		}
+	}
+
+	if !exists {
+		if !apply {
+			return false, nil
+		}
+		if obj.Backing != "" {
+			obj.init.Logf("creating %s from %s", p, obj.Backing)
+		} else {
+			obj.init.Logf("creating %s", p)
+		}
+		if err := obj.imager.Create(p, obj.Format, obj.Backing, obj.BackingFormat, size); err != nil {
+			return false, errwrap.Wrapf(err, "could not create image")
+		}
+		return false, nil
+	}
+
+	info, err := obj.imager.Info(p)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not inspect image")
+	}
+	// we won't convert or rebase an image, since it might hold valuable data
+	if info.Format != obj.Format {
+		return false, fmt.Errorf("the image has format %s instead of %s", info.Format, obj.Format)
+	}
+	if info.BackingFilename != obj.Backing {
+		return false, fmt.Errorf("the image has backing image %s instead of %s", info.BackingFilename, obj.Backing)
+	}
+	if size == 0 || info.VirtualSize == size {
+		return true, nil
+	}
+	if info.VirtualSize > size {
+		return false, fmt.Errorf("the image is bigger than %s, and won't be shrunk", obj.Size)
+	}
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("resizing %s to %s", p, obj.Size)
+	if err := obj.imager.Resize(p, obj.Format, size); err != nil {
+		return false, errwrap.Wrapf(err, "could not resize image")
+	}
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *VirtVolumeRes) Cmp(r engine.Res) error {
+	// we can only compare VirtVolumeRes to others of the same resource kind
+	res, ok := r.(*VirtVolumeRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Format != res.Format {
+		return fmt.Errorf("the Format differs")
+	}
+	if obj.Backing != res.Backing {
+		return fmt.Errorf("the Backing differs")
+	}
+	if obj.BackingFormat != res.BackingFormat {
+		return fmt.Errorf("the BackingFormat differs")
+	}
+	if obj.Size != res.Size {
+		return fmt.Errorf("the Size differs")
+	}
+	if obj.imager != res.imager {
+		return fmt.Errorf("the imager differs")
+	}
+	return nil
+}
+
+// VirtVolumeUID is the UID struct for VirtVolumeRes.
+type VirtVolumeUID struct {
+	engine.BaseUID
+	path string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *VirtVolumeUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*VirtVolumeUID)
+	if !ok {
+		return false
+	}
+	return obj.path == res.path
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *VirtVolumeRes) UIDs() []engine.ResUID {
+	x := &VirtVolumeUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    obj.getPath(),
+	}
+	return []engine.ResUID{x}
+}
+
+// VirtVolumeResAutoEdges holds the state of the auto edge generator.
+type VirtVolumeResAutoEdges struct {
+	edges []engine.ResUID
+}
+
+// Next returns the next automatic edge.
+func (obj *VirtVolumeResAutoEdges) Next() []engine.ResUID {
+	return obj.edges
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *VirtVolumeResAutoEdges) Test(input []bool) bool {
+	return false // never keep going
+}
+
+// AutoEdges returns the AutoEdge interface. In this case the nearest parent
+// directory, and the base image, which can be managed by another volume or by
+// a file resource.
+func (obj *VirtVolumeRes) AutoEdges() (engine.AutoEdge, error) {
+	var data []engine.ResUID
+	values := util.PathSplitFullReversed(obj.getPath())
+	for _, x := range values[1:] { // skip the image itself
+		var reversed = true // cheat by passing a pointer
+		data = append(data, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x, // what matters
+		})
+	}
+	dirEdges := &FileResAutoEdges{
+		data:    data,
+		pointer: 0,
+		found:   false,
+	}
+	if obj.Backing == "" {
+		return dirEdges, nil
+	}
+
+	var reversed = true // the base has to exist first
+	base := engine.BaseUID{
+		Name:     obj.Name(),
+		Kind:     obj.Kind(),
+		Reversed: &reversed,
+	}
+	baseEdges := &VirtVolumeResAutoEdges{
+		edges: []engine.ResUID{
+			&VirtVolumeUID{BaseUID: base, path: obj.Backing},
+			&FileUID{BaseUID: base, path: obj.Backing},
+		},
+	}
+	return engineUtil.AutoEdgeCombiner(dirEdges, baseEdges)
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *VirtVolumeRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes VirtVolumeRes // indirection to avoid infinite recursion
+
+	def := obj.Default()            // get the default
+	res, ok := def.(*VirtVolumeRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to VirtVolumeRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = VirtVolumeRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// virtParseSize parses an image size, such as 20G, into bytes. The suffixes
+// are powers of 1024, like they are for qemu-img.
+func virtParseSize(size string) (uint64, error) {
+	m := regexp.MustCompile(`^([0-9]+)([KMGT]?)$`).FindStringSubmatch(strings.ToUpper(size))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	var shift uint // no suffix means bytes
+	if m[2] != "" {
+		shift = uint(10 * (strings.Index("KMGT", m[2]) + 1))
+	}
+	if n > (^uint64(0))>>shift {
+		return 0, fmt.Errorf("size is too big: %s", size)
+	}
+	return n << shift, nil
+}
+
+// VirtCloudInit is the first boot configuration of a machine. It gets written
+// to a NoCloud seed iso, which is attached to the machine as an extra cdrom. As
+// usual, cloud-init only runs once for each instance-id in the meta-data.
+type VirtCloudInit struct {
+	UserData      string `yaml:"userdata"`      // the #cloud-config user-data
+	MetaData      string `yaml:"metadata"`      // defaults to the instance-id and hostname
+	NetworkConfig string `yaml:"networkconfig"` // optional network-config
+}
+
+// files returns the contents of the seed iso for a machine named name.
+func (obj *VirtCloudInit) files(name string) map[string]string {
+	files := map[string]string{
+		"user-data": obj.UserData,
+		"meta-data": obj.MetaData,
+	}
+	if obj.MetaData == "" {
+		files["meta-data"] = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, name)
+	}
+	if obj.NetworkConfig != "" {
+		files["network-config"] = obj.NetworkConfig
+	}
+	return files
+}
+
+// virtCloudInitSeed writes the cloud-init files into the cidata directory in
+// dir, and then builds the NoCloud seed iso from them if they changed, or if
+// the iso doesn't exist. It returns true if nothing had to change. The old iso
+// is removed before the files change, so that if the build fails, then the
+// next run builds it again, instead of finding the new files with a stale iso.
+func virtCloudInitSeed(imager virtImager, dir string, files map[string]string, apply bool) (bool, error) {
+	iso := path.Join(dir, virtCloudInitISO)
+	cidata := path.Join(dir, virtCloudInitLabel)
+
+	checkOK := true
+	if _, err := os.Stat(iso); os.IsNotExist(err) {
+		checkOK = false
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "could not stat iso")
+	}
+
+	existing, err := ioutil.ReadDir(cidata)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read cloud-init dir")
+	}
+	remove := []string{} // old files
+	for _, x := range existing {
+		if _, exists := files[x.Name()]; !exists {
+			remove = append(remove, x.Name())
+		}
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	write := []string{} // changed files
+	for _, name := range names {
+		b, err := ioutil.ReadFile(path.Join(cidata, name))
+		if err == nil && bytes.Equal(b, []byte(files[name])) {
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		write = append(write, name)
+	}
+
+	if len(remove) > 0 || len(write) > 0 {
+		checkOK = false
+	}
+	if checkOK || !apply {
+		return checkOK, nil
+	}
+
+	if err := os.Remove(iso); err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not remove the old iso")
+	}
+	for _, name := range remove {
+		if err := os.Remove(path.Join(cidata, name)); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(cidata, 0700); err != nil {
+		return false, err
+	}
+	for _, name := range write {
+		if err := ioutil.WriteFile(path.Join(cidata, name), []byte(files[name]), 0600); err != nil {
+			return false, err
+		}
+	}
+
+	paths := []string{}
+	for _, name := range names {
+		paths = append(paths, path.Join(cidata, name))
+	}
+	if err := imager.MakeISO(iso, virtCloudInitLabel, paths); err != nil {
+		return false, errwrap.Wrapf(err, "could not build the cloud-init iso")
+	}
+	return false, nil
+}
+
+// virtImageInfo is the information about an image, as `qemu-img info` shows it.
+type virtImageInfo struct {
+	Format          string `json:"format"`
+	VirtualSize     uint64 `json:"virtual-size"`
+	BackingFilename string `json:"backing-filename"`
+}
+
+// virtImager runs the commands that build images. This is an interface so that
+// the commands can be replaced in the tests.
+type virtImager interface {
+	// Info returns the information about an existing image.
+	Info(path string) (*virtImageInfo, error)
+
+	// Create creates a new image. If the base is not empty, then the image
+	// is an overlay on top of it. A size of zero means the size of the base.
+	Create(path, format, base, baseFormat string, size uint64) error
+
+	// Resize changes the virtual size of an image.
+	Resize(path, format string, size uint64) error
+
+	// MakeISO builds an iso9660 image with a volume label, which contains
+	// the files at the top level.
+	MakeISO(path, label string, files []string) error
+}
+
+// virtImgCmd is the virtImager which runs the real commands.
+type virtImgCmd struct {
+	qemuImg string
+	genIso  string
+}
+
+// Info runs qemu-img info on the image. The image might be in use by a running
+// machine, so it shares the lock.
+func (obj *virtImgCmd) Info(path string) (*virtImageInfo, error) {
+	out, err := obj.run(obj.qemuImg, "info", "-U", "--output=json", path)
+	if err != nil {
+		return nil, err
+	}
+	info := &virtImageInfo{}
+	if err := json.Unmarshal(out, info); err != nil {
+		return nil, errwrap.Wrapf(err, "could not decode image info")
+	}
+	return info, nil
+}
+
+// Create runs qemu-img create.
+func (obj *virtImgCmd) Create(path, format, base, baseFormat string, size uint64) error {
+	args := []string{"create", "-f", format}
+	if base != "" {
+		args = append(args, "-b", base, "-F", baseFormat)
+	}
+	args = append(args, path)
+	if size > 0 {
+		args = append(args, strconv.FormatUint(size, 10))
+	}
+	_, err := obj.run(obj.qemuImg, args...)
+	return err
+}
+
+// Resize runs qemu-img resize.
+func (obj *virtImgCmd) Resize(path, format string, size uint64) error {
+	_, err := obj.run(obj.qemuImg, "resize", "-f", format, path, strconv.FormatUint(size, 10))
+	return err
+}
+
+// MakeISO runs genisoimage.
+func (obj *virtImgCmd) MakeISO(path, label string, files []string) error {
+	args := []string{"-output", path, "-volid", label, "-joliet", "-rock"}
+	_, err := obj.run(obj.genIso, append(args, files...)...)
+	return err
+}
+
+// run runs the command and returns the stdout, or the stderr as an error.
+func (obj *virtImgCmd) run(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return nil, fmt.Errorf("%s failed: %s", name, s)
+		}
+		return nil, errwrap.Wrapf(err, "%s failed", name)
+	}
+	return stdout.Bytes(), nil
+}
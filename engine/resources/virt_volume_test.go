@@ -0,0 +1,334 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// virtQemuImgStub is a fake qemu-img which stores the image info as json in the
+// image file, instead of an actual image.
+const virtQemuImgStub = `#!/bin/sh
+cmd=$1; shift
+case "$cmd" in
+info)
+	for img; do :; done # the last arg
+	exec cat "$img"
+	;;
+create)
+	while [ $# -gt 0 ]; do
+		case "$1" in
+		-f) fmt=$2; shift 2;;
+		-b) base=$2; shift 2;;
+		-F) shift 2;;
+		*) if [ -z "$img" ]; then img=$1; else size=$1; fi; shift;;
+		esac
+	done
+	if [ -z "$size" ]; then
+		size=$(sed 's/.*"virtual-size": *\([0-9]*\).*/\1/' "$base") || exit 1
+	fi
+	printf '{"format": "%s", "virtual-size": %s, "backing-filename": "%s"}\n' "$fmt" "$size" "$base" > "$img"
+	;;
+resize)
+	sed -i "s/\"virtual-size\": [0-9]*/\"virtual-size\": $4/" "$3"
+	;;
+*)
+	echo "unknown command: $cmd" >&2
+	exit 1
+	;;
+esac
+`
+
+// virtGenIsoImageStub is a fake genisoimage which concatenates the files.
+const virtGenIsoImageStub = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-output) out=$2; shift 2;;
+	-volid) label=$2; shift 2;;
+	-*) shift;;
+	*) files="$files $1"; shift;;
+	esac
+done
+{ echo "$label"; for f in $files; do echo "== $(basename $f)"; cat "$f"; done; } > "$out"
+`
+
+// virtImgStubs writes the stub commands into dir, and returns an imager which
+// runs them.
+func virtImgStubs(t *testing.T, dir string) *virtImgCmd {
+	qemuImg := path.Join(dir, "qemu-img")
+	genIso := path.Join(dir, "genisoimage")
+	if err := ioutil.WriteFile(qemuImg, []byte(virtQemuImgStub), 0755); err != nil {
+		t.Fatalf("could not write stub: %v", err)
+	}
+	if err := ioutil.WriteFile(genIso, []byte(virtGenIsoImageStub), 0755); err != nil {
+		t.Fatalf("could not write stub: %v", err)
+	}
+	return &virtImgCmd{
+		qemuImg: qemuImg,
+		genIso:  genIso,
+	}
+}
+
+// virtVolumeConverge runs CheckApply until the volume is converged, and then
+// checks that it stays that way.
+func virtVolumeConverge(t *testing.T, res *VirtVolumeRes) {
+	if _, err := res.CheckApply(true); err != nil {
+		t.Fatalf("checkapply failed with: %v", err)
+	}
+	checkOK, err := res.CheckApply(false)
+	if err != nil {
+		t.Fatalf("checkapply failed with: %v", err)
+	}
+	if !checkOK {
+		t.Fatalf("volume did not converge")
+	}
+}
+
+func TestVirtParseSize(t *testing.T) {
+	tests := map[string]uint64{
+		"512": 512,
+		"1K":  1024,
+		"10M": 10 * 1024 * 1024,
+		"20G": 20 * 1024 * 1024 * 1024,
+		"2t":  2 * 1024 * 1024 * 1024 * 1024,
+	}
+	for s, expected := range tests {
+		size, err := virtParseSize(s)
+		if err != nil {
+			t.Errorf("size %s failed with: %v", s, err)
+			continue
+		}
+		if size != expected {
+			t.Errorf("size %s is %d instead of %d", s, size, expected)
+		}
+	}
+
+	for _, s := range []string{"", "0", "G", "1.5G", "1GB", "-1M", "99999999999T"} {
+		if _, err := virtParseSize(s); err == nil {
+			t.Errorf("size %s should have failed", s)
+		}
+	}
+}
+
+func TestVirtVolumeValidate(t *testing.T) {
+	tests := []struct {
+		res *VirtVolumeRes
+		ok  bool
+	}{
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "exists", Format: "qcow2", Size: "10G"}, true},
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "exists", Format: "qcow2", Backing: "/var/lib/base.qcow2", BackingFormat: "qcow2"}, true},
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "absent", Format: "qcow2"}, true},
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "exists", Format: "qcow2"}, false},               // no size
+		{&VirtVolumeRes{Path: "vm.qcow2", State: "exists", Format: "qcow2", Size: "10G"}, false},           // relative
+		{&VirtVolumeRes{Path: "/var/lib/vm.img", State: "exists", Format: "vmdk", Size: "10G"}, false},     // format
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "running", Format: "qcow2", Size: "10G"}, false}, // state
+		{&VirtVolumeRes{Path: "/var/lib/vm.img", State: "exists", Format: "raw", Backing: "/var/lib/base.qcow2", BackingFormat: "qcow2"}, false},
+		{&VirtVolumeRes{Path: "/var/lib/vm.qcow2", State: "exists", Format: "qcow2", Backing: "/var/lib/vm.qcow2", BackingFormat: "qcow2"}, false},
+	}
+	for i, x := range tests {
+		err := x.res.Validate()
+		if x.ok && err != nil {
+			t.Errorf("test #%d: validate failed with: %v", i, err)
+		}
+		if !x.ok && err == nil {
+			t.Errorf("test #%d: validate should have failed", i)
+		}
+	}
+}
+
+func TestVirtVolumeCheckApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-virt-volume-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	imager := virtImgStubs(t, dir)
+
+	base := &VirtVolumeRes{
+		Path:   path.Join(dir, "base.img"),
+		State:  "exists",
+		Format: "raw",
+		Size:   "1G",
+		imager: imager,
+	}
+	if err := base.Validate(); err != nil {
+		t.Fatalf("validate failed with: %v", err)
+	}
+	if err := base.Init(fakeInit(t)); err != nil {
+		t.Fatalf("init failed with: %v", err)
+	}
+	virtVolumeConverge(t, base)
+
+	overlay := &VirtVolumeRes{
+		Path:          path.Join(dir, "vm.qcow2"),
+		State:         "exists",
+		Format:        "qcow2",
+		Backing:       base.Path,
+		BackingFormat: "raw",
+		imager:        imager,
+	}
+	if err := overlay.Validate(); err != nil {
+		t.Fatalf("validate failed with: %v", err)
+	}
+	if err := overlay.Init(fakeInit(t)); err != nil {
+		t.Fatalf("init failed with: %v", err)
+	}
+	virtVolumeConverge(t, overlay)
+
+	info, err := imager.Info(overlay.Path)
+	if err != nil {
+		t.Fatalf("info failed with: %v", err)
+	}
+	if info.Format != "qcow2" || info.BackingFilename != base.Path || info.VirtualSize != 1<<30 {
+		t.Errorf("unexpected overlay: %+v", info)
+	}
+
+	overlay.Size = "2G" // grow it
+	virtVolumeConverge(t, overlay)
+	if info, err := imager.Info(overlay.Path); err != nil || info.VirtualSize != 2<<30 {
+		t.Errorf("overlay was not resized: %+v, %v", info, err)
+	}
+
+	overlay.Size = "1G" // never shrink it
+	if _, err := overlay.CheckApply(true); err == nil {
+		t.Errorf("shrinking should have failed")
+	}
+	overlay.Size = "2G"
+
+	overlay.Backing = path.Join(dir, "other.img") // never rebase it
+	if _, err := overlay.CheckApply(true); err == nil {
+		t.Errorf("changing the backing image should have failed")
+	}
+	overlay.Backing = base.Path
+
+	overlay.State = "absent"
+	virtVolumeConverge(t, overlay)
+	if _, err := os.Stat(overlay.Path); !os.IsNotExist(err) {
+		t.Errorf("overlay was not removed: %v", err)
+	}
+}
+
+func TestVirtVolumeMissingBacking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-virt-volume-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	res := &VirtVolumeRes{
+		Path:          path.Join(dir, "vm.qcow2"),
+		State:         "exists",
+		Format:        "qcow2",
+		Backing:       path.Join(dir, "missing.qcow2"),
+		BackingFormat: "qcow2",
+		imager:        virtImgStubs(t, dir),
+	}
+	if err := res.Init(fakeInit(t)); err != nil {
+		t.Fatalf("init failed with: %v", err)
+	}
+	if _, err := res.CheckApply(true); err == nil {
+		t.Errorf("checkapply should have failed without the backing image")
+	}
+}
+
+func TestVirtCloudInitSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-virt-cloudinit-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	imager := virtImgStubs(t, dir)
+	iso := path.Join(dir, virtCloudInitISO)
+
+	ci := &VirtCloudInit{
+		UserData:      "#cloud-config\npackages: [vim]\n",
+		NetworkConfig: "version: 2\n",
+	}
+	files := ci.files("vm1")
+
+	if checkOK, err := virtCloudInitSeed(imager, dir, files, false); err != nil || checkOK {
+		t.Fatalf("seed check returned: %t, %v", checkOK, err)
+	}
+	if _, err := os.Stat(iso); !os.IsNotExist(err) {
+		t.Fatalf("the iso was built without apply: %v", err)
+	}
+
+	if checkOK, err := virtCloudInitSeed(imager, dir, files, true); err != nil || checkOK {
+		t.Fatalf("seed apply returned: %t, %v", checkOK, err)
+	}
+	b, err := ioutil.ReadFile(iso)
+	if err != nil {
+		t.Fatalf("could not read the iso: %v", err)
+	}
+	for _, s := range []string{"cidata\n", "== user-data\n#cloud-config", "== meta-data\ninstance-id: vm1\nlocal-hostname: vm1\n", "== network-config\nversion: 2\n"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("the iso does not contain: %q", s)
+		}
+	}
+
+	if checkOK, err := virtCloudInitSeed(imager, dir, files, true); err != nil || !checkOK {
+		t.Errorf("seed did not converge: %t, %v", checkOK, err)
+	}
+
+	ci.NetworkConfig = "" // the old file must be removed
+	if checkOK, err := virtCloudInitSeed(imager, dir, ci.files("vm1"), true); err != nil || checkOK {
+		t.Fatalf("seed apply returned: %t, %v", checkOK, err)
+	}
+	if b, err := ioutil.ReadFile(iso); err != nil || strings.Contains(string(b), "network-config") {
+		t.Errorf("the iso was not rebuilt: %v", err)
+	}
+	if checkOK, err := virtCloudInitSeed(imager, dir, ci.files("vm1"), true); err != nil || !checkOK {
+		t.Errorf("seed did not converge: %t, %v", checkOK, err)
+	}
+
+	if err := os.Remove(iso); err != nil {
+		t.Fatalf("could not remove the iso: %v", err)
+	}
+	if checkOK, err := virtCloudInitSeed(imager, dir, ci.files("vm1"), true); err != nil || checkOK {
+		t.Errorf("seed apply returned: %t, %v", checkOK, err)
+	}
+	if _, err := os.Stat(iso); err != nil {
+		t.Errorf("the iso was not rebuilt: %v", err)
+	}
+
+	// a failed build must not leave the old iso with the new files
+	ci.UserData = "#cloud-config\npackages: [git]\n"
+	if _, err := virtCloudInitSeed(&virtFailingImager{imager}, dir, ci.files("vm1"), true); err == nil {
+		t.Fatalf("seed apply should have failed")
+	}
+	if checkOK, err := virtCloudInitSeed(imager, dir, ci.files("vm1"), false); err != nil || checkOK {
+		t.Errorf("the failed build is not retried: %t, %v", checkOK, err)
+	}
+}
+
+// virtFailingImager is a virtImager which fails to build the iso.
+type virtFailingImager struct {
+	*virtImgCmd
+}
+
+// MakeISO always fails.
+func (obj *virtFailingImager) MakeISO(path, label string, files []string) error {
+	return fmt.Errorf("no space left on device")
+}
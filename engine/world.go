@@ -18,31 +18,73 @@
 package engine
 
 import (
+	"context"
+
 	"github.com/purpleidea/mgmt/etcd/scheduler"
 )
 
 // World is an interface to the rest of the different graph state. It allows
 // the GAPI to store state and exchange information throughout the cluster. It
 // is the interface each machine uses to communicate with the rest of the world.
+//
+// Each of the watch methods returns a channel which spits out events until the
+// context is cancelled, at which point the watch gets removed.
 type World interface { // TODO: is there a better name for this interface?
-	ResWatch() chan error
+	ResWatch(ctx context.Context) chan error
 	ResExport([]Res) error
-	// FIXME: should this method take a "filter" data struct instead of many args?
-	ResCollect(hostnameFilter, kindFilter []string) ([]Res, error)
+	// ResCollect returns the collection of exported resources for each of
+	// the filters, which are all read at the same time.
+	ResCollect(filters []*ResFilter) ([][]Res, error)
 
-	StrWatch(namespace string) chan error
+	StrWatch(ctx context.Context, namespace string) chan error
 	StrIsNotExist(error) bool
 	StrGet(namespace string) (string, error)
 	StrSet(namespace, value string) error
+	// StrSetOpts sets the namespace value with some additional options. It
+	// returns false if the value wasn't set because the comparison failed.
+	StrSetOpts(namespace, value string, opts *StrOpts) (bool, error)
 	StrDel(namespace string) error
 
 	// XXX: add the exchange primitives in here directly?
-	StrMapWatch(namespace string) chan error
+	StrMapWatch(ctx context.Context, namespace string) chan error
 	StrMapGet(namespace string) (map[string]string, error)
 	StrMapSet(namespace, value string) error
+	StrMapSetOpts(namespace, value string, opts *StrOpts) (bool, error)
 	StrMapDel(namespace string) error
 
+	// HostsWatch returns a channel which spits out events on possible host
+	// label changes.
+	HostsWatch(ctx context.Context) chan error
+	// HostLabelsSet publishes the labels of this host. They replace any
+	// labels which were previously published by it.
+	HostLabelsSet(labels map[string]string) error
+	// HostLabels returns the published labels of each host.
+	HostLabels() (map[string]map[string]string, error)
+	// HostsSelect returns the sorted list of hosts whose labels match the
+	// label selector.
+	HostsSelect(selector string) ([]string, error)
+
+	// SecretWatch returns a channel which spits out events on possible
+	// changes to the named secret.
+	SecretWatch(ctx context.Context, name string) chan error
+	// SecretGet returns the decrypted value of the named secret. It errors
+	// if the secret doesn't exist, or if this host can't decrypt it.
+	SecretGet(name string) (string, error)
+
 	Scheduler(namespace string, opts ...scheduler.Option) (*scheduler.Result, error)
 
 	Fs(uri string) (Fs, error)
 }
+
+// StrOpts are the additional options which can be used when setting a string.
+type StrOpts struct {
+	// TTL is the number of seconds that the value outlives its host. It is
+	// attached to a lease which this host keeps alive, so the value gets
+	// removed automatically when the host dies. Zero keeps it forever.
+	TTL int64
+
+	// Prev is the value which must be stored for the set to happen, which
+	// makes it a compare-and-swap. An empty string requires the key to be
+	// absent, and nil skips the comparison.
+	Prev *string
+}
@@ -0,0 +1,214 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package etcd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
+)
+
+const (
+	// HostSeenInterval is the number of seconds between the times that each
+	// host publishes that it is still alive.
+	HostSeenInterval = 30 // seconds
+
+	// clusterStatusTimeout is how long to wait for the status of a member.
+	clusterStatusTimeout = 2 * time.Second
+
+	// CompactRetention is the number of the latest revisions that Compact
+	// keeps, so that a watcher which reconnects can usually resume without
+	// missing any events.
+	CompactRetention = 10000
+
+	// compactTimeout is how long to wait for a compaction of the history.
+	compactTimeout = 60 * time.Second
+)
+
+// ClusterHost is the state that a host of the cluster has published. The hosts
+// which aren't etcd servers are in here too.
+type ClusterHost struct {
+	Volunteer string // peer urls it volunteered to be a server with
+	Nominated string // peer urls it was nominated to be a server with
+	Endpoints string // client urls it advertises as a server
+	Converged string // true or false, or empty if it's unknown
+	Seen      int64  // unix timestamp of when it was last seen, or zero
+}
+
+// ClusterMember is an etcd server member of the cluster.
+type ClusterMember struct {
+	ID         uint64
+	Name       string // empty if it hasn't started yet
+	PeerURLs   []string
+	ClientURLs []string
+	Healthy    bool // true if its status could be read
+	Leader     bool
+}
+
+// SetHostnameSeen publishes that the host is alive at this time. It uses the
+// raw client, because going through our main loop would reset the converger.
+func SetHostnameSeen(obj *EmbdEtcd, hostname string) error {
+	// key structure is $NS/seen/$hostname = $timestamp
+	key := fmt.Sprintf("%s/seen/%s", NS, hostname)
+	ctx, cancel := context.WithTimeout(context.Background(), HostSeenInterval*time.Second)
+	defer cancel()
+	_, err := obj.GetClient().Put(ctx, key, strconv.FormatInt(time.Now().Unix(), 10))
+	return errwrap.Wrapf(err, "could not set seen time of: %s", hostname)
+}
+
+// GetClusterHosts returns the published state of each host of the cluster.
+func GetClusterHosts(obj Client) (map[string]*ClusterHost, error) {
+	hosts := make(map[string]*ClusterHost)
+	host := func(hostname string) *ClusterHost {
+		if _, exists := hosts[hostname]; !exists {
+			hosts[hostname] = &ClusterHost{}
+		}
+		return hosts[hostname]
+	}
+	fields := map[string]func(hostname, value string) error{
+		"volunteers": func(hostname, value string) error {
+			host(hostname).Volunteer = value
+			return nil
+		},
+		"nominated": func(hostname, value string) error {
+			host(hostname).Nominated = value
+			return nil
+		},
+		"endpoints": func(hostname, value string) error {
+			host(hostname).Endpoints = value
+			return nil
+		},
+		"converged": func(hostname, value string) error {
+			host(hostname).Converged = value
+			return nil
+		},
+		"seen": func(hostname, value string) error {
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errwrap.Wrapf(err, "invalid seen time of: %s", hostname)
+			}
+			host(hostname).Seen = t
+			return nil
+		},
+	}
+	for name, fn := range fields {
+		// key structure is $NS/$name/$hostname = $value
+		path := fmt.Sprintf("%s/%s/", NS, name)
+		keyMap, err := obj.Get(path, etcd.WithPrefix())
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "could not get %s", name)
+		}
+		for key, val := range keyMap {
+			if !strings.HasPrefix(key, path) || val == "" { // skip "erased" values
+				continue
+			}
+			if err := fn(key[len(path):], val); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// GetClusterMembers returns the etcd server members of the cluster, sorted by
+// name. The status of each one is read, which is how the leader is found.
+func GetClusterMembers(client *etcd.Client) ([]*ClusterMember, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterStatusTimeout)
+	response, err := client.MemberList(ctx)
+	cancel()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not list members")
+	}
+
+	members := []*ClusterMember{}
+	for _, x := range response.Members {
+		member := &ClusterMember{
+			ID:         x.ID,
+			Name:       x.Name,
+			PeerURLs:   x.PeerURLs,
+			ClientURLs: x.ClientURLs,
+		}
+		for _, s := range x.ClientURLs {
+			u, err := url.Parse(s)
+			if err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), clusterStatusTimeout)
+			status, err := client.Maintenance.Status(ctx, u.Host)
+			cancel()
+			if err != nil {
+				continue // try the next one
+			}
+			member.Healthy = true
+			member.Leader = status.Leader == x.ID
+			break
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
+
+// RemoveHost removes the published state of a host, so that it stops being
+// a volunteer, and so that it isn't selected by its labels. If it is a member,
+// the leader then removes it, in the same way as with any host that quits.
+func RemoveHost(obj Client, hostname string) error {
+	if hostname == "" || strings.Contains(hostname, "/") {
+		return fmt.Errorf("invalid hostname: `%s`", hostname)
+	}
+	ops := []etcd.Op{}
+	for _, name := range []string{"volunteers", "nominated", "endpoints", "converged", "seen"} {
+		// key structure is $NS/$name/$hostname = $value
+		ops = append(ops, etcd.OpDelete(fmt.Sprintf("%s/%s/%s", NS, name, hostname)))
+	}
+	// key structure is $NS/labels/$hostname/$key = $value
+	ops = append(ops, etcd.OpDelete(fmt.Sprintf("%s/labels/%s/", NS, hostname), etcd.WithPrefix()))
+
+	// it's important to do this in one transaction, and atomically, because
+	// this way, we only generate one watch event, and only when it's needed
+	_, err := obj.Txn(nil, ops, nil)
+	return errwrap.Wrapf(err, "could not remove host: %s", hostname)
+}
+
+// Compact compacts the etcd history up to CompactRetention revisions behind the
+// current one, so that the space of the removed and the overwritten keys can be
+// reused. It returns the revision that it compacted to, or zero if the history
+// is too short to compact.
+func Compact(client *etcd.Client) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), compactTimeout)
+	defer cancel()
+	resp, err := client.Get(ctx, NS, etcd.WithCountOnly())
+	if err != nil {
+		return 0, errwrap.Wrapf(err, "could not get the revision")
+	}
+	rev := resp.Header.Revision - CompactRetention
+	if rev <= 0 {
+		return 0, nil
+	}
+	if _, err := client.Compact(ctx, rev, etcd.WithCompactPhysical()); err != nil {
+		return 0, errwrap.Wrapf(err, "could not compact to revision %d", rev)
+	}
+	return rev, nil
+}
@@ -18,6 +18,7 @@
 package etcd
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -30,8 +31,32 @@ const (
 	deployPath  = "deploy"
 	payloadPath = "payload"
 	hashPath    = "hash"
+	infoPath    = "info"
 )
 
+// DeployInfo is the metadata which is stored along side each deploy.
+type DeployInfo struct {
+	Time     int64  `json:"time"`     // unix timestamp of the deploy
+	Author   string `json:"author"`   // who made the deploy
+	Frontend string `json:"frontend"` // name of the GAPI that was used
+	URI      string `json:"uri"`      // uri of the file system of the deploy
+
+	// Rollback is the id of the deploy that this one is a copy of, or zero
+	// if it's not a rollback.
+	Rollback uint64 `json:"rollback,omitempty"`
+
+	// Manifest lists the files of the deploy file system with their sums.
+	// It is part of what gets signed, so the files can be verified too.
+	Manifest string `json:"manifest,omitempty"`
+	// Signature is the detached pgp signature of the deploy, if it's
+	// signed.
+	Signature string `json:"signature,omitempty"`
+
+	// Hash is the hash that was stored with the deploy, if any. It is kept
+	// in its own key, since the deploy chain compares with it.
+	Hash string `json:"-"`
+}
+
 // WatchDeploy returns a channel which spits out events on new deploy activity.
 // FIXME: It should close the channel when it's done, and spit out errors when
 // something goes wrong.
@@ -119,18 +144,66 @@ func GetDeploy(obj Client, id uint64) (string, error) {
 	return result[max], nil
 }
 
+// GetDeployInfos gets the metadata of all the available deploys. The deploys
+// which were added without any metadata only have the hash set, if it exists.
+func GetDeployInfos(obj Client) (map[uint64]*DeployInfo, error) {
+	// key structure is $NS/deploy/$id/info = $data
+	// key structure is $NS/deploy/$id/hash = $hash
+	path := fmt.Sprintf("%s/%s/", NS, deployPath)
+	keyMap, err := obj.Get(path, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not get deploy")
+	}
+	result := make(map[uint64]*DeployInfo)
+	for key, val := range keyMap {
+		if !strings.HasPrefix(key, path) { // sanity check
+			continue
+		}
+
+		str := strings.Split(key[len(path):], "/")
+		if len(str) != 2 {
+			return nil, fmt.Errorf("unexpected chunk count of %d", len(str))
+		}
+		x := str[0]
+		id, err := strconv.ParseUint(x, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id of `%s`", x)
+		}
+		info, exists := result[id]
+		if !exists {
+			info = &DeployInfo{}
+			result[id] = info
+		}
+
+		switch str[1] {
+		case hashPath:
+			info.Hash = val
+		case infoPath:
+			hash := info.Hash // don't lose it if it came first
+			if err := json.Unmarshal([]byte(val), info); err != nil {
+				return nil, errwrap.Wrapf(err, "invalid info for id `%d`", id)
+			}
+			info.Hash = hash
+		}
+	}
+	return result, nil
+}
+
 // AddDeploy adds a new deploy. It takes an id and ensures it's sequential. If
 // hash is not empty, then it will check that the pHash matches what the
 // previous hash was, and also adds this new hash along side the id. This is
 // useful to make sure you get a linear chain of git patches, and to avoid two
 // contributors pushing conflicting deploys. This isn't git specific, and so any
-// arbitrary string hash can be used.
+// arbitrary string hash can be used. The info is optional metadata which is
+// stored with the deploy.
 // FIXME: prune old deploys from the store when they aren't needed anymore...
-func AddDeploy(obj Client, id uint64, hash, pHash string, data *string) error {
+func AddDeploy(obj Client, id uint64, hash, pHash string, data *string, info *DeployInfo) error {
 	// key structure is $NS/deploy/$id/payload = $data
 	// key structure is $NS/deploy/$id/hash = $hash
+	// key structure is $NS/deploy/$id/info = $info
 	path := fmt.Sprintf("%s/%s/%d/%s", NS, deployPath, id, payloadPath)
 	tPath := fmt.Sprintf("%s/%s/%d/%s", NS, deployPath, id, hashPath)
+	iPath := fmt.Sprintf("%s/%s/%d/%s", NS, deployPath, id, infoPath)
 	ifs := []etcd.Cmp{} // list matching the desired state
 	ops := []etcd.Op{}  // list of ops in this transaction (then)
 
@@ -157,6 +230,13 @@ func AddDeploy(obj Client, id uint64, hash, pHash string, data *string) error {
 	if hash != "" {
 		ops = append(ops, etcd.OpPut(tPath, hash)) // store new hash as well
 	}
+	if info != nil {
+		b, err := json.Marshal(info)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not encode the deploy info")
+		}
+		ops = append(ops, etcd.OpPut(iPath, string(b)))
+	}
 
 	// it's important to do this in one transaction, and atomically, because
 	// this way, we only generate one watch event, and only when it's needed
@@ -169,3 +249,28 @@ func AddDeploy(obj Client, id uint64, hash, pHash string, data *string) error {
 	}
 	return nil // success
 }
+
+// RemoveDeploy removes a deploy, and the superblock of its file system if one
+// is passed in. A deploy can only be removed if the one after it exists, so the
+// latest one is never removed, and old ones must be removed in order.
+func RemoveDeploy(obj Client, id uint64, metadata string) error {
+	// key structure is $NS/deploy/$id/$name = $value
+	path := fmt.Sprintf("%s/%s/%d/", NS, deployPath, id)
+	next := fmt.Sprintf("%s/%s/%d/%s", NS, deployPath, id+1, payloadPath)
+	ifs := []etcd.Cmp{etcd.Compare(etcd.Version(next), ">", 0)} // KeyExists
+	ops := []etcd.Op{etcd.OpDelete(path, etcd.WithPrefix())}
+	if metadata != "" {
+		ops = append(ops, etcd.OpDelete(metadata))
+	}
+
+	// it's important to do this in one transaction, and atomically, because
+	// this way, we only generate one watch event, and only when it's needed
+	result, err := obj.Txn(ifs, ops, nil)
+	if err != nil {
+		return errwrap.Wrapf(err, "error removing deploy id %d", id)
+	}
+	if !result.Succeeded {
+		return fmt.Errorf("deploy id %d has no next deploy", id)
+	}
+	return nil
+}
@@ -178,6 +178,10 @@ type EmbdEtcd struct { // EMBeddeD etcd
 	cError error // permanent client error
 	ctxErr error // permanent ctx error
 
+	// leases of this host, see Lease
+	leaseLock sync.Mutex
+	leases    map[int64]etcd.LeaseID // ttl to lease id
+
 	// exit and cleanup related
 	cancelLock sync.Mutex // lock for the cancels list
 	cancels    []func()   // array of every cancel function for watches
@@ -476,6 +480,9 @@ func (obj *EmbdEtcd) Startup() error {
 // only want to shutdown the embedded server portion.
 func (obj *EmbdEtcd) Destroy() error {
 
+	// remove the keys which are attached to our leases while we still can
+	obj.revokeLeases()
+
 	// this should also trigger an unnominate, which should cause a shutdown
 	log.Printf("Etcd: Destroy: Unvolunteering...")
 	if err := Volunteer(obj, nil); err != nil { // unvolunteer so we can shutdown...
@@ -1145,15 +1152,18 @@ func (obj *EmbdEtcd) rawAddWatcher(ctx context.Context, aw *AW) (func(), error)
 		for {
 			response := <-rch // read
 			err := response.Err()
+			// if our revision was compacted away, we resume from the
+			// oldest one left, since that's better than erroring out
+			compacted := response.CompactRevision != 0
 			isCanceled := response.Canceled || err == context.Canceled
-			if response.Header.Revision == 0 { // by inspection
+			if response.Header.Revision == 0 && !compacted { // by inspection
 				if obj.flags.Debug {
 					log.Printf("Etcd: Watch: Received empty message!") // switched client connection
 				}
 				isCanceled = true
 			}
 
-			if isCanceled {
+			if isCanceled && !compacted {
 				if obj.exiting { // if not, it could be reconnect
 					return
 				}
@@ -1176,7 +1186,11 @@ func (obj *EmbdEtcd) rawAddWatcher(ctx context.Context, aw *AW) (func(), error)
 				// the existing canceled context! it has state!
 				ctx = context.Background() // this is critical!
 
-				if ctx, err = obj.CtxError(ctx, err); err != nil {
+				if compacted { // a reconnect wouldn't fix this
+					log.Printf("Etcd: Watch: Revision %d was compacted, resuming from: %d", rev, response.CompactRevision)
+					rev = response.CompactRevision
+					useRev = true
+				} else if ctx, err = obj.CtxError(ctx, err); err != nil {
 					return // TODO: it's bad, break or return?
 				}
 
@@ -46,7 +46,7 @@ type File struct {
 	Path    string // relative path to file, trailing slash if it's a directory
 	Mode    os.FileMode
 	ModTime time.Time
-	//Size int64 // XXX: cache the size to avoid full file downloads for stat!
+	Size    int64 // size of the data as of the last sync, used for MaxSize
 
 	Children []*File // dir's use this
 	Hash     string  // string not []byte so it's readable, matches data
@@ -260,6 +260,9 @@ func (obj *File) Sync() error {
 		return ErrFileClosed
 	}
 
+	obj.fs.size += int64(len(obj.data)) - obj.Size
+	obj.Size = int64(len(obj.data))
+
 	p := obj.path() // store file data at this path in etcd
 
 	// TODO: use https://github.com/coreos/etcd/pull/7417 if merged
@@ -268,9 +271,13 @@ func (obj *File) Sync() error {
 
 	op := etcd.OpPut(p, string(obj.data)) // this pushes contents to server
 
+	// if the data is already there, then bump its revision without sending
+	// it again, so that a running GC knows that it's still used
+	touch := etcd.OpPut(p, "", etcd.WithIgnoreValue())
+
 	// it's important to do this in one transaction, and atomically, because
 	// this way, we only generate one watch event, and only when it's needed
-	result, err := obj.fs.txn([]etcd.Cmp{cmp}, []etcd.Op{op}, nil)
+	result, err := obj.fs.txn([]etcd.Cmp{cmp}, []etcd.Op{op}, []etcd.Op{touch})
 	if err != nil {
 		return errwrap.Wrapf(err, "sync error with: %s (%s)", obj.Path, p)
 	}
@@ -286,6 +293,20 @@ func (obj *File) Sync() error {
 	return nil
 }
 
+// checkSize returns an error if the file system would be over its MaxSize with
+// the file at this size. This is checked before the data gets changed, so that
+// the tree never points to data which didn't get pushed up to the server.
+func (obj *File) checkSize(size int64) error {
+	max := obj.fs.MaxSize
+	if max <= 0 {
+		return nil
+	}
+	if total := obj.fs.size - obj.Size + size; total > max {
+		return errwrap.Wrapf(ErrMaxSize, "%s would make it %d bytes", obj.Path, total)
+	}
+	return nil
+}
+
 // Truncate trims the file to the requested size. Since our file system can only
 // read and write data, but never edit existing data blocks, doing this will not
 // cause more space to be available.
@@ -299,6 +320,9 @@ func (obj *File) Truncate(size int64) error {
 	if size < 0 {
 		return ErrOutOfRange
 	}
+	if err := obj.checkSize(size); err != nil {
+		return err
+	}
 
 	if size > 0 { // if size == 0, we don't need to run cache!
 		// download file contents into obj.data
@@ -462,6 +486,12 @@ func (obj *File) Write(b []byte) (n int, err error) {
 	cur := obj.cursor
 	diff := cur - int64(len(obj.data))
 
+	if size := cur + int64(n); size > int64(len(obj.data)) {
+		if err := obj.checkSize(size); err != nil {
+			return 0, err
+		}
+	}
+
 	var tail []byte
 	if n+int(cur) < len(obj.data) {
 		tail = obj.data[n+int(cur):]
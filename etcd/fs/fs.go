@@ -50,6 +50,9 @@ const (
 	EtcdTimeout = 5 * time.Second // FIXME: chosen arbitrarily
 	// DefaultDataPrefix is the default path for data storage in etcd.
 	DefaultDataPrefix = "/_etcdfs/data"
+	// GCGrace is the grace period that GC should wait for, which is longer
+	// than a sync of a file and its superblock can take.
+	GCGrace = 3 * EtcdTimeout
 	// DefaultHash is the default hashing algorithm to use.
 	DefaultHash = "sha256"
 	// PathSeparator is the path separator to use on this filesystem.
@@ -69,6 +72,10 @@ var (
 	// ErrNotExist is returned when we can't find the requested path.
 	ErrNotExist = os.ErrNotExist
 
+	// ErrMaxSize is returned when a write would grow the file system past
+	// its MaxSize.
+	ErrMaxSize = errors.New("file system is over its maximum size")
+
 	ErrFileClosed   = errors.New("File is closed")
 	ErrFileReadOnly = errors.New("File handle is read only")
 	ErrOutOfRange   = errors.New("Out of range")
@@ -86,9 +93,8 @@ var (
 // but as many readers as you like.
 // FIXME: this is not currently thread-safe, nor is it clear if it needs to be.
 // XXX: we probably aren't updating the modification time everywhere we should!
-// XXX: because we never delete data blocks, we need to occasionally "vacuum".
-// XXX: this is harder because we need to list of *all* metadata paths, if we
-// want them to be able to share storage backends. (we do)
+// Since we never delete data blocks, they need to be garbage collected with GC,
+// which must be given the list of *all* the metadata paths which share storage.
 type Fs struct {
 	Client *etcd.Client
 
@@ -97,10 +103,15 @@ type Fs struct {
 	DataPrefix string // prefix of data storage (no trailing slashes)
 	Hash       string // eg: sha256
 
+	// MaxSize is the maximum total size in bytes of the file data which
+	// this file system can hold. Zero means that there's no limit.
+	MaxSize int64
+
 	Debug bool
 
 	sb      *superBlock
 	mounted bool
+	size    int64 // running total of the file data size, for MaxSize
 }
 
 // superBlock is the metadata structure of everything stored outside of the data
@@ -278,6 +289,7 @@ func (obj *Fs) mount() error {
 
 	// hook up file system pointers to each element in the tree structure
 	obj.traverse(obj.sb.Tree)
+	obj.size = treeSize(obj.sb.Tree)
 
 	obj.mounted = true
 	return nil
@@ -294,6 +306,24 @@ func (obj *Fs) traverse(node *File) {
 	}
 }
 
+// treeSize returns the total size of the file data in the tree, as of the last
+// sync of each file.
+func treeSize(tree *File) int64 {
+	var size int64
+	var walk func(*File)
+	walk = func(node *File) {
+		if node == nil {
+			return
+		}
+		size += node.Size
+		for _, n := range node.Children {
+			walk(n)
+		}
+	}
+	walk(tree)
+	return size
+}
+
 // find returns the file node corresponding to this absolute path if it exists.
 func (obj *Fs) find(absPath string) (*File, error) { // TODO: function naming?
 	if absPath == "" {
@@ -559,6 +589,7 @@ func (obj *Fs) Remove(name string) error {
 	}
 	// remove from list
 	node.Children = append(node.Children[:index], node.Children[index+1:]...)
+	obj.size -= f.Size
 	return obj.sync()
 }
 
@@ -712,6 +743,8 @@ func (obj *Fs) Rename(oldname, newname string) error {
 		// we're a file clobbering another file...
 		// move file content from src -> dst and then delete src
 		// TODO: run a dst.Close() for extra safety first?
+		obj.size -= dst.Size // the clobbered data is gone
+
 		save := dst.Path // save the "name"
 		*dst = *src      // TODO: is this safe?
 		dst.Path = save  // "rename" it
@@ -25,12 +25,14 @@ import (
 	"os/exec"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/purpleidea/mgmt/etcd"
 	etcdfs "github.com/purpleidea/mgmt/etcd/fs"
 	"github.com/purpleidea/mgmt/integration"
 	"github.com/purpleidea/mgmt/util"
 
+	etcdv3 "github.com/coreos/etcd/clientv3"
 	errwrap "github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
@@ -303,3 +305,136 @@ func TestFs3(t *testing.T) {
 		return
 	}
 }
+
+func TestFsMaxSize(t *testing.T) {
+	stopEtcd, err := runEtcd()
+	if err != nil {
+		t.Errorf("setup error: %+v", err)
+	}
+	defer stopEtcd() // ignore the error
+
+	etcdClient := &etcd.ClientEtcd{
+		Seeds: []string{"localhost:2379"}, // endpoints
+	}
+
+	if err := etcdClient.Connect(); err != nil {
+		t.Errorf("client connection error: %+v", err)
+		return
+	}
+	defer etcdClient.Destroy()
+
+	etcdFs := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   "/some/maxsize/superblock",
+		DataPrefix: etcdfs.DefaultDataPrefix,
+		MaxSize:    16,
+	}
+
+	if err := etcdFs.WriteFile("/foo", []byte("hello world!\n"), umask); err != nil {
+		t.Errorf("writefile error: %+v", err)
+		return
+	}
+	if err := etcdFs.WriteFile("/bar", []byte("hello bar!\n"), umask); errwrap.Cause(err) != etcdfs.ErrMaxSize {
+		t.Errorf("writefile should have been over the max size: %+v", err)
+		return
+	}
+	// replacing a file only counts the new size
+	if err := etcdFs.WriteFile("/foo", []byte("hello foo!\n"), umask); err != nil {
+		t.Errorf("writefile2 error: %+v", err)
+	}
+}
+
+func TestFsGC(t *testing.T) {
+	stopEtcd, err := runEtcd()
+	if err != nil {
+		t.Errorf("setup error: %+v", err)
+	}
+	defer stopEtcd() // ignore the error
+
+	etcdClient := &etcd.ClientEtcd{
+		Seeds: []string{"localhost:2379"}, // endpoints
+	}
+
+	if err := etcdClient.Connect(); err != nil {
+		t.Errorf("client connection error: %+v", err)
+		return
+	}
+	defer etcdClient.Destroy()
+
+	dataPrefix := "/some/gc/data"
+	metadataPrefix := "/some/gc/metadata/"
+	fs1 := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   metadataPrefix + "1",
+		DataPrefix: dataPrefix,
+	}
+	fs2 := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   metadataPrefix + "2",
+		DataPrefix: dataPrefix,
+	}
+	if err := fs1.WriteFile("/shared", []byte("hello world!\n"), umask); err != nil {
+		t.Errorf("writefile error: %+v", err)
+		return
+	}
+	if err := fs1.WriteFile("/old", []byte("hello old!\n"), umask); err != nil {
+		t.Errorf("writefile2 error: %+v", err)
+		return
+	}
+	if err := fs2.WriteFile("/shared", []byte("hello world!\n"), umask); err != nil {
+		t.Errorf("writefile3 error: %+v", err)
+		return
+	}
+	if _, err := etcdClient.Txn(nil, []etcdv3.Op{etcdv3.OpDelete(fs1.Metadata)}, nil); err != nil {
+		t.Errorf("could not remove the superblock: %+v", err)
+		return
+	}
+
+	// while the gc waits, a writer which isn't synced yet reuses a block
+	type result struct {
+		count int
+		err   error
+	}
+	ch := make(chan result)
+	go func() {
+		count, err := etcdfs.GC(etcdClient.GetClient(), dataPrefix, metadataPrefix, 2*time.Second)
+		ch <- result{count, err}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	fs3 := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   "/some/gc/unsynced/3", // not under the prefix yet
+		DataPrefix: dataPrefix,
+	}
+	if err := fs3.WriteFile("/old", []byte("hello old!\n"), umask); err != nil {
+		t.Errorf("writefile4 error: %+v", err)
+		return
+	}
+
+	// fs3 bumped all the unused blocks during the grace period
+	r := <-ch
+	if r.err != nil {
+		t.Errorf("gc error: %+v", r.err)
+		return
+	}
+	if r.count != 0 {
+		t.Errorf("gc removed %d blocks", r.count)
+	}
+	if b, err := fs3.ReadFile("/old"); err != nil || string(b) != "hello old!\n" {
+		t.Errorf("reused data is wrong: %q, %+v", string(b), err)
+	}
+
+	// once nothing is writing, the unused blocks are removed
+	count, err := etcdfs.GC(etcdClient.GetClient(), dataPrefix, metadataPrefix, 0)
+	if err != nil {
+		t.Errorf("gc error: %+v", err)
+		return
+	}
+	if count != 2 { // the empty block and the one only fs3 uses
+		t.Errorf("second gc removed %d blocks", count)
+	}
+	b, err := fs2.ReadFile("/shared")
+	if err != nil || string(b) != "hello world!\n" {
+		t.Errorf("shared data is wrong: %q, %+v", string(b), err)
+	}
+}
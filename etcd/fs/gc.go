@@ -0,0 +1,151 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fs
+
+import (
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3" // "clientv3"
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
+)
+
+// Refs returns the set of data keys which the files in this file system point
+// to.
+func (obj *Fs) Refs() (map[string]bool, error) {
+	if err := obj.mount(); err != nil {
+		return nil, err
+	}
+	refs := make(map[string]bool)
+	var walk func(*File)
+	walk = func(node *File) {
+		if node == nil {
+			return
+		}
+		if !node.Mode.IsDir() {
+			refs[node.path()] = true
+		}
+		for _, n := range node.Children {
+			walk(n)
+		}
+	}
+	walk(obj.sb.Tree)
+	return refs, nil
+}
+
+// superblocks returns the paths of all the superblocks which are stored under
+// the prefix.
+func superblocks(client *etcd.Client, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), EtcdTimeout)
+	resp, err := client.Get(ctx, prefix, etcd.WithPrefix(), etcd.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not list the superblocks")
+	}
+	paths := []string{}
+	for _, kv := range resp.Kvs {
+		paths = append(paths, string(kv.Key))
+	}
+	return paths, nil
+}
+
+// GC removes the data blocks in the data prefix which aren't pointed to by any
+// of the superblocks under the metadata prefix. Since superblocks can share
+// their data prefix, every superblock which uses it must be under that prefix.
+// It returns the number of removed blocks.
+//
+// A writer stores a block, or bumps its revision if it already exists, before
+// it syncs the superblock which points to it. To avoid removing a block which
+// is used by a superblock that isn't synced yet, GC first records the current
+// revision, and waits for the grace period before it reads the superblocks.
+// Only the blocks which weren't stored or bumped since that revision are ever
+// removed, so the grace period must be longer than it takes a writer to sync.
+func GC(client *etcd.Client, dataPrefix, metadataPrefix string, grace time.Duration) (int, error) {
+	for strings.HasSuffix(dataPrefix, "/") {
+		dataPrefix = strings.TrimSuffix(dataPrefix, "/")
+	}
+	if dataPrefix == "" {
+		dataPrefix = DefaultDataPrefix
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), EtcdTimeout)
+	resp, err := client.Get(ctx, dataPrefix+"/", etcd.WithPrefix(), etcd.WithCountOnly())
+	cancel()
+	if err != nil {
+		return 0, errwrap.Wrapf(err, "could not get the revision")
+	}
+	fence := resp.Header.Revision + 1 // blocks at or after this are kept
+	time.Sleep(grace)
+
+	metadata, err := superblocks(client, metadataPrefix)
+	if err != nil {
+		return 0, err
+	}
+	refs := make(map[string]bool)
+	for _, m := range metadata {
+		fs := &Fs{
+			Client:     client,
+			Metadata:   m,
+			DataPrefix: dataPrefix,
+		}
+		// don't let the mount create a superblock which isn't there
+		if result, err := fs.get(m); err != nil {
+			return 0, errwrap.Wrapf(err, "could not get the superblock at: %s", m)
+		} else if len(result) == 0 {
+			continue
+		}
+		r, err := fs.Refs()
+		if err != nil {
+			return 0, errwrap.Wrapf(err, "could not read the superblock at: %s", m)
+		}
+		for k := range r {
+			refs[k] = true
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), EtcdTimeout)
+	resp, err = client.Get(ctx, dataPrefix+"/", etcd.WithPrefix(), etcd.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return 0, errwrap.Wrapf(err, "could not list the data")
+	}
+
+	count := 0
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if refs[key] || kv.ModRevision >= fence {
+			continue
+		}
+		// only remove it if it still wasn't stored or bumped since then
+		cmps := []etcd.Cmp{
+			etcd.Compare(etcd.Version(key), ">", 0), // KeyExists
+			etcd.Compare(etcd.ModRevision(key), "<", fence),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), EtcdTimeout)
+		result, err := client.Txn(ctx).If(cmps...).Then(etcd.OpDelete(key)).Commit()
+		cancel()
+		if err != nil {
+			return count, errwrap.Wrapf(err, "could not remove: %s", key)
+		}
+		if result.Succeeded {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,144 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package etcd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/util"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	errwrap "github.com/pkg/errors"
+)
+
+// LabelsTTL is the number of seconds that the labels of a host stay after it
+// stops running, since they are attached to a lease of that host. This way, a
+// dead host can't get selected by its labels.
+const LabelsTTL = 10 // seconds
+
+// WatchLabels returns a channel that outputs events when host labels change.
+func WatchLabels(obj *EmbdEtcd) chan error {
+	// key structure is $NS/labels/$hostname/$key = $value
+	path := fmt.Sprintf("%s/labels/", NS)
+	ch := make(chan error, 1)
+	// FIXME: fix our API so that we get a close event on shutdown.
+	callback := func(re *RE) error {
+		if re == nil || re.response.Canceled {
+			return fmt.Errorf("watch is empty") // will cause a CtxError+retry
+		}
+		if len(ch) == 0 { // send event only if one isn't pending
+			ch <- nil // event
+		}
+		return nil
+	}
+	_, _ = obj.AddWatcher(path, callback, true, false, etcd.WithPrefix()) // no need to check errors
+	return ch
+}
+
+// SetLabels publishes the labels of a host in etcd. It replaces any labels that
+// it previously set. They are attached to the lease of this host, so they get
+// removed when it goes away. It can be called again to publish them with a new
+// lease if the old one expired, and it does nothing if they're already set.
+func SetLabels(obj *EmbdEtcd, hostname string, labels map[string]string) error {
+	// key structure is $NS/labels/$hostname/$key = $value
+	if err := engine.ValidateLabels(labels); err != nil {
+		return err
+	}
+	leaseID, err := obj.Lease(LabelsTTL)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get the lease of: %s", hostname)
+	}
+	// this is not a race because we should only be reading keys which we
+	// set, and there should not be any contention with other hosts here!
+	hostLabels, err := GetLabels(obj, []string{hostname})
+	if err != nil {
+		return err
+	}
+	originals := hostLabels[hostname]
+
+	ifs := []etcd.Cmp{} // list matching the desired state
+	ops := []etcd.Op{}  // list of ops in this transaction
+	for k, v := range labels {
+		path := fmt.Sprintf("%s/labels/%s/%s", NS, hostname, k)
+		ifs = append(ifs, etcd.Compare(etcd.Value(path), "=", v)) // desired state
+		ifs = append(ifs, etcd.Compare(etcd.LeaseValue(path), "=", leaseID))
+		ops = append(ops, etcd.OpPut(path, v, etcd.WithLease(leaseID)))
+	}
+
+	hasDeletes := false
+	for k := range originals { // delete the old, now unused labels
+		if _, exists := labels[k]; exists {
+			continue
+		}
+		path := fmt.Sprintf("%s/labels/%s/%s", NS, hostname, k)
+		ops = append(ops, etcd.OpDelete(path))
+		hasDeletes = true
+	}
+
+	// if everything is already correct, do nothing, otherwise, run the ops!
+	// it's important to do this in one transaction, and atomically, because
+	// this way, we only generate one watch event, and only when it's needed
+	if hasDeletes { // always run, ifs don't matter
+		_, err = obj.Txn(nil, ops, nil)
+	} else if len(ops) > 0 {
+		_, err = obj.Txn(ifs, nil, ops)
+	}
+	return errwrap.Wrapf(err, "could not set labels of: %s", hostname)
+}
+
+// GetLabels returns the labels of each host, keyed by hostname. If the filter is
+// not empty, then only the labels of those hosts are returned.
+func GetLabels(obj *EmbdEtcd, hostnameFilter []string) (map[string]map[string]string, error) {
+	// key structure is $NS/labels/$hostname/$key = $value
+	path := fmt.Sprintf("%s/labels/", NS)
+	prefix := path
+	if len(hostnameFilter) == 1 {
+		prefix = fmt.Sprintf("%s%s/", path, hostnameFilter[0])
+	}
+	keyMap, err := obj.Get(prefix, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not get labels")
+	}
+	return labelsFromKeys(path, keyMap, hostnameFilter), nil
+}
+
+// labelsFromKeys returns the labels of each host from the keys under the path,
+// keeping only those of the hosts in the filter if it is not empty.
+func labelsFromKeys(path string, keyMap map[string]string, hostnameFilter []string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for key, val := range keyMap {
+		if !strings.HasPrefix(key, path) { // sanity check
+			continue
+		}
+		str := strings.Split(key[len(path):], "/")
+		if len(str) != 2 {
+			continue
+		}
+		hostname, k := str[0], str[1]
+		if len(hostnameFilter) > 0 && !util.StrInList(hostname, hostnameFilter) {
+			continue
+		}
+		if _, exists := result[hostname]; !exists {
+			result[hostname] = make(map[string]string)
+		}
+		result[hostname][k] = val
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package etcd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
+)
+
+const (
+	// leaseTimeout is the number of seconds to wait for a lease to be
+	// granted, or revoked on a clean shutdown.
+	leaseTimeout = 5
+)
+
+// Lease returns the lease of this host for the given TTL in seconds. It is
+// kept alive for as long as we run, so the keys which are attached to it get
+// removed automatically once this host goes away. There is one lease for each
+// distinct TTL, which gets granted on first use.
+func (obj *EmbdEtcd) Lease(ttl int64) (etcd.LeaseID, error) {
+	obj.leaseLock.Lock()
+	defer obj.leaseLock.Unlock()
+	if obj.leases == nil {
+		obj.leases = make(map[int64]etcd.LeaseID)
+	}
+	if leaseID, exists := obj.leases[ttl]; exists {
+		return leaseID, nil
+	}
+
+	obj.rLock.RLock()
+	defer obj.rLock.RUnlock()
+	if obj.client == nil {
+		return etcd.NoLease, fmt.Errorf("client is not connected")
+	}
+	ctx, cancel := obj.TimeoutCtx(context.Background(), leaseTimeout*time.Second)
+	resp, err := obj.client.Grant(ctx, ttl)
+	cancel()
+	if err != nil {
+		return etcd.NoLease, errwrap.Wrapf(err, "could not grant a lease")
+	}
+
+	ctx, cancel = obj.CancelCtx(context.Background()) // cancelled on Destroy
+	ch, err := obj.client.KeepAlive(ctx, resp.ID)
+	if err != nil {
+		cancel()
+		return etcd.NoLease, errwrap.Wrapf(err, "could not keep the lease alive")
+	}
+	obj.leases[ttl] = resp.ID
+
+	go func() {
+		defer cancel() // release the context when the keep alive ends
+		for range ch { // drain the keep alive responses
+		}
+		// the lease expired, or we're shutting down, so forget it, and a
+		// new one gets granted the next time that it's needed
+		obj.leaseLock.Lock()
+		if obj.leases[ttl] == resp.ID {
+			delete(obj.leases, ttl)
+		}
+		obj.leaseLock.Unlock()
+		if obj.flags.Debug {
+			log.Printf("Etcd: Lease: Lease %x with TTL %d ended", resp.ID, ttl)
+		}
+	}()
+	return resp.ID, nil
+}
+
+// revokeLeases revokes all of our leases, so that the keys which are attached
+// to them get removed right away on a clean shutdown, instead of after the TTL.
+func (obj *EmbdEtcd) revokeLeases() {
+	obj.leaseLock.Lock()
+	defer obj.leaseLock.Unlock()
+	if len(obj.leases) == 0 {
+		return
+	}
+	obj.rLock.RLock()
+	defer obj.rLock.RUnlock()
+	if obj.client == nil {
+		return
+	}
+	for ttl, leaseID := range obj.leases {
+		ctx, cancel := context.WithTimeout(context.Background(), leaseTimeout*time.Second)
+		if _, err := obj.client.Revoke(ctx, leaseID); err != nil {
+			log.Printf("Etcd: Lease: Could not revoke lease %x: %v", leaseID, err)
+		}
+		cancel()
+		delete(obj.leases, ttl)
+	}
+}
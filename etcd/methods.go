@@ -253,21 +253,17 @@ func AddHostnameConvergedWatcher(obj *EmbdEtcd, callbackFn func(map[string]bool)
 }
 
 // SetClusterSize sets the ideal target cluster size of etcd peers.
-func SetClusterSize(obj *EmbdEtcd, value uint16) error {
-	if obj.flags.Trace {
-		log.Printf("Trace: Etcd: SetClusterSize(): %v", value)
-		defer log.Printf("Trace: Etcd: SetClusterSize(): Finished!")
-	}
+func SetClusterSize(obj Client, value uint16) error {
 	key := fmt.Sprintf("%s/idealClusterSize", NS)
-
-	if err := obj.Set(key, strconv.FormatUint(uint64(value), 10)); err != nil {
+	ops := []etcd.Op{etcd.OpPut(key, strconv.FormatUint(uint64(value), 10))}
+	if _, err := obj.Txn(nil, ops, nil); err != nil {
 		return fmt.Errorf("function SetClusterSize failed: %v", err) // exit in progress?
 	}
 	return nil
 }
 
 // GetClusterSize gets the ideal target cluster size of etcd peers.
-func GetClusterSize(obj *EmbdEtcd) (uint16, error) {
+func GetClusterSize(obj Client) (uint16, error) {
 	key := fmt.Sprintf("%s/idealClusterSize", NS)
 	keyMap, err := obj.Get(key)
 	if err != nil {
@@ -27,36 +27,41 @@ import (
 	"github.com/purpleidea/mgmt/util"
 
 	etcd "github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	errwrap "github.com/pkg/errors"
 )
 
 // WatchResources returns a channel that outputs events when exported resources
-// change.
+// change. The labels of the hosts are watched too, since the label selectors of
+// the collections depend on them.
 // TODO: Filter our watch (on the server side if possible) based on the
 // collection prefixes and filters that we care about...
 func WatchResources(obj *EmbdEtcd) chan error {
 	ch := make(chan error, 1) // buffer it so we can measure it
-	path := fmt.Sprintf("%s/exported/", NS)
-	callback := func(re *RE) error {
-		// TODO: is this even needed? it used to happen on conn errors
-		log.Printf("Etcd: Watch: Path: %v", path) // event
-		if re == nil || re.response.Canceled {
-			return fmt.Errorf("watch is empty") // will cause a CtxError+retry
-		}
-		// we normally need to check if anything changed since the last
-		// event, since a set (export) with no changes still causes the
-		// watcher to trigger and this would cause an infinite loop. we
-		// don't need to do this check anymore because we do the export
-		// transactionally, and only if a change is needed. since it is
-		// atomic, all the changes arrive together which avoids dupes!!
-		if len(ch) == 0 { // send event only if one isn't pending
-			// this check avoids multiple events all queueing up and then
-			// being released continuously long after the changes stopped
-			// do not block!
-			ch <- nil // event
+	for _, path := range []string{fmt.Sprintf("%s/exported/", NS), fmt.Sprintf("%s/labels/", NS)} {
+		path := path
+		callback := func(re *RE) error {
+			// TODO: is this even needed? it used to happen on conn errors
+			log.Printf("Etcd: Watch: Path: %v", path) // event
+			if re == nil || re.response.Canceled {
+				return fmt.Errorf("watch is empty") // will cause a CtxError+retry
+			}
+			// we normally need to check if anything changed since the last
+			// event, since a set (export) with no changes still causes the
+			// watcher to trigger and this would cause an infinite loop. we
+			// don't need to do this check anymore because we do the export
+			// transactionally, and only if a change is needed. since it is
+			// atomic, all the changes arrive together which avoids dupes!!
+			if len(ch) == 0 { // send event only if one isn't pending
+				// this check avoids multiple events all queueing up and then
+				// being released continuously long after the changes stopped
+				// do not block!
+				ch <- nil // event
+			}
+			return nil
 		}
-		return nil
+		_, _ = obj.AddWatcher(path, callback, true, false, etcd.WithPrefix()) // no need to check errors
 	}
-	_, _ = obj.AddWatcher(path, callback, true, false, etcd.WithPrefix()) // no need to check errors
 	return ch
 }
 
@@ -64,14 +69,16 @@ func WatchResources(obj *EmbdEtcd) chan error {
 func SetResources(obj *EmbdEtcd, hostname string, resourceList []engine.Res) error {
 	// key structure is $NS/exported/$hostname/resources/$uid = $data
 
-	var kindFilter []string // empty to get from everyone
-	hostnameFilter := []string{hostname}
+	filter := &engine.ResFilter{ // all of our own resources
+		Hostnames: []string{hostname},
+	}
 	// this is not a race because we should only be reading keys which we
 	// set, and there should not be any contention with other hosts here!
-	originals, err := GetResources(obj, hostnameFilter, kindFilter)
+	collections, err := GetResources(obj, []*engine.ResFilter{filter})
 	if err != nil {
 		return err
 	}
+	originals := collections[0]
 
 	if len(originals) == 0 && len(resourceList) == 0 { // special case of no add or del
 		return nil
@@ -131,19 +138,48 @@ func SetResources(obj *EmbdEtcd, hostname string, resourceList []engine.Res) err
 	return err
 }
 
-// GetResources collects all of the resources which match a filter from etcd.
-// If the kindfilter or hostnameFilter is empty, then it assumes no filtering...
-// TODO: Expand this with a more powerful filter based on what we eventually
-// support in our collect DSL. Ideally a server side filter like WithFilter()
-// We could do this if the pattern was $NS/exported/$kind/$hostname/$uid = $data.
-func GetResources(obj *EmbdEtcd, hostnameFilter, kindFilter []string) ([]engine.Res, error) {
+// GetResources collects all of the resources which match each filter from etcd.
+// It returns one collection for each filter, and they all come from the same
+// read, so they are consistent with each other. Only the resources which match
+// the hostname, kind and name of a filter get decoded, and the predicates on
+// their fields are then evaluated here, so the caller only gets what it needs.
+// The labels of the hosts are read at the same time for the label selectors.
+// TODO: Ideally this would be a server side filter like WithFilter(). We could
+// do this if the pattern was $NS/exported/$kind/$hostname/$uid = $data.
+func GetResources(obj *EmbdEtcd, filters []*engine.ResFilter) ([][]engine.Res, error) {
 	// key structure is $NS/exported/$hostname/resources/$uid = $data
+	// key structure is $NS/labels/$hostname/$key = $value
 	path := fmt.Sprintf("%s/exported/", NS)
-	resourceList := []engine.Res{}
-	keyMap, err := obj.Get(path, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	labelsPath := fmt.Sprintf("%s/labels/", NS)
+	for _, filter := range filters {
+		if err := filter.Validate(); err != nil {
+			return nil, errwrap.Wrapf(err, "invalid filter")
+		}
+	}
+
+	// if we only collect from one host, then only get the keys of that host
+	prefix, labelsPrefix := path, labelsPath
+	if hostnames := resFilterHostnames(filters); len(hostnames) == 1 {
+		prefix = fmt.Sprintf("%s%s/", path, hostnames[0])
+		labelsPrefix = fmt.Sprintf("%s%s/", labelsPath, hostnames[0])
+	}
+
+	// get the resources and the labels in one transaction, so they match
+	ops := []etcd.Op{
+		etcd.OpGet(prefix, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend)),
+		etcd.OpGet(labelsPrefix, etcd.WithPrefix()),
+	}
+	txn, err := obj.Txn(nil, ops, nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not get resources: %v", err)
 	}
+	if len(txn.Responses) != len(ops) {
+		return nil, fmt.Errorf("could not get resources: unexpected response count")
+	}
+	keyMap := rangeKeyMap(txn.Responses[0].GetResponseRange())
+	labels := labelsFromKeys(labelsPath, rangeKeyMap(txn.Responses[1].GetResponseRange()), nil)
+
+	exported := []*engine.ExportedRes{}
 	for key, val := range keyMap {
 		if !strings.HasPrefix(key, path) { // sanity check
 			continue
@@ -161,22 +197,66 @@ func GetResources(obj *EmbdEtcd, hostnameFilter, kindFilter []string) ([]engine.
 			return nil, fmt.Errorf("unexpected kind chunk")
 		}
 
-		// FIXME: ideally this would be a server side filter instead!
-		if len(hostnameFilter) > 0 && !util.StrInList(hostname, hostnameFilter) {
-			continue
+		// skip decoding the resources that no filter can match
+		matched := false
+		for _, filter := range filters {
+			if filter.MatchKey(hostname, kind, name) {
+				matched = true
+				break
+			}
 		}
-
-		// FIXME: ideally this would be a server side filter instead!
-		if len(kindFilter) > 0 && !util.StrInList(kind, kindFilter) {
+		if !matched {
 			continue
 		}
 
 		if obj, err := engineUtil.B64ToRes(val); err == nil {
 			log.Printf("Etcd: Get: (Hostname, Kind, Name): (%s, %s, %s)", hostname, kind, name)
-			resourceList = append(resourceList, obj)
+			exported = append(exported, &engine.ExportedRes{Hostname: hostname, Res: obj})
 		} else {
 			return nil, fmt.Errorf("can't convert from B64: %v", err)
 		}
 	}
-	return resourceList, nil
+
+	for _, x := range exported {
+		x.Labels = labels[x.Hostname]
+	}
+
+	result := [][]engine.Res{}
+	for _, filter := range filters {
+		resourceList, err := filter.Collect(exported)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, resourceList)
+	}
+	return result, nil
+}
+
+// rangeKeyMap returns the keys and the values of a range response in a map.
+func rangeKeyMap(resp *pb.RangeResponse) map[string]string {
+	keyMap := make(map[string]string)
+	if resp == nil {
+		return keyMap
+	}
+	for _, kv := range resp.Kvs {
+		keyMap[string(kv.Key)] = string(kv.Value)
+	}
+	return keyMap
+}
+
+// resFilterHostnames returns the list of hostnames that the filters restrict
+// the collection to, or nil if any of them collects from every host.
+func resFilterHostnames(filters []*engine.ResFilter) []string {
+	hostnames := []string{}
+	for _, filter := range filters {
+		if len(filter.Hostnames) == 0 {
+			return nil
+		}
+		for _, hostname := range filter.Hostnames {
+			if !util.StrInList(hostname, hostnames) {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+	}
+	return hostnames
 }
@@ -0,0 +1,217 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// Local is a scheduler which runs within a single process, without etcd. Each
+// host which runs Schedule with the same path joins the scheduled set, and it
+// leaves it on Shutdown. Every host gets the same result, which is decided with
+// the options of the host that joined the earliest and is still present. It is
+// safe for concurrent use.
+type Local struct {
+	mutex sync.Mutex
+	paths map[string]*localPath
+
+	// the results have their own lock, because they're read by the host
+	// filters, which run while the main lock is held
+	resultsMutex sync.Mutex
+	results      map[string][]string // path => last result
+}
+
+// localPath is the state of the scheduler for one path.
+type localPath struct {
+	path      string
+	hosts     []*localHost // in the order that they joined
+	hostnames []string     // last result
+	err       error        // last error
+}
+
+// localHost is one host which has joined the scheduled set of a path.
+type localHost struct {
+	hostname string
+	options  *schedulerOptions
+	notify   chan struct{} // signals that a new result is available
+}
+
+// NewLocal returns a new local scheduler with no hosts in it.
+func NewLocal() *Local {
+	return &Local{
+		paths:   make(map[string]*localPath),
+		results: make(map[string][]string),
+	}
+}
+
+// Schedule returns a scheduler result which can be queried with it's available
+// methods. It is the local equivalent of the etcd backed Schedule function, and
+// it takes the same options. The behaviour is undefined if this is run more
+// than once with the same path and hostname simultaneously.
+func (obj *Local) Schedule(path string, hostname string, opts ...Option) (*Result, error) {
+	if hostname == "" {
+		return nil, fmt.Errorf("scheduler: hostname must not be empty")
+	}
+	if strings.Contains(hostname, hostnameJoinChar) {
+		return nil, fmt.Errorf("scheduler: hostname must not contain join char: %s", hostnameJoinChar)
+	}
+
+	options := &schedulerOptions{ // default scheduler options
+		sessionTTL: DefaultSessionTTL,
+		maxCount:   DefaultMaxCount,
+		logf:       func(format string, v ...interface{}) {}, // noop
+	}
+	for _, optionFunc := range opts { // apply the scheduler options
+		optionFunc(options)
+	}
+	options.path = path
+	if options.strategy == nil {
+		return nil, fmt.Errorf("scheduler: strategy must be specified")
+	}
+	if len(options.antiAffinity) > 0 && options.scheduledFunc == nil {
+		return nil, fmt.Errorf("scheduler: anti-affinity needs a scheduled func")
+	}
+
+	host := &localHost{
+		hostname: hostname,
+		options:  options,
+		notify:   make(chan struct{}, 1),
+	}
+
+	obj.mutex.Lock()
+	p, exists := obj.paths[path]
+	if !exists {
+		p = &localPath{path: path}
+		obj.paths[path] = p
+	}
+	p.hosts = append(p.hosts, host)
+	obj.reschedule(p)
+	obj.mutex.Unlock()
+
+	ch := make(chan *schedulerResult)
+	closeChan := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ch)
+		for {
+			select {
+			case <-host.notify:
+			case <-closeChan:
+				return
+			}
+
+			obj.mutex.Lock()
+			result := &schedulerResult{
+				hosts: p.hostnames,
+				err:   p.err,
+			}
+			obj.mutex.Unlock()
+
+			if options.debug {
+				options.logf("sending hosts: %+v", result.hosts)
+			}
+			select {
+			case ch <- result: // send
+			case <-closeChan:
+				return
+			}
+		}
+	}()
+
+	once := &sync.Once{}
+	closeFunc := func() {
+		once.Do(func() {
+			obj.mutex.Lock()
+			for i, x := range p.hosts {
+				if x == host {
+					p.hosts = append(p.hosts[:i], p.hosts[i+1:]...)
+					break
+				}
+			}
+			if len(p.hosts) == 0 {
+				delete(obj.paths, path)
+				obj.resultsMutex.Lock()
+				delete(obj.results, path)
+				obj.resultsMutex.Unlock()
+			} else {
+				obj.reschedule(p)
+			}
+			obj.mutex.Unlock()
+
+			close(closeChan)
+			wg.Wait()
+		})
+	}
+
+	return &Result{
+		results:   ch,
+		closeFunc: closeFunc,
+	}, nil
+}
+
+// reschedule runs the strategy of the earliest host on the current hosts, and
+// notifies every host of the new result. The mutex must be held.
+func (obj *Local) reschedule(p *localPath) {
+	options := p.hosts[0].options // the earliest host decides
+	hostnames := make(map[string]string)
+	for _, x := range p.hosts {
+		hostnames[x.hostname] = ""
+	}
+
+	available, err := filterHosts(hostnames, options)
+	if err == nil && len(available) == 0 {
+		options.logf("zero hosts available after filtering")
+		return // not enough hosts available
+	}
+	var hosts []string
+	if err == nil {
+		options.previous = p.hostnames // lets the strategy keep it stable
+		hosts, err = options.strategy.Schedule(available, options)
+	}
+	if err != nil {
+		p.hostnames, p.err = nil, errwrap.Wrapf(err, "scheduler: strategy failed")
+	} else {
+		sort.Strings(hosts) // for consistency
+		p.hostnames, p.err = hosts, nil
+	}
+	obj.resultsMutex.Lock()
+	obj.results[p.path] = p.hostnames
+	obj.resultsMutex.Unlock()
+
+	for _, x := range p.hosts {
+		select {
+		case x.notify <- struct{}{}: // send a new result is available
+		default: // one is already pending
+		}
+	}
+}
+
+// Scheduled returns the current result of the scheduler at the path, or nothing
+// if it hasn't made a choice yet.
+func (obj *Local) Scheduled(path string) ([]string, error) {
+	obj.resultsMutex.Lock()
+	defer obj.resultsMutex.Unlock()
+	return append([]string{}, obj.results[path]...), nil // copy
+}
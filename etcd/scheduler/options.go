@@ -34,7 +34,20 @@ type schedulerOptions struct {
 	reuseLease  bool
 	sessionTTL  int // TODO: should this be *int to know when it's set?
 	hostsFilter []string
+	// hostsFilterFunc returns the hosts to use each time we schedule.
+	hostsFilterFunc func() ([]string, error)
+	// hostLabelsFunc returns the labels of each host for the strategies.
+	hostLabelsFunc func() (map[string]map[string]string, error)
+	weightLabel    string
+	spreadLabel    string
+	antiAffinity   []string
+	// scheduledFunc returns the current result of another namespace.
+	scheduledFunc func(namespace string) ([]string, error)
 	// TODO: add more options
+
+	// these are set by the scheduler before each run of the strategy
+	path     string   // path of this scheduler, which seeds the hashes
+	previous []string // previous result, which might be empty
 }
 
 // Debug specifies whether we should run in debug mode or not.
@@ -92,9 +105,61 @@ func SessionTTL(sessionTTL int) Option {
 
 // HostsFilter specifies a manual list of hosts, to use as a subset of whatever
 // was auto-discovered.
-// XXX: think more about this idea...
 func HostsFilter(hosts []string) Option {
 	return func(so *schedulerOptions) {
 		so.hostsFilter = hosts
 	}
 }
+
+// HostsFilterFunc specifies a function which returns the list of hosts to use
+// as a subset of whatever was auto-discovered. It runs each time a scheduling
+// decision is made, so the list can change, such as when it comes from a label
+// selector. It can be combined with HostsFilter.
+func HostsFilterFunc(fn func() ([]string, error)) Option {
+	return func(so *schedulerOptions) {
+		so.hostsFilterFunc = fn
+	}
+}
+
+// HostLabelsFunc specifies a function which returns the labels of each host, for
+// the strategies which use them. The World usually adds this for you.
+func HostLabelsFunc(fn func() (map[string]map[string]string, error)) Option {
+	return func(so *schedulerOptions) {
+		so.hostLabelsFunc = fn
+	}
+}
+
+// WeightLabel is the host label whose integer value is the capacity of a host.
+// It is used by the weighted strategy. Hosts without it have a weight of one,
+// and hosts with a weight of zero are never chosen.
+func WeightLabel(key string) Option {
+	return func(so *schedulerOptions) {
+		so.weightLabel = key
+	}
+}
+
+// SpreadLabel is the host label, such as a rack or a zone, whose values the
+// spread strategy spreads the chosen hosts across.
+func SpreadLabel(key string) Option {
+	return func(so *schedulerOptions) {
+		so.spreadLabel = key
+	}
+}
+
+// AntiAffinity specifies the namespaces whose scheduled hosts must not also be
+// chosen by this one. It works with any strategy. It is checked each time that
+// this namespace is scheduled, and not when the other namespaces change.
+func AntiAffinity(namespaces []string) Option {
+	return func(so *schedulerOptions) {
+		so.antiAffinity = namespaces
+	}
+}
+
+// ScheduledFunc specifies a function which returns the current result of the
+// scheduler of another namespace, so that AntiAffinity can work. The World
+// usually adds this for you.
+func ScheduledFunc(fn func(namespace string) ([]string, error)) Option {
+	return func(so *schedulerOptions) {
+		so.scheduledFunc = fn
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/purpleidea/mgmt/util"
+
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
 	errwrap "github.com/pkg/errors"
@@ -126,10 +128,14 @@ func Schedule(client *etcd.Client, path string, hostname string, opts ...Option)
 	for _, optionFunc := range opts { // apply the scheduler options
 		optionFunc(options)
 	}
+	options.path = path
 
 	if options.strategy == nil {
 		return nil, fmt.Errorf("scheduler: strategy must be specified")
 	}
+	if len(options.antiAffinity) > 0 && options.scheduledFunc == nil {
+		return nil, fmt.Errorf("scheduler: anti-affinity needs a scheduled func")
+	}
 
 	sessionOptions := []concurrency.SessionOption{}
 
@@ -505,10 +511,28 @@ func Schedule(client *etcd.Client, path string, hostname string, opts ...Option)
 			// i am the leader, run scheduler and store result
 			options.logf("i am elected, running scheduler...")
 
+			available, err := filterHosts(hostnames, options)
+			if err != nil {
+				send(nil, errwrap.Wrapf(err, "scheduler: hosts filter failed"))
+				continue
+			}
+			if len(available) == 0 {
+				options.logf("zero hosts available after filtering")
+				continue // not enough hosts available
+			}
+
+			// the previous result lets the strategy keep it stable
+			previous, err := getScheduled(ctx, client, scheduledPath)
+			if err != nil {
+				send(nil, errwrap.Wrapf(err, "scheduler: could not get scheduling result in `%s`", path))
+				continue
+			}
+			options.previous = previous
+
 			// run actual scheduler and decide who should be chosen
 			// TODO: is there any additional data that we can pass
 			// to the scheduler so it can make a better decision ?
-			hosts, err := options.strategy.Schedule(hostnames, options)
+			hosts, err := options.strategy.Schedule(available, options)
 			if err != nil {
 				send(nil, errwrap.Wrapf(err, "scheduler: strategy failed"))
 				continue
@@ -562,3 +586,62 @@ func Schedule(client *etcd.Client, path string, hostname string, opts ...Option)
 
 	return result, nil
 }
+
+// filterHosts returns the subset of the available hostnames which pass the
+// hosts filters in the options.
+func filterHosts(hostnames map[string]string, options *schedulerOptions) (map[string]string, error) {
+	if options.hostsFilter == nil && options.hostsFilterFunc == nil && len(options.antiAffinity) == 0 {
+		return hostnames, nil
+	}
+	var filtered []string
+	if options.hostsFilterFunc != nil {
+		var err error
+		if filtered, err = options.hostsFilterFunc(); err != nil {
+			return nil, err
+		}
+	}
+	avoid := []string{} // hosts which are scheduled in the other namespaces
+	for _, namespace := range options.antiAffinity {
+		hosts, err := options.scheduledFunc(namespace)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "could not get the hosts of `%s`", namespace)
+		}
+		avoid = append(avoid, hosts...)
+	}
+	result := make(map[string]string)
+	for hostname, data := range hostnames {
+		if options.hostsFilter != nil && !util.StrInList(hostname, options.hostsFilter) {
+			continue
+		}
+		if options.hostsFilterFunc != nil && !util.StrInList(hostname, filtered) {
+			continue
+		}
+		if util.StrInList(hostname, avoid) {
+			continue
+		}
+		result[hostname] = data
+	}
+	return result, nil
+}
+
+// Scheduled returns the current result of the scheduler at the path, or nothing
+// if it hasn't made a choice yet. It can be used by any host, even ones which
+// aren't part of that scheduled set.
+func Scheduled(client *etcd.Client, path string) ([]string, error) {
+	return getScheduled(context.TODO(), client, fmt.Sprintf("%s/scheduled", path))
+}
+
+// getScheduled returns the scheduling result which is stored at the key.
+func getScheduled(ctx context.Context, client *etcd.Client, scheduledPath string) ([]string, error) {
+	resp, err := client.Get(ctx, scheduledPath)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("resp is nil")
+	}
+	if len(resp.Kvs) == 0 || len(resp.Kvs[0].Value) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(string(resp.Kvs[0].Value), hostnameJoinChar), nil
+}
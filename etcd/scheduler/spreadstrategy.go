@@ -0,0 +1,82 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler // TODO: i'd like this to be a separate package, but cycles!
+
+import (
+	"fmt"
+	"sort"
+)
+
+func init() {
+	Register("spread", func() Strategy { return &spreadStrategy{} }) // must register the func and name
+}
+
+type spreadStrategy struct {
+	// no state to store
+}
+
+// Schedule returns hosts which are spread as evenly as possible across the
+// values of the SpreadLabel, such as across racks or zones. The hosts without
+// that label are considered to be in one more group. Within each group, hosts
+// are ranked by rendezvous hashing, so that the same ones keep getting picked.
+func (obj *spreadStrategy) Schedule(hostnames map[string]string, opts *schedulerOptions) ([]string, error) {
+	if len(hostnames) <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule from zero hosts")
+	}
+	if opts.maxCount <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule with a max of zero")
+	}
+	if opts.spreadLabel == "" {
+		return nil, fmt.Errorf("strategy: cannot schedule without a spread label")
+	}
+	labels, err := opts.hostLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]string) // label value => hostnames
+	for hostname := range hostnames {
+		value := labels[hostname][opts.spreadLabel] // empty if missing
+		groups[value] = append(groups[value], hostname)
+	}
+	values := []string{}
+	for value, group := range groups {
+		values = append(values, value)
+		groups[value] = rankHosts(group, opts.path)
+	}
+	sort.Strings(values)
+
+	// take one host from each group in turn, until we have enough of them
+	result := []string{}
+	for i := 0; len(result) < opts.maxCount; i++ {
+		found := false
+		for _, value := range values {
+			if i >= len(groups[value]) {
+				continue // this group is used up
+			}
+			found = true
+			if len(result) < opts.maxCount {
+				result = append(result, groups[value][i])
+			}
+		}
+		if !found { // all the groups are used up
+			break
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler // TODO: i'd like this to be a separate package, but cycles!
+
+import (
+	"fmt"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+func init() {
+	Register("sticky", func() Strategy { return &stickyStrategy{} }) // must register the func and name
+}
+
+type stickyStrategy struct {
+	// no state to store
+}
+
+// Schedule returns the previously scheduled hosts which are still available,
+// and fills any remaining places with hosts ranked by rendezvous hashing. This
+// means that a host which joins never displaces one which was already chosen,
+// and when a chosen host leaves, only its place changes. Since the ranking is a
+// consistent hash, every host which gets elected makes the same choices.
+func (obj *stickyStrategy) Schedule(hostnames map[string]string, opts *schedulerOptions) ([]string, error) {
+	if len(hostnames) <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule from zero hosts")
+	}
+	if opts.maxCount <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule with a max of zero")
+	}
+
+	sortedHosts := []string{}
+	for hostname := range hostnames {
+		sortedHosts = append(sortedHosts, hostname)
+	}
+	ranked := rankHosts(sortedHosts, opts.path)
+
+	// keep the best ranked of the previous hosts first, in case the max
+	// count was lowered, and then add the best ranked of the others
+	result := []string{}
+	for _, hostname := range ranked {
+		if len(result) < opts.maxCount && util.StrInList(hostname, opts.previous) {
+			result = append(result, hostname)
+		}
+	}
+	for _, hostname := range ranked {
+		if len(result) < opts.maxCount && !util.StrInList(hostname, result) {
+			result = append(result, hostname)
+		}
+	}
+	return result, nil
+}
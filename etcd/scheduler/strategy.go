@@ -18,7 +18,12 @@
 package scheduler
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"sort"
+
+	errwrap "github.com/pkg/errors"
 )
 
 // registeredStrategies is a global map of all possible strategy implementations
@@ -49,3 +54,37 @@ type nilStrategy struct {
 func (obj *nilStrategy) Schedule(hostnames map[string]string, opts *schedulerOptions) ([]string, error) {
 	return nil, fmt.Errorf("scheduler: cannot schedule with nil scheduler")
 }
+
+// hostHash returns a stable pseudo random number for a host in the path of a
+// scheduler. Ranking the hosts by it is known as rendezvous hashing. Each host
+// keeps its rank when others join or leave, so that few choices change then.
+func hostHash(path, hostname string) uint64 {
+	sum := sha256.Sum256([]byte(path + "\x00" + hostname))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// rankHosts returns the hostnames sorted by their hash, highest first.
+func rankHosts(hostnames []string, path string) []string {
+	ranked := append([]string{}, hostnames...) // copy
+	sort.Slice(ranked, func(i, j int) bool {
+		hi, hj := hostHash(path, ranked[i]), hostHash(path, ranked[j])
+		if hi != hj {
+			return hi > hj
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
+
+// hostLabels returns the labels of each host, or none if there's no func to get
+// them with.
+func (obj *schedulerOptions) hostLabels() (map[string]map[string]string, error) {
+	if obj.hostLabelsFunc == nil {
+		return map[string]map[string]string{}, nil
+	}
+	labels, err := obj.hostLabelsFunc()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "strategy: cannot get host labels")
+	}
+	return labels, nil
+}
@@ -0,0 +1,220 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// strategyHosts returns a hostnames map of the hosts h1 to hN.
+func strategyHosts(n int) map[string]string {
+	hostnames := make(map[string]string)
+	for i := 1; i <= n; i++ {
+		hostnames[fmt.Sprintf("h%d", i)] = ""
+	}
+	return hostnames
+}
+
+// strategyOptions returns the options that a scheduler would pass in.
+func strategyOptions(path string, opts ...Option) *schedulerOptions {
+	options := &schedulerOptions{
+		maxCount: DefaultMaxCount,
+		path:     path,
+	}
+	for _, optionFunc := range opts {
+		optionFunc(options)
+	}
+	return options
+}
+
+// strategyLabels returns a host labels func which always returns the labels.
+func strategyLabels(labels map[string]map[string]string) Option {
+	return HostLabelsFunc(func() (map[string]map[string]string, error) {
+		return labels, nil
+	})
+}
+
+func TestStickyStrategy(t *testing.T) {
+	strategy := &stickyStrategy{}
+	options := strategyOptions("/scheduler/test", MaxCount(2))
+	hosts, err := strategy.Schedule(strategyHosts(5), options)
+	if err != nil {
+		t.Errorf("schedule failed with: %v", err)
+		return
+	}
+	if len(hosts) != 2 {
+		t.Errorf("expected two hosts, got: %v", hosts)
+		return
+	}
+	if again, err := strategy.Schedule(strategyHosts(5), options); err != nil || fmt.Sprintf("%v", again) != fmt.Sprintf("%v", hosts) {
+		t.Errorf("the choice is not consistent: %v, %v", again, err)
+	}
+
+	// hosts which join never displace the chosen ones
+	options.previous = hosts
+	for n := 6; n <= 20; n++ {
+		result, err := strategy.Schedule(strategyHosts(n), options)
+		if err != nil {
+			t.Errorf("schedule failed with: %v", err)
+			return
+		}
+		if fmt.Sprintf("%v", result) != fmt.Sprintf("%v", hosts) {
+			t.Errorf("the choice changed from %v to %v with %d hosts", hosts, result, n)
+		}
+	}
+
+	// when a chosen host leaves, the other one stays
+	available := strategyHosts(20)
+	delete(available, hosts[0])
+	result, err := strategy.Schedule(available, options)
+	if err != nil {
+		t.Errorf("schedule failed with: %v", err)
+		return
+	}
+	if len(result) != 2 || (result[0] != hosts[1] && result[1] != hosts[1]) {
+		t.Errorf("the remaining host was not kept: %v", result)
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	labels := map[string]map[string]string{
+		"h1": {"capacity": "9"},
+		"h2": {}, // a weight of one
+		"h3": {"capacity": "0"},
+	}
+	strategy := &weightedStrategy{}
+	counts := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		options := strategyOptions(fmt.Sprintf("/scheduler/test%d", i), WeightLabel("capacity"), strategyLabels(labels))
+		hosts, err := strategy.Schedule(strategyHosts(3), options)
+		if err != nil {
+			t.Errorf("schedule failed with: %v", err)
+			return
+		}
+		if len(hosts) != 1 {
+			t.Errorf("expected one host, got: %v", hosts)
+			return
+		}
+		counts[hosts[0]]++
+	}
+	if counts["h3"] != 0 {
+		t.Errorf("a host with a weight of zero was chosen %d times", counts["h3"])
+	}
+	if counts["h1"] < 400 || counts["h1"] > 490 { // expect about 450
+		t.Errorf("the weights were not respected: %v", counts)
+	}
+
+	options := strategyOptions("/scheduler/test", MaxCount(3), WeightLabel("capacity"), strategyLabels(labels))
+	if hosts, err := strategy.Schedule(strategyHosts(3), options); err != nil || len(hosts) != 2 {
+		t.Errorf("expected two hosts, got: %v, %v", hosts, err)
+	}
+
+	labels["h2"]["capacity"] = "lots"
+	if _, err := strategy.Schedule(strategyHosts(3), options); err == nil {
+		t.Errorf("an invalid weight should have failed")
+	}
+	if _, err := strategy.Schedule(strategyHosts(3), strategyOptions("/scheduler/test")); err == nil {
+		t.Errorf("a missing weight label should have failed")
+	}
+}
+
+func TestSpreadStrategy(t *testing.T) {
+	labels := map[string]map[string]string{
+		"h1": {"rack": "a"},
+		"h2": {"rack": "a"},
+		"h3": {"rack": "a"},
+		"h4": {"rack": "b"},
+		"h5": {"rack": "c"},
+		"h6": {"rack": "c"},
+	}
+	strategy := &spreadStrategy{}
+	tests := map[int]map[string]int{ // max => rack => count
+		1: {"a": 1},
+		3: {"a": 1, "b": 1, "c": 1},
+		4: {"a": 2, "b": 1, "c": 1},
+		5: {"a": 2, "b": 1, "c": 2},
+		9: {"a": 3, "b": 1, "c": 2},
+	}
+	for max, expected := range tests {
+		options := strategyOptions("/scheduler/test", MaxCount(max), SpreadLabel("rack"), strategyLabels(labels))
+		hosts, err := strategy.Schedule(strategyHosts(6), options)
+		if err != nil {
+			t.Errorf("schedule failed with: %v", err)
+			return
+		}
+		counts := make(map[string]int)
+		for _, hostname := range hosts {
+			counts[labels[hostname]["rack"]]++
+		}
+		if fmt.Sprintf("%v", counts) != fmt.Sprintf("%v", expected) {
+			t.Errorf("max %d: got wrong spread: %v", max, counts)
+		}
+	}
+}
+
+func TestLocalAntiAffinity(t *testing.T) {
+	next := func(r *Result, expected string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			hosts, err := r.Next(ctx)
+			if err != nil {
+				t.Fatalf("expected %s, but got error: %v", expected, err)
+			}
+			if fmt.Sprintf("%v", hosts) == expected {
+				return
+			}
+		}
+	}
+
+	local := NewLocal()
+	scheduled := ScheduledFunc(func(namespace string) ([]string, error) {
+		return local.Scheduled(fmt.Sprintf("/scheduler/%s", namespace))
+	})
+	if _, err := local.Schedule("/scheduler/db", "h1", StrategyKind("alpha"), AntiAffinity([]string{"web"})); err == nil {
+		t.Errorf("anti-affinity without a scheduled func should have failed")
+	}
+
+	web := []Option{StrategyKind("alpha")}
+	db := []Option{StrategyKind("alpha"), AntiAffinity([]string{"web"}), scheduled}
+	w1, err := local.Schedule("/scheduler/web", "h1", web...)
+	if err != nil {
+		t.Fatalf("schedule failed with: %v", err)
+	}
+	defer w1.Shutdown()
+	next(w1, "[h1]")
+
+	d1, err := local.Schedule("/scheduler/db", "h1", db...)
+	if err != nil {
+		t.Fatalf("schedule failed with: %v", err)
+	}
+	defer d1.Shutdown()
+	d2, err := local.Schedule("/scheduler/db", "h2", db...)
+	if err != nil {
+		t.Fatalf("schedule failed with: %v", err)
+	}
+	defer d2.Shutdown()
+	next(d1, "[h2]") // h1 runs web
+	next(d2, "[h2]")
+}
@@ -0,0 +1,85 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler // TODO: i'd like this to be a separate package, but cycles!
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	Register("weighted", func() Strategy { return &weightedStrategy{} }) // must register the func and name
+}
+
+type weightedStrategy struct {
+	// no state to store
+}
+
+// Schedule returns hosts chosen in proportion to their weight, which is read
+// from the WeightLabel of each host. It uses weighted rendezvous hashing, so the
+// same hosts keep getting chosen, and few of them change when others join.
+func (obj *weightedStrategy) Schedule(hostnames map[string]string, opts *schedulerOptions) ([]string, error) {
+	if len(hostnames) <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule from zero hosts")
+	}
+	if opts.maxCount <= 0 {
+		return nil, fmt.Errorf("strategy: cannot schedule with a max of zero")
+	}
+	if opts.weightLabel == "" {
+		return nil, fmt.Errorf("strategy: cannot schedule without a weight label")
+	}
+	labels, err := opts.hostLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]float64)
+	for hostname := range hostnames {
+		weight := 1 // the default for hosts which don't publish one
+		if s, exists := labels[hostname][opts.weightLabel]; exists {
+			if weight, err = strconv.Atoi(s); err != nil || weight < 0 {
+				return nil, fmt.Errorf("strategy: invalid weight `%s` on host: %s", s, hostname)
+			}
+		}
+		if weight == 0 {
+			continue // never choose this host
+		}
+		// map the hash to (0, 1), and the highest score wins
+		u := (float64(hostHash(opts.path, hostname)>>11) + 0.5) / (1 << 53)
+		scores[hostname] = float64(weight) / -math.Log(u)
+	}
+
+	sortedHosts := []string{}
+	for hostname := range scores {
+		sortedHosts = append(sortedHosts, hostname)
+	}
+	sort.Slice(sortedHosts, func(i, j int) bool {
+		si, sj := scores[sortedHosts[i]], scores[sortedHosts[j]]
+		if si != sj {
+			return si > sj
+		}
+		return sortedHosts[i] < sortedHosts[j]
+	})
+
+	if len(sortedHosts) > opts.maxCount {
+		sortedHosts = sortedHosts[:opts.maxCount]
+	}
+	return sortedHosts, nil
+}
@@ -0,0 +1,209 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/purpleidea/mgmt/util"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	secretsPath      = "secrets"
+	secretKeysPath   = "keys"
+	secretValuesPath = "values"
+	secretInfoPath   = "info"
+)
+
+// secretNameRegexp matches the valid secret names.
+var secretNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+// ErrSecretNotExist is returned when a secret can not be found.
+var ErrSecretNotExist = fmt.Errorf("secret does not exist")
+
+// SecretInfo is the metadata of a secret. The value of a secret is stored once
+// for each of its recipients, encrypted to the public pgp key of that host.
+type SecretInfo struct {
+	Version uint64 `json:"version"` // incremented each time it's set
+	Time    int64  `json:"time"`    // unix timestamp of the last change
+
+	// Recipients is the sorted list of the hosts that can decrypt it. It's
+	// computed from the stored values.
+	Recipients []string `json:"-"`
+}
+
+// ValidateSecretName returns an error if the secret name is not valid.
+func ValidateSecretName(name string) error {
+	if !secretNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid secret name: `%s`", name)
+	}
+	return nil
+}
+
+// SetPublicKey publishes the public pgp key of a host, so that secrets can be
+// encrypted to it.
+func SetPublicKey(obj Client, hostname, key string) error {
+	// key structure is $NS/secrets/keys/$hostname = $key
+	path := fmt.Sprintf("%s/%s/%s/%s", NS, secretsPath, secretKeysPath, hostname)
+	ifs := []etcd.Cmp{etcd.Compare(etcd.Value(path), "=", key)} // desired state
+	ops := []etcd.Op{etcd.OpPut(path, key)}
+	_, err := obj.Txn(ifs, nil, ops)
+	return errwrap.Wrapf(err, "could not set public key of: %s", hostname)
+}
+
+// GetPublicKeys returns the published public pgp key of each host. If the filter
+// is not empty, then only the keys of those hosts are returned.
+func GetPublicKeys(obj Client, hostnameFilter []string) (map[string]string, error) {
+	// key structure is $NS/secrets/keys/$hostname = $key
+	path := fmt.Sprintf("%s/%s/%s/", NS, secretsPath, secretKeysPath)
+	keyMap, err := obj.Get(path, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not get public keys")
+	}
+	result := make(map[string]string)
+	for key, val := range keyMap {
+		if !strings.HasPrefix(key, path) { // sanity check
+			continue
+		}
+		hostname := key[len(path):]
+		if len(hostnameFilter) > 0 && !util.StrInList(hostname, hostnameFilter) {
+			continue
+		}
+		result[hostname] = val
+	}
+	return result, nil
+}
+
+// WatchSecret returns a channel that outputs events when the secret changes.
+func WatchSecret(obj *EmbdEtcd, name string) chan error {
+	// key structure is $NS/secrets/values/$name/$hostname = $encrypted
+	path := fmt.Sprintf("%s/%s/%s/%s/", NS, secretsPath, secretValuesPath, name)
+	ch := make(chan error, 1)
+	// FIXME: fix our API so that we get a close event on shutdown.
+	callback := func(re *RE) error {
+		if re == nil || re.response.Canceled {
+			return fmt.Errorf("watch is empty") // will cause a CtxError+retry
+		}
+		if len(ch) == 0 { // send event only if one isn't pending
+			ch <- nil // event
+		}
+		return nil
+	}
+	_, _ = obj.AddWatcher(path, callback, true, false, etcd.WithPrefix()) // no need to check errors
+	return ch
+}
+
+// GetSecret returns the info of the secret, and its encrypted value for each of
+// its recipients. It returns ErrSecretNotExist if it doesn't exist.
+func GetSecret(obj Client, name string) (*SecretInfo, map[string]string, error) {
+	if err := ValidateSecretName(name); err != nil {
+		return nil, nil, err
+	}
+	// key structure is $NS/secrets/info/$name = $info
+	// key structure is $NS/secrets/values/$name/$hostname = $encrypted
+	iPath := fmt.Sprintf("%s/%s/%s/%s", NS, secretsPath, secretInfoPath, name)
+	keyMap, err := obj.Get(iPath)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "could not get secret")
+	}
+	data, exists := keyMap[iPath]
+	if !exists {
+		return nil, nil, ErrSecretNotExist
+	}
+	info := &SecretInfo{}
+	if err := json.Unmarshal([]byte(data), info); err != nil {
+		return nil, nil, errwrap.Wrapf(err, "invalid info for secret `%s`", name)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s/%s/", NS, secretsPath, secretValuesPath, name)
+	keyMap, err = obj.Get(path, etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "could not get secret")
+	}
+	values := make(map[string]string)
+	for key, val := range keyMap {
+		if !strings.HasPrefix(key, path) { // sanity check
+			continue
+		}
+		hostname := key[len(path):]
+		values[hostname] = val
+		info.Recipients = append(info.Recipients, hostname)
+	}
+	sort.Strings(info.Recipients)
+	return info, values, nil
+}
+
+// SetSecret replaces the secret with the values which were encrypted for each
+// of its recipients. The prev info is what the caller last read with GetSecret,
+// or nil if the secret must not exist yet, so that concurrent changes can't get
+// lost. The recipients which aren't in the values anymore are removed.
+func SetSecret(obj Client, name string, prev, info *SecretInfo, values map[string]string) error {
+	if err := ValidateSecretName(name); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("a secret needs at least one recipient")
+	}
+	iPath := fmt.Sprintf("%s/%s/%s/%s", NS, secretsPath, secretInfoPath, name)
+	path := fmt.Sprintf("%s/%s/%s/%s/", NS, secretsPath, secretValuesPath, name)
+
+	ifs := []etcd.Cmp{} // list matching the desired state
+	if prev == nil {
+		ifs = append(ifs, etcd.Compare(etcd.Version(iPath), "=", 0)) // KeyMissing
+	} else {
+		b, err := json.Marshal(prev)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not encode the secret info")
+		}
+		ifs = append(ifs, etcd.Compare(etcd.Value(iPath), "=", string(b)))
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not encode the secret info")
+	}
+	ops := []etcd.Op{etcd.OpPut(iPath, string(b))}
+	for hostname, value := range values {
+		ops = append(ops, etcd.OpPut(path+hostname, value))
+	}
+	if prev != nil {
+		for _, hostname := range prev.Recipients { // remove the old ones
+			if _, exists := values[hostname]; !exists {
+				ops = append(ops, etcd.OpDelete(path+hostname))
+			}
+		}
+	}
+
+	// it's important to do this in one transaction, and atomically, because
+	// this way, we only generate one watch event, and only when it's needed
+	result, err := obj.Txn(ifs, ops, nil)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not set secret `%s`", name)
+	}
+	if !result.Succeeded {
+		return fmt.Errorf("secret `%s` was changed concurrently", name)
+	}
+	return nil
+}
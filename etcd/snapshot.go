@@ -0,0 +1,349 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package etcd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/etcd/etcdserver/api/v3client"
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	"github.com/coreos/etcd/snapshot"
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
+)
+
+const (
+	// SnapshotVersion is the version of the snapshot file format.
+	SnapshotVersion = 1
+
+	// SnapshotExt is the extension of the snapshots which are made
+	// periodically.
+	SnapshotExt = ".snap"
+
+	snapshotMetaName = "metadata.json" // name of the metadata in the archive
+	snapshotDataName = "etcd.db"       // name of the etcd snapshot in the archive
+	snapshotTimeout  = 60 * time.Second
+)
+
+// SnapshotMeta is the mgmt metadata which is stored next to the etcd data in
+// each snapshot.
+type SnapshotMeta struct {
+	Version     int      `json:"version"`
+	Program     string   `json:"program"`
+	Hostname    string   `json:"hostname"` // the host which made the snapshot
+	Time        int64    `json:"time"`     // unix timestamp
+	Revision    int64    `json:"revision"` // etcd revision of the snapshot
+	ClusterSize uint16   `json:"clusterSize"`
+	Hosts       []string `json:"hosts"`   // the hosts of the cluster
+	Deploys     []uint64 `json:"deploys"` // the ids of the stored deploys
+}
+
+// NewSnapshotMeta builds the metadata for a snapshot of the current cluster.
+func NewSnapshotMeta(obj Client, program, hostname string) (*SnapshotMeta, error) {
+	meta := &SnapshotMeta{
+		Version:  SnapshotVersion,
+		Program:  program,
+		Hostname: hostname,
+		Hosts:    []string{},
+		Deploys:  []uint64{},
+	}
+	if size, err := GetClusterSize(obj); err == nil {
+		meta.ClusterSize = size
+	} // it's okay if it wasn't set yet
+	hosts, err := GetClusterHosts(obj)
+	if err != nil {
+		return nil, err
+	}
+	for h := range hosts {
+		meta.Hosts = append(meta.Hosts, h)
+	}
+	sort.Strings(meta.Hosts)
+	deploys, err := GetDeploys(obj)
+	if err != nil {
+		return nil, err
+	}
+	for id := range deploys {
+		meta.Deploys = append(meta.Deploys, id)
+	}
+	sort.Slice(meta.Deploys, func(i, j int) bool { return meta.Deploys[i] < meta.Deploys[j] })
+	return meta, nil
+}
+
+// SaveSnapshot writes a snapshot of the etcd data, along with the metadata, to
+// the file. The file is an archive, and the etcd data in it can also be used
+// with the standard etcd restore tools. The file is replaced atomically.
+func SaveSnapshot(client *etcd.Client, meta *SnapshotMeta, filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	// the data might be a little more recent than this, but never older
+	resp, err := client.Get(ctx, NS, etcd.WithCountOnly())
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get the revision")
+	}
+	meta.Revision = resp.Header.Revision
+	meta.Time = time.Now().Unix()
+
+	// etcd streams the snapshot, so spool it to get its size for the header
+	data, err := ioutil.TempFile(path.Dir(filename), ".snapshot-")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not create the temporary file")
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+	rc, err := client.Maintenance.Snapshot(ctx)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not start the snapshot")
+	}
+	size, err := io.Copy(data, rc)
+	rc.Close()
+	if err != nil {
+		return errwrap.Wrapf(err, "could not read the snapshot")
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not encode the metadata")
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not create the snapshot")
+	}
+	defer os.Remove(tmp) // no-op after the rename
+	tw := tar.NewWriter(f)
+	now := time.Unix(meta.Time, 0)
+	err = tw.WriteHeader(&tar.Header{Name: snapshotMetaName, Mode: 0600, Size: int64(len(b)), ModTime: now})
+	if err == nil {
+		_, err = tw.Write(b)
+	}
+	if err == nil {
+		err = tw.WriteHeader(&tar.Header{Name: snapshotDataName, Mode: 0600, Size: size, ModTime: now})
+	}
+	if err == nil {
+		_, err = io.Copy(tw, data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return errwrap.Wrapf(err, "could not write the snapshot")
+	}
+	return os.Rename(tmp, filename)
+}
+
+// ReadSnapshotMeta reads the metadata from a snapshot file.
+func ReadSnapshotMeta(filename string) (*SnapshotMeta, error) {
+	var meta *SnapshotMeta
+	err := readSnapshot(filename, func(name string, r io.Reader) error {
+		if name != snapshotMetaName {
+			return nil
+		}
+		meta = &SnapshotMeta{}
+		return json.NewDecoder(r).Decode(meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("the snapshot has no metadata")
+	}
+	if meta.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", meta.Version)
+	}
+	return meta, nil
+}
+
+// readSnapshot runs fn on each of the files in the snapshot archive.
+func readSnapshot(filename string, fn func(string, io.Reader) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not open the snapshot")
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errwrap.Wrapf(err, "could not read the snapshot")
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return errwrap.Wrapf(err, "could not read `%s` from the snapshot", hdr.Name)
+		}
+	}
+}
+
+// RestoreSnapshot builds the etcd data dir in the prefix from a snapshot file,
+// so that the next run with this prefix starts a new cluster in which it is
+// the only member. The published state of the hosts in the snapshot is removed
+// so that the new cluster doesn't wait for them. The other hosts must then be
+// joined to the new cluster with fresh prefixes.
+func RestoreSnapshot(filename, prefix, hostname string, peerURLs etcdtypes.URLs) (*SnapshotMeta, error) {
+	meta, err := ReadSnapshotMeta(filename)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := path.Join(prefix, "etcd") // same as in NewEmbdEtcd
+	if _, err := os.Stat(dataDir); err == nil {
+		return nil, fmt.Errorf("the data dir `%s` already exists", dataDir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(prefix, 0770); err != nil {
+		return nil, errwrap.Wrapf(err, "could not create the prefix")
+	}
+
+	dir, err := ioutil.TempDir(prefix, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	db := path.Join(dir, snapshotDataName)
+	found := false
+	err = readSnapshot(filename, func(name string, r io.Reader) error {
+		if name != snapshotDataName {
+			return nil
+		}
+		found = true
+		f, err := os.OpenFile(db, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("the snapshot has no etcd data")
+	}
+
+	// restore into a temporary dir first, so that a failure doesn't leave
+	// behind a data dir which would get used by the next run
+	tmpDataDir := path.Join(dir, "etcd")
+	cfg := snapshot.RestoreConfig{
+		Name:                hostname,
+		OutputDataDir:       tmpDataDir,
+		InitialCluster:      etcdtypes.URLsMap{hostname: peerURLs},
+		InitialClusterToken: "etcd-cluster", // the etcd default, as we use
+		PeerURLs:            peerURLs,
+	}
+	if err := snapshot.NewV3(nil, nil).Restore(db, cfg); err != nil {
+		return nil, errwrap.Wrapf(err, "could not restore the etcd data")
+	}
+	if err := restoreHosts(tmpDataDir, hostname); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpDataDir, dataDir); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// restoreHosts starts a private etcd server on the restored data dir, and
+// removes the published state of all the hosts from it. Otherwise the leader
+// of the new cluster would try to add the old members back.
+func restoreHosts(dataDir, hostname string) error {
+	local, _ := etcdtypes.NewURLs([]string{"http://localhost:0"}) // pick a free port
+	cfg := embed.NewConfig()
+	cfg.Name = hostname
+	cfg.Dir = dataDir
+	cfg.LCUrls = local
+	cfg.ACUrls = local
+	cfg.LPUrls = local
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not start the restored server")
+	}
+	defer e.Close()
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Duration(MaxStartServerTimeout) * time.Second):
+		return fmt.Errorf("timeout of %d seconds reached", MaxStartServerTimeout)
+	}
+
+	client := v3client.New(e.Server)
+	defer client.Close()
+	obj := &ClientEtcd{client: client}
+	hosts, err := GetClusterHosts(obj)
+	if err != nil {
+		return err
+	}
+	for h := range hosts {
+		if err := RemoveHost(obj, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneSnapshots removes the oldest snapshots in the dir, so that only the
+// most recent retention number of them remain.
+func PruneSnapshots(dir string, retention int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), SnapshotExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names) // the names sort by time
+	for len(names) > retention {
+		if err := os.Remove(path.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// SnapshotName returns the file name for a periodic snapshot made at time t.
+func SnapshotName(t time.Time) string {
+	return "snapshot-" + t.UTC().Format("20060102-150405") + SnapshotExt
+}
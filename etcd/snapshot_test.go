@@ -0,0 +1,203 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package etcd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/etcd/etcdserver/api/v3client"
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	context "golang.org/x/net/context"
+)
+
+func TestPruneSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-snapshot-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	names := []string{"notes.txt"} // not a snapshot, so it's kept
+	for i := 0; i < 5; i++ {
+		names = append(names, SnapshotName(now.Add(time.Duration(i)*time.Hour)))
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte{}, 0600); err != nil {
+			t.Fatalf("could not write file: %v", err)
+		}
+	}
+
+	if err := PruneSnapshots(dir, 2); err != nil {
+		t.Fatalf("prune failed with: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read dir: %v", err)
+	}
+	kept := []string{}
+	for _, f := range files {
+		kept = append(kept, f.Name())
+	}
+	sort.Strings(kept)
+	exp := "[notes.txt snapshot-20180101-030000.snap snapshot-20180101-040000.snap]"
+	if s := fmt.Sprintf("%v", kept); s != exp {
+		t.Errorf("kept the wrong files: %s", s)
+	}
+}
+
+func TestReadSnapshotMetaInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "mgmt-snapshot-")
+	if err != nil {
+		t.Fatalf("could not make tempfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("this is not an archive")
+	f.Close()
+
+	if _, err := ReadSnapshotMeta(f.Name()); err == nil {
+		t.Errorf("reading an invalid snapshot should have failed")
+	}
+}
+
+// startTestEtcd starts an etcd server in the dir with these peer urls. It
+// returns a client of the server, and a function which stops it.
+func startTestEtcd(t *testing.T, dir, name string, peerURLs etcdtypes.URLs) (*ClientEtcd, func()) {
+	local, _ := etcdtypes.NewURLs([]string{"http://localhost:0"}) // pick a free port
+	cfg := embed.NewConfig()
+	cfg.Name = name
+	cfg.Dir = dir
+	cfg.LCUrls = local
+	cfg.ACUrls = local
+	cfg.LPUrls = peerURLs
+	cfg.APUrls = peerURLs
+	cfg.InitialCluster = cfg.InitialClusterFromName(name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("could not start etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(MaxStartServerTimeout * time.Second):
+		e.Close()
+		t.Fatalf("etcd startup timeout")
+	}
+	client := v3client.New(e.Server)
+	return &ClientEtcd{client: client}, func() {
+		client.Close()
+		e.Close()
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-snapshot-")
+	if err != nil {
+		t.Fatalf("could not make tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, SnapshotName(time.Now()))
+
+	obj, stop := startTestEtcd(t, path.Join(dir, "h1", "etcd"), "h1", freeURLs(t))
+	for id := uint64(1); id <= 2; id++ {
+		data := fmt.Sprintf("payload%d", id)
+		if err := AddDeploy(obj, id, fmt.Sprintf("hash%d", id), fmt.Sprintf("hash%d", id-1), &data, nil); err != nil {
+			stop()
+			t.Fatalf("could not add deploy: %v", err)
+		}
+	}
+	// the published state of the hosts of the old cluster
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	for _, h := range []string{"h1", "h2"} {
+		keys := map[string]string{
+			fmt.Sprintf("%s/volunteers/%s", NS, h):  "http://127.0.0.1:2380",
+			fmt.Sprintf("%s/nominated/%s", NS, h):   "http://127.0.0.1:2380",
+			fmt.Sprintf("%s/endpoints/%s", NS, h):   "http://127.0.0.1:2379",
+			fmt.Sprintf("%s/converged/%s", NS, h):   "true",
+			fmt.Sprintf("%s/seen/%s", NS, h):        "1514764800",
+			fmt.Sprintf("%s/labels/%s/role", NS, h): "web",
+		}
+		for key, value := range keys {
+			if _, err := obj.GetClient().Put(ctx, key, value); err != nil {
+				stop()
+				t.Fatalf("could not put `%s`: %v", key, err)
+			}
+		}
+	}
+
+	meta, err := NewSnapshotMeta(obj, "mgmt", "h1")
+	if err != nil {
+		stop()
+		t.Fatalf("could not make the metadata: %v", err)
+	}
+	err = SaveSnapshot(obj.GetClient(), meta, filename)
+	stop()
+	if err != nil {
+		t.Fatalf("could not save the snapshot: %v", err)
+	}
+	if s := fmt.Sprintf("%v %v", meta.Hosts, meta.Deploys); s != "[h1 h2] [1 2]" {
+		t.Errorf("unexpected metadata: %s", s)
+	}
+
+	prefix := path.Join(dir, "h3")
+	peerURLs := freeURLs(t)
+	restored, err := RestoreSnapshot(filename, prefix, "h3", peerURLs)
+	if err != nil {
+		t.Fatalf("could not restore the snapshot: %v", err)
+	}
+	if restored.Hostname != "h1" || restored.Revision != meta.Revision {
+		t.Errorf("unexpected restored metadata: %+v", restored)
+	}
+	if _, err := RestoreSnapshot(filename, prefix, "h3", peerURLs); err == nil {
+		t.Errorf("restoring over an existing data dir should fail")
+	}
+
+	obj, stop = startTestEtcd(t, path.Join(prefix, "etcd"), "h3", peerURLs)
+	defer stop()
+	deploys, err := GetDeploys(obj)
+	if err != nil {
+		t.Fatalf("could not get the deploys: %v", err)
+	}
+	if s := fmt.Sprintf("%v", deploys); s != "map[1:payload1 2:payload2]" {
+		t.Errorf("the deploys didn't survive: %s", s)
+	}
+	hosts, err := GetClusterHosts(obj)
+	if err != nil {
+		t.Fatalf("could not get the hosts: %v", err)
+	}
+	if len(hosts) != 0 {
+		t.Errorf("the state of the old hosts is still there: %+v", hosts)
+	}
+	labels, err := obj.Get(fmt.Sprintf("%s/labels/", NS), etcd.WithPrefix())
+	if err != nil {
+		t.Fatalf("could not get the labels: %v", err)
+	}
+	if len(labels) != 0 {
+		t.Errorf("the labels of the old hosts are still there: %v", labels)
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/purpleidea/mgmt/engine"
+
 	etcd "github.com/coreos/etcd/clientv3"
 	errwrap "github.com/pkg/errors"
 )
@@ -107,3 +109,55 @@ func SetStr(obj *EmbdEtcd, key string, data *string) error {
 	_, err := obj.Txn(ifs, ops, els) // TODO: do we need to look at response?
 	return errwrap.Wrapf(err, "could not set strings in: %s", key)
 }
+
+// SetStrOpts sets a key to a certain value, with the additional options. The
+// value can be attached to our lease with a TTL, so that it gets removed when
+// we go away, and it can be a compare-and-swap on the previously stored value.
+// It returns false if the value wasn't set because the comparison failed.
+func SetStrOpts(obj *EmbdEtcd, key, data string, opts *engine.StrOpts) (bool, error) {
+	// key structure is $NS/strings/$key = $data
+	path := fmt.Sprintf("%s/strings/%s", NS, key)
+	ok, err := setStrOpts(obj, path, data, opts)
+	return ok, errwrap.Wrapf(err, "could not set strings in: %s", key)
+}
+
+// setStrOpts sets the path to a value with the options. If the value is already
+// stored with the right lease, then nothing is written.
+func setStrOpts(obj *EmbdEtcd, path, data string, opts *engine.StrOpts) (bool, error) {
+	if opts == nil {
+		opts = &engine.StrOpts{}
+	}
+	leaseID := etcd.NoLease
+	putOpts := []etcd.OpOption{}
+	if opts.TTL > 0 {
+		var err error
+		if leaseID, err = obj.Lease(opts.TTL); err != nil {
+			return false, err
+		}
+		putOpts = append(putOpts, etcd.WithLease(leaseID))
+	}
+
+	// check for the desired state first, so we don't cause a watch event
+	ifs := []etcd.Cmp{
+		etcd.Compare(etcd.Value(path), "=", data),
+		etcd.Compare(etcd.LeaseValue(path), "=", leaseID),
+	}
+	if txn, err := obj.Txn(ifs, []etcd.Op{}, []etcd.Op{}); err != nil {
+		return false, err
+	} else if txn.Succeeded {
+		return true, nil // nothing to do
+	}
+
+	ifs = []etcd.Cmp{} // the compare-and-swap, if there is one
+	if prev := opts.Prev; prev != nil && *prev == "" {
+		ifs = append(ifs, etcd.Compare(etcd.Version(path), "=", 0)) // absent
+	} else if prev != nil {
+		ifs = append(ifs, etcd.Compare(etcd.Value(path), "=", *prev))
+	}
+	ops := []etcd.Op{etcd.OpPut(path, data, putOpts...)}
+	txn, err := obj.Txn(ifs, ops, []etcd.Op{})
+	if err != nil {
+		return false, err
+	}
+	return txn.Succeeded, nil
+}
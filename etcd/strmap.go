@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/util"
 
 	etcd "github.com/coreos/etcd/clientv3"
@@ -113,3 +114,13 @@ func SetStrMap(obj *EmbdEtcd, hostname, key string, data *string) error {
 	_, err := obj.Txn(ifs, ops, els) // TODO: do we need to look at response?
 	return errwrap.Wrapf(err, "could not set strings in: %s", key)
 }
+
+// SetStrMapOpts sets a key and hostname pair to a certain value, with the
+// additional options. See SetStrOpts for the details of the options. It returns
+// false if the value wasn't set because the comparison failed.
+func SetStrMapOpts(obj *EmbdEtcd, hostname, key, data string, opts *engine.StrOpts) (bool, error) {
+	// key structure is $NS/strings/$key/$hostname = $data
+	path := fmt.Sprintf("%s/strings/%s/%s", NS, key, hostname)
+	ok, err := setStrOpts(obj, path, data, opts)
+	return ok, errwrap.Wrapf(err, "could not set strings in: %s", key)
+}
@@ -25,6 +25,10 @@ import (
 	"github.com/purpleidea/mgmt/engine"
 	etcdfs "github.com/purpleidea/mgmt/etcd/fs"
 	"github.com/purpleidea/mgmt/etcd/scheduler"
+	"github.com/purpleidea/mgmt/pgp"
+
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
 )
 
 // World is an etcd backed implementation of the World interface.
@@ -34,14 +38,37 @@ type World struct {
 	MetadataPrefix string    // expected metadata prefix
 	StoragePrefix  string    // storage prefix for etcdfs storage
 	StandaloneFs   engine.Fs // store an fs here for local usage
+	PgpKeys        *pgp.PGP  // key pair of this host, which decrypts secrets
 	Debug          bool
 	Logf           func(format string, v ...interface{})
 }
 
+// watchCtx forwards the events of a watch until the context is cancelled.
+// FIXME: the etcd watch itself keeps running, since AddWatcher can't cancel it
+// without it getting restarted like it is on a reconnect.
+func watchCtx(ctx context.Context, ch chan error) chan error {
+	out := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case err := <-ch:
+				select {
+				case out <- err:
+				default: // an event is already pending
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
 // ResWatch returns a channel which spits out events on possible exported
 // resource changes.
-func (obj *World) ResWatch() chan error {
-	return WatchResources(obj.EmbdEtcd)
+func (obj *World) ResWatch(ctx context.Context) chan error {
+	return watchCtx(ctx, WatchResources(obj.EmbdEtcd))
 }
 
 // ResExport exports a list of resources under our hostname namespace.
@@ -50,18 +77,19 @@ func (obj *World) ResExport(resourceList []engine.Res) error {
 	return SetResources(obj.EmbdEtcd, obj.Hostname, resourceList)
 }
 
-// ResCollect gets the collection of exported resources which match the filter.
-// It does this atomically so that a call always returns a complete collection.
-func (obj *World) ResCollect(hostnameFilter, kindFilter []string) ([]engine.Res, error) {
+// ResCollect gets the collection of exported resources which match each of the
+// filters. It does this atomically so that a call always returns a complete and
+// consistent set of collections.
+func (obj *World) ResCollect(filters []*engine.ResFilter) ([][]engine.Res, error) {
 	// XXX: should we be restricted to retrieving resources that were
 	// exported with a tag that allows or restricts our hostname? We could
 	// enforce that here if the underlying API supported it... Add this?
-	return GetResources(obj.EmbdEtcd, hostnameFilter, kindFilter)
+	return GetResources(obj.EmbdEtcd, filters)
 }
 
 // StrWatch returns a channel which spits out events on possible string changes.
-func (obj *World) StrWatch(namespace string) chan error {
-	return WatchStr(obj.EmbdEtcd, namespace)
+func (obj *World) StrWatch(ctx context.Context, namespace string) chan error {
+	return watchCtx(ctx, WatchStr(obj.EmbdEtcd, namespace))
 }
 
 // StrIsNotExist returns whether the error from StrGet is a key missing error.
@@ -79,14 +107,20 @@ func (obj *World) StrSet(namespace, value string) error {
 	return SetStr(obj.EmbdEtcd, namespace, &value)
 }
 
+// StrSetOpts sets the namespace value to a particular string, with a TTL or a
+// compare-and-swap. It returns false if the comparison failed.
+func (obj *World) StrSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	return SetStrOpts(obj.EmbdEtcd, namespace, value, opts)
+}
+
 // StrDel deletes the value in a particular namespace.
 func (obj *World) StrDel(namespace string) error {
 	return SetStr(obj.EmbdEtcd, namespace, nil)
 }
 
 // StrMapWatch returns a channel which spits out events on possible string changes.
-func (obj *World) StrMapWatch(namespace string) chan error {
-	return WatchStrMap(obj.EmbdEtcd, namespace)
+func (obj *World) StrMapWatch(ctx context.Context, namespace string) chan error {
+	return watchCtx(ctx, WatchStrMap(obj.EmbdEtcd, namespace))
 }
 
 // StrMapGet returns a map of hostnames to values in the given namespace.
@@ -100,11 +134,75 @@ func (obj *World) StrMapSet(namespace, value string) error {
 	return SetStrMap(obj.EmbdEtcd, obj.Hostname, namespace, &value)
 }
 
+// StrMapSetOpts sets the namespace value to a particular string under the
+// identity of its own hostname, with a TTL or a compare-and-swap. It returns
+// false if the comparison failed.
+func (obj *World) StrMapSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	return SetStrMapOpts(obj.EmbdEtcd, obj.Hostname, namespace, value, opts)
+}
+
 // StrMapDel deletes the value in a particular namespace.
 func (obj *World) StrMapDel(namespace string) error {
 	return SetStrMap(obj.EmbdEtcd, obj.Hostname, namespace, nil)
 }
 
+// HostsWatch returns a channel which spits out events on possible host label
+// changes.
+func (obj *World) HostsWatch(ctx context.Context) chan error {
+	return watchCtx(ctx, WatchLabels(obj.EmbdEtcd))
+}
+
+// HostLabelsSet publishes the labels of this host, replacing its old labels.
+func (obj *World) HostLabelsSet(labels map[string]string) error {
+	return SetLabels(obj.EmbdEtcd, obj.Hostname, labels)
+}
+
+// HostLabels returns the published labels of each host.
+func (obj *World) HostLabels() (map[string]map[string]string, error) {
+	return GetLabels(obj.EmbdEtcd, []string{})
+}
+
+// HostsSelect returns the sorted list of hosts whose labels match the label
+// selector.
+func (obj *World) HostsSelect(selector string) ([]string, error) {
+	s, err := engine.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	hostLabels, err := GetLabels(obj.EmbdEtcd, []string{})
+	if err != nil {
+		return nil, err
+	}
+	return s.Select(hostLabels), nil
+}
+
+// SecretWatch returns a channel which spits out events on possible changes to
+// the named secret.
+func (obj *World) SecretWatch(ctx context.Context, name string) chan error {
+	return watchCtx(ctx, WatchSecret(obj.EmbdEtcd, name))
+}
+
+// SecretGet returns the decrypted value of the named secret. This host must be
+// one of its recipients.
+func (obj *World) SecretGet(name string) (string, error) {
+	_, values, err := GetSecret(obj.EmbdEtcd, name)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't get secret `%s`", name)
+	}
+	encrypted, exists := values[obj.Hostname]
+	if !exists {
+		return "", fmt.Errorf("secret `%s` isn't encrypted for this host", name)
+	}
+	if obj.PgpKeys == nil {
+		return "", fmt.Errorf("can't decrypt secret `%s` without pgp keys", name)
+	}
+	value, err := obj.PgpKeys.Decrypt(encrypted)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't decrypt secret `%s`", name)
+	}
+	return value, nil
+}
+
 // Scheduler returns a scheduling result of hosts in a particular namespace.
 func (obj *World) Scheduler(namespace string, opts ...scheduler.Option) (*scheduler.Result, error) {
 	modifiedOpts := []scheduler.Option{}
@@ -114,6 +212,10 @@ func (obj *World) Scheduler(namespace string, opts ...scheduler.Option) (*schedu
 
 	modifiedOpts = append(modifiedOpts, scheduler.Debug(obj.Debug))
 	modifiedOpts = append(modifiedOpts, scheduler.Logf(obj.Logf))
+	modifiedOpts = append(modifiedOpts, scheduler.HostLabelsFunc(obj.HostLabels))
+	modifiedOpts = append(modifiedOpts, scheduler.ScheduledFunc(func(namespace string) ([]string, error) {
+		return scheduler.Scheduled(obj.EmbdEtcd.GetClient(), fmt.Sprintf("%s/scheduler/%s", NS, namespace))
+	}))
 
 	return scheduler.Schedule(obj.EmbdEtcd.GetClient(), fmt.Sprintf("%s/scheduler/%s", NS, namespace), obj.Hostname, modifiedOpts...)
 }
@@ -0,0 +1,101 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package etcd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/converger"
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/world/worldtest"
+
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+)
+
+// freeURLs returns a localhost url on an unused port.
+func freeURLs(t *testing.T) etcdtypes.URLs {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	urls, err := etcdtypes.NewURLs([]string{fmt.Sprintf("http://%s", addr)})
+	if err != nil {
+		t.Fatalf("could not parse urls: %v", err)
+	}
+	return urls
+}
+
+func TestWorld(t *testing.T) {
+	suite := &worldtest.Suite{
+		New: func(t *testing.T) (func(string) engine.World, func()) {
+			dir, err := ioutil.TempDir("", "mgmt-etcd-world-")
+			if err != nil {
+				t.Fatalf("could not make tempdir: %v", err)
+			}
+			conv := converger.NewConverger(-1)
+			go conv.Loop(true)
+			embdEtcd := NewEmbdEtcd("h1", nil, freeURLs(t), freeURLs(t), nil, nil, false, 1, Flags{}, dir, conv)
+			if embdEtcd == nil {
+				os.RemoveAll(dir)
+				t.Fatalf("etcd creation failed")
+			}
+			if err := embdEtcd.Startup(); err != nil {
+				os.RemoveAll(dir)
+				t.Fatalf("etcd startup failed with: %v", err)
+			}
+			cleanup := func() {
+				if err := embdEtcd.Destroy(); err != nil {
+					t.Errorf("etcd destroy failed with: %v", err)
+				}
+				os.RemoveAll(dir)
+			}
+			select {
+			case <-embdEtcd.ServerReady():
+			case <-time.After(MaxStartServerTimeout * time.Second):
+				cleanup()
+				t.Fatalf("etcd startup timeout")
+			}
+
+			// all the hosts share the one etcd server
+			world := func(hostname string) engine.World {
+				return &World{
+					Hostname:       hostname,
+					EmbdEtcd:       embdEtcd,
+					MetadataPrefix: NS + "/fs",
+					StoragePrefix:  NS + "/storage",
+					Logf: func(format string, v ...interface{}) {
+						t.Logf("world: "+hostname+": "+format, v...)
+					},
+				}
+			}
+			return world, cleanup
+		},
+		FsURI: "etcdfs://" + NS + "/fs/deploy",
+		// SecretSet is nil, since the hosts would all need pgp keys
+	}
+	suite.Run(t)
+}
@@ -0,0 +1,193 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package funcs
+
+import (
+	"context"
+
+	"github.com/purpleidea/mgmt/engine"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// CollectFuncName is the name this function is registered as. This
+	// starts with an underscore so that it cannot be used from the lexer.
+	CollectFuncName = "_collect"
+)
+
+func init() {
+	Register(CollectFuncName, func() interfaces.Func { return &CollectFunc{} }) // must register the func and name
+}
+
+// CollectFunc is a special function which returns the exported resources that
+// match a query. They are returned as a list of encoded resources, which the
+// collect statement decodes and adds to the graph. It returns a new list each
+// time that the exported resources change.
+type CollectFunc struct {
+	init *interfaces.Init
+
+	filter *engine.ResFilter
+
+	last   types.Value
+	result types.Value // last calculated output
+
+	watchChan chan error
+	closeChan chan struct{}
+}
+
+// Validate makes sure we've built our struct properly. It is usually unused for
+// normal functions that users can use directly.
+func (obj *CollectFunc) Validate() error {
+	return nil
+}
+
+// Info returns some static info about itself.
+func (obj *CollectFunc) Info() *interfaces.Info {
+	return &interfaces.Info{
+		Pure: false, // definitely false
+		Memo: false,
+		// output is a list of encoded resources
+		Sig: types.NewType("func(kind str, hostnames []str, labels str, name str, nameregexp str, fields []str, sort str, limit int) []str"),
+		Err: obj.Validate(),
+	}
+}
+
+// Init runs some startup code for this function.
+func (obj *CollectFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	obj.watchChan = make(chan error) // XXX: sender should close this, but did I implement that part yet???
+	obj.closeChan = make(chan struct{})
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *CollectFunc) Stream() error {
+	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				obj.init.Input = nil // don't infinite loop back
+				continue             // no more inputs, but don't return!
+			}
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			filter, err := obj.buildFilter(input)
+			if err != nil {
+				return err
+			}
+			if obj.init.Debug {
+				obj.init.Logf("filter: %+v", filter)
+			}
+			if obj.filter == nil { // watch once we know what to collect
+				obj.watchChan = obj.init.World.ResWatch(ctx)
+			}
+			obj.filter = filter // the query can change over time
+
+		case err, ok := <-obj.watchChan:
+			if !ok { // closed
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "channel watch failed on collect")
+			}
+
+		case <-obj.closeChan:
+			return nil
+		}
+
+		result, err := obj.buildList() // build the list...
+		if err != nil {
+			return err
+		}
+
+		// if the result is still the same, skip sending an update...
+		if obj.result != nil && result.Cmp(obj.result) == nil {
+			continue // result didn't change
+		}
+		obj.result = result // store new result
+
+		select {
+		case obj.init.Output <- obj.result: // send
+			// pass
+		case <-obj.closeChan:
+			return nil
+		}
+	}
+}
+
+// Close runs some shutdown code for this function and turns off the stream.
+func (obj *CollectFunc) Close() error {
+	close(obj.closeChan)
+	return nil
+}
+
+// buildFilter builds the resource filter from the input args.
+func (obj *CollectFunc) buildFilter(input types.Value) (*engine.ResFilter, error) {
+	args := input.Struct()
+	strs := func(value types.Value) []string {
+		result := []string{}
+		for _, x := range value.List() {
+			result = append(result, x.Str())
+		}
+		return result
+	}
+	filter := &engine.ResFilter{
+		Kind:       args["kind"].Str(),
+		Hostnames:  strs(args["hostnames"]),
+		Labels:     args["labels"].Str(),
+		Name:       args["name"].Str(),
+		NameRegexp: args["nameregexp"].Str(),
+		Fields:     strs(args["fields"]),
+		Sort:       args["sort"].Str(),
+		Limit:      int(args["limit"].Int()),
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, errwrap.Wrapf(err, "invalid collect of kind %s", filter.Kind)
+	}
+	return filter, nil
+}
+
+// buildList builds the list of encoded resources which match the filter.
+func (obj *CollectFunc) buildList() (types.Value, error) {
+	collections, err := obj.init.World.ResCollect([]*engine.ResFilter{obj.filter})
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not collect resources")
+	}
+
+	l := types.NewList(obj.Info().Sig.Out)
+	for _, res := range collections[0] {
+		s, err := engineUtil.ResToB64(res)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "could not encode %s", res)
+		}
+		if err := l.Add(&types.StrValue{V: s}); err != nil {
+			return nil, errwrap.Wrapf(err, "list could not add resource %s", res)
+		}
+	}
+	return l, nil
+}
@@ -18,6 +18,7 @@
 package core // TODO: should this be in its own individual package?
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/purpleidea/mgmt/lang/funcs"
@@ -76,6 +77,8 @@ func (obj *ExchangeFunc) Init(init *interfaces.Init) error {
 // Stream returns the changing values that this func has over time.
 func (obj *ExchangeFunc) Stream() error {
 	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
 	for {
 		select {
 		// TODO: should this first chan be run as a priority channel to
@@ -106,8 +109,8 @@ func (obj *ExchangeFunc) Stream() error {
 			// TODO: support changing the namespace over time...
 			// TODO: possibly removing our stored value there first!
 			if obj.namespace == "" {
-				obj.namespace = namespace                                 // store it
-				obj.watchChan = obj.init.World.StrMapWatch(obj.namespace) // watch for var changes
+				obj.namespace = namespace                                      // store it
+				obj.watchChan = obj.init.World.StrMapWatch(ctx, obj.namespace) // watch for var changes
 			} else if obj.namespace != namespace {
 				return fmt.Errorf("can't change namespace, previously: `%s`", obj.namespace)
 			}
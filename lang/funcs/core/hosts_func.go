@@ -0,0 +1,160 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core // TODO: should this be in its own individual package?
+
+import (
+	"context"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/lang/funcs"
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	funcs.Register("hosts", func() interfaces.Func { return &HostsFunc{} }) // must register the func and name
+}
+
+// HostsFunc is special function which returns the sorted list of hosts whose
+// labels match a label selector, such as `role=db,rack=3`. The empty selector
+// returns every host which has published its labels. It returns a new list each
+// time that the matching hosts change.
+type HostsFunc struct {
+	init *interfaces.Init
+
+	selector string
+
+	last   types.Value
+	result types.Value // last calculated output
+
+	watchChan chan error
+	closeChan chan struct{}
+}
+
+// Validate makes sure we've built our struct properly. It is usually unused for
+// normal functions that users can use directly.
+func (obj *HostsFunc) Validate() error {
+	return nil
+}
+
+// Info returns some static info about itself.
+func (obj *HostsFunc) Info() *interfaces.Info {
+	return &interfaces.Info{
+		Pure: false, // definitely false
+		Memo: false,
+		// output is a sorted list of hostnames
+		Sig: types.NewType("func(selector str) []str"),
+		Err: obj.Validate(),
+	}
+}
+
+// Init runs some startup code for this function.
+func (obj *HostsFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	obj.watchChan = make(chan error) // XXX: sender should close this, but did I implement that part yet???
+	obj.closeChan = make(chan struct{})
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *HostsFunc) Stream() error {
+	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
+	started := false
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				obj.init.Input = nil // don't infinite loop back
+				continue             // no more inputs, but don't return!
+			}
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			selector := input.Struct()["selector"].Str()
+			if _, err := engine.ParseLabelSelector(selector); err != nil {
+				return errwrap.Wrapf(err, "invalid selector")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("selector: %s", selector)
+			}
+			obj.selector = selector // the selector can change over time
+
+			if !started { // watch once we know what to select
+				obj.watchChan = obj.init.World.HostsWatch(ctx)
+				started = true
+			}
+
+		case err, ok := <-obj.watchChan:
+			if !ok { // closed
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "channel watch failed on hosts")
+			}
+
+		case <-obj.closeChan:
+			return nil
+		}
+
+		result, err := obj.buildList() // build the list...
+		if err != nil {
+			return err
+		}
+
+		// if the result is still the same, skip sending an update...
+		if obj.result != nil && result.Cmp(obj.result) == nil {
+			continue // result didn't change
+		}
+		obj.result = result // store new result
+
+		select {
+		case obj.init.Output <- obj.result: // send
+			// pass
+		case <-obj.closeChan:
+			return nil
+		}
+	}
+}
+
+// Close runs some shutdown code for this function and turns off the stream.
+func (obj *HostsFunc) Close() error {
+	close(obj.closeChan)
+	return nil
+}
+
+// buildList builds the list of hosts which match the selector.
+func (obj *HostsFunc) buildList() (types.Value, error) {
+	hostnames, err := obj.init.World.HostsSelect(obj.selector)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not select hosts with `%s`", obj.selector)
+	}
+
+	l := types.NewList(obj.Info().Sig.Out)
+	for _, hostname := range hostnames {
+		if err := l.Add(&types.StrValue{V: hostname}); err != nil {
+			return nil, errwrap.Wrapf(err, "list could not add hostname `%s`", hostname)
+		}
+	}
+	return l, nil
+}
@@ -18,6 +18,7 @@
 package core // TODO: should this be in its own individual package?
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/purpleidea/mgmt/lang/funcs"
@@ -74,6 +75,8 @@ func (obj *KVLookupFunc) Init(init *interfaces.Init) error {
 // Stream returns the changing values that this func has over time.
 func (obj *KVLookupFunc) Stream() error {
 	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
 	for {
 		select {
 		// TODO: should this first chan be run as a priority channel to
@@ -104,8 +107,8 @@ func (obj *KVLookupFunc) Stream() error {
 			// TODO: support changing the namespace over time...
 			// TODO: possibly removing our stored value there first!
 			if obj.namespace == "" {
-				obj.namespace = namespace                                 // store it
-				obj.watchChan = obj.init.World.StrMapWatch(obj.namespace) // watch for var changes
+				obj.namespace = namespace                                      // store it
+				obj.watchChan = obj.init.World.StrMapWatch(ctx, obj.namespace) // watch for var changes
 
 				result, err := obj.buildMap() // build the map...
 				if err != nil {
@@ -33,6 +33,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/etcd/scheduler" // TODO: is it okay to import this without abstraction?
 	"github.com/purpleidea/mgmt/lang/funcs"
 	"github.com/purpleidea/mgmt/lang/interfaces"
@@ -74,6 +75,10 @@ func (obj *SchedulePolyFunc) validOpts() map[string]*types.Type {
 		"max":      types.TypeInt,
 		"reuse":    types.TypeBool,
 		"ttl":      types.TypeInt,
+		"labels":   types.TypeStr,
+		"weight":   types.TypeStr,
+		"spread":   types.TypeStr,
+		"anti":     types.NewType("[]str"),
 	}
 }
 
@@ -334,6 +339,52 @@ func (obj *SchedulePolyFunc) Stream() error {
 					schedulerOpts = append(schedulerOpts, scheduler.SessionTTL(ttl))
 				}
 			}
+			if val, exists := opts["labels"]; exists {
+				if labels := val.Str(); labels != "" {
+					if obj.init.Debug {
+						obj.init.Logf("opts: labels: %s", labels)
+					}
+					if _, err := engine.ParseLabelSelector(labels); err != nil {
+						return errwrap.Wrapf(err, "invalid labels")
+					}
+					world := obj.init.World // only schedule on these hosts
+					schedulerOpts = append(schedulerOpts, scheduler.HostsFilterFunc(func() ([]string, error) {
+						return world.HostsSelect(labels)
+					}))
+				}
+			}
+
+			if val, exists := opts["weight"]; exists {
+				if weight := val.Str(); weight != "" {
+					if obj.init.Debug {
+						obj.init.Logf("opts: weight: %s", weight)
+					}
+					schedulerOpts = append(schedulerOpts, scheduler.WeightLabel(weight))
+				}
+			}
+			if val, exists := opts["spread"]; exists {
+				if spread := val.Str(); spread != "" {
+					if obj.init.Debug {
+						obj.init.Logf("opts: spread: %s", spread)
+					}
+					schedulerOpts = append(schedulerOpts, scheduler.SpreadLabel(spread))
+				}
+			}
+			if val, exists := opts["anti"]; exists {
+				anti := []string{}
+				for _, x := range val.List() {
+					if x.Str() == namespace {
+						return fmt.Errorf("can't be anti-affine with itself")
+					}
+					anti = append(anti, x.Str())
+				}
+				if len(anti) > 0 {
+					if obj.init.Debug {
+						obj.init.Logf("opts: anti: %v", anti)
+					}
+					schedulerOpts = append(schedulerOpts, scheduler.AntiAffinity(anti))
+				}
+			}
 
 			// TODO: support changing the namespace over time...
 			// TODO: possibly removing our stored value there first!
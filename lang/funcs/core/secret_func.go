@@ -0,0 +1,172 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package core // TODO: should this be in its own individual package?
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/purpleidea/mgmt/lang/funcs"
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	funcs.Register("secret", func() interfaces.Func { return &SecretFunc{} }) // must register the func and name
+}
+
+// SecretFunc is a function which returns the decrypted value of a secret from
+// the exposed world. The value is never logged, but anything it is passed to
+// can still leak it, so it's usually better to use the secret param of a
+// resource, which looks it up itself, instead of this function.
+type SecretFunc struct {
+	init *interfaces.Init
+
+	name string
+
+	last   types.Value
+	result types.Value // last calculated output
+
+	watchChan chan error
+	closeChan chan struct{}
+}
+
+// Validate makes sure we've built our struct properly. It is usually unused for
+// normal functions that users can use directly.
+func (obj *SecretFunc) Validate() error {
+	return nil
+}
+
+// Info returns some static info about itself.
+func (obj *SecretFunc) Info() *interfaces.Info {
+	return &interfaces.Info{
+		Pure: false, // definitely false
+		Memo: false,
+		Sig:  types.NewType("func(name str) str"),
+		Err:  obj.Validate(),
+	}
+}
+
+// Init runs some startup code for this function.
+func (obj *SecretFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	obj.watchChan = make(chan error) // XXX: sender should close this, but did I implement that part yet???
+	obj.closeChan = make(chan struct{})
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *SecretFunc) Stream() error {
+	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // removes the watch
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				obj.init.Input = nil // don't infinite loop back
+				continue             // no more inputs, but don't return!
+			}
+			//if err := input.Type().Cmp(obj.Info().Sig.Input); err != nil {
+			//	return errwrap.Wrapf(err, "wrong function input")
+			//}
+
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			name := input.Struct()["name"].Str()
+			if name == "" {
+				return fmt.Errorf("can't use an empty secret name")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("name: %s", name) // never log the value!
+			}
+
+			// TODO: support changing the name over time...
+			if obj.name == "" {
+				obj.name = name                                           // store it
+				obj.watchChan = obj.init.World.SecretWatch(ctx, obj.name) // watch for changes
+
+				result, err := obj.get()
+				if err != nil {
+					return err
+				}
+				obj.result = result // store new result
+				select {
+				case obj.init.Output <- result: // send one!
+					// pass
+				case <-obj.closeChan:
+					return nil
+				}
+
+			} else if obj.name != name {
+				return fmt.Errorf("can't change secret name, previously: `%s`", obj.name)
+			}
+
+			continue // we get values on the watch chan, not here!
+
+		case err, ok := <-obj.watchChan:
+			if !ok { // closed
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "channel watch failed on secret `%s`", obj.name)
+			}
+
+			result, err := obj.get()
+			if err != nil {
+				return err
+			}
+
+			// if the result is still the same, skip sending an update...
+			if obj.result != nil && result.Cmp(obj.result) == nil {
+				continue // result didn't change
+			}
+			obj.result = result // store new result
+
+		case <-obj.closeChan:
+			return nil
+		}
+
+		select {
+		case obj.init.Output <- obj.result: // send
+			// pass
+		case <-obj.closeChan:
+			return nil
+		}
+	}
+}
+
+// Close runs some shutdown code for this function and turns off the stream.
+func (obj *SecretFunc) Close() error {
+	close(obj.closeChan)
+	return nil
+}
+
+// get returns the decrypted value of the secret. The error doesn't contain it.
+func (obj *SecretFunc) get() (types.Value, error) {
+	value, err := obj.init.World.SecretGet(obj.name)
+	if err != nil {
+		return nil, err // this already includes the secret name
+	}
+	return &types.StrValue{V: value}, nil
+}
@@ -0,0 +1,60 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package simplepoly // TODO: should this be in its own individual package?
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/purpleidea/mgmt/lang/types"
+
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	Register("json_encode", []*types.FuncValue{
+		{
+			T: types.NewType("func([]variant) str"),
+			V: JSONEncode,
+		},
+		{
+			T: types.NewType("func(map{variant: variant}) str"),
+			V: JSONEncode,
+		},
+	})
+}
+
+// JSONEncode returns the JSON encoding of a list or a map. This lets us store
+// structured values as strings, such as with the kv resource. The keys of each
+// map are sorted, so that the same value always has the same encoding.
+func JSONEncode(input []types.Value) (types.Value, error) {
+	switch k := input[0].Type().Kind; k {
+	case types.KindList, types.KindMap:
+	default:
+		return nil, fmt.Errorf("unsupported kind: %+v", k)
+	}
+
+	b, err := json.Marshal(input[0].Value())
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not encode the value")
+	}
+
+	return &types.StrValue{
+		V: string(b),
+	}, nil
+}
@@ -43,6 +43,7 @@ const (
 	operatorFuncName = funcs.OperatorFuncName
 	historyFuncName  = funcs.HistoryFuncName
 	containsFuncName = funcs.ContainsFuncName
+	collectFuncName  = funcs.CollectFuncName
 )
 
 // Lang is the main language lexer/parser object.
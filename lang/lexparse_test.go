@@ -1049,6 +1049,51 @@ func TestLexParse0(t *testing.T) {
 			exp:  exp,
 		})
 	}
+	{
+		exp := &StmtProg{
+			Prog: []interfaces.Stmt{
+				&StmtCollect{
+					Kind: "file",
+					Contents: []StmtResContents{
+						&StmtResField{
+							Field: "name",
+							Value: &ExprStr{
+								V: "/tmp/*",
+							},
+						},
+						&StmtResField{
+							Field: "limit",
+							Value: &ExprInt{
+								V: 2,
+							},
+						},
+					},
+				},
+			},
+		}
+		values = append(values, test{
+			name: "simple collect 1",
+			code: `
+			collect file {
+				name => "/tmp/*",
+				limit => 2,
+			}
+			`,
+			fail: false,
+			exp:  exp,
+		})
+	}
+	{
+		values = append(values, test{
+			name: "collect needs a kind",
+			code: `
+			collect {
+				name => "/tmp/*",
+			}
+			`,
+			fail: true,
+		})
+	}
 
 	for index, test := range values { // run all the tests
 		name, code, fail, exp := test.name, test.code, test.fail, test.exp
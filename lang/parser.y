@@ -85,7 +85,7 @@ func init() {
 %token STR_IDENTIFIER BOOL_IDENTIFIER INT_IDENTIFIER FLOAT_IDENTIFIER
 %token MAP_IDENTIFIER STRUCT_IDENTIFIER VARIANT_IDENTIFIER VAR_IDENTIFIER IDENTIFIER
 %token VAR_IDENTIFIER_HX CAPITALIZED_IDENTIFIER
-%token CLASS_IDENTIFIER INCLUDE_IDENTIFIER
+%token CLASS_IDENTIFIER INCLUDE_IDENTIFIER COLLECT_IDENTIFIER
 %token COMMENT ERROR
 
 // precedence table
@@ -227,6 +227,15 @@ stmt:
 			Args: $4.exprs,
 		}
 	}
+	// `collect kind { <field> => <expr>, ... }`
+|	COLLECT_IDENTIFIER IDENTIFIER OPEN_CURLY resource_body CLOSE_CURLY
+	{
+		posLast(yylex, yyDollar) // our pos
+		$$.stmt = &StmtCollect{
+			Kind:     $2.str,
+			Contents: $4.resContents,
+		}
+	}
 /*
 	// resource bind
 |	rbind
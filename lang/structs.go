@@ -1571,6 +1571,212 @@ func (obj *StmtInclude) Output() (*interfaces.Output, error) {
 	return obj.class.Output()
 }
 
+// StmtCollect is a representation of a collect statement. It adds the exported
+// resources which match its query to the graph. The query is specified with the
+// same field syntax as a resource, and the special pattern field is passed to
+// any collected resources which support it.
+type StmtCollect struct {
+	Kind     string            // kind of resource to collect, eg: file
+	Contents []StmtResContents // list of query fields in parsed order
+
+	call    *ExprCall       // the function call which does the collecting
+	pattern interfaces.Expr // the pattern to pass on, if any
+}
+
+// collectFields are the valid fields of the collect statement. The first ones
+// are the args of the collect function, in order, followed by the pattern.
+var collectFields = []string{"hostnames", "labels", "name", "nameregexp", "fields", "sort", "limit", "pattern"}
+
+// Interpolate returns a new node (aka a copy) once it has been expanded. This
+// generally increases the size of the AST when it is used. It calls Interpolate
+// on any child elements and builds the new node with those new node contents.
+// This also builds the function call which is used to collect the resources.
+func (obj *StmtCollect) Interpolate() (interfaces.Stmt, error) {
+	contents := []StmtResContents{}
+	fields := make(map[string]interfaces.Expr)
+	for _, line := range obj.Contents {
+		x, ok := line.(*StmtResField)
+		if !ok {
+			return nil, fmt.Errorf("collect of kind `%s` cannot have edges", obj.Kind)
+		}
+		if x.Condition != nil {
+			return nil, fmt.Errorf("collect field `%s` cannot be conditional", x.Field)
+		}
+		if !util.StrInList(x.Field, collectFields) {
+			return nil, fmt.Errorf("collect field `%s` does not exist", x.Field)
+		}
+		if _, exists := fields[x.Field]; exists {
+			return nil, fmt.Errorf("collect field `%s` was specified more than once", x.Field)
+		}
+		interpolated, err := x.Interpolate()
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, interpolated)
+		fields[x.Field] = interpolated.(*StmtResField).Value
+	}
+
+	// the defaults for any fields that weren't specified
+	strList := func() interfaces.Expr {
+		expr := &ExprList{Elements: []interfaces.Expr{}}
+		if err := expr.SetType(types.NewType("[]str")); err != nil {
+			panic(err) // programming error
+		}
+		return expr
+	}
+	defaults := map[string]func() interfaces.Expr{
+		"hostnames":  strList,
+		"labels":     func() interfaces.Expr { return &ExprStr{V: ""} },
+		"name":       func() interfaces.Expr { return &ExprStr{V: ""} },
+		"nameregexp": func() interfaces.Expr { return &ExprStr{V: ""} },
+		"fields":     strList,
+		"sort":       func() interfaces.Expr { return &ExprStr{V: ""} },
+		"limit":      func() interfaces.Expr { return &ExprInt{V: 0} },
+	}
+
+	args := []interfaces.Expr{&ExprStr{V: obj.Kind}}
+	for _, field := range collectFields[:len(collectFields)-1] { // not pattern
+		expr, exists := fields[field]
+		if !exists {
+			expr = defaults[field]()
+		}
+		args = append(args, expr)
+	}
+
+	return &StmtCollect{
+		Kind:     obj.Kind,
+		Contents: contents,
+		call: &ExprCall{
+			Name: collectFuncName,
+			Args: args,
+		},
+		pattern: fields["pattern"], // nil if it was not specified
+	}, nil
+}
+
+// SetScope stores the scope for later use in this statement and it's children,
+// which it propagates this downwards to.
+func (obj *StmtCollect) SetScope(scope *interfaces.Scope) error {
+	if obj.call == nil {
+		return fmt.Errorf("collect of kind `%s` was not interpolated", obj.Kind)
+	}
+	if err := obj.call.SetScope(scope); err != nil {
+		return err
+	}
+	if obj.pattern != nil {
+		return obj.pattern.SetScope(scope)
+	}
+	return nil
+}
+
+// Unify returns the list of invariants that this node produces. It recursively
+// calls Unify on any children elements that exist in the AST, and returns the
+// collection to the caller.
+func (obj *StmtCollect) Unify() ([]interfaces.Invariant, error) {
+	if obj.call == nil {
+		return nil, fmt.Errorf("collect of kind `%s` was not interpolated", obj.Kind)
+	}
+	var invariants []interfaces.Invariant
+
+	invars, err := obj.call.Unify()
+	if err != nil {
+		return nil, err
+	}
+	invariants = append(invariants, invars...)
+
+	if obj.pattern != nil {
+		invars, err := obj.pattern.Unify()
+		if err != nil {
+			return nil, err
+		}
+		invariants = append(invariants, invars...)
+
+		// pattern must be a string
+		invar := &unification.EqualsInvariant{
+			Expr: obj.pattern,
+			Type: types.TypeStr,
+		}
+		invariants = append(invariants, invar)
+	}
+
+	return invariants, nil
+}
+
+// Graph returns the reactive function graph which is expressed by this node. It
+// includes any vertices produced by this node, and the appropriate edges to any
+// vertices that are produced by its children. Nodes which fulfill the Expr
+// interface directly produce vertices (and possible children) where as nodes
+// that fulfill the Stmt interface do not produces vertices, where as their
+// children might. This returns the graph of the collect function call, which
+// changes its value whenever the collected resources change.
+func (obj *StmtCollect) Graph() (*pgraph.Graph, error) {
+	if obj.call == nil {
+		return nil, fmt.Errorf("collect of kind `%s` was not interpolated", obj.Kind)
+	}
+	graph, err := pgraph.NewGraph("collect")
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not create graph")
+	}
+
+	g, err := obj.call.Graph()
+	if err != nil {
+		return nil, err
+	}
+	graph.AddGraph(g)
+
+	if obj.pattern != nil {
+		g, err := obj.pattern.Graph()
+		if err != nil {
+			return nil, err
+		}
+		graph.AddGraph(g)
+	}
+
+	return graph, nil
+}
+
+// Output returns the output that this "program" produces. This output is what
+// is used to build the output graph. This only exists for statements. The
+// analogous function for expressions is Value. Those Value functions might get
+// called by this Output function if they are needed to produce the output. In
+// the case of this collect statement, this decodes the collected resources.
+func (obj *StmtCollect) Output() (*interfaces.Output, error) {
+	if obj.call == nil {
+		return nil, fmt.Errorf("collect of kind `%s` was not interpolated", obj.Kind)
+	}
+	value, err := obj.call.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := ""
+	if obj.pattern != nil {
+		p, err := obj.pattern.Value()
+		if err != nil {
+			return nil, err
+		}
+		pattern = p.Str() // must not panic
+	}
+
+	resources := []engine.Res{}
+	for _, x := range value.List() {
+		res, err := engineUtil.B64ToRes(x.Str())
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "could not decode collected resource")
+		}
+		if pattern != "" { // XXX: simplistic for now
+			if xres, ok := res.(engine.CollectableRes); ok {
+				xres.CollectPattern(pattern)
+			}
+		}
+		resources = append(resources, res)
+	}
+
+	return &interfaces.Output{
+		Resources: resources,
+	}, nil
+}
+
 // StmtComment is a representation of a comment. It is currently unused. It
 // probably makes sense to make a third kind of Node (not a Stmt or an Expr) so
 // that comments can still be part of the AST (for eventual automatic code
@@ -60,6 +60,9 @@ func run(c *cli.Context) error {
 		obj.Hostname = &h
 	}
 
+	obj.Labels = c.StringSlice("label")
+	obj.LabelsFile = c.String("labels-file")
+
 	if s := c.String("prefix"); c.IsSet("prefix") && s != "" {
 		obj.Prefix = &s
 	}
@@ -116,6 +119,7 @@ func run(c *cli.Context) error {
 	obj.AdvertiseServerURLs = c.StringSlice("advertise-server-urls")
 	obj.IdealClusterSize = c.Int("ideal-cluster-size")
 	obj.NoServer = c.Bool("no-server")
+	obj.World = c.String("world")
 
 	obj.NoPgp = c.Bool("no-pgp")
 
@@ -126,6 +130,11 @@ func run(c *cli.Context) error {
 	if us := c.String("pgp-identity"); c.IsSet("pgp-identity") {
 		obj.PgpIdentity = &us
 	}
+	obj.PgpKeyring = c.String("pgp-keyring")
+
+	obj.SnapshotDir = c.String("snapshot-dir")
+	obj.SnapshotInterval = c.Int("snapshot-interval")
+	obj.SnapshotRetention = c.Int("snapshot-retention")
 
 	obj.Prometheus = c.Bool("prometheus")
 	obj.PrometheusListen = c.String("prometheus-listen")
@@ -210,6 +219,17 @@ func CLI(program, version string, flags Flags) error {
 			Value: "",
 			Usage: "hostname to use",
 		},
+		cli.StringSliceFlag{
+			Name:   "label, l",
+			Value:  &cli.StringSlice{},
+			Usage:  "key=value label to publish for this host, can be repeated",
+			EnvVar: "MGMT_LABELS",
+		},
+		cli.StringFlag{
+			Name:  "labels-file",
+			Value: "",
+			Usage: "file of key=value labels to publish for this host, one per line",
+		},
 
 		cli.StringFlag{
 			Name:   "prefix",
@@ -279,6 +299,12 @@ func CLI(program, version string, flags Flags) error {
 			EnvVar: "MGMT_MAX_RUNTIME",
 		},
 
+		cli.StringFlag{
+			Name:   "world",
+			Value:  "etcd",
+			Usage:  "world implementation to use: etcd, or memory for a single host",
+			EnvVar: "MGMT_WORLD",
+		},
 		// if empty, it will startup a new server
 		cli.StringSliceFlag{
 			Name:   "seeds, s",
@@ -339,6 +365,27 @@ func CLI(program, version string, flags Flags) error {
 			Value: "",
 			Usage: "default identity used for generation",
 		},
+		cli.StringFlag{
+			Name:  "pgp-keyring",
+			Value: "",
+			Usage: "only accept deploys which are signed by a key in this keyring",
+		},
+		cli.StringFlag{
+			Name:   "snapshot-dir",
+			Value:  "",
+			Usage:  "periodically write snapshots of the cluster data to this dir",
+			EnvVar: "MGMT_SNAPSHOT_DIR",
+		},
+		cli.IntFlag{
+			Name:  "snapshot-interval",
+			Value: 3600,
+			Usage: "number of seconds between the periodic snapshots",
+		},
+		cli.IntFlag{
+			Name:  "snapshot-retention",
+			Value: 24,
+			Usage: "number of periodic snapshots to keep",
+		},
 		cli.BoolFlag{
 			Name:  "prometheus",
 			Usage: "start a prometheus instance",
@@ -380,6 +427,41 @@ func CLI(program, version string, flags Flags) error {
 		}
 		subCommands = append(subCommands, command)
 	}
+	subCommands = append(subCommands, []cli.Command{ // deploy history commands
+		{
+			Name:   "list",
+			Usage:  "list the deploy history",
+			Action: deployAction(deployList),
+		},
+		{
+			Name:      "show",
+			Usage:     "show a deploy and the contents of its file system",
+			ArgsUsage: "<id>",
+			Action:    deployAction(deployShow),
+		},
+		{
+			Name:      "rollback",
+			Usage:     "add a new deploy which is a copy of an earlier one",
+			ArgsUsage: "<id>",
+			Action:    deployAction(deployRollback),
+		},
+		{
+			Name:   "gc",
+			Usage:  "remove the old deploys and their unused data, and compact etcd",
+			Action: deployAction(deployGC),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "keep",
+					Value: 10,
+					Usage: "number of the latest deploys to keep",
+				},
+				cli.DurationFlag{
+					Name:  "keep-for",
+					Usage: "also keep the deploys which are newer than this, eg: 720h",
+				},
+			},
+		},
+	}...)
 
 	app := cli.NewApp()
 	app.Name = program // App.name and App.version pass these values through
@@ -455,6 +537,121 @@ func CLI(program, version string, flags Flags) error {
 					Name:  "force",
 					Usage: "force a new deploy, even if the safety chain would break",
 				},
+				cli.IntFlag{
+					Name:  "max-size",
+					Value: 16,
+					Usage: "maximum total size in MiB of the files in a deploy; 0 for no limit",
+				},
+				cli.StringFlag{
+					Name:   "pgp-key-path",
+					Value:  "",
+					Usage:  "sign the deploy with the pgp key at this path",
+					EnvVar: "MGMT_PGP_KEY_PATH",
+				},
+			},
+		},
+		{
+			Name:  "cluster",
+			Usage: "inspect and manage the members of the cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:   "status",
+					Usage:  "show the members and the hosts of the cluster",
+					Action: clusterAction(clusterStatus),
+				},
+				{
+					Name:      "set-size",
+					Usage:     "set the ideal number of etcd servers in the cluster",
+					ArgsUsage: "<size>",
+					Action:    clusterAction(clusterSetSize),
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a dead host from the cluster",
+					ArgsUsage: "<hostname>",
+					Action:    clusterAction(clusterRemove),
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "remove the host, even if it looks alive or quorum would be lost",
+						},
+					},
+				},
+				{
+					Name:      "snapshot",
+					Usage:     "write a snapshot of the cluster data to a file",
+					ArgsUsage: "<file>",
+					Action:    clusterAction(clusterSnapshot),
+				},
+				{
+					Name:      "restore",
+					Usage:     "build a new single member cluster from a snapshot file",
+					ArgsUsage: "<file>",
+					Action:    clusterAction(clusterRestore),
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "prefix",
+							Usage: "prefix of the host which will run the new cluster",
+						},
+						cli.StringFlag{
+							Name:  "hostname",
+							Usage: "hostname of the host which will run the new cluster",
+						},
+						cli.StringSliceFlag{
+							Name:  "server-urls, peer-urls",
+							Value: &cli.StringSlice{},
+							Usage: "list of URLs that the new cluster will listen on for server (peer) traffic",
+						},
+					},
+				},
+			},
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "seeds, s",
+					Value:  &cli.StringSlice{}, // empty slice
+					Usage:  "default etc client endpoint",
+					EnvVar: "MGMT_SEEDS",
+				},
+			},
+		},
+		{
+			Name:  "secret",
+			Usage: "manage the encrypted secrets of the cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:      "set",
+					Usage:     "set a secret to the value read from stdin",
+					ArgsUsage: "<name>",
+					Action:    secretAction(secretSet),
+					Flags:     []cli.Flag{secretHostsFlag},
+				},
+				{
+					Name:      "get",
+					Usage:     "show a secret, and its value if it can be decrypted",
+					ArgsUsage: "<name>",
+					Action:    secretAction(secretGet),
+				},
+				{
+					Name:      "rotate",
+					Usage:     "replace the value of a secret with the one read from stdin",
+					ArgsUsage: "<name>",
+					Action:    secretAction(secretRotate),
+					Flags:     []cli.Flag{secretHostsFlag},
+				},
+			},
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "seeds, s",
+					Value:  &cli.StringSlice{}, // empty slice
+					Usage:  "default etc client endpoint",
+					EnvVar: "MGMT_SEEDS",
+				},
+				cli.StringFlag{
+					Name:   "pgp-key-path",
+					Value:  "",
+					Usage:  "decrypt the secret with the pgp key at this path",
+					EnvVar: "MGMT_PGP_KEY_PATH",
+				},
 			},
 		},
 	}
@@ -0,0 +1,294 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/purpleidea/mgmt/etcd"
+
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+	errwrap "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// clusterStatus is the cli target to show the members and the hosts of our
+// cluster.
+func clusterStatus(c *cli.Context) error {
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	members, err := etcd.GetClusterMembers(etcdClient.GetClient())
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting members")
+	}
+	hosts, err := etcd.GetClusterHosts(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting hosts")
+	}
+	if size, err := etcd.GetClusterSize(etcdClient); err == nil {
+		fmt.Printf("Ideal cluster size: %d\n", size)
+	} else {
+		fmt.Printf("Ideal cluster size: -\n") // it wasn't set yet
+	}
+	fmt.Printf("Members: %d\n\n", len(members))
+
+	memberMap := make(map[string]*etcd.ClusterMember)
+	hostnames := []string{}
+	for _, member := range members {
+		if member.Name == "" { // it hasn't started yet
+			fmt.Printf("Unstarted member: %x (%s)\n\n", member.ID, strings.Join(member.PeerURLs, ","))
+			continue
+		}
+		memberMap[member.Name] = member
+		if _, exists := hosts[member.Name]; !exists {
+			hostnames = append(hostnames, member.Name)
+		}
+	}
+	for hostname := range hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "HOSTNAME\tMEMBER\tHEALTH\tVOLUNTEER\tENDPOINTS\tCONVERGED\tLAST SEEN\t\n")
+	for _, hostname := range hostnames {
+		host, exists := hosts[hostname]
+		if !exists {
+			host = &etcd.ClusterHost{}
+		}
+		role, health := "-", "-"
+		if member, exists := memberMap[hostname]; exists {
+			role, health = "member", "unhealthy"
+			if member.Leader {
+				role = "leader"
+			}
+			if member.Healthy {
+				health = "healthy"
+			}
+		} else if host.Nominated != "" {
+			role = "nominated"
+		}
+		volunteer := "no"
+		if host.Volunteer != "" {
+			volunteer = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", hostname, role, health, volunteer, orDash(host.Endpoints), orDash(host.Converged), clusterSeen(host.Seen))
+	}
+	return w.Flush()
+}
+
+// clusterSetSize is the cli target to change the ideal number of etcd servers
+// in our cluster.
+func clusterSetSize(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected a cluster size")
+	}
+	size, err := strconv.ParseUint(c.Args().First(), 10, 16)
+	if err != nil || size == 0 {
+		return fmt.Errorf("invalid cluster size `%s`", c.Args().First())
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	if err := etcd.SetClusterSize(etcdClient, uint16(size)); err != nil {
+		return err
+	}
+	log.Printf("Cluster: Ideal cluster size is now: %d", size)
+	return nil
+}
+
+// clusterRemove is the cli target to evict a dead host from our cluster. It
+// refuses to remove a host which still looks alive, or a member without which
+// the cluster would lose quorum, unless it's forced.
+func clusterRemove(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected a hostname")
+	}
+	hostname := c.Args().First()
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	members, err := etcd.GetClusterMembers(etcdClient.GetClient())
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting members")
+	}
+	hosts, err := etcd.GetClusterHosts(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting hosts")
+	}
+
+	isMember, err := clusterRemoveCheck(hostname, members, hosts, c.Bool("force"), time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := etcd.RemoveHost(etcdClient, hostname); err != nil {
+		return err
+	}
+	if isMember {
+		log.Printf("Cluster: Removed `%s`, the leader will now remove it from the members", hostname)
+		return nil
+	}
+	log.Printf("Cluster: Removed `%s`", hostname)
+	return nil
+}
+
+// clusterRemoveCheck returns an error if the host can't be removed from the
+// cluster with these members and hosts. Unless it's forced, a host which is
+// still alive, or which the cluster needs for quorum, is refused. It returns
+// whether the host is an etcd member.
+func clusterRemoveCheck(hostname string, members []*etcd.ClusterMember, hosts map[string]*etcd.ClusterHost, force bool, now time.Time) (bool, error) {
+	var member *etcd.ClusterMember
+	healthy := 0 // the healthy members which would be left
+	for _, x := range members {
+		if x.Name == hostname {
+			member = x
+		} else if x.Healthy {
+			healthy++
+		}
+	}
+	host, exists := hosts[hostname]
+	if !exists && member == nil {
+		return false, fmt.Errorf("host `%s` is not part of the cluster", hostname)
+	}
+
+	if !force {
+		if member != nil && member.Healthy {
+			return false, fmt.Errorf("member `%s` is still healthy", hostname)
+		}
+		if exists && host.Seen > 0 {
+			if d := now.Sub(time.Unix(host.Seen, 0)); d < 2*etcd.HostSeenInterval*time.Second {
+				return false, fmt.Errorf("host `%s` was seen %s ago", hostname, d.Round(time.Second))
+			}
+		}
+		// a majority of the members which are left must be healthy
+		if member != nil && healthy <= (len(members)-1)/2 {
+			return false, fmt.Errorf("removing member `%s` would leave the cluster without quorum", hostname)
+		}
+	}
+	if member != nil && len(members) == 1 {
+		return false, fmt.Errorf("can't remove the last member of the cluster")
+	}
+	return member != nil, nil
+}
+
+// clusterSnapshot is the cli target to write a snapshot of the cluster data to
+// a file.
+func clusterSnapshot(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected a file name")
+	}
+	filename := c.Args().First()
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errwrap.Wrapf(err, "can't get the hostname")
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	meta, err := etcd.NewSnapshotMeta(etcdClient, c.App.Name, hostname)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting the snapshot metadata")
+	}
+	if err := etcd.SaveSnapshot(etcdClient.GetClient(), meta, filename); err != nil {
+		return err
+	}
+	log.Printf("Cluster: Wrote snapshot of revision %d with %d deploy(s) to: %s", meta.Revision, len(meta.Deploys), filename)
+	return nil
+}
+
+// clusterRestore is the cli target to build the data of a new single member
+// cluster from a snapshot. The new cluster gets started by the next run which
+// uses the same prefix and hostname.
+func clusterRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected a file name")
+	}
+	filename := c.Args().First()
+
+	prefix := fmt.Sprintf("/var/lib/%s/", c.App.Name) // same default as run
+	if s := c.String("prefix"); s != "" {
+		prefix = s
+	}
+	hostname := c.String("hostname")
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return errwrap.Wrapf(err, "can't get the hostname")
+		}
+	}
+	urls := c.StringSlice("server-urls")
+	if len(urls) == 0 {
+		urls = []string{etcd.DefaultServerURL}
+	}
+	serverURLs, err := etcdtypes.NewURLs(urls)
+	if err != nil {
+		return errwrap.Wrapf(err, "invalid server urls")
+	}
+
+	meta, err := etcd.RestoreSnapshot(filename, prefix, hostname, serverURLs)
+	if err != nil {
+		return err
+	}
+	t := time.Unix(meta.Time, 0).Format(time.RFC3339)
+	log.Printf("Cluster: Restored snapshot of revision %d from %s, made by `%s` at %s", meta.Revision, filename, meta.Hostname, t)
+	log.Printf("Cluster: Start the new cluster with: %s run --prefix %s --hostname %s --server-urls %s", c.App.Name, prefix, hostname, serverURLs)
+	return nil
+}
+
+// clusterAction wraps a cluster cli target so that its errors get logged.
+func clusterAction(fn func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := fn(c); err != nil {
+			log.Printf("Cluster: Error: %v", err)
+			return cli.NewExitError("", 1)
+		}
+		return nil
+	}
+}
+
+// clusterSeen formats how long ago a host was last seen.
+func clusterSeen(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s ago", time.Since(time.Unix(t, 0)).Round(time.Second))
+}
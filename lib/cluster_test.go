@@ -0,0 +1,78 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/etcd"
+)
+
+func TestClusterRemoveCheck(t *testing.T) {
+	now := time.Unix(1514764800, 0)
+	seen := func(ago time.Duration) map[string]*etcd.ClusterHost {
+		return map[string]*etcd.ClusterHost{"h3": {Seen: now.Add(-ago).Unix()}}
+	}
+	members := func(healthy ...bool) []*etcd.ClusterMember {
+		result := []*etcd.ClusterMember{}
+		for i, x := range healthy {
+			name := []string{"h1", "h2", "h3", "h4", "h5"}[i]
+			result = append(result, &etcd.ClusterMember{Name: name, Healthy: x})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		members  []*etcd.ClusterMember
+		hosts    map[string]*etcd.ClusterHost
+		force    bool
+		ok       bool
+		isMember bool
+	}{
+		{"unknown host", "h9", members(true, true, false), seen(time.Hour), false, false, false},
+		{"dead member", "h3", members(true, true, false), seen(time.Hour), false, true, true},
+		{"dead host", "h3", members(true, true), seen(time.Hour), false, true, false},
+		{"host without seen time", "h3", members(true), map[string]*etcd.ClusterHost{"h3": {}}, false, true, false},
+		{"member without host", "h3", members(true, true, false), nil, false, true, true},
+		{"healthy member", "h3", members(true, true, true), seen(time.Hour), false, false, false},
+		{"healthy member forced", "h3", members(true, true, true), seen(time.Hour), true, true, true},
+		{"recently seen", "h3", members(true, true, false), seen(30 * time.Second), false, false, false},
+		{"recently seen forced", "h3", members(true, true, false), seen(30 * time.Second), true, true, true},
+		{"seen long enough ago", "h3", members(true), seen(2 * etcd.HostSeenInterval * time.Second), false, true, false},
+		{"no quorum left", "h3", members(true, false, false), seen(time.Hour), false, false, false},
+		{"no quorum left forced", "h3", members(true, false, false), seen(time.Hour), true, true, true},
+		{"quorum of five", "h3", members(true, true, false, true, false), seen(time.Hour), false, true, true},
+		{"no quorum of five", "h3", members(true, false, false, true, false), seen(time.Hour), false, false, false},
+		{"last member", "h1", members(false), nil, true, false, false},
+	}
+	for _, tt := range tests {
+		isMember, err := clusterRemoveCheck(tt.hostname, tt.members, tt.hosts, tt.force, now)
+		if tt.ok && err != nil {
+			t.Errorf("%s: check failed with: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: check should have failed", tt.name)
+		} else if tt.ok && isMember != tt.isMember {
+			t.Errorf("%s: expected member to be %t", tt.name, tt.isMember)
+		}
+	}
+}
@@ -19,12 +19,21 @@ package lib
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/purpleidea/mgmt/etcd"
 	etcdfs "github.com/purpleidea/mgmt/etcd/fs"
 	"github.com/purpleidea/mgmt/gapi"
+	"github.com/purpleidea/mgmt/pgp"
 	// these imports are so that GAPIs register themselves in init()
 	_ "github.com/purpleidea/mgmt/lang"
 	_ "github.com/purpleidea/mgmt/langpuppet"
@@ -99,11 +108,9 @@ func deploy(c *cli.Context, name string, gapiObj gapi.GAPI) error {
 
 	uniqueid := uuid.New() // panic's if it can't generate one :P
 
-	etcdClient := &etcd.ClientEtcd{
-		Seeds: c.GlobalStringSlice("seeds"), // endpoints
-	}
-	if err := etcdClient.Connect(); err != nil {
-		return errwrap.Wrapf(err, "client connection error")
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
 	}
 	defer etcdClient.Destroy()
 
@@ -112,13 +119,7 @@ func deploy(c *cli.Context, name string, gapiObj gapi.GAPI) error {
 	if err != nil {
 		return errwrap.Wrapf(err, "error getting previous deploys")
 	}
-	// find the latest id
-	var max uint64
-	for i := range deploys {
-		if i > max {
-			max = i
-		}
-	}
+	max := latestDeploy(deploys)
 	var id = max + 1 // next id
 	log.Printf("Deploy: Previous deploy id: %d", max)
 
@@ -127,6 +128,7 @@ func deploy(c *cli.Context, name string, gapiObj gapi.GAPI) error {
 		// TODO: using a uuid is meant as a temporary measure, i hate them
 		Metadata:   MetadataPrefix + fmt.Sprintf("/deploy/%d-%s", id, uniqueid),
 		DataPrefix: StoragePrefix,
+		MaxSize:    int64(c.GlobalInt("max-size")) << 20, // MiB
 	}
 
 	deploy, err := gapiObj.Cli(c, etcdFs)
@@ -146,10 +148,416 @@ func deploy(c *cli.Context, name string, gapiObj gapi.GAPI) error {
 		return errwrap.Wrapf(err, "encoding error")
 	}
 
+	info := &etcd.DeployInfo{
+		Time:     time.Now().Unix(),
+		Author:   deployAuthor(),
+		Frontend: name,
+		URI:      etcdFs.URI(),
+	}
+	if p := c.GlobalString("pgp-key-path"); p != "" {
+		keys, err := pgp.Import(p)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't import pgp key")
+		}
+		if err := signDeploy(keys, etcdFs, id, str, info); err != nil {
+			return errwrap.Wrapf(err, "can't sign the deploy")
+		}
+	}
+
 	// this nominally checks the previous git hash matches our expectation
-	if err := etcd.AddDeploy(etcdClient, id, hash, pHash, &str); err != nil {
+	if err := etcd.AddDeploy(etcdClient, id, hash, pHash, &str, info); err != nil {
 		return errwrap.Wrapf(err, "could not create deploy id `%d`", id)
 	}
 	log.Printf("Deploy: Success, id: %d", id)
 	return nil
 }
+
+// deployList is the cli target to list the deploy history of our cluster.
+func deployList(c *cli.Context) error {
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	return listDeploys(etcdClient, os.Stdout)
+}
+
+// listDeploys writes a table of the deploys to w.
+func listDeploys(etcdClient *etcd.ClientEtcd, w io.Writer) error {
+	deploys, err := etcd.GetDeploys(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploys")
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploy infos")
+	}
+	if len(deploys) == 0 {
+		log.Printf("Deploy: No deploys exist yet")
+		return nil
+	}
+
+	ids := []uint64{}
+	for id := range deploys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tTIME\tAUTHOR\tHASH\tFRONTEND\t\n")
+	for _, id := range ids {
+		info, exists := infos[id]
+		if !exists {
+			info = &etcd.DeployInfo{}
+		}
+		frontend := info.Frontend
+		if info.Rollback > 0 {
+			frontend = fmt.Sprintf("%s (rollback to %d)", frontend, info.Rollback)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t\n", id, deployTime(info.Time), orDash(info.Author), orDash(info.Hash), orDash(frontend))
+	}
+	return tw.Flush()
+}
+
+// deployShow is the cli target to show a deploy and the contents of its file
+// system.
+func deployShow(c *cli.Context) error {
+	id, err := deployID(c)
+	if err != nil {
+		return err
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	return showDeploy(etcdClient, id, os.Stdout)
+}
+
+// showDeploy writes the deploy with that id, and the contents of its file
+// system, to w.
+func showDeploy(etcdClient *etcd.ClientEtcd, id uint64, w io.Writer) error {
+	str, err := etcd.GetDeploy(etcdClient, id)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploy")
+	}
+	deploy, err := gapi.NewDeployFromB64(str)
+	if err != nil {
+		return errwrap.Wrapf(err, "error decoding deploy")
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploy infos")
+	}
+	info, exists := infos[id]
+	if !exists {
+		info = &etcd.DeployInfo{}
+	}
+
+	fmt.Fprintf(w, "ID: %d\n", id)
+	fmt.Fprintf(w, "Time: %s\n", deployTime(info.Time))
+	fmt.Fprintf(w, "Author: %s\n", orDash(info.Author))
+	fmt.Fprintf(w, "Hash: %s\n", orDash(info.Hash))
+	fmt.Fprintf(w, "Frontend: %s\n", orDash(info.Frontend))
+	if info.Rollback > 0 {
+		fmt.Fprintf(w, "Rollback: %d\n", info.Rollback)
+	}
+	fmt.Fprintf(w, "Signed: %t\n", info.Signature != "")
+	fmt.Fprintf(w, "Name: %s\n", deploy.Name)
+	fmt.Fprintf(w, "Noop: %t\n", deploy.Noop)
+	fmt.Fprintf(w, "Sema: %d\n", deploy.Sema)
+	fmt.Fprintf(w, "GAPI: %+v\n", deploy.GAPI)
+
+	if info.URI == "" {
+		fmt.Fprintf(w, "Fs: -\n") // it was deployed without the info
+		return nil
+	}
+	fmt.Fprintf(w, "Fs: %s\n", info.URI)
+	etcdFs, err := deployFs(etcdClient, info.URI)
+	if err != nil {
+		return err
+	}
+	return etcdFs.Walk("/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		b, err := etcdFs.ReadFile(path)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't read file `%s`", path)
+		}
+		fmt.Fprintf(w, "\n== %s (%d bytes)\n%s", path, len(b), b)
+		return nil
+	})
+}
+
+// deployRollback is the cli target to roll back to an earlier deploy. It adds
+// a new deploy which is a copy of the earlier one, so that the history stays
+// append only, and the hash chain stays consistent.
+func deployRollback(c *cli.Context) error {
+	id, err := deployID(c)
+	if err != nil {
+		return err
+	}
+
+	var keys *pgp.PGP // the signature covers the deploy id, so re-sign it
+	if p := c.GlobalString("pgp-key-path"); p != "" {
+		if keys, err = pgp.Import(p); err != nil {
+			return errwrap.Wrapf(err, "can't import pgp key")
+		}
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	newID, err := rollbackDeploy(etcdClient, id, keys, c.GlobalBool("force"))
+	if err != nil {
+		return err
+	}
+	log.Printf("Deploy: Success, id: %d (rollback to %d)", newID, id)
+	return nil
+}
+
+// rollbackDeploy adds a new deploy which is a copy of the one with that id, and
+// returns the id of the new one. If the keys are not nil, the new deploy is
+// signed with them. If force is true, the hash chain isn't checked.
+func rollbackDeploy(etcdClient *etcd.ClientEtcd, id uint64, keys *pgp.PGP, force bool) (uint64, error) {
+	deploys, err := etcd.GetDeploys(etcdClient)
+	if err != nil {
+		return 0, errwrap.Wrapf(err, "error getting deploys")
+	}
+	str, exists := deploys[id]
+	if !exists {
+		return 0, fmt.Errorf("can't find id `%d`", id)
+	}
+	max := latestDeploy(deploys)
+	if id == max {
+		return 0, fmt.Errorf("deploy id `%d` is already the latest", id)
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		return 0, errwrap.Wrapf(err, "error getting deploy infos")
+	}
+	prev, exists := infos[id]
+	if !exists {
+		prev = &etcd.DeployInfo{}
+	}
+
+	// the new deploy takes the hash of the one it copies, and it must come
+	// after the latest one, so that the next deploy can follow on from it
+	var pHash string
+	if latest, exists := infos[max]; exists && !force {
+		pHash = latest.Hash
+	}
+	info := &etcd.DeployInfo{
+		Time:     time.Now().Unix(),
+		Author:   deployAuthor(),
+		Frontend: prev.Frontend,
+		URI:      prev.URI, // the content is the same, so share the fs
+		Rollback: id,
+	}
+	if keys != nil {
+		etcdFs, err := deployFs(etcdClient, info.URI)
+		if err != nil {
+			return 0, err
+		}
+		if err := signDeploy(keys, etcdFs, max+1, str, info); err != nil {
+			return 0, errwrap.Wrapf(err, "can't sign the deploy")
+		}
+	} else if prev.Signature != "" {
+		return 0, fmt.Errorf("deploy id `%d` is signed, so the rollback must be signed too, use --pgp-key-path", id)
+	}
+	if err := etcd.AddDeploy(etcdClient, max+1, prev.Hash, pHash, &str, info); err != nil {
+		return 0, errwrap.Wrapf(err, "could not create deploy id `%d`", max+1)
+	}
+	return max + 1, nil
+}
+
+// deployGC is the cli target to remove the old deploys, and the file system
+// data which only they used, and to then compact the etcd history.
+func deployGC(c *cli.Context) error {
+	keep := c.Int("keep")
+	keepFor := c.Duration("keep-for")
+	if keep < 1 {
+		return fmt.Errorf("at least one deploy must be kept")
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	return gcDeploys(etcdClient, keep, keepFor, etcdfs.GCGrace)
+}
+
+// gcDeploys keeps the latest keep deploys and those newer than keepFor, and it
+// removes the other ones, along with the file system data which only they used.
+// It then compacts the etcd history. The grace is passed to the fs GC.
+func gcDeploys(etcdClient *etcd.ClientEtcd, keep int, keepFor, grace time.Duration) error {
+	deploys, err := etcd.GetDeploys(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploys")
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting deploy infos")
+	}
+	ids := []uint64{}
+	for id := range deploys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// keep the last ones, and the newer ones, which together are the tail
+	remove := []uint64{}
+	for i, id := range ids {
+		if i >= len(ids)-keep {
+			break
+		}
+		if info, exists := infos[id]; exists && keepFor > 0 && time.Since(time.Unix(info.Time, 0)) < keepFor {
+			break
+		}
+		remove = append(remove, id)
+	}
+
+	// a rollback shares the fs of the deploy it copies, so keep those too
+	uris := make(map[string]bool)
+	for _, id := range ids[len(remove):] {
+		if info, exists := infos[id]; exists && info.URI != "" {
+			uris[info.URI] = true
+		}
+	}
+	for _, id := range remove {
+		var metadata string
+		if info, exists := infos[id]; exists && info.URI != "" && !uris[info.URI] {
+			u, err := url.Parse(info.URI)
+			if err != nil {
+				return errwrap.Wrapf(err, "invalid fs uri of deploy id `%d`", id)
+			}
+			if !strings.HasPrefix(u.Path, MetadataPrefix+"/") { // sanity check
+				return fmt.Errorf("unexpected fs uri of deploy id `%d`: %s", id, info.URI)
+			}
+			metadata = u.Path
+		}
+		if err := etcd.RemoveDeploy(etcdClient, id, metadata); err != nil {
+			return err
+		}
+	}
+	log.Printf("Deploy: Removed %d deploy(s), kept %d", len(remove), len(ids)-len(remove))
+
+	// every other superblock is kept, including those of running deploys
+	count, err := etcdfs.GC(etcdClient.GetClient(), StoragePrefix, MetadataPrefix+"/", grace)
+	if err != nil {
+		return errwrap.Wrapf(err, "error removing the fs data")
+	}
+	log.Printf("Deploy: Removed %d unused fs data block(s)", count)
+
+	rev, err := etcd.Compact(etcdClient.GetClient())
+	if err != nil {
+		return err
+	}
+	if rev > 0 {
+		log.Printf("Deploy: Compacted the history to revision %d", rev)
+	}
+	return nil
+}
+
+// deployFs returns the file system of a deploy from its uri.
+func deployFs(etcdClient *etcd.ClientEtcd, uri string) (*etcdfs.Fs, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("the deploy has no fs") // deployed without the info
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "invalid fs uri")
+	}
+	return &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   u.Path,
+		DataPrefix: StoragePrefix,
+	}, nil
+}
+
+// deployAction wraps a deploy cli target so that its errors get logged.
+func deployAction(fn func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := fn(c); err != nil {
+			log.Printf("Deploy: Error: %v", err)
+			//return cli.NewExitError(err.Error(), 1) // TODO: ?
+			return cli.NewExitError("", 1)
+		}
+		return nil
+	}
+}
+
+// deployClient connects to the etcd cluster that the deploy commands use. The
+// caller must Destroy it when done.
+func deployClient(c *cli.Context) (*etcd.ClientEtcd, error) {
+	etcdClient := &etcd.ClientEtcd{
+		Seeds: c.GlobalStringSlice("seeds"), // endpoints
+	}
+	if err := etcdClient.Connect(); err != nil {
+		return nil, errwrap.Wrapf(err, "client connection error")
+	}
+	return etcdClient, nil
+}
+
+// deployID parses the deploy id argument.
+func deployID(c *cli.Context) (uint64, error) {
+	if c.NArg() != 1 {
+		return 0, fmt.Errorf("expected a deploy id")
+	}
+	id, err := strconv.ParseUint(c.Args().First(), 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid deploy id `%s`", c.Args().First())
+	}
+	return id, nil
+}
+
+// latestDeploy returns the latest deploy id, or zero if there are none.
+func latestDeploy(deploys map[uint64]string) uint64 {
+	var max uint64
+	for i := range deploys {
+		if i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+// deployAuthor returns the user@hostname of whoever is running the deploy.
+func deployAuthor() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if hostname, err := os.Hostname(); err == nil && name != "" {
+		return fmt.Sprintf("%s@%s", name, hostname)
+	}
+	return name
+}
+
+// deployTime formats the unix timestamp of a deploy.
+func deployTime(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
+
+// orDash returns the string, or a dash if it's empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,417 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/etcd"
+	etcdfs "github.com/purpleidea/mgmt/etcd/fs"
+	"github.com/purpleidea/mgmt/gapi"
+	"github.com/purpleidea/mgmt/pgp"
+
+	etcdv3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	etcdtypes "github.com/coreos/etcd/pkg/types"
+)
+
+// runTestEtcd starts an embedded etcd server in a temporary directory, and
+// returns a client which is connected to it. The returned function must be
+// used by the caller to clean up.
+func runTestEtcd(t *testing.T) (*etcd.ClientEtcd, func()) {
+	dir, err := ioutil.TempDir("", "mgmt-lib-test-")
+	if err != nil {
+		t.Fatalf("can't create the temp dir: %v", err)
+	}
+	local, _ := etcdtypes.NewURLs([]string{"http://localhost:0"}) // pick a free port
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls = local
+	cfg.ACUrls = local
+	cfg.LPUrls = local
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("can't start etcd: %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Duration(etcd.MaxStartServerTimeout) * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("etcd didn't start")
+	}
+
+	etcdClient := &etcd.ClientEtcd{
+		Seeds: []string{e.Clients[0].Addr().String()},
+	}
+	if err := etcdClient.Connect(); err != nil {
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("client connection error: %v", err)
+	}
+	return etcdClient, func() {
+		etcdClient.Destroy()
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testPayload returns the encoded deploy with that id.
+func testPayload(t *testing.T, id uint64) string {
+	deploy := &gapi.Deploy{Name: "lang", Sema: int(id)}
+	str, err := deploy.ToB64()
+	if err != nil {
+		t.Fatalf("can't encode the deploy: %v", err)
+	}
+	return str
+}
+
+// testDeploy adds the next deploy with a file system which contains the files.
+func testDeploy(t *testing.T, etcdClient *etcd.ClientEtcd, id uint64, files map[string]string) *etcd.DeployInfo {
+	etcdFs := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   MetadataPrefix + fmt.Sprintf("/deploy/%d-test", id),
+		DataPrefix: StoragePrefix,
+	}
+	for name, data := range files {
+		if err := etcdFs.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatalf("can't write `%s`: %v", name, err)
+		}
+	}
+	info := &etcd.DeployInfo{
+		Time:     time.Now().Unix(),
+		Author:   "test",
+		Frontend: "lang",
+		URI:      etcdFs.URI(),
+	}
+	str := testPayload(t, id)
+	hash := fmt.Sprintf("hash%d", id)
+	if err := etcd.AddDeploy(etcdClient, id, hash, fmt.Sprintf("hash%d", id-1), &str, info); err != nil {
+		t.Fatalf("can't add deploy id `%d`: %v", id, err)
+	}
+	return info
+}
+
+// testReadFile reads a file from the file system at the uri.
+func testReadFile(etcdClient *etcd.ClientEtcd, metadata, name string) (string, error) {
+	etcdFs := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   metadata,
+		DataPrefix: StoragePrefix,
+	}
+	b, err := etcdFs.ReadFile(name)
+	return string(b), err
+}
+
+func TestGCDeploys(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	info1 := testDeploy(t, etcdClient, 1, map[string]string{"/main.mcl": "one"})
+	testDeploy(t, etcdClient, 2, map[string]string{"/main.mcl": "two", "/common": "common"})
+	testDeploy(t, etcdClient, 3, map[string]string{"/main.mcl": "three"})
+	testDeploy(t, etcdClient, 4, map[string]string{"/main.mcl": "four", "/common": "common"})
+
+	// a rollback to the first deploy shares its fs
+	str := testPayload(t, 1)
+	rollback := &etcd.DeployInfo{
+		Time:     time.Now().Unix(),
+		Frontend: info1.Frontend,
+		URI:      info1.URI,
+		Rollback: 1,
+	}
+	if err := etcd.AddDeploy(etcdClient, 5, "hash1", "hash4", &str, rollback); err != nil {
+		t.Fatalf("can't add the rollback: %v", err)
+	}
+
+	// everything is recent, so nothing is removed
+	if err := gcDeploys(etcdClient, 1, time.Hour, 0); err != nil {
+		t.Fatalf("gc error: %v", err)
+	}
+	if deploys, err := etcd.GetDeploys(etcdClient); err != nil || len(deploys) != 5 {
+		t.Fatalf("expected 5 deploys, got %d: %v", len(deploys), err)
+	}
+
+	if err := gcDeploys(etcdClient, 2, 0, 0); err != nil {
+		t.Fatalf("gc error: %v", err)
+	}
+	deploys, err := etcd.GetDeploys(etcdClient)
+	if err != nil {
+		t.Fatalf("can't get deploys: %v", err)
+	}
+	for id := uint64(1); id <= 5; id++ {
+		if _, exists := deploys[id]; exists != (id >= 4) {
+			t.Errorf("deploy id `%d` exists: %t", id, exists)
+		}
+	}
+
+	// the rollback still uses the fs of the first deploy
+	if s, err := testReadFile(etcdClient, MetadataPrefix+"/deploy/1-test", "/main.mcl"); err != nil || s != "one" {
+		t.Errorf("the shared fs is wrong: %q, %v", s, err)
+	}
+	if s, err := testReadFile(etcdClient, MetadataPrefix+"/deploy/4-test", "/common"); err != nil || s != "common" {
+		t.Errorf("the kept fs is wrong: %q, %v", s, err)
+	}
+	for _, id := range []uint64{2, 3} {
+		keyMap, err := etcdClient.Get(MetadataPrefix + fmt.Sprintf("/deploy/%d-test", id))
+		if err != nil {
+			t.Fatalf("can't get the superblock: %v", err)
+		}
+		if len(keyMap) != 0 {
+			t.Errorf("the superblock of deploy id `%d` still exists", id)
+		}
+	}
+
+	// the data of the removed deploys is gone, and only theirs is
+	count, err := etcdfs.GC(etcdClient.GetClient(), StoragePrefix, MetadataPrefix+"/", 0)
+	if err != nil {
+		t.Fatalf("fs gc error: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("the deploy gc left %d unused blocks", count)
+	}
+	keyMap, err := etcdClient.Get(StoragePrefix+"/", etcdv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("can't get the data: %v", err)
+	}
+	for _, v := range keyMap {
+		if v == "two" || v == "three" {
+			t.Errorf("unused data `%s` still exists", v)
+		}
+	}
+}
+
+func TestLatestDeploy(t *testing.T) {
+	tests := []struct {
+		deploys map[uint64]string
+		exp     uint64
+	}{
+		{nil, 0},
+		{map[uint64]string{1: "a"}, 1},
+		{map[uint64]string{3: "c", 5: "e", 4: "d"}, 5},
+	}
+	for i, tt := range tests {
+		if max := latestDeploy(tt.deploys); max != tt.exp {
+			t.Errorf("test #%d: expected %d, got %d", i, tt.exp, max)
+		}
+	}
+}
+
+func TestGetDeployInfos(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	info1 := testDeploy(t, etcdClient, 1, map[string]string{"/main.mcl": "one"})
+	str := testPayload(t, 2)
+	if err := etcd.AddDeploy(etcdClient, 2, "hash2", "hash1", &str, nil); err != nil {
+		t.Fatalf("can't add deploy: %v", err)
+	}
+	str = testPayload(t, 3)
+	if err := etcd.AddDeploy(etcdClient, 3, "", "", &str, nil); err != nil {
+		t.Fatalf("can't add deploy: %v", err)
+	}
+
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		t.Fatalf("can't get deploy infos: %v", err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected 3 infos, got %d", len(infos))
+	}
+	if x := infos[1]; x == nil || x.Hash != "hash1" || x.URI != info1.URI || x.Author != "test" {
+		t.Errorf("unexpected info: %+v", x)
+	}
+	if x := infos[2]; x == nil || x.Hash != "hash2" || x.URI != "" {
+		t.Errorf("a deploy without info must only have the hash: %+v", x)
+	}
+	if x := infos[3]; x == nil || *x != (etcd.DeployInfo{}) {
+		t.Errorf("a deploy without info or hash must be empty: %+v", x)
+	}
+}
+
+func TestRollbackDeploy(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	info1 := testDeploy(t, etcdClient, 1, map[string]string{"/main.mcl": "one"})
+	testDeploy(t, etcdClient, 2, map[string]string{"/main.mcl": "two"})
+
+	if _, err := rollbackDeploy(etcdClient, 2, nil, false); err == nil {
+		t.Errorf("a rollback to the latest deploy must fail")
+	}
+	if _, err := rollbackDeploy(etcdClient, 9, nil, false); err == nil {
+		t.Errorf("a rollback to a missing deploy must fail")
+	}
+
+	id, err := rollbackDeploy(etcdClient, 1, nil, false)
+	if err != nil {
+		t.Fatalf("rollback error: %v", err)
+	} else if id != 3 {
+		t.Errorf("expected the rollback to be id 3, got %d", id)
+	}
+	deploys, err := etcd.GetDeploys(etcdClient)
+	if err != nil {
+		t.Fatalf("can't get deploys: %v", err)
+	}
+	if deploys[3] != deploys[1] {
+		t.Errorf("the rollback must copy the payload")
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		t.Fatalf("can't get deploy infos: %v", err)
+	}
+	if x := infos[3]; x.Hash != "hash1" || x.URI != info1.URI || x.Rollback != 1 || x.Frontend != "lang" {
+		t.Errorf("unexpected rollback info: %+v", x)
+	}
+
+	// the hash chain continues from the hash that the rollback copied
+	str := testPayload(t, 4)
+	if err := etcd.AddDeploy(etcdClient, 4, "hash4", "hash2", &str, nil); err == nil {
+		t.Errorf("a deploy which follows on from the replaced hash must fail")
+	}
+	if err := etcd.AddDeploy(etcdClient, 4, "hash4", "hash1", &str, nil); err != nil {
+		t.Errorf("a deploy which follows on from the rollback failed: %v", err)
+	}
+}
+
+func TestRollbackSignedDeploy(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	keys, err := pgp.Generate("deployer", "test", "deployer@example.com", nil)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	etcdFs := &etcdfs.Fs{
+		Client:     etcdClient.GetClient(),
+		Metadata:   MetadataPrefix + "/deploy/1-test",
+		DataPrefix: StoragePrefix,
+	}
+	if err := etcdFs.WriteFile("/main.mcl", []byte("one"), 0644); err != nil {
+		t.Fatalf("can't write file: %v", err)
+	}
+	str := testPayload(t, 1)
+	info := &etcd.DeployInfo{Frontend: "lang", URI: etcdFs.URI()}
+	if err := signDeploy(keys, etcdFs, 1, str, info); err != nil {
+		t.Fatalf("can't sign deploy: %v", err)
+	}
+	if err := etcd.AddDeploy(etcdClient, 1, "hash1", "", &str, info); err != nil {
+		t.Fatalf("can't add deploy: %v", err)
+	}
+	testDeploy(t, etcdClient, 2, map[string]string{"/main.mcl": "two"})
+
+	if _, err := rollbackDeploy(etcdClient, 1, nil, false); err == nil {
+		t.Errorf("an unsigned rollback to a signed deploy must fail")
+	}
+	if _, err := rollbackDeploy(etcdClient, 1, keys, false); err != nil {
+		t.Fatalf("rollback error: %v", err)
+	}
+	infos, err := etcd.GetDeployInfos(etcdClient)
+	if err != nil {
+		t.Fatalf("can't get deploy infos: %v", err)
+	}
+	if infos[3].Signature == "" || infos[3].Signature == info.Signature {
+		t.Errorf("the rollback must be signed for its own id")
+	}
+}
+
+func TestListDeploys(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	buf := &bytes.Buffer{}
+	if err := listDeploys(etcdClient, buf); err != nil {
+		t.Fatalf("list error: %v", err)
+	} else if buf.Len() != 0 {
+		t.Errorf("expected no output without deploys, got: %q", buf.String())
+	}
+
+	testDeploy(t, etcdClient, 1, map[string]string{"/main.mcl": "one"})
+	testDeploy(t, etcdClient, 2, map[string]string{"/main.mcl": "two"})
+	if _, err := rollbackDeploy(etcdClient, 1, nil, false); err != nil {
+		t.Fatalf("rollback error: %v", err)
+	}
+	buf.Reset()
+	if err := listDeploys(etcdClient, buf); err != nil {
+		t.Fatalf("list error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 deploys, got: %q", buf.String())
+	}
+	if f := strings.Fields(lines[0]); strings.Join(f, " ") != "ID TIME AUTHOR HASH FRONTEND" {
+		t.Errorf("unexpected header: %q", lines[0])
+	}
+	for i, exp := range []string{"1 * test hash1 lang", "2 * test hash2 lang", "3 * * hash1 lang (rollback to 1)"} {
+		f := strings.Fields(lines[i+1])
+		if len(f) < 5 {
+			t.Errorf("unexpected line: %q", lines[i+1])
+			continue
+		}
+		f[1] = "*" // the time
+		if i == 2 {
+			f[2] = "*" // whoever runs the test
+		}
+		if s := strings.Join(f, " "); s != exp {
+			t.Errorf("expected %q, got %q", exp, s)
+		}
+	}
+}
+
+func TestShowDeploy(t *testing.T) {
+	etcdClient, cleanup := runTestEtcd(t)
+	defer cleanup()
+
+	testDeploy(t, etcdClient, 1, map[string]string{"/main.mcl": "one", "/files/a": "aaa"})
+	buf := &bytes.Buffer{}
+	if err := showDeploy(etcdClient, 1, buf); err != nil {
+		t.Fatalf("show error: %v", err)
+	}
+	out := buf.String()
+	for _, exp := range []string{
+		"ID: 1\n",
+		"Author: test\n",
+		"Hash: hash1\n",
+		"Frontend: lang\n",
+		"Signed: false\n",
+		"Name: lang\n",
+		"Sema: 1\n",
+		"\n== /files/a (3 bytes)\naaa",
+		"\n== /main.mcl (3 bytes)\none",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Errorf("expected %q in the output: %q", exp, out)
+		}
+	}
+	if strings.Contains(out, "Rollback:") {
+		t.Errorf("a deploy which isn't a rollback must not show one")
+	}
+
+	if err := showDeploy(etcdClient, 2, buf); err == nil {
+		t.Errorf("showing a missing deploy must fail")
+	}
+}
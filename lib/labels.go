@@ -0,0 +1,115 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// meminfoPath is the file which we read the total memory from.
+	meminfoPath = "/proc/meminfo"
+)
+
+// hostLabels builds the labels which this host publishes. The inventory facts
+// are overridden by the labels from the file, which are overridden in turn by
+// the labels from the command line.
+func hostLabels(labels []string, labelsFile string) (map[string]string, error) {
+	result := hostFacts()
+
+	if labelsFile != "" {
+		b, err := ioutil.ReadFile(labelsFile)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "can't read the labels file")
+		}
+		fileLabels, err := parseLabelsFile(string(b))
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "can't parse the labels file")
+		}
+		for k, v := range fileLabels {
+			result[k] = v
+		}
+	}
+
+	cliLabels, err := engine.ParseLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range cliLabels {
+		result[k] = v
+	}
+	return result, nil
+}
+
+// parseLabelsFile parses a file with one `key=value` label per line. Empty
+// lines and lines which start with a # are ignored.
+func parseLabelsFile(data string) (map[string]string, error) {
+	labels := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		labels = append(labels, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return engine.ParseLabels(labels)
+}
+
+// hostFacts returns the inventory facts of this host as labels.
+func hostFacts() map[string]string {
+	facts := map[string]string{
+		engine.LabelOS:   runtime.GOOS,
+		engine.LabelArch: runtime.GOARCH,
+		engine.LabelCPUs: strconv.Itoa(runtime.NumCPU()),
+	}
+	if b, err := ioutil.ReadFile(meminfoPath); err == nil { // not everywhere
+		if memory, err := parseMeminfo(string(b)); err == nil {
+			facts[engine.LabelMemory] = strconv.FormatUint(memory, 10)
+		}
+	}
+	return facts
+}
+
+// parseMeminfo returns the total memory in MiB from the contents of meminfo.
+func parseMeminfo(data string) (uint64, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "MemTotal:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb / 1024, nil
+	}
+	return 0, fmt.Errorf("total memory not found")
+}
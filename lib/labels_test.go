@@ -0,0 +1,54 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseLabelsFile(t *testing.T) {
+	labels, err := parseLabelsFile("# rack labels\nrole=db\n\n  rack=3\n")
+	if err != nil {
+		t.Errorf("parse failed with: %v", err)
+		return
+	}
+	if s := fmt.Sprintf("%v", labels); s != "map[rack:3 role:db]" {
+		t.Errorf("got wrong labels: %s", s)
+	}
+	if _, err := parseLabelsFile("role db\n"); err == nil {
+		t.Errorf("parse should have failed")
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	data := "MemTotal:       16318412 kB\nMemFree:         1066568 kB\n"
+	memory, err := parseMeminfo(data)
+	if err != nil {
+		t.Errorf("parse failed with: %v", err)
+		return
+	}
+	if memory != 15935 {
+		t.Errorf("got wrong memory: %d", memory)
+	}
+	if _, err := parseMeminfo("MemFree: 1066568 kB\n"); err == nil {
+		t.Errorf("parse should have failed")
+	}
+}
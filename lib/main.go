@@ -38,12 +38,17 @@ import (
 	"github.com/purpleidea/mgmt/pgraph"
 	"github.com/purpleidea/mgmt/prometheus"
 	"github.com/purpleidea/mgmt/util"
+	"github.com/purpleidea/mgmt/world/memory"
 
 	etcdtypes "github.com/coreos/etcd/pkg/types"
 	multierr "github.com/hashicorp/go-multierror"
 	errwrap "github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
 )
 
+// etcdWorld is the name of the default world implementation.
+const etcdWorld = "etcd"
+
 // Flags are some constant flags which are used throughout the program.
 type Flags struct {
 	Debug   bool // add additional log messages
@@ -58,7 +63,9 @@ type Main struct {
 
 	Flags Flags // static global flags that are set at compile time
 
-	Hostname *string // hostname to use; nil if undefined
+	Hostname   *string  // hostname to use; nil if undefined
+	Labels     []string // list of key=value labels to publish for this host
+	LabelsFile string   // file of key=value labels to publish for this host
 
 	Prefix         *string // prefix passed in; nil if undefined
 	TmpPrefix      bool    // request a pseudo-random, temporary prefix to be used
@@ -88,6 +95,8 @@ type Main struct {
 	IdealClusterSize    int      // ideal number of server peers in cluster; only read by initial server
 	NoServer            bool     // do not let other servers peer with me
 
+	World string // name of the world implementation to use: etcd or memory
+
 	seeds               etcdtypes.URLs // processed seeds value
 	clientURLs          etcdtypes.URLs // processed client urls value
 	serverURLs          etcdtypes.URLs // processed server urls value
@@ -98,8 +107,13 @@ type Main struct {
 	NoPgp       bool    // disallow pgp functionality
 	PgpKeyPath  *string // import a pre-made key pair
 	PgpIdentity *string
+	PgpKeyring  string   // keyring of the keys which must sign each deploy
 	pgpKeys     *pgp.PGP // agent key pair
 
+	SnapshotDir       string // dir to write the periodic snapshots to; empty to disable
+	SnapshotInterval  int    // number of seconds between the periodic snapshots
+	SnapshotRetention int    // number of periodic snapshots to keep
+
 	Prometheus       bool   // enable prometheus metrics
 	PrometheusListen string // prometheus instance bind specification
 
@@ -119,6 +133,22 @@ func (obj *Main) Validate() error {
 		return fmt.Errorf("choosing a prefix and the request for a tmp prefix is illogical")
 	}
 
+	if obj.World != "" && obj.World != etcdWorld && obj.World != memory.Name {
+		return fmt.Errorf("unknown world: `%s`", obj.World)
+	}
+	if obj.World == memory.Name && obj.Deploy == nil {
+		return fmt.Errorf("the %s world can only run a static deploy", memory.Name)
+	}
+
+	if obj.SnapshotDir != "" {
+		if obj.World == memory.Name {
+			return fmt.Errorf("the %s world has no data to snapshot", memory.Name)
+		}
+		if obj.SnapshotInterval <= 0 || obj.SnapshotRetention <= 0 {
+			return fmt.Errorf("the snapshot interval and retention must be positive")
+		}
+	}
+
 	return nil
 }
 
@@ -289,6 +319,15 @@ func (obj *Main) Run() error {
 		// TODO: Import admin key
 	}
 
+	var keyring openpgp.EntityList // the deploys must be signed if it's set
+	if obj.PgpKeyring != "" {
+		var err error
+		if keyring, err = pgp.ReadKeyring(obj.PgpKeyring); err != nil {
+			return errwrap.Wrapf(err, "can't read pgp keyring")
+		}
+		Logf("pgp: deploys must be signed by one of %d keys", len(keyring))
+	}
+
 	exitchan := make(chan struct{}) // exit on close
 	wg := &sync.WaitGroup{}         // waitgroup for inner loop & goroutines
 
@@ -335,62 +374,153 @@ func (obj *Main) Run() error {
 		return nil
 	})
 
-	// embedded etcd
-	if len(obj.seeds) == 0 {
-		Logf("etcd: seeds: no seeds specified!")
+	labels, err := hostLabels(obj.Labels, obj.LabelsFile)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't build the host labels")
+	}
+	if obj.Flags.Debug {
+		Logf("labels: %+v", labels)
+	}
+
+	var world engine.World
+	var embdEtcd *etcd.EmbdEtcd
+	if obj.World == memory.Name {
+		// a single host world which doesn't need etcd at all
+		Logf("world: memory: running without etcd")
+		world = &memory.World{
+			Hostname:     hostname,
+			Store:        memory.NewStore(),
+			StandaloneFs: obj.DeployFs, // used for static deploys
+			Debug:        obj.Flags.Debug,
+			Logf: func(format string, v ...interface{}) {
+				log.Printf("world: memory: "+format, v...)
+			},
+		}
 	} else {
-		Logf("etcd: seeds(%d): %+v", len(obj.seeds), obj.seeds)
-	}
-	embdEtcd := etcd.NewEmbdEtcd(
-		hostname,
-		obj.seeds,
-		obj.clientURLs,
-		obj.serverURLs,
-		obj.advertiseClientURLs,
-		obj.advertiseServerURLs,
-		obj.NoServer,
-		obj.idealClusterSize,
-		etcd.Flags{
-			Debug:   obj.Flags.Debug,
-			Trace:   obj.Flags.Trace,
-			Verbose: obj.Flags.Verbose,
-		},
-		prefix,
-		converger,
-	)
-	if embdEtcd == nil {
-		return fmt.Errorf("etcd: creation failed")
-	} else if err := embdEtcd.Startup(); err != nil { // startup (returns when etcd main loop is running)
-		return errwrap.Wrapf(err, "etcd: startup failed")
+		// embedded etcd
+		if len(obj.seeds) == 0 {
+			Logf("etcd: seeds: no seeds specified!")
+		} else {
+			Logf("etcd: seeds(%d): %+v", len(obj.seeds), obj.seeds)
+		}
+		embdEtcd = etcd.NewEmbdEtcd(
+			hostname,
+			obj.seeds,
+			obj.clientURLs,
+			obj.serverURLs,
+			obj.advertiseClientURLs,
+			obj.advertiseServerURLs,
+			obj.NoServer,
+			obj.idealClusterSize,
+			etcd.Flags{
+				Debug:   obj.Flags.Debug,
+				Trace:   obj.Flags.Trace,
+				Verbose: obj.Flags.Verbose,
+			},
+			prefix,
+			converger,
+		)
+		if embdEtcd == nil {
+			return fmt.Errorf("etcd: creation failed")
+		} else if err := embdEtcd.Startup(); err != nil { // startup (returns when etcd main loop is running)
+			return errwrap.Wrapf(err, "etcd: startup failed")
+		}
+		obj.cleanup = append(obj.cleanup, func() error {
+			// cleanup etcd main loop last so it can process everything first
+			err := embdEtcd.Destroy() // shutdown and cleanup etcd
+			return errwrap.Wrapf(err, "etcd: exited poorly")
+		})
+
+		// wait for etcd server to be ready before continuing...
+		// XXX: this is wrong if we're not going to be a server! we'll block!!!
+		//	select {
+		//	case <-embdEtcd.ServerReady():
+		//		Logf("etcd: server: ready!")
+		//		// pass
+		//	case <-time.After(((etcd.MaxStartServerTimeout * etcd.MaxStartServerRetries) + 1) * time.Second):
+		//		return fmt.Errorf("etcd: startup timeout")
+		//	}
+		time.Sleep(1 * time.Second) // XXX: temporary workaround
+
+		// implementation of the World API (alternatives can be substituted in)
+		world = &etcd.World{
+			Hostname:       hostname,
+			EmbdEtcd:       embdEtcd,
+			MetadataPrefix: MetadataPrefix,
+			StoragePrefix:  StoragePrefix,
+			StandaloneFs:   obj.DeployFs, // used for static deploys
+			PgpKeys:        obj.pgpKeys,  // used to decrypt secrets
+			Debug:          obj.Flags.Debug,
+			Logf: func(format string, v ...interface{}) {
+				log.Printf("world: etcd: "+format, v...)
+			},
+		}
+
+		// publish our public key so that secrets can be encrypted for us
+		if obj.pgpKeys != nil {
+			pub, err := obj.pgpKeys.PublicKey()
+			if err != nil {
+				return errwrap.Wrapf(err, "can't export the public key")
+			}
+			if err := etcd.SetPublicKey(embdEtcd, hostname, pub); err != nil {
+				return errwrap.Wrapf(err, "can't publish the public key")
+			}
+		}
+
+		// publish that we're alive, so that dead hosts can be spotted
+		seenClose := make(chan struct{})
+		obj.cleanup = append(obj.cleanup, func() error {
+			close(seenClose) // runs before etcd is destroyed
+			return nil
+		})
+		go func() {
+			ticker := time.NewTicker(etcd.HostSeenInterval * time.Second)
+			defer ticker.Stop()
+			for {
+				if err := etcd.SetHostnameSeen(embdEtcd, hostname); err != nil {
+					Logf("etcd: %v", err)
+				}
+				// the labels go away if our lease expired, so put them back
+				if err := etcd.SetLabels(embdEtcd, hostname, labels); err != nil {
+					Logf("etcd: %v", err)
+				}
+				select {
+				case <-ticker.C:
+				case <-seenClose:
+					return
+				}
+			}
+		}()
+
+		// write periodic snapshots of our data to the local dir, and prune them
+		if obj.SnapshotDir != "" {
+			if err := os.MkdirAll(obj.SnapshotDir, 0700); err != nil {
+				return errwrap.Wrapf(err, "can't create the snapshot dir")
+			}
+			snapshotClose := make(chan struct{})
+			obj.cleanup = append(obj.cleanup, func() error {
+				close(snapshotClose) // runs before etcd is destroyed
+				return nil
+			})
+			go func() {
+				ticker := time.NewTicker(time.Duration(obj.SnapshotInterval) * time.Second)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+					case <-snapshotClose:
+						return
+					}
+					if err := obj.snapshot(embdEtcd, hostname); err != nil {
+						Logf("snapshot: %v", err)
+					}
+				}
+			}()
+		}
 	}
-	obj.cleanup = append(obj.cleanup, func() error {
-		// cleanup etcd main loop last so it can process everything first
-		err := embdEtcd.Destroy() // shutdown and cleanup etcd
-		return errwrap.Wrapf(err, "etcd: exited poorly")
-	})
 
-	// wait for etcd server to be ready before continuing...
-	// XXX: this is wrong if we're not going to be a server! we'll block!!!
-	//	select {
-	//	case <-embdEtcd.ServerReady():
-	//		Logf("etcd: server: ready!")
-	//		// pass
-	//	case <-time.After(((etcd.MaxStartServerTimeout * etcd.MaxStartServerRetries) + 1) * time.Second):
-	//		return fmt.Errorf("etcd: startup timeout")
-	//	}
-	time.Sleep(1 * time.Second) // XXX: temporary workaround
-
-	// implementation of the World API (alternatives can be substituted in)
-	world := &etcd.World{
-		Hostname:       hostname,
-		EmbdEtcd:       embdEtcd,
-		MetadataPrefix: MetadataPrefix,
-		StoragePrefix:  StoragePrefix,
-		StandaloneFs:   obj.DeployFs, // used for static deploys
-		Debug:          obj.Flags.Debug,
-		Logf: func(format string, v ...interface{}) {
-			log.Printf("world: etcd: "+format, v...)
-		},
+	if err := world.HostLabelsSet(labels); err != nil {
+		return errwrap.Wrapf(err, "can't publish the host labels")
 	}
 
 	obj.ge = &graph.Engine{
@@ -414,6 +544,9 @@ func (obj *Main) Run() error {
 
 	// main loop logic starts here
 	deployChan := make(chan *gapi.Deploy)
+	// the worlds of the signed deploys, which pin their verified files
+	pinnedWorlds := make(map[*gapi.Deploy]engine.World)
+	pinnedMutex := &sync.Mutex{}
 	var gapiImpl gapi.GAPI // active GAPI implementation
 	gapiImpl = nil         // starts off missing
 
@@ -472,10 +605,18 @@ func (obj *Main) Run() error {
 				}
 				gapiImpl = gapiObj // copy it to active
 
+				deployWorld := world
+				pinnedMutex.Lock()
+				if w, exists := pinnedWorlds[deploy]; exists {
+					deployWorld = w
+					delete(pinnedWorlds, deploy)
+				}
+				pinnedMutex.Unlock()
+
 				data := gapi.Data{
 					Program:  obj.Program,
 					Hostname: hostname,
-					World:    world,
+					World:    deployWorld,
 					Noop:     mainDeploy.Noop,
 					// FIXME: should the below flags come from the deploy struct?
 					//NoWatch:  obj.NoWatch,
@@ -721,11 +862,13 @@ func (obj *Main) Run() error {
 				if obj.Flags.Debug {
 					Logf("deploy: got activity")
 				}
-				str, err := etcd.GetDeploy(embdEtcd, 0) // 0 means get the latest one
+				deploys, err := etcd.GetDeploys(embdEtcd)
 				if err != nil {
 					Logf("deploy: error getting deploy: %+v", err)
 					continue
 				}
+				id := latestDeploy(deploys)
+				str := deploys[id]
 				if str == "" { // no available deploys exist yet
 					// send an empty deploy... this is done
 					// to start up the engine so it can run
@@ -748,12 +891,39 @@ func (obj *Main) Run() error {
 					continue
 				}
 
+				var pinned engine.World
+				if keyring != nil {
+					infos, err := etcd.GetDeployInfos(embdEtcd)
+					if err != nil {
+						Logf("deploy: error getting deploy info: %+v", err)
+						continue
+					}
+					signer, w, err := verifyDeploy(keyring, world, id, str, infos[id])
+					if err != nil {
+						Logf("deploy: rejected deploy id %d: %+v", id, err)
+						if err := prom.UpdateDeploysTotal(false); err != nil {
+							Logf("prometheus: UpdateDeploysTotal() errored: %+v", err)
+						}
+						continue
+					}
+					Logf("deploy: deploy id %d is signed by: %s", id, signerName(signer))
+					pinned = w
+				}
+
 				// decode the deploy (incl. GAPI) and send it!
 				deploy, err := gapi.NewDeployFromB64(str)
 				if err != nil {
 					Logf("deploy: error decoding deploy: %+v", err)
 					continue
 				}
+				if err := prom.UpdateDeploysTotal(true); err != nil {
+					Logf("prometheus: UpdateDeploysTotal() errored: %+v", err)
+				}
+				if pinned != nil {
+					pinnedMutex.Lock()
+					pinnedWorlds[deploy] = pinned
+					pinnedMutex.Unlock()
+				}
 
 				select {
 				case deployChan <- deploy:
@@ -785,6 +955,23 @@ func (obj *Main) Run() error {
 	return reterr
 }
 
+// snapshot writes a snapshot of the etcd data to the snapshot dir, and then
+// removes the oldest ones which are past the retention.
+func (obj *Main) snapshot(embdEtcd *etcd.EmbdEtcd, hostname string) error {
+	meta, err := etcd.NewSnapshotMeta(embdEtcd, obj.Program, hostname)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't get the snapshot metadata")
+	}
+	filename := path.Join(obj.SnapshotDir, etcd.SnapshotName(time.Now()))
+	if err := etcd.SaveSnapshot(embdEtcd.GetClient(), meta, filename); err != nil {
+		return err
+	}
+	if obj.Flags.Debug {
+		log.Printf("main: snapshot: wrote revision %d to: %s", meta.Revision, filename)
+	}
+	return etcd.PruneSnapshots(obj.SnapshotDir, obj.SnapshotRetention)
+}
+
 // Close contains a number of methods which must be run after the Run method.
 // You must run them to properly clean up after the main program execution.
 func (obj *Main) Close() error {
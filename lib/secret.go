@@ -0,0 +1,220 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/etcd"
+	"github.com/purpleidea/mgmt/pgp"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// secretHostsFlag chooses the recipients of a secret.
+var secretHostsFlag = cli.StringSliceFlag{
+	Name:  "hosts",
+	Value: &cli.StringSlice{}, // empty slice
+	Usage: "encrypt the secret for these hosts instead of for all of them",
+}
+
+// secretSet is the cli target to set the value of a secret. The value is read
+// from stdin, and it's encrypted separately for each recipient.
+func secretSet(c *cli.Context) error {
+	name, err := secretName(c)
+	if err != nil {
+		return err
+	}
+	value, err := secretValue()
+	if err != nil {
+		return err
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	prev, _, err := etcd.GetSecret(etcdClient, name)
+	if err != nil && err != etcd.ErrSecretNotExist {
+		return errwrap.Wrapf(err, "error getting secret")
+	}
+	info := &etcd.SecretInfo{
+		Version: 1,
+		Time:    time.Now().Unix(),
+	}
+	if prev != nil {
+		info.Version = prev.Version + 1
+	}
+	return secretStore(etcdClient, name, prev, info, value, c.StringSlice("hosts"))
+}
+
+// secretGet is the cli target to show a secret. The value is only shown if it
+// can be decrypted with the pgp key that was specified.
+func secretGet(c *cli.Context) error {
+	name, err := secretName(c)
+	if err != nil {
+		return err
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	info, values, err := etcd.GetSecret(etcdClient, name)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting secret")
+	}
+	fmt.Printf("Name: %s\n", name)
+	fmt.Printf("Version: %d\n", info.Version)
+	fmt.Printf("Time: %s\n", deployTime(info.Time))
+	fmt.Printf("Recipients: %s\n", strings.Join(info.Recipients, ", "))
+
+	p := c.GlobalString("pgp-key-path")
+	if p == "" {
+		return nil
+	}
+	keys, err := pgp.Import(p)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't import pgp key")
+	}
+	for _, hostname := range info.Recipients { // we don't know which is ours
+		if value, err := keys.Decrypt(values[hostname]); err == nil {
+			fmt.Printf("Value: %s\n", value)
+			return nil
+		}
+	}
+	return fmt.Errorf("the secret isn't encrypted for this pgp key")
+}
+
+// secretRotate is the cli target to replace the value of an existing secret.
+// The recipients stay the same unless some hosts are specified, but their keys
+// are looked up again, so that the hosts which changed their keys get it too.
+func secretRotate(c *cli.Context) error {
+	name, err := secretName(c)
+	if err != nil {
+		return err
+	}
+	value, err := secretValue()
+	if err != nil {
+		return err
+	}
+
+	etcdClient, err := deployClient(c)
+	if err != nil {
+		return err
+	}
+	defer etcdClient.Destroy()
+
+	prev, _, err := etcd.GetSecret(etcdClient, name)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting secret")
+	}
+	hostnames := c.StringSlice("hosts")
+	if len(hostnames) == 0 {
+		hostnames = prev.Recipients
+	}
+	info := &etcd.SecretInfo{
+		Version: prev.Version + 1,
+		Time:    time.Now().Unix(),
+	}
+	return secretStore(etcdClient, name, prev, info, value, hostnames)
+}
+
+// secretStore encrypts the value to the public key of each of the hosts, or to
+// all the hosts which published a key if none are specified, and stores it.
+func secretStore(etcdClient etcd.Client, name string, prev, info *etcd.SecretInfo, value string, hostnames []string) error {
+	keys, err := etcd.GetPublicKeys(etcdClient, hostnames)
+	if err != nil {
+		return errwrap.Wrapf(err, "error getting public keys")
+	}
+	for _, hostname := range hostnames {
+		if _, exists := keys[hostname]; !exists {
+			return fmt.Errorf("host `%s` didn't publish a public key", hostname)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no hosts published a public key")
+	}
+
+	recipients := []string{}
+	values := make(map[string]string)
+	for hostname, key := range keys {
+		entity, err := pgp.ParsePublicKey(key)
+		if err != nil {
+			return errwrap.Wrapf(err, "invalid public key of host `%s`", hostname)
+		}
+		encrypted, err := (&pgp.PGP{}).Encrypt(entity, value)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't encrypt to host `%s`", hostname)
+		}
+		values[hostname] = encrypted
+		recipients = append(recipients, hostname)
+	}
+	sort.Strings(recipients)
+
+	if err := etcd.SetSecret(etcdClient, name, prev, info, values); err != nil {
+		return err
+	}
+	log.Printf("Secret: Set `%s` to version %d for: %s", name, info.Version, strings.Join(recipients, ", "))
+	return nil
+}
+
+// secretAction wraps a secret cli target so that its errors get logged.
+func secretAction(fn func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := fn(c); err != nil {
+			log.Printf("Secret: Error: %v", err)
+			return cli.NewExitError("", 1)
+		}
+		return nil
+	}
+}
+
+// secretName parses the secret name argument.
+func secretName(c *cli.Context) (string, error) {
+	if c.NArg() != 1 {
+		return "", fmt.Errorf("expected a secret name")
+	}
+	name := c.Args().First()
+	return name, etcd.ValidateSecretName(name)
+}
+
+// secretValue reads the value of a secret from stdin. It's not taken as an arg
+// so that it doesn't end up in the shell history or in the process list.
+func secretValue() (string, error) {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't read the value from stdin")
+	}
+	value := strings.TrimSuffix(string(b), "\n")
+	if value == "" {
+		return "", fmt.Errorf("the secret value is empty")
+	}
+	return value, nil
+}
@@ -0,0 +1,167 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/etcd"
+	"github.com/purpleidea/mgmt/pgp"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/openpgp"
+)
+
+// deployMessage returns the message which is signed for a deploy. It covers the
+// deploy id, the encoded deploy, and the uri and the manifest of its file
+// system. The id is included so that an old signed deploy can't be replayed as
+// a newer one, since that would let anyone downgrade the cluster.
+func deployMessage(id uint64, payload, uri, manifest string) []byte {
+	return []byte(fmt.Sprintf("%d\n%s\n%s\n%s", id, payload, uri, manifest))
+}
+
+// fsManifest returns the manifest of the files in a file system. It has a line
+// with the sha256 sum and the path of each file, in lexical order.
+func fsManifest(fs afero.Fs) (string, error) {
+	lines := []string{}
+	err := afero.Walk(fs, "/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		b, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't read file `%s`", path)
+		}
+		lines = append(lines, fmt.Sprintf("%x  %s\n", sha256.Sum256(b), path))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// fsCopy copies all the files of a file system into a new memory backed one.
+func fsCopy(fs afero.Fs) (*Fs, error) {
+	dst := &Fs{&afero.Afero{Fs: afero.NewMemMapFs()}}
+	err := afero.Walk(fs, "/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return dst.MkdirAll(path, fi.Mode().Perm())
+		}
+		b, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't read file `%s`", path)
+		}
+		return dst.WriteFile(path, b, fi.Mode().Perm())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// signDeploy signs the deploy with that id and the manifest of its file system,
+// and stores both of them in the deploy info.
+func signDeploy(keys *pgp.PGP, fs engine.Fs, id uint64, payload string, info *etcd.DeployInfo) error {
+	manifest, err := fsManifest(fs)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't build the fs manifest")
+	}
+	signature, err := keys.Sign(deployMessage(id, payload, info.URI, manifest))
+	if err != nil {
+		return err
+	}
+	info.Manifest = manifest
+	info.Signature = signature
+	return nil
+}
+
+// verifyDeploy checks that the deploy with that id was signed by one of the
+// keys in the keyring, and that the files of its file system still match the
+// manifest that was signed. It returns the entity which signed it, and a world
+// which pins the files that were verified, so that the GAPI can't read some
+// which were changed in etcd afterwards.
+func verifyDeploy(keyring openpgp.EntityList, world engine.World, id uint64, payload string, info *etcd.DeployInfo) (*openpgp.Entity, engine.World, error) {
+	if info == nil || info.Signature == "" {
+		return nil, nil, fmt.Errorf("the deploy is not signed")
+	}
+	signer, err := pgp.Verify(keyring, deployMessage(id, payload, info.URI, info.Manifest), info.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs, err := world.Fs(info.URI)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "can't open the deploy fs")
+	}
+	pinned, err := fsCopy(fs) // only read it once
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "can't copy the deploy fs")
+	}
+	manifest, err := fsManifest(pinned)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "can't build the fs manifest")
+	}
+	if manifest != info.Manifest {
+		return nil, nil, fmt.Errorf("the deploy fs doesn't match the signed manifest")
+	}
+	return signer, &pinnedWorld{World: world, uri: info.URI, fs: pinned}, nil
+}
+
+// pinnedWorld is a world which only returns the verified copy of the file
+// system of a signed deploy. The other file systems aren't covered by the
+// signature, so they can't be used.
+type pinnedWorld struct {
+	engine.World
+
+	uri string
+	fs  engine.Fs
+}
+
+// Fs returns the verified file system if the uri is the one of the deploy.
+func (obj *pinnedWorld) Fs(uri string) (engine.Fs, error) {
+	if uri != obj.uri {
+		return nil, fmt.Errorf("the fs `%s` is not part of the signed deploy", uri)
+	}
+	return obj.fs, nil
+}
+
+// signerName returns a readable name for the entity which signed a deploy.
+func signerName(signer *openpgp.Entity) string {
+	names := []string{}
+	for name := range signer.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return signer.PrimaryKey.KeyIdShortString()
+	}
+	return fmt.Sprintf("%s (%s)", names[0], signer.PrimaryKey.KeyIdShortString())
+}
@@ -0,0 +1,96 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/purpleidea/mgmt/etcd"
+	"github.com/purpleidea/mgmt/pgp"
+	"github.com/purpleidea/mgmt/world/memory"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestSignDeploy(t *testing.T) {
+	keys, err := pgp.Generate("deployer", "test", "deployer@example.com", nil)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	other, err := pgp.Generate("other", "test", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+
+	fs := &Fs{&afero.Afero{Fs: afero.NewMemMapFs()}}
+	if err := fs.WriteFile("/main.mcl", []byte("noop \"n1\" {}\n"), 0644); err != nil {
+		t.Fatalf("can't write file: %v", err)
+	}
+	world := &memory.World{
+		Hostname:     "h1",
+		Store:        memory.NewStore(),
+		StandaloneFs: fs,
+	}
+	keyring := openpgp.EntityList{keys.Entity}
+
+	info := &etcd.DeployInfo{URI: fs.URI()}
+	if _, _, err := verifyDeploy(keyring, world, 3, "payload", info); err == nil {
+		t.Errorf("an unsigned deploy must be rejected")
+	}
+	if err := signDeploy(keys, fs, 3, "payload", info); err != nil {
+		t.Fatalf("can't sign deploy: %v", err)
+	}
+	signer, pinned, err := verifyDeploy(keyring, world, 3, "payload", info)
+	if err != nil {
+		t.Fatalf("can't verify deploy: %v", err)
+	} else if signer != keys.Entity {
+		t.Errorf("got the wrong signer: %s", signerName(signer))
+	}
+
+	if _, _, err := verifyDeploy(keyring, world, 3, "payl0ad", info); err == nil {
+		t.Errorf("a changed payload must be rejected")
+	}
+	if _, _, err := verifyDeploy(keyring, world, 7, "payload", info); err == nil {
+		t.Errorf("a deploy which is replayed with a new id must be rejected")
+	}
+	if _, _, err := verifyDeploy(openpgp.EntityList{other.Entity}, world, 3, "payload", info); err == nil {
+		t.Errorf("a deploy signed by an unknown key must be rejected")
+	}
+	if err := fs.WriteFile("/main.mcl", []byte("noop \"n2\" {}\n"), 0644); err != nil {
+		t.Fatalf("can't write file: %v", err)
+	}
+	if _, _, err := verifyDeploy(keyring, world, 3, "payload", info); err == nil {
+		t.Errorf("a changed file must be rejected")
+	}
+
+	// the files which were verified are the ones that the deploy sees
+	pinnedFs, err := pinned.Fs(info.URI)
+	if err != nil {
+		t.Fatalf("can't get the pinned fs: %v", err)
+	}
+	b, err := afero.ReadFile(pinnedFs, "/main.mcl")
+	if err != nil || string(b) != "noop \"n1\" {}\n" {
+		t.Errorf("the pinned file is wrong: %q, %v", string(b), err)
+	}
+	if _, err := pinned.Fs("etcdfs:///some/other/fs"); err == nil {
+		t.Errorf("an fs which wasn't signed must be rejected")
+	}
+}
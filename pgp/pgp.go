@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"crypto"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -30,6 +31,7 @@ import (
 	errwrap "github.com/pkg/errors"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
 )
 
 // DefaultKeyringFile is the default file name for keyrings.
@@ -202,6 +204,84 @@ func (obj *PGP) Decrypt(encString string) (string, error) {
 	return string(bytes), nil
 }
 
+// Sign returns a detached signature of the message, which is base64 encoded.
+func (obj *PGP) Sign(msg []byte) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := openpgp.DetachSign(buf, obj.Entity, bytes.NewReader(msg), &CONFIG); err != nil {
+		return "", errwrap.Wrapf(err, "can't sign message")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Verify checks a detached base64 encoded signature of the message against the
+// keys of the keyring, and returns the entity which signed it.
+func Verify(keyring openpgp.EntityList, msg []byte, signature string) (*openpgp.Entity, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "fail at decoding signature")
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(msg), bytes.NewReader(sig))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "invalid signature")
+	}
+	return signer, nil
+}
+
+// ReadKeyring reads a keyring of public keys from a file. It can be armored, as
+// exported with `gpg --export --armor`, or binary, such as a key saved by mgmt.
+func ReadKeyring(path string) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't read keyring")
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't parse keyring")
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("empty keyring")
+	}
+	return keyring, nil
+}
+
+// PublicKey returns the public key of the entity, which is base64 encoded.
+func (obj *PGP) PublicKey() (string, error) {
+	buf := new(bytes.Buffer)
+	if err := obj.Entity.Serialize(buf); err != nil {
+		return "", errwrap.Wrapf(err, "can't serialize public key")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// ParsePublicKey parses a base64 encoded public key, as returned by PublicKey,
+// into an entity that messages can be encrypted to.
+func ParsePublicKey(key string) (*openpgp.Entity, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "fail at decoding public key")
+	}
+	entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't read entity from public key")
+	}
+	// the hash preferences of our keys don't survive serialization, and the
+	// fallback hash isn't compiled in, so prefer the default hash instead
+	if id, ok := s2k.HashToHashId(CONFIG.DefaultHash); ok {
+		for _, ident := range entity.Identities {
+			if sig := ident.SelfSignature; sig != nil && len(sig.PreferredHash) == 0 {
+				sig.PreferredHash = []uint8{id}
+			}
+		}
+	}
+	return entity, nil
+}
+
 // GetIdentities return the first identities from current object.
 func (obj *PGP) GetIdentities() (string, error) {
 	identities := []*openpgp.Identity{}
@@ -57,6 +57,7 @@ type Prometheus struct {
 	managedResources       *prometheus.GaugeVec   // Resources we manage now
 	failedResourcesTotal   *prometheus.CounterVec // Total of failures since mgmt has started
 	failedResources        *prometheus.GaugeVec   // Number of current resources
+	deploysTotal           *prometheus.CounterVec // Total of deploys that were accepted or rejected
 
 	resourcesState map[string]resStateWithKind // Maps the resources with their current kind/state
 	mutex          *sync.Mutex                 // Mutex used to update resourcesState
@@ -131,6 +132,16 @@ func (obj *Prometheus) Init() error {
 	)
 	prometheus.MustRegister(obj.failedResources)
 
+	obj.deploysTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mgmt_deploys_total",
+			Help: "Total of deploys that were received.",
+		},
+		// status: accepted or rejected
+		[]string{"status"},
+	)
+	prometheus.MustRegister(obj.deploysTotal)
+
 	return nil
 }
 
@@ -205,6 +216,20 @@ func (obj *Prometheus) UpdatePgraphStartTime() error {
 	return nil
 }
 
+// UpdateDeploysTotal increments the mgmt_deploys_total metric for a deploy
+// which was accepted, or rejected because it failed verification.
+func (obj *Prometheus) UpdateDeploysTotal(accepted bool) error {
+	if obj == nil {
+		return nil // happens when mgmt is launched without --prometheus
+	}
+	status := "accepted"
+	if !accepted {
+		status = "rejected"
+	}
+	obj.deploysTotal.With(prometheus.Labels{"status": status}).Inc()
+	return nil
+}
+
 // AddManagedResource increments the Managed Resource counter and updates the resource status.
 func (obj *Prometheus) AddManagedResource(resUUID string, rtype string) error {
 	if obj == nil {
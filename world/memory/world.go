@@ -0,0 +1,530 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memory implements an in-memory World. It is useful for tests and for
+// running a single host which doesn't need a cluster.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/etcd/scheduler"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// Name is the name of this World implementation.
+	Name = "memory"
+
+	// FsScheme is the scheme of the uri of the in-memory file systems, such
+	// as memfs:///deploy. Each uri is a different file system.
+	FsScheme = "memfs"
+
+	watchResources = "resources"
+	watchHosts     = "hosts"
+	watchStr       = "strings/"
+	watchStrMap    = "strmap/"
+	watchSecret    = "secrets/"
+)
+
+// ErrNotExist is returned when StrGet can not find the requested key.
+var ErrNotExist = errors.New("errNotExist")
+
+// Store is the state which is shared by the in-memory worlds. Each World is a
+// host, and the worlds which share a store see each other as if they were part
+// of the same cluster. It is safe for concurrent use.
+type Store struct {
+	mutex sync.Mutex
+
+	strings   map[string]string
+	strmaps   map[string]map[string]string // namespace -> hostname -> value
+	resources map[string]map[string]string // hostname -> kind/name -> res
+	labels    map[string]map[string]string // hostname -> key -> value
+	secrets   map[string]map[string]string // name -> hostname -> value
+	fs        map[string]*Fs               // uri -> fs
+
+	watches map[string][]chan error // watch key -> channels
+
+	scheduler *scheduler.Local
+}
+
+// NewStore returns a new empty store for the in-memory worlds.
+func NewStore() *Store {
+	return &Store{
+		strings:   make(map[string]string),
+		strmaps:   make(map[string]map[string]string),
+		resources: make(map[string]map[string]string),
+		labels:    make(map[string]map[string]string),
+		secrets:   make(map[string]map[string]string),
+		fs:        make(map[string]*Fs),
+		watches:   make(map[string][]chan error),
+		scheduler: scheduler.NewLocal(),
+	}
+}
+
+// watch returns a new channel which gets an event when the key is notified. It
+// is removed from the watches when the context is cancelled.
+func (obj *Store) watch(ctx context.Context, key string) chan error {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	ch := make(chan error, 1)
+	obj.watches[key] = append(obj.watches[key], ch)
+
+	go func() {
+		<-ctx.Done()
+		obj.mutex.Lock()
+		defer obj.mutex.Unlock()
+		watches := []chan error{}
+		for _, x := range obj.watches[key] {
+			if x != ch {
+				watches = append(watches, x)
+			}
+		}
+		if len(watches) == 0 {
+			delete(obj.watches, key)
+			return
+		}
+		obj.watches[key] = watches
+	}()
+	return ch
+}
+
+// notify sends an event to each of the watches of the key. The mutex must be
+// held.
+func (obj *Store) notify(key string) {
+	for _, ch := range obj.watches[key] {
+		if len(ch) == 0 { // send event only if one isn't pending
+			ch <- nil // event
+		}
+	}
+}
+
+// SecretSet sets the value of the named secret for each of the hostnames, which
+// are the only ones that can get it. The secrets aren't encrypted, since they
+// never leave the memory of this process.
+func (obj *Store) SecretSet(name, value string, hostnames []string) error {
+	if len(hostnames) == 0 {
+		return fmt.Errorf("a secret needs at least one recipient")
+	}
+	values := make(map[string]string)
+	for _, hostname := range hostnames {
+		values[hostname] = value
+	}
+
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if strMapEqual(obj.secrets[name], values) {
+		return nil // nothing changed
+	}
+	obj.secrets[name] = values
+	obj.notify(watchSecret + name)
+	return nil
+}
+
+// Fs is an in-memory file system which is shared by the worlds of a store.
+type Fs struct {
+	*afero.Afero
+	uri string
+}
+
+// URI returns the unique URI of this file system.
+func (obj *Fs) URI() string { return obj.uri }
+
+// World is an in-memory implementation of the World interface. The values which
+// are set with a TTL are kept until the store goes away, since it can't outlive
+// the process that its hosts are running in anyways.
+type World struct {
+	Hostname     string    // uuid for the consumer of these
+	Store        *Store    // the state shared with the other hosts
+	StandaloneFs engine.Fs // store an fs here for local usage
+	Debug        bool
+	Logf         func(format string, v ...interface{})
+}
+
+// ResWatch returns a channel which spits out events on possible exported
+// resource changes.
+func (obj *World) ResWatch(ctx context.Context) chan error {
+	return obj.Store.watch(ctx, watchResources)
+}
+
+// ResExport exports a list of resources under our hostname namespace.
+// Subsequent calls replace the previously set collection atomically.
+func (obj *World) ResExport(resourceList []engine.Res) error {
+	resources := make(map[string]string)
+	for _, res := range resourceList {
+		if res.Kind() == "" {
+			return fmt.Errorf("empty kind: %s", res.Name())
+		}
+		data, err := engineUtil.ResToB64(res)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't convert to B64")
+		}
+		resources[fmt.Sprintf("%s/%s", res.Kind(), res.Name())] = data
+	}
+
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	if strMapEqual(obj.Store.resources[obj.Hostname], resources) {
+		return nil // nothing changed
+	}
+	obj.Store.resources[obj.Hostname] = resources
+	obj.Store.notify(watchResources)
+	return nil
+}
+
+// ResCollect gets the collection of exported resources which match each of the
+// filters. It does this atomically so that a call always returns a complete and
+// consistent set of collections.
+func (obj *World) ResCollect(filters []*engine.ResFilter) ([][]engine.Res, error) {
+	for _, filter := range filters {
+		if err := filter.Validate(); err != nil {
+			return nil, errwrap.Wrapf(err, "invalid filter")
+		}
+	}
+
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+
+	hostnames := []string{}
+	for hostname := range obj.Store.resources {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	exported := []*engine.ExportedRes{}
+	for _, hostname := range hostnames {
+		resources := obj.Store.resources[hostname]
+		uids := []string{}
+		for uid := range resources {
+			uids = append(uids, uid)
+		}
+		sort.Strings(uids)
+
+		for _, uid := range uids {
+			res, err := engineUtil.B64ToRes(resources[uid])
+			if err != nil {
+				return nil, errwrap.Wrapf(err, "can't convert from B64")
+			}
+			// skip the resources that no filter can match
+			matched := false
+			for _, filter := range filters {
+				if filter.MatchKey(hostname, res.Kind(), res.Name()) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			exported = append(exported, &engine.ExportedRes{
+				Hostname: hostname,
+				Labels:   obj.Store.labels[hostname],
+				Res:      res,
+			})
+		}
+	}
+
+	result := [][]engine.Res{}
+	for _, filter := range filters {
+		resourceList, err := filter.Collect(exported)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, resourceList)
+	}
+	return result, nil
+}
+
+// StrWatch returns a channel which spits out events on possible string changes.
+func (obj *World) StrWatch(ctx context.Context, namespace string) chan error {
+	return obj.Store.watch(ctx, watchStr+namespace)
+}
+
+// StrIsNotExist returns whether the error from StrGet is a key missing error.
+func (obj *World) StrIsNotExist(err error) bool {
+	return err == ErrNotExist
+}
+
+// StrGet returns the value for the the given namespace.
+func (obj *World) StrGet(namespace string) (string, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	value, exists := obj.Store.strings[namespace]
+	if !exists {
+		return "", ErrNotExist
+	}
+	return value, nil
+}
+
+// StrSet sets the namespace value to a particular string.
+func (obj *World) StrSet(namespace, value string) error {
+	_, err := obj.StrSetOpts(namespace, value, nil)
+	return err
+}
+
+// StrSetOpts sets the namespace value to a particular string, with a TTL or a
+// compare-and-swap. It returns false if the comparison failed.
+func (obj *World) StrSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	changed, ok := setStrOpts(obj.Store.strings, namespace, value, opts)
+	if changed {
+		obj.Store.notify(watchStr + namespace)
+	}
+	return ok, nil
+}
+
+// StrDel deletes the value in a particular namespace.
+func (obj *World) StrDel(namespace string) error {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	if _, exists := obj.Store.strings[namespace]; !exists {
+		return nil
+	}
+	delete(obj.Store.strings, namespace)
+	obj.Store.notify(watchStr + namespace)
+	return nil
+}
+
+// StrMapWatch returns a channel which spits out events on possible string changes.
+func (obj *World) StrMapWatch(ctx context.Context, namespace string) chan error {
+	return obj.Store.watch(ctx, watchStrMap+namespace)
+}
+
+// StrMapGet returns a map of hostnames to values in the given namespace.
+func (obj *World) StrMapGet(namespace string) (map[string]string, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	result := make(map[string]string)
+	for hostname, value := range obj.Store.strmaps[namespace] {
+		result[hostname] = value
+	}
+	return result, nil
+}
+
+// StrMapSet sets the namespace value to a particular string under the identity
+// of its own hostname.
+func (obj *World) StrMapSet(namespace, value string) error {
+	_, err := obj.StrMapSetOpts(namespace, value, nil)
+	return err
+}
+
+// StrMapSetOpts sets the namespace value to a particular string under the
+// identity of its own hostname, with a TTL or a compare-and-swap. It returns
+// false if the comparison failed.
+func (obj *World) StrMapSetOpts(namespace, value string, opts *engine.StrOpts) (bool, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	m, exists := obj.Store.strmaps[namespace]
+	if !exists {
+		m = make(map[string]string)
+		obj.Store.strmaps[namespace] = m
+	}
+	changed, ok := setStrOpts(m, obj.Hostname, value, opts)
+	if changed {
+		obj.Store.notify(watchStrMap + namespace)
+	}
+	return ok, nil
+}
+
+// StrMapDel deletes the value in a particular namespace.
+func (obj *World) StrMapDel(namespace string) error {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	if _, exists := obj.Store.strmaps[namespace][obj.Hostname]; !exists {
+		return nil
+	}
+	delete(obj.Store.strmaps[namespace], obj.Hostname)
+	obj.Store.notify(watchStrMap + namespace)
+	return nil
+}
+
+// HostsWatch returns a channel which spits out events on possible host label
+// changes.
+func (obj *World) HostsWatch(ctx context.Context) chan error {
+	return obj.Store.watch(ctx, watchHosts)
+}
+
+// HostLabelsSet publishes the labels of this host, replacing its old labels.
+func (obj *World) HostLabelsSet(labels map[string]string) error {
+	if err := engine.ValidateLabels(labels); err != nil {
+		return err
+	}
+	copied := make(map[string]string)
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	if strMapEqual(obj.Store.labels[obj.Hostname], copied) {
+		return nil // nothing changed
+	}
+	obj.Store.labels[obj.Hostname] = copied
+	obj.Store.notify(watchHosts)
+	obj.Store.notify(watchResources) // collections can select on labels
+	return nil
+}
+
+// HostLabels returns the published labels of each host.
+func (obj *World) HostLabels() (map[string]map[string]string, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	result := make(map[string]map[string]string)
+	for hostname, labels := range obj.Store.labels {
+		result[hostname] = make(map[string]string)
+		for k, v := range labels {
+			result[hostname][k] = v
+		}
+	}
+	return result, nil
+}
+
+// HostsSelect returns the sorted list of hosts whose labels match the label
+// selector.
+func (obj *World) HostsSelect(selector string) ([]string, error) {
+	s, err := engine.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	hostLabels, err := obj.HostLabels()
+	if err != nil {
+		return nil, err
+	}
+	return s.Select(hostLabels), nil
+}
+
+// SecretWatch returns a channel which spits out events on possible changes to
+// the named secret.
+func (obj *World) SecretWatch(ctx context.Context, name string) chan error {
+	return obj.Store.watch(ctx, watchSecret+name)
+}
+
+// SecretGet returns the value of the named secret. This host must be one of its
+// recipients.
+func (obj *World) SecretGet(name string) (string, error) {
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	values, exists := obj.Store.secrets[name]
+	if !exists {
+		return "", fmt.Errorf("secret `%s` does not exist", name)
+	}
+	value, exists := values[obj.Hostname]
+	if !exists {
+		return "", fmt.Errorf("secret `%s` isn't available to this host", name)
+	}
+	return value, nil
+}
+
+// Scheduler returns a scheduling result of hosts in a particular namespace.
+// The hosts which are scheduled are the ones which share our store.
+func (obj *World) Scheduler(namespace string, opts ...scheduler.Option) (*scheduler.Result, error) {
+	modifiedOpts := []scheduler.Option{}
+	for _, o := range opts {
+		modifiedOpts = append(modifiedOpts, o) // copy in
+	}
+
+	modifiedOpts = append(modifiedOpts, scheduler.Debug(obj.Debug))
+	if obj.Logf != nil {
+		modifiedOpts = append(modifiedOpts, scheduler.Logf(obj.Logf))
+	}
+	modifiedOpts = append(modifiedOpts, scheduler.HostLabelsFunc(obj.HostLabels))
+	modifiedOpts = append(modifiedOpts, scheduler.ScheduledFunc(func(namespace string) ([]string, error) {
+		return obj.Store.scheduler.Scheduled(fmt.Sprintf("/scheduler/%s", namespace))
+	}))
+
+	return obj.Store.scheduler.Schedule(fmt.Sprintf("/scheduler/%s", namespace), obj.Hostname, modifiedOpts...)
+}
+
+// Fs returns a file system from a unique URI. The standalone file system has
+// the memmapfs:/// URI, and every other URI with the memfs scheme is a separate
+// in-memory file system which is shared by the worlds of our store.
+func (obj *World) Fs(uri string) (engine.Fs, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// we're in standalone mode
+	if u.Scheme == "memmapfs" && u.Path == "/" {
+		if obj.StandaloneFs == nil {
+			return nil, fmt.Errorf("no standalone fs")
+		}
+		return obj.StandaloneFs, nil
+	}
+
+	if u.Scheme != FsScheme {
+		return nil, fmt.Errorf("unknown scheme: `%s`", u.Scheme)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("empty path: %s", u.Path)
+	}
+
+	obj.Store.mutex.Lock()
+	defer obj.Store.mutex.Unlock()
+	fs, exists := obj.Store.fs[uri]
+	if !exists {
+		fs = &Fs{
+			Afero: &afero.Afero{Fs: afero.NewMemMapFs()},
+			uri:   uri,
+		}
+		obj.Store.fs[uri] = fs
+	}
+	return fs, nil
+}
+
+// setStrOpts sets the key of the map to a value with the options. It returns
+// whether the map changed, and false for ok if the comparison failed. A value
+// which is already set is considered a success, like it is with etcd.
+func setStrOpts(m map[string]string, key, value string, opts *engine.StrOpts) (changed, ok bool) {
+	if opts == nil {
+		opts = &engine.StrOpts{}
+	}
+	stored, exists := m[key]
+	if exists && stored == value {
+		return false, true // we're already in the desired state
+	}
+	if prev := opts.Prev; prev != nil && *prev == "" && exists {
+		return false, false // must be absent
+	} else if prev != nil && *prev != "" && (!exists || stored != *prev) {
+		return false, false
+	}
+	m[key] = value
+	return true, true
+}
+
+// strMapEqual returns true if the two maps have the same keys and values.
+func strMapEqual(m1, m2 map[string]string) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for k, v := range m1 {
+		if x, exists := m2[k]; !exists || x != v {
+			return false
+		}
+	}
+	return true
+}
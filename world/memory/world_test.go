@@ -0,0 +1,96 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// +build !root
+
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/world/worldtest"
+)
+
+func TestWorld(t *testing.T) {
+	suite := &worldtest.Suite{
+		New: func(t *testing.T) (func(string) engine.World, func()) {
+			store := NewStore()
+			world := func(hostname string) engine.World {
+				return &World{
+					Hostname: hostname,
+					Store:    store,
+					Logf: func(format string, v ...interface{}) {
+						t.Logf("world: "+hostname+": "+format, v...)
+					},
+				}
+			}
+			return world, func() {}
+		},
+		FsURI: FsScheme + ":///deploy",
+		SecretSet: func(world func(string) engine.World, name, value string, hostnames []string) error {
+			return world(hostnames[0]).(*World).Store.SecretSet(name, value, hostnames)
+		},
+	}
+	suite.Run(t)
+}
+
+func TestFs(t *testing.T) {
+	w := &World{Hostname: "h1", Store: NewStore()}
+	for _, uri := range []string{"memmapfs:///", "etcdfs:///fs", "memfs://", ":"} {
+		if _, err := w.Fs(uri); err == nil {
+			t.Errorf("fs `%s` should fail", uri)
+		}
+	}
+	fs1, err := w.Fs("memfs:///a")
+	if err != nil {
+		t.Fatalf("fs failed with: %v", err)
+	}
+	fs2, err := w.Fs("memfs:///b")
+	if err != nil {
+		t.Fatalf("fs failed with: %v", err)
+	}
+	if err := fs1.WriteFile("/hello", []byte("world"), 0644); err != nil {
+		t.Fatalf("write failed with: %v", err)
+	}
+	if _, err := fs2.ReadFile("/hello"); err == nil {
+		t.Errorf("each uri must be a separate fs")
+	}
+}
+
+func TestWatchRemove(t *testing.T) {
+	store := NewStore()
+	w := &World{Hostname: "h1", Store: store}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.StrWatch(ctx, "k")
+	w.StrWatch(context.Background(), "k") // stays
+	cancel()
+
+	count := func() int {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return len(store.watches[watchStr+"k"])
+	}
+	for i := 0; count() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("the cancelled watch was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,430 @@
+// Mgmt
+// Copyright (C) 2013-2018+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package worldtest is a conformance suite for implementations of the World
+// interface. Each implementation runs it from its own tests, so that they all
+// behave the same way.
+package worldtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	_ "github.com/purpleidea/mgmt/engine/resources" // let us use the noop res
+	"github.com/purpleidea/mgmt/etcd/scheduler"
+)
+
+// Timeout is how long we wait for an event before a test fails.
+const Timeout = 10 * time.Second
+
+// Suite is the conformance suite for a World implementation.
+type Suite struct {
+	// New starts a new cluster for one test, and returns a function which
+	// returns the World of each hostname in it, and a cleanup function
+	// which is run when the test is done.
+	New func(t *testing.T) (world func(hostname string) engine.World, cleanup func())
+
+	// FsURI is a uri that the Fs of the worlds can open. The Fs test is
+	// skipped if this is empty.
+	FsURI string
+
+	// SecretSet sets a secret for the hosts in the cluster of the world,
+	// since that isn't part of the World interface. The secret test is
+	// skipped if this is nil.
+	SecretSet func(world func(hostname string) engine.World, name, value string, hostnames []string) error
+}
+
+// Run runs each test of the suite as a subtest.
+func (obj *Suite) Run(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, func(string) engine.World)
+	}{
+		{"str", testStr},
+		{"stropts", testStrOpts},
+		{"strmap", testStrMap},
+		{"resources", testResources},
+		{"hosts", testHosts},
+		{"watch", testWatch},
+		{"watchcancel", testWatchCancel},
+		{"scheduler", testScheduler},
+		{"fs", obj.testFs},
+		{"secret", obj.testSecret},
+	}
+	for _, tt := range tests {
+		fn := tt.fn
+		t.Run(tt.name, func(t *testing.T) {
+			world, cleanup := obj.New(t)
+			defer cleanup()
+			fn(t, world)
+		})
+	}
+}
+
+func testStr(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	if _, err := w1.StrGet("k"); err == nil || !w1.StrIsNotExist(err) {
+		t.Errorf("missing key returned: %v", err)
+	}
+	if err := w1.StrSet("k", "v1"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	if s, err := w2.StrGet("k"); err != nil || s != "v1" {
+		t.Errorf("got: %s, %v", s, err)
+	}
+	if err := w2.StrDel("k"); err != nil {
+		t.Fatalf("del failed with: %v", err)
+	}
+	if _, err := w1.StrGet("k"); err == nil || !w1.StrIsNotExist(err) {
+		t.Errorf("deleted key returned: %v", err)
+	}
+}
+
+func testStrOpts(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	empty, v1 := "", "v1"
+	tests := []struct {
+		w    engine.World
+		v    string
+		prev *string
+		ok   bool
+	}{
+		{w1, "v1", &empty, true}, // absent
+		{w2, "v2", &empty, false},
+		{w2, "v1", &empty, true}, // already set
+		{w2, "v2", &v1, true},
+		{w1, "v3", &v1, false},
+		{w1, "v3", nil, true},
+	}
+	for i, tt := range tests {
+		ok, err := tt.w.StrSetOpts("k", tt.v, &engine.StrOpts{Prev: tt.prev})
+		if err != nil {
+			t.Fatalf("test #%d: set failed with: %v", i, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("test #%d: set returned: %t", i, ok)
+		}
+	}
+	if s, err := w2.StrGet("k"); err != nil || s != "v3" {
+		t.Errorf("got: %s, %v", s, err)
+	}
+
+	if ok, err := w1.StrMapSetOpts("m", "v1", &engine.StrOpts{Prev: &empty}); err != nil || !ok {
+		t.Errorf("map set returned: %t, %v", ok, err)
+	}
+	if ok, err := w2.StrMapSetOpts("m", "v2", &engine.StrOpts{Prev: &empty}); err != nil || !ok {
+		t.Errorf("each host must have its own key: %t, %v", ok, err)
+	}
+	if ok, err := w1.StrMapSetOpts("m", "v3", &engine.StrOpts{Prev: &empty}); err != nil || ok {
+		t.Errorf("map set returned: %t, %v", ok, err)
+	}
+}
+
+func testStrMap(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	if err := w1.StrMapSet("m", "v1"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	if err := w2.StrMapSet("m", "v2"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	m, err := w1.StrMapGet("m")
+	if err != nil {
+		t.Fatalf("get failed with: %v", err)
+	}
+	if s := fmt.Sprintf("%v", m); s != "map[h1:v1 h2:v2]" {
+		t.Errorf("got: %s", s)
+	}
+
+	if err := w1.StrMapDel("m"); err != nil {
+		t.Fatalf("del failed with: %v", err)
+	}
+	m, err = w2.StrMapGet("m")
+	if err != nil {
+		t.Fatalf("get failed with: %v", err)
+	}
+	if s := fmt.Sprintf("%v", m); s != "map[h2:v2]" {
+		t.Errorf("got: %s", s)
+	}
+}
+
+// noops returns a list of noop resources with the names.
+func noops(t *testing.T, names ...string) []engine.Res {
+	resources := []engine.Res{}
+	for _, name := range names {
+		res, err := engine.NewNamedResource("noop", name)
+		if err != nil {
+			t.Fatalf("could not build res: %v", err)
+		}
+		resources = append(resources, res)
+	}
+	return resources
+}
+
+func testResources(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	if err := w1.ResExport(noops(t, "n1", "n2")); err != nil {
+		t.Fatalf("export failed with: %v", err)
+	}
+	if err := w2.ResExport(noops(t, "n3")); err != nil {
+		t.Fatalf("export failed with: %v", err)
+	}
+	if err := w2.HostLabelsSet(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("labels failed with: %v", err)
+	}
+
+	filters := []*engine.ResFilter{
+		{Kind: "noop"},
+		{Kind: "noop", Hostnames: []string{"h1"}},
+		{Kind: "noop", Labels: "role=web"},
+		{Kind: "noop", NameRegexp: "^n[23]$", Sort: engine.ResFilterSortName, Limit: 1},
+		{Kind: "file"},
+	}
+	collections, err := w1.ResCollect(filters)
+	if err != nil {
+		t.Fatalf("collect failed with: %v", err)
+	}
+	exp := "[[noop[n1] noop[n2] noop[n3]] [noop[n1] noop[n2]] [noop[n3]] [noop[n2]] []]"
+	if s := fmt.Sprintf("%v", collections); s != exp {
+		t.Errorf("got: %s", s)
+	}
+
+	if err := w1.ResExport([]engine.Res{}); err != nil { // replace it all
+		t.Fatalf("export failed with: %v", err)
+	}
+	collections, err = w2.ResCollect(filters[:1])
+	if err != nil {
+		t.Fatalf("collect failed with: %v", err)
+	}
+	if s := fmt.Sprintf("%v", collections); s != "[[noop[n3]]]" {
+		t.Errorf("got: %s", s)
+	}
+
+	if _, err := w1.ResCollect([]*engine.ResFilter{{Kind: "noop", Labels: "role in (web"}}); err == nil {
+		t.Errorf("an invalid filter should fail")
+	}
+}
+
+func testHosts(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	if err := w1.HostLabelsSet(map[string]string{"role": "db", "zone": "a"}); err != nil {
+		t.Fatalf("labels failed with: %v", err)
+	}
+	if err := w2.HostLabelsSet(map[string]string{"role": "web", "zone": "a"}); err != nil {
+		t.Fatalf("labels failed with: %v", err)
+	}
+	if err := w2.HostLabelsSet(map[string]string{"role": "web!"}); err == nil {
+		t.Errorf("invalid labels should fail")
+	}
+
+	labels, err := w1.HostLabels()
+	if err != nil {
+		t.Fatalf("labels failed with: %v", err)
+	}
+	if s := fmt.Sprintf("%v", labels); s != "map[h1:map[role:db zone:a] h2:map[role:web zone:a]]" {
+		t.Errorf("got: %s", s)
+	}
+
+	tests := map[string]string{
+		"":                   "[h1 h2]",
+		"zone=a":             "[h1 h2]",
+		"role=web":           "[h2]",
+		"role notin (web),a": "[]",
+		"!role":              "[]",
+	}
+	for selector, exp := range tests {
+		hosts, err := w2.HostsSelect(selector)
+		if err != nil {
+			t.Errorf("selector `%s` failed with: %v", selector, err)
+			continue
+		}
+		if s := fmt.Sprintf("%v", hosts); s != exp {
+			t.Errorf("selector `%s` got: %s", selector, s)
+		}
+	}
+}
+
+// waitEvent waits until the watch channel gets an event.
+func waitEvent(t *testing.T, name string, ch chan error) {
+	select {
+	case err, ok := <-ch:
+		if !ok {
+			t.Fatalf("%s: watch closed", name)
+		}
+		if err != nil {
+			t.Fatalf("%s: watch failed with: %v", name, err)
+		}
+	case <-time.After(Timeout):
+		t.Fatalf("%s: timeout waiting for event", name)
+	}
+}
+
+func testWatch(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := w1.StrWatch(ctx, "k")
+	if err := w2.StrSet("k", "v"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	waitEvent(t, "str", ch)
+
+	ch = w1.StrMapWatch(ctx, "m")
+	if err := w2.StrMapSet("m", "v"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	waitEvent(t, "strmap", ch)
+
+	ch = w1.ResWatch(ctx)
+	if err := w2.ResExport(noops(t, "n1")); err != nil {
+		t.Fatalf("export failed with: %v", err)
+	}
+	waitEvent(t, "resources", ch)
+
+	ch = w1.HostsWatch(ctx)
+	if err := w2.HostLabelsSet(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("labels failed with: %v", err)
+	}
+	waitEvent(t, "hosts", ch)
+}
+
+func testWatchCancel(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := w1.StrWatch(ctx, "k")
+	if err := w2.StrSet("k", "v1"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	waitEvent(t, "str", ch)
+
+	cancel()
+	time.Sleep(100 * time.Millisecond) // let the watch go away
+	select {
+	case <-ch: // drain an event which arrived before the cancel
+	default:
+	}
+	if err := w2.StrSet("k", "v2"); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	select {
+	case <-ch:
+		t.Errorf("got an event after the watch was cancelled")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+// nextHosts waits until the scheduler returns the expected hosts.
+func nextHosts(t *testing.T, result *scheduler.Result, exp string) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	s := ""
+	for s != exp {
+		hosts, err := result.Next(ctx)
+		if err != nil {
+			t.Fatalf("scheduler failed with: %v (last result: %s)", err, s)
+		}
+		s = fmt.Sprintf("%v", hosts)
+	}
+}
+
+func testScheduler(t *testing.T, world func(string) engine.World) {
+	w1, w2 := world("h1"), world("h2")
+	opts := []scheduler.Option{
+		scheduler.StrategyKind("rr"),
+		scheduler.MaxCount(2),
+		scheduler.SessionTTL(1),
+	}
+	r1, err := w1.Scheduler("ns", opts...)
+	if err != nil {
+		t.Fatalf("scheduler failed with: %v", err)
+	}
+	defer r1.Shutdown()
+	r2, err := w2.Scheduler("ns", opts...)
+	if err != nil {
+		t.Fatalf("scheduler failed with: %v", err)
+	}
+	nextHosts(t, r1, "[h1 h2]")
+	nextHosts(t, r2, "[h1 h2]")
+
+	r2.Shutdown()
+	nextHosts(t, r1, "[h1]")
+}
+
+func (obj *Suite) testFs(t *testing.T, world func(string) engine.World) {
+	if obj.FsURI == "" {
+		t.Skip("no fs uri")
+	}
+	fs1, err := world("h1").Fs(obj.FsURI)
+	if err != nil {
+		t.Fatalf("fs failed with: %v", err)
+	}
+	if err := fs1.WriteFile("/hello", []byte("world"), 0644); err != nil {
+		t.Fatalf("write failed with: %v", err)
+	}
+
+	fs2, err := world("h2").Fs(obj.FsURI)
+	if err != nil {
+		t.Fatalf("fs failed with: %v", err)
+	}
+	if fs2.URI() != fs1.URI() {
+		t.Errorf("got different uris: %s != %s", fs1.URI(), fs2.URI())
+	}
+	b, err := fs2.ReadFile("/hello")
+	if err != nil {
+		t.Fatalf("read failed with: %v", err)
+	}
+	if string(b) != "world" {
+		t.Errorf("got: %s", string(b))
+	}
+}
+
+func (obj *Suite) testSecret(t *testing.T, world func(string) engine.World) {
+	if obj.SecretSet == nil {
+		t.Skip("no secret setter")
+	}
+	w1, w2 := world("h1"), world("h2")
+	if _, err := w1.SecretGet("password"); err == nil {
+		t.Errorf("a missing secret should fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := w1.SecretWatch(ctx, "password")
+	if err := obj.SecretSet(world, "password", "hunter2", []string{"h1"}); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	waitEvent(t, "secret", ch)
+	if s, err := w1.SecretGet("password"); err != nil || s != "hunter2" {
+		t.Errorf("got: %s, %v", s, err)
+	}
+	if _, err := w2.SecretGet("password"); err == nil {
+		t.Errorf("a host which isn't a recipient must not get the secret")
+	}
+
+	if err := obj.SecretSet(world, "password", "hunter3", []string{"h1", "h2"}); err != nil {
+		t.Fatalf("set failed with: %v", err)
+	}
+	waitEvent(t, "secret", ch)
+	if s, err := w2.SecretGet("password"); err != nil || s != "hunter3" {
+		t.Errorf("got: %s, %v", s, err)
+	}
+}
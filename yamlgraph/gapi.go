@@ -18,6 +18,7 @@
 package yamlgraph
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -154,11 +155,13 @@ func (obj *GAPI) Next() chan gapi.Next {
 		startChan := make(chan struct{}) // start signal
 		close(startChan)                 // kick it off!
 
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel() // removes the watch
 		var watchChan chan error
 		if obj.data.NoStreamWatch {
 			watchChan = nil
 		} else {
-			watchChan = obj.data.World.ResWatch()
+			watchChan = obj.data.World.ResWatch(ctx)
 		}
 
 		for {
@@ -29,9 +29,32 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// collectorResConfig is a query for collecting exported resources. Everything
+// except the kind is optional.
 type collectorResConfig struct {
-	Kind    string `yaml:"kind"`
-	Pattern string `yaml:"pattern"` // XXX: not implemented
+	Kind       string   `yaml:"kind"`
+	Pattern    string   `yaml:"pattern"`    // passed to CollectPattern
+	Hostnames  []string `yaml:"hostnames"`  // hosts which exported them
+	Labels     string   `yaml:"labels"`     // label selector of the hosts
+	Name       string   `yaml:"name"`       // glob pattern of the names
+	NameRegexp string   `yaml:"nameregexp"` // regexp of the names
+	Fields     []string `yaml:"fields"`     // field predicates: owner == "www"
+	Sort       string   `yaml:"sort"`       // name, kind or hostname
+	Limit      int      `yaml:"limit"`      // max number of resources
+}
+
+// filter returns the resource filter of this collector.
+func (obj *collectorResConfig) filter() *engine.ResFilter {
+	return &engine.ResFilter{
+		Kind:       strings.ToLower(obj.Kind),
+		Hostnames:  obj.Hostnames,
+		Labels:     obj.Labels,
+		Name:       obj.Name,
+		NameRegexp: obj.NameRegexp,
+		Fields:     obj.Fields,
+		Sort:       obj.Sort,
+		Limit:      obj.Limit,
+	}
 }
 
 // Vertex is the data structure of a vertex.
@@ -229,39 +252,36 @@ func (obj *GraphConfig) NewGraphFromConfig(hostname string, world engine.World,
 	}
 
 	// lookup from backend (usually etcd)
-	var hostnameFilter []string // empty to get from everyone
-	kindFilter := []string{}
+	filters := []*engine.ResFilter{}
 	for _, t := range obj.Collector {
-		kind := strings.ToLower(t.Kind)
-		kindFilter = append(kindFilter, kind)
+		filter := t.filter()
+		if err := filter.Validate(); err != nil {
+			return nil, errwrap.Wrapf(err, "invalid collect of kind %s", t.Kind)
+		}
+		filters = append(filters, filter)
 	}
 	// do all the graph look ups in one single step, so that if the backend
 	// database changes, we don't have a partial state of affairs...
-	if len(kindFilter) > 0 { // if kindFilter is empty, don't need to do lookups!
+	var collections [][]engine.Res
+	if len(filters) > 0 { // if there are no filters, don't need to do lookups!
 		var err error
-		resourceList, err = world.ResCollect(hostnameFilter, kindFilter)
+		collections, err = world.ResCollect(filters)
 		if err != nil {
 			return nil, fmt.Errorf("Config: Could not collect resources: %v", err)
 		}
 	}
-	for _, res := range resourceList {
-		matched := false
-		// see if we find a collect pattern that matches
-		for _, t := range obj.Collector {
-			kind := strings.ToLower(t.Kind)
-			// use t.Kind and optionally t.Pattern to collect from storage
-			obj.Logf("collect: %s; pattern: %v", kind, t.Pattern)
-
-			// XXX: expand to more complex pattern matching here...
-			if res.Kind() != kind {
-				continue
-			}
-
-			if matched {
+	collected := make(map[engine.Res]bool) // resources which matched already
+	for i, resourceList := range collections {
+		t := obj.Collector[i]
+		obj.Logf("collect: %s; pattern: %v", filters[i].Kind, t.Pattern)
+
+		for _, res := range resourceList {
+			kind := res.Kind()
+			if collected[res] {
 				// we've already matched this resource, should we match again?
 				obj.Logf("warning: matching %s again!", res)
 			}
-			matched = true
+			collected[res] = true
 
 			// collect resources but add the noop metaparam
 			//if noop { // now done in main lib